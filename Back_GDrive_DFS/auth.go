@@ -0,0 +1,374 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"firebase.google.com/go/auth"
+	"github.com/gofiber/fiber/v3"
+)
+
+// Identity is who a bearer token belongs to.
+type Identity struct {
+	UserID string
+	Claims map[string]interface{}
+}
+
+// Authenticator turns a bearer token into an Identity. The HTTP layer only
+// talks to this interface, so the provider can be swapped by configuration.
+type Authenticator interface {
+	Authenticate(ctx context.Context, token string) (*Identity, error)
+}
+
+// authenticator is the provider selected at startup by AUTH_PROVIDER.
+var authenticator Authenticator
+
+// UserDirectory looks accounts up, for sharing by email and for showing who
+// a file is shared with. Providers with a user list implement it next to
+// Authenticator; with the others, files are shared by user id only.
+type UserDirectory interface {
+	GetUser(ctx context.Context, uid string) (*auth.UserRecord, error)
+	GetUserByEmail(ctx context.Context, email string) (*auth.UserRecord, error)
+}
+
+// userDirectory is the provider's UserDirectory, or nil.
+var userDirectory UserDirectory
+
+// newAuthenticatorFromEnv builds the provider named by AUTH_PROVIDER:
+// "firebase" (default), "oidc" or "static".
+func newAuthenticatorFromEnv() (Authenticator, error) {
+	switch provider := getEnv("AUTH_PROVIDER", "firebase"); provider {
+	case "firebase":
+		if firebaseAuth == nil {
+			return nil, fmt.Errorf("firebase auth client not initialized")
+		}
+		return &FirebaseAuthenticator{client: firebaseAuth}, nil
+
+	case "oidc":
+		return NewOIDCAuthenticator(OIDCOpts{
+			Issuer:    getEnv("OIDC_ISSUER", ""),
+			Audience:  getEnv("OIDC_AUDIENCE", ""),
+			JWKSURL:   getEnv("OIDC_JWKS_URL", ""),
+			UserClaim: getEnv("OIDC_USER_CLAIM", "sub"),
+		})
+
+	case "static":
+		return NewStaticAuthenticator(StaticOpts{
+			APIKeys:   parseAPIKeys(getEnv("AUTH_STATIC_KEYS", "")),
+			JWTSecret: []byte(getEnv("AUTH_JWT_SECRET", "")),
+			Issuer:    getEnv("AUTH_JWT_ISSUER", ""),
+		})
+
+	default:
+		return nil, fmt.Errorf("unknown AUTH_PROVIDER %q", provider)
+	}
+}
+
+func bearerToken(header string) string {
+	return strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+}
+
+// authMiddleware authenticates the bearer token with the configured provider
+// and exposes the caller as c.Locals("userID") and c.Locals("claims").
+func authMiddleware(c fiber.Ctx) error {
+	authHeader := c.Get("Authorization")
+	if authHeader == "" {
+		return c.Status(401).JSON(fiber.Map{"error": "missing Authorization header"})
+	}
+
+	ident, err := authenticator.Authenticate(context.Background(), bearerToken(authHeader))
+	if err != nil || ident.UserID == "" {
+		return c.Status(401).JSON(fiber.Map{"error": "invalid token"})
+	}
+
+	c.Locals("userID", ident.UserID)
+	c.Locals("claims", ident.Claims)
+	return c.Next()
+}
+
+// -------------------- Firebase --------------------
+
+type FirebaseAuthenticator struct {
+	client *auth.Client
+}
+
+func (a *FirebaseAuthenticator) Authenticate(ctx context.Context, token string) (*Identity, error) {
+	decoded, err := a.client.VerifyIDToken(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{UserID: decoded.UID, Claims: decoded.Claims}, nil
+}
+
+func (a *FirebaseAuthenticator) GetUser(ctx context.Context, uid string) (*auth.UserRecord, error) {
+	return a.client.GetUser(ctx, uid)
+}
+
+func (a *FirebaseAuthenticator) GetUserByEmail(ctx context.Context, email string) (*auth.UserRecord, error) {
+	return a.client.GetUserByEmail(ctx, email)
+}
+
+// -------------------- Static (API keys / HS256) --------------------
+
+type StaticOpts struct {
+	// APIKeys maps a raw key to the user it authenticates as.
+	APIKeys   map[string]string
+	JWTSecret []byte
+	Issuer    string
+}
+
+// StaticAuthenticator accepts fixed API keys and HS256 JWTs signed with a
+// shared secret. It is meant for service accounts and local development.
+type StaticAuthenticator struct {
+	StaticOpts
+}
+
+func NewStaticAuthenticator(opts StaticOpts) (*StaticAuthenticator, error) {
+	if len(opts.APIKeys) == 0 && len(opts.JWTSecret) == 0 {
+		return nil, fmt.Errorf("static auth needs AUTH_STATIC_KEYS or AUTH_JWT_SECRET")
+	}
+	return &StaticAuthenticator{StaticOpts: opts}, nil
+}
+
+// parseAPIKeys reads "key:user,key:user".
+func parseAPIKeys(s string) map[string]string {
+	keys := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		key, user, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		if ok && key != "" && user != "" {
+			keys[key] = user
+		}
+	}
+	return keys
+}
+
+func (a *StaticAuthenticator) Authenticate(ctx context.Context, token string) (*Identity, error) {
+	for key, user := range a.APIKeys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(token)) == 1 {
+			return &Identity{UserID: user, Claims: map[string]interface{}{}}, nil
+		}
+	}
+
+	if len(a.JWTSecret) == 0 {
+		return nil, fmt.Errorf("unknown api key")
+	}
+
+	tok, err := parseJWT(token)
+	if err != nil {
+		return nil, err
+	}
+	if err := tok.verifyHS256(a.JWTSecret); err != nil {
+		return nil, err
+	}
+	if err := tok.validateClaims(a.Issuer, "", time.Now()); err != nil {
+		return nil, err
+	}
+	return &Identity{UserID: tok.stringClaim("sub"), Claims: tok.Claims}, nil
+}
+
+// -------------------- OIDC / JWKS --------------------
+
+type OIDCOpts struct {
+	Issuer   string
+	Audience string
+	// JWKSURL is discovered from the issuer when empty.
+	JWKSURL   string
+	UserClaim string
+}
+
+// OIDCAuthenticator verifies RS256/ES256 ID tokens from any OpenID Connect
+// provider against its published JWKS. Keys are cached and refetched when a
+// token names a key id we haven't seen, which covers provider key rotation.
+type OIDCAuthenticator struct {
+	OIDCOpts
+
+	client *http.Client
+
+	keyLock     sync.Mutex
+	keys        map[string]crypto.PublicKey
+	lastRefresh time.Time
+}
+
+func NewOIDCAuthenticator(opts OIDCOpts) (*OIDCAuthenticator, error) {
+	if opts.Issuer == "" {
+		return nil, fmt.Errorf("OIDC_ISSUER is required")
+	}
+	// Without it, a token the issuer minted for any other client would do.
+	if opts.Audience == "" {
+		return nil, fmt.Errorf("OIDC_AUDIENCE is required")
+	}
+	if opts.UserClaim == "" {
+		opts.UserClaim = "sub"
+	}
+	return &OIDCAuthenticator{
+		OIDCOpts: opts,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		keys:     make(map[string]crypto.PublicKey),
+	}, nil
+}
+
+func (a *OIDCAuthenticator) Authenticate(ctx context.Context, token string) (*Identity, error) {
+	tok, err := parseJWT(token)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := a.key(ctx, tok.Header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := tok.verifyKey(key); err != nil {
+		return nil, err
+	}
+	if err := tok.validateClaims(a.Issuer, a.Audience, time.Now()); err != nil {
+		return nil, err
+	}
+
+	userID := tok.stringClaim(a.UserClaim)
+	if userID == "" {
+		return nil, fmt.Errorf("token has no %q claim", a.UserClaim)
+	}
+	return &Identity{UserID: userID, Claims: tok.Claims}, nil
+}
+
+func (a *OIDCAuthenticator) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	a.keyLock.Lock()
+	defer a.keyLock.Unlock()
+
+	if key, ok := a.keys[kid]; ok {
+		return key, nil
+	}
+
+	// Unknown kid: refresh, but not more than once every few seconds so a
+	// stream of junk tokens can't hammer the provider.
+	if time.Since(a.lastRefresh) < 5*time.Second {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	if err := a.refreshKeys(ctx); err != nil {
+		return nil, err
+	}
+
+	if key, ok := a.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+func (a *OIDCAuthenticator) getJSON(ctx context.Context, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("%s returned %d", url, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (a *OIDCAuthenticator) refreshKeys(ctx context.Context) error {
+	a.lastRefresh = time.Now()
+
+	jwksURL := a.JWKSURL
+	if jwksURL == "" {
+		var discovery struct {
+			JWKSURI string `json:"jwks_uri"`
+		}
+		wellKnown := strings.TrimSuffix(a.Issuer, "/") + "/.well-known/openid-configuration"
+		if err := a.getJSON(ctx, wellKnown, &discovery); err != nil {
+			return fmt.Errorf("oidc discovery: %w", err)
+		}
+		jwksURL = discovery.JWKSURI
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := a.getJSON(ctx, jwksURL, &set); err != nil {
+		return fmt.Errorf("fetching jwks: %w", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, jwk := range set.Keys {
+		key, err := jwk.publicKey()
+		if err != nil {
+			log.Printf("[auth] skipping jwk %s: %v", jwk.Kid, err)
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	a.keys = keys
+	return nil
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	if k.Use != "" && k.Use != "sig" {
+		return nil, fmt.Errorf("key use %q is not sig", k.Use)
+	}
+
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
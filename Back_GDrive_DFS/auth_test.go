@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+)
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func encodeJWT(t *testing.T, header, claims map[string]interface{}, sign func([]byte) []byte) string {
+	h, _ := json.Marshal(header)
+	c, _ := json.Marshal(claims)
+	input := b64(h) + "." + b64(c)
+	return input + "." + b64(sign([]byte(input)))
+}
+
+func hs256Token(t *testing.T, secret []byte, claims map[string]interface{}) string {
+	return encodeJWT(t, map[string]interface{}{"alg": "HS256", "typ": "JWT"}, claims, func(in []byte) []byte {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(in)
+		return mac.Sum(nil)
+	})
+}
+
+func TestStaticAuthenticator(t *testing.T) {
+	secret := []byte("local dev secret")
+	a, err := NewStaticAuthenticator(StaticOpts{
+		APIKeys:   parseAPIKeys("ci-key:ci-bot, bad-pair ,other:alice"),
+		JWTSecret: secret,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	ident, err := a.Authenticate(ctx, "ci-key")
+	if err != nil || ident.UserID != "ci-bot" {
+		t.Errorf("api key: have %+v, %v", ident, err)
+	}
+
+	tok := hs256Token(t, secret, map[string]interface{}{
+		"sub":   "bob",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"admin": true,
+	})
+	ident, err = a.Authenticate(ctx, tok)
+	if err != nil || ident.UserID != "bob" || ident.Claims["admin"] != true {
+		t.Errorf("jwt: have %+v, %v", ident, err)
+	}
+
+	expired := hs256Token(t, secret, map[string]interface{}{"sub": "bob", "exp": time.Now().Add(-time.Hour).Unix()})
+	if _, err := a.Authenticate(ctx, expired); err == nil {
+		t.Error("expected expired token to fail")
+	}
+
+	forged := hs256Token(t, []byte("wrong secret"), map[string]interface{}{"sub": "bob", "exp": time.Now().Add(time.Hour).Unix()})
+	if _, err := a.Authenticate(ctx, forged); err == nil {
+		t.Error("expected forged token to fail")
+	}
+
+	if _, err := a.Authenticate(ctx, "not-a-key"); err == nil {
+		t.Error("expected unknown key to fail")
+	}
+}
+
+func TestOIDCAuthenticator(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]string{"jwks_uri": srv.URL + "/jwks"})
+		case "/jwks":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"keys": []map[string]string{
+					{
+						"kty": "RSA", "kid": "rsa-1", "use": "sig",
+						"n": b64(rsaKey.N.Bytes()),
+						"e": b64(big.NewInt(int64(rsaKey.E)).Bytes()),
+					},
+					{
+						"kty": "EC", "kid": "ec-1", "crv": "P-256",
+						"x": b64(ecKey.X.FillBytes(make([]byte, 32))),
+						"y": b64(ecKey.Y.FillBytes(make([]byte, 32))),
+					},
+				},
+			})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	if _, err := NewOIDCAuthenticator(OIDCOpts{Issuer: srv.URL}); err == nil {
+		t.Error("expected an authenticator without an audience to be refused")
+	}
+	a, err := NewOIDCAuthenticator(OIDCOpts{Issuer: srv.URL, Audience: "goomairu"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims := map[string]interface{}{
+		"iss": srv.URL,
+		"aud": "goomairu",
+		"sub": "carol",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+
+	rsaTok := encodeJWT(t, map[string]interface{}{"alg": "RS256", "kid": "rsa-1"}, claims, func(in []byte) []byte {
+		sum := sha256.Sum256(in)
+		sig, _ := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, sum[:])
+		return sig
+	})
+	ident, err := a.Authenticate(context.Background(), rsaTok)
+	if err != nil || ident.UserID != "carol" {
+		t.Errorf("rs256: have %+v, %v", ident, err)
+	}
+
+	ecTok := encodeJWT(t, map[string]interface{}{"alg": "ES256", "kid": "ec-1"}, claims, func(in []byte) []byte {
+		sum := sha256.Sum256(in)
+		r, s, _ := ecdsa.Sign(rand.Reader, ecKey, sum[:])
+		sig := make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+		return sig
+	})
+	if ident, err := a.Authenticate(context.Background(), ecTok); err != nil || ident.UserID != "carol" {
+		t.Errorf("es256: have %+v, %v", ident, err)
+	}
+
+	claims["aud"] = "someone-else"
+	wrongAud := encodeJWT(t, map[string]interface{}{"alg": "RS256", "kid": "rsa-1"}, claims, func(in []byte) []byte {
+		sum := sha256.Sum256(in)
+		sig, _ := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, sum[:])
+		return sig
+	})
+	if _, err := a.Authenticate(context.Background(), wrongAud); err == nil {
+		t.Error("expected token for another audience to fail")
+	}
+
+	delete(claims, "aud")
+	noAud := encodeJWT(t, map[string]interface{}{"alg": "RS256", "kid": "rsa-1"}, claims, func(in []byte) []byte {
+		sum := sha256.Sum256(in)
+		sig, _ := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, sum[:])
+		return sig
+	})
+	if _, err := a.Authenticate(context.Background(), noAud); err == nil {
+		t.Error("expected token without an audience to fail")
+	}
+
+	// An HS256 token must never be accepted against the provider's keys.
+	hsTok := hs256Token(t, []byte("guess"), claims)
+	if _, err := a.Authenticate(context.Background(), hsTok); err == nil {
+		t.Error("expected HS256 token to fail")
+	}
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	prev := authenticator
+	defer func() { authenticator = prev }()
+	authenticator, _ = NewStaticAuthenticator(StaticOpts{APIKeys: map[string]string{"k1": "dave"}})
+
+	app := fiber.New()
+	app.Get("/whoami", authMiddleware, func(c fiber.Ctx) error {
+		return c.SendString(localUserID(c))
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/whoami", nil)
+	req.Header.Set("Authorization", "Bearer k1")
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 200 {
+		t.Errorf("have status %d want 200", resp.StatusCode)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/whoami", nil)
+	req.Header.Set("Authorization", "Bearer nope")
+	if resp, _ := app.Test(req); resp.StatusCode != 401 {
+		t.Errorf("have status %d want 401", resp.StatusCode)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/whoami", nil)
+	if resp, _ := app.Test(req); resp.StatusCode != 401 {
+		t.Errorf("have status %d want 401", resp.StatusCode)
+	}
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Backend is where a Store keeps its bytes. Names are slash-separated paths
+// like "alice/ab/cd/abcd...", built by the Store from an id and the key's
+// PathKey. A name that isn't there is reported as os.ErrNotExist.
+type Backend interface {
+	// Put stores everything read from r under name, replacing what was
+	// there. Readers see either the old contents or all of the new.
+	Put(name string, r io.Reader) (int64, error)
+	Get(name string) (io.ReadCloser, BlobInfo, error)
+	Stat(name string) (BlobInfo, error)
+	Delete(name string) error
+	// List calls fn for every name starting with prefix. Returning an
+	// error from fn stops the listing, and List returns it.
+	List(prefix string, fn func(name string, info BlobInfo) error) error
+}
+
+type BlobInfo struct {
+	Size    int64
+	ModTime time.Time
+}
+
+// -------------------- Local Disk --------------------
+
+// DiskBackend keeps each name as a file under Root.
+type DiskBackend struct {
+	Root string
+}
+
+func NewDiskBackend(root string) *DiskBackend {
+	return &DiskBackend{Root: root}
+}
+
+func (b *DiskBackend) path(name string) string {
+	return filepath.Join(b.Root, filepath.FromSlash(name))
+}
+
+// Writes go to a temp file next to the name's path, which is synced and then
+// renamed over it. A crash leaves either the old contents or the new, plus
+// perhaps a temp file for Recover to clean up.
+const tempFilePrefix = ".tmp-"
+
+func isTempFile(name string) bool {
+	return strings.HasPrefix(name, tempFilePrefix)
+}
+
+func (b *DiskBackend) Put(name string, r io.Reader) (int64, error) {
+	fullPath := b.path(name)
+	dir := filepath.Dir(fullPath)
+
+	// A Delete pruning empty directories can remove the one just made, so
+	// make it again if it is gone.
+	var (
+		f   *os.File
+		err error
+	)
+	for attempt := 0; attempt < 3; attempt++ {
+		if err = os.MkdirAll(dir, os.ModePerm); err != nil {
+			return 0, err
+		}
+		f, err = os.CreateTemp(dir, tempFilePrefix+"*")
+		if !errors.Is(err, os.ErrNotExist) {
+			break
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(f, r)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), fullPath)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return n, err
+	}
+
+	// The rename itself is only durable once the directory is.
+	return n, syncDir(dir)
+}
+
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+func (b *DiskBackend) Get(name string) (io.ReadCloser, BlobInfo, error) {
+	file, err := os.Open(b.path(name))
+	if err != nil {
+		return nil, BlobInfo{}, err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, BlobInfo{}, err
+	}
+	return file, BlobInfo{Size: fi.Size(), ModTime: fi.ModTime()}, nil
+}
+
+func (b *DiskBackend) Stat(name string) (BlobInfo, error) {
+	fi, err := os.Stat(b.path(name))
+	if err != nil {
+		return BlobInfo{}, err
+	}
+	return BlobInfo{Size: fi.Size(), ModTime: fi.ModTime()}, nil
+}
+
+// Delete removes the file holding name, then whichever of its parent
+// directories, up to Root, that leaves empty.
+func (b *DiskBackend) Delete(name string) error {
+	fullPath := b.path(name)
+	if err := os.Remove(fullPath); err != nil {
+		return err
+	}
+
+	root := filepath.Clean(b.Root)
+	for dir := filepath.Dir(fullPath); dir != root && dir != "." && dir != "/"; dir = filepath.Dir(dir) {
+		// Fails, and stops here, once a directory still holds something.
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+func (b *DiskBackend) List(prefix string, fn func(name string, info BlobInfo) error) error {
+	// Walk from the deepest directory the prefix names.
+	start := b.Root
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		start = b.path(prefix[:i])
+	}
+
+	err := filepath.WalkDir(start, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() || isTempFile(d.Name()) {
+			return nil
+		}
+		rel, err := filepath.Rel(b.Root, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if !strings.HasPrefix(name, prefix) {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		return fn(name, BlobInfo{Size: fi.Size(), ModTime: fi.ModTime()})
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// Recover removes temp files left by writes that never finished. It must
+// run before the backend takes any writes.
+func (b *DiskBackend) Recover() (int, error) {
+	removed := 0
+	err := filepath.WalkDir(b.Root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !isTempFile(d.Name()) {
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		log.Printf("removed unfinished write %s", path)
+		removed++
+		return nil
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		return removed, nil
+	}
+	return removed, err
+}
+
+func (b *DiskBackend) Clear() error {
+	return os.RemoveAll(b.Root)
+}
+
+// -------------------- In Memory --------------------
+
+// MemoryBackend keeps everything in a map, for tests and throwaway nodes.
+type MemoryBackend struct {
+	mu    sync.RWMutex
+	blobs map[string]memoryBlob
+}
+
+type memoryBlob struct {
+	data    []byte
+	modTime time.Time
+}
+
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{blobs: make(map[string]memoryBlob)}
+}
+
+func (b *MemoryBackend) Put(name string, r io.Reader) (int64, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return int64(len(data)), err
+	}
+
+	b.mu.Lock()
+	b.blobs[name] = memoryBlob{data: data, modTime: time.Now()}
+	b.mu.Unlock()
+	return int64(len(data)), nil
+}
+
+func (b *MemoryBackend) Get(name string) (io.ReadCloser, BlobInfo, error) {
+	b.mu.RLock()
+	blob, ok := b.blobs[name]
+	b.mu.RUnlock()
+	if !ok {
+		return nil, BlobInfo{}, notExist("get", name)
+	}
+	// Put replaces the slice rather than writing into it, so it can be
+	// read without the lock.
+	return io.NopCloser(bytes.NewReader(blob.data)), blob.info(), nil
+}
+
+func (b *MemoryBackend) Stat(name string) (BlobInfo, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	blob, ok := b.blobs[name]
+	if !ok {
+		return BlobInfo{}, notExist("stat", name)
+	}
+	return blob.info(), nil
+}
+
+func (b *MemoryBackend) Delete(name string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.blobs[name]; !ok {
+		return notExist("delete", name)
+	}
+	delete(b.blobs, name)
+	return nil
+}
+
+func (b *MemoryBackend) List(prefix string, fn func(name string, info BlobInfo) error) error {
+	b.mu.RLock()
+	var names []string
+	infos := map[string]BlobInfo{}
+	for name, blob := range b.blobs {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+			infos[name] = blob.info()
+		}
+	}
+	b.mu.RUnlock()
+
+	sort.Strings(names)
+	for _, name := range names {
+		if err := fn(name, infos[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m memoryBlob) info() BlobInfo {
+	return BlobInfo{Size: int64(len(m.data)), ModTime: m.modTime}
+}
+
+func notExist(op, name string) error {
+	return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+}
+
+// -------------------- Configuration --------------------
+
+// newBackendFromEnv picks where chunks are kept: STORAGE_BACKEND is "disk"
+// (the default, under root), "memory" or "s3", configured by the S3_*
+// variables. Objects go under S3_PREFIX, by default the node id.
+func newBackendFromEnv(root, nodeID string) (Backend, error) {
+	kind := getEnv("STORAGE_BACKEND", "disk")
+	prefix := getEnv("S3_PREFIX", nodeID+"/")
+	if kind == "s3" {
+		if err := checkNodePrefix("S3_PREFIX", prefix, nodeID); err != nil {
+			return nil, err
+		}
+	}
+	return newBackend(kind, root, prefix)
+}
+
+// checkNodePrefix makes sure a node keeps its objects apart from every other
+// node's. Chunk names are hashes of what this node sealed, and garbage
+// collection deletes whatever under the prefix no local manifest refers to,
+// so nodes sharing a prefix would collect each other's chunks.
+func checkNodePrefix(env, prefix, nodeID string) error {
+	if !strings.HasSuffix(prefix, "/") || !slices.Contains(strings.Split(prefix, "/"), nodeID) {
+		return fmt.Errorf("%s %q must end in / and name the node id %q as one of its parts", env, prefix, nodeID)
+	}
+	return nil
+}
+
+// newColdBackendFromEnv picks where chunks of cold files are kept, or
+// returns nil to keep everything hot. COLD_STORAGE_BACKEND takes the same
+// values as STORAGE_BACKEND; a cold disk goes under COLD_STORAGE_ROOT, and
+// cold objects under COLD_S3_PREFIX, by default "cold/" followed by the
+// hot prefix, e.g. "cold/s1/" next to "s1/". Neither tier's directory or
+// prefix may contain the other's, or walking one tier would list the other's
+// chunks too, and moving a file would delete the copy it just made.
+// hotRoot is the hot tier's directory, when that is on disk.
+func newColdBackendFromEnv(nodeID, hotRoot string) (Backend, error) {
+	kind := getEnv("COLD_STORAGE_BACKEND", "")
+	if kind == "" {
+		return nil, nil
+	}
+	root := getEnv("COLD_STORAGE_ROOT", "")
+	if kind == "disk" && root == "" {
+		return nil, fmt.Errorf("COLD_STORAGE_BACKEND=disk needs COLD_STORAGE_ROOT")
+	}
+	coldRoot := filepath.Join(root, nodeID, blobsDir)
+	if kind == "disk" && getEnv("STORAGE_BACKEND", "disk") == "disk" &&
+		(pathWithin(coldRoot, hotRoot) || pathWithin(hotRoot, coldRoot)) {
+		return nil, fmt.Errorf("cold tier %s and hot tier %s overlap; COLD_STORAGE_ROOT must be apart from STORAGE_ROOT", coldRoot, hotRoot)
+	}
+	hotPrefix := getEnv("S3_PREFIX", nodeID+"/")
+	coldPrefix := getEnv("COLD_S3_PREFIX", "cold/"+hotPrefix)
+	if kind == "s3" {
+		if err := checkNodePrefix("COLD_S3_PREFIX", coldPrefix, nodeID); err != nil {
+			return nil, err
+		}
+		if getEnv("STORAGE_BACKEND", "disk") == "s3" &&
+			(strings.HasPrefix(coldPrefix, hotPrefix) || strings.HasPrefix(hotPrefix, coldPrefix)) {
+			return nil, fmt.Errorf("S3_PREFIX %q and COLD_S3_PREFIX %q overlap", hotPrefix, coldPrefix)
+		}
+	}
+	return newBackend(kind, coldRoot, coldPrefix)
+}
+
+// pathWithin reports whether path is dir or somewhere under it.
+func pathWithin(path, dir string) bool {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	dir, err = filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+func newBackend(kind, root, s3Prefix string) (Backend, error) {
+	switch kind {
+	case "disk":
+		return NewDiskBackend(root), nil
+	case "memory":
+		return NewMemoryBackend(), nil
+	case "s3":
+		b, err := NewS3Backend(S3BackendOpts{
+			Endpoint:        getEnv("S3_ENDPOINT", ""),
+			Region:          getEnv("S3_REGION", "us-east-1"),
+			Bucket:          getEnv("S3_BUCKET", ""),
+			Prefix:          s3Prefix,
+			AccessKeyID:     getEnv("S3_ACCESS_KEY_ID", ""),
+			SecretAccessKey: getEnv("S3_SECRET_ACCESS_KEY", ""),
+		})
+		if err != nil {
+			return nil, err
+		}
+		return b, nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", kind)
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3Backend keeps each name as an object in a bucket of S3, or anything
+// that speaks its API such as MinIO. Requests are path-style and signed with
+// AWS Signature Version 4.
+type S3Backend struct {
+	S3BackendOpts
+	client *http.Client
+}
+
+type S3BackendOpts struct {
+	// Endpoint is the service's base URL, e.g. "https://s3.us-east-1.amazonaws.com"
+	// or "http://minio:9000".
+	Endpoint string
+	Region   string
+	Bucket   string
+	// Prefix goes in front of every name. Nodes sharing a bucket each need
+	// their own, as none of them knows the others' chunks.
+	Prefix          string
+	AccessKeyID     string
+	SecretAccessKey string
+	Client          *http.Client
+}
+
+func NewS3Backend(opts S3BackendOpts) (*S3Backend, error) {
+	if opts.Endpoint == "" || opts.Bucket == "" {
+		return nil, errors.New("s3 backend needs an endpoint and a bucket")
+	}
+	if _, err := url.Parse(opts.Endpoint); err != nil {
+		return nil, fmt.Errorf("s3 endpoint: %w", err)
+	}
+	opts.Endpoint = strings.TrimRight(opts.Endpoint, "/")
+	if opts.Region == "" {
+		opts.Region = "us-east-1"
+	}
+	client := opts.Client
+	if client == nil {
+		client = &http.Client{Timeout: time.Minute}
+	}
+	return &S3Backend{S3BackendOpts: opts, client: client}, nil
+}
+
+// Put reads all of r before sending it; objects are chunk sized. S3 puts
+// are atomic, so nothing half written is ever visible.
+func (b *S3Backend) Put(name string, r io.Reader) (int64, error) {
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return int64(len(body)), err
+	}
+	resp, err := b.do(http.MethodPut, b.objectPath(name), nil, body)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return int64(len(body)), nil
+}
+
+func (b *S3Backend) Get(name string) (io.ReadCloser, BlobInfo, error) {
+	resp, err := b.do(http.MethodGet, b.objectPath(name), nil, nil)
+	if err != nil {
+		return nil, BlobInfo{}, wrapNotExist("get", name, err)
+	}
+	return resp.Body, objectInfo(resp), nil
+}
+
+func (b *S3Backend) Stat(name string) (BlobInfo, error) {
+	resp, err := b.do(http.MethodHead, b.objectPath(name), nil, nil)
+	if err != nil {
+		return BlobInfo{}, wrapNotExist("stat", name, err)
+	}
+	resp.Body.Close()
+	return objectInfo(resp), nil
+}
+
+// Delete checks that name is there first, as S3 reports deleting a missing
+// object as a success.
+func (b *S3Backend) Delete(name string) error {
+	if _, err := b.Stat(name); err != nil {
+		return err
+	}
+	resp, err := b.do(http.MethodDelete, b.objectPath(name), nil, nil)
+	if err != nil {
+		return wrapNotExist("delete", name, err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+type listBucketResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (b *S3Backend) List(prefix string, fn func(name string, info BlobInfo) error) error {
+	query := url.Values{
+		"list-type": {"2"},
+		"prefix":    {b.Prefix + prefix},
+	}
+	for {
+		resp, err := b.do(http.MethodGet, "/"+b.Bucket, query, nil)
+		if err != nil {
+			return err
+		}
+		var page listBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("s3 list: %w", err)
+		}
+
+		for _, obj := range page.Contents {
+			info := BlobInfo{Size: obj.Size, ModTime: obj.LastModified}
+			if err := fn(strings.TrimPrefix(obj.Key, b.Prefix), info); err != nil {
+				return err
+			}
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return nil
+		}
+		query.Set("continuation-token", page.NextContinuationToken)
+	}
+}
+
+func (b *S3Backend) objectPath(name string) string {
+	return "/" + b.Bucket + "/" + b.Prefix + name
+}
+
+func objectInfo(resp *http.Response) BlobInfo {
+	size, _ := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return BlobInfo{Size: size, ModTime: modTime}
+}
+
+// s3Error is a response S3 answered with an error status.
+type s3Error struct {
+	Status int
+	Code   string `xml:"Code"`
+	Msg    string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("s3: status %d", e.Status)
+	}
+	return fmt.Sprintf("s3: %s: %s", e.Code, e.Msg)
+}
+
+func wrapNotExist(op, name string, err error) error {
+	var s3err *s3Error
+	if errors.As(err, &s3err) && s3err.Status == http.StatusNotFound {
+		return notExist(op, name)
+	}
+	return err
+}
+
+// do sends a signed request, and turns any status but 2xx into an *s3Error.
+func (b *S3Backend) do(method, path string, query url.Values, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, b.Endpoint+s3EscapePath(path), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.URL.RawQuery = s3EncodeQuery(query)
+	req.ContentLength = int64(len(body))
+	b.sign(req, body, time.Now().UTC())
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	s3err := &s3Error{Status: resp.StatusCode}
+	xml.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(s3err)
+	return nil, s3err
+}
+
+// -------------------- Signature Version 4 --------------------
+
+func (b *S3Backend) sign(req *http.Request, body []byte, now time.Time) {
+	sum := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(sum[:])
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signed := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	var headers strings.Builder
+	for _, h := range signed {
+		value := req.Header.Get(h)
+		if h == "host" {
+			// Go sends the URL's host, not a Host header.
+			value = req.URL.Host
+		}
+		headers.WriteString(h + ":" + strings.TrimSpace(value) + "\n")
+	}
+
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		headers.String(),
+		strings.Join(signed, ";"),
+		payloadHash,
+	}, "\n")
+	scope := day + "/" + b.Region + "/s3/aws4_request"
+	canonicalSum := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalSum[:])
+
+	key := hmacSHA256([]byte("AWS4"+b.SecretAccessKey), day)
+	key = hmacSHA256(key, b.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		b.AccessKeyID, scope, strings.Join(signed, ";"), signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Escape percent-encodes everything but the characters SigV4 leaves
+// alone, and slashes too if keepSlash.
+func s3Escape(s string, keepSlash bool) string {
+	var out strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && keepSlash:
+			out.WriteByte(c)
+		default:
+			fmt.Fprintf(&out, "%%%02X", c)
+		}
+	}
+	return out.String()
+}
+
+func s3EscapePath(path string) string {
+	return s3Escape(path, true)
+}
+
+// s3EncodeQuery sorts by key, as the canonical request needs, and uses the
+// same encoding for the URL so the two match.
+func s3EncodeQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, s3Escape(k, false)+"="+s3Escape(v, false))
+		}
+	}
+	return strings.Join(parts, "&")
+}
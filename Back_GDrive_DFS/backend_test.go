@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testBackend runs the same checks against any Backend.
+func testBackend(t *testing.T, b Backend) {
+	names := []string{"alice/ab/cd/abcd", "alice/ab/ef/abef", "bob/00/ff/00ff"}
+	for _, name := range names {
+		if n, err := b.Put(name, strings.NewReader("data of "+name)); err != nil || n != int64(len("data of "+name)) {
+			t.Fatalf("put %s: %d, %v", name, n, err)
+		}
+	}
+	if _, err := b.Put(names[0], strings.NewReader("replaced")); err != nil {
+		t.Fatal(err)
+	}
+
+	r, info, err := b.Get(names[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := io.ReadAll(r)
+	r.Close()
+	if string(got) != "replaced" || info.Size != 8 {
+		t.Errorf("have %q, %+v", got, info)
+	}
+	if info, err := b.Stat(names[1]); err != nil || info.Size != int64(len("data of "+names[1])) || info.ModTime.IsZero() {
+		t.Errorf("stat: %+v, %v", info, err)
+	}
+
+	var listed []string
+	err = b.List("alice/", func(name string, info BlobInfo) error {
+		listed = append(listed, name)
+		return nil
+	})
+	sort.Strings(listed)
+	if err != nil || strings.Join(listed, ",") != "alice/ab/cd/abcd,alice/ab/ef/abef" {
+		t.Errorf("listed %v, %v", listed, err)
+	}
+	stop := errors.New("stop")
+	if err := b.List("", func(string, BlobInfo) error { return stop }); err != stop {
+		t.Errorf("list did not stop: %v", err)
+	}
+
+	if err := b.Delete(names[1]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Stat(names[1]); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("stat after delete: %v", err)
+	}
+	if _, _, err := b.Get(names[1]); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("get after delete: %v", err)
+	}
+	if err := b.Delete(names[1]); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("deleting twice: %v", err)
+	}
+	if _, err := b.Stat(names[0]); err != nil {
+		t.Errorf("delete removed a neighbour: %v", err)
+	}
+}
+
+func TestDiskBackend(t *testing.T) {
+	testBackend(t, NewDiskBackend(t.TempDir()))
+}
+
+func TestMemoryBackend(t *testing.T) {
+	testBackend(t, NewMemoryBackend())
+}
+
+func TestS3Backend(t *testing.T) {
+	b, fake := newFakeS3Backend(t)
+	testBackend(t, b)
+
+	if fake.badSignatures > 0 {
+		t.Errorf("%d requests had bad signatures", fake.badSignatures)
+	}
+	for name := range fake.objects {
+		if !strings.HasPrefix(name, "node1/") {
+			t.Errorf("object %s is outside the prefix", name)
+		}
+	}
+}
+
+func TestColdPrefixMustNotOverlap(t *testing.T) {
+	t.Setenv("STORAGE_BACKEND", "s3")
+	t.Setenv("COLD_STORAGE_BACKEND", "s3")
+	for _, prefixes := range [][2]string{{"s1/", "s1/cold/"}, {"", "cold/"}, {"s1/cold/", "s1/"}} {
+		t.Setenv("S3_PREFIX", prefixes[0])
+		t.Setenv("COLD_S3_PREFIX", prefixes[1])
+		if _, err := newColdBackendFromEnv("s1", ""); err == nil {
+			t.Errorf("hot %q and cold %q were accepted", prefixes[0], prefixes[1])
+		}
+	}
+
+	// The defaults keep the tiers, and the nodes, apart.
+	t.Setenv("S3_ENDPOINT", "http://localhost:9000")
+	t.Setenv("S3_BUCKET", "chunks")
+	t.Setenv("S3_PREFIX", "")
+	t.Setenv("COLD_S3_PREFIX", "")
+	hot, err := newBackendFromEnv("", "s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cold, err := newColdBackendFromEnv("s1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hot.(*S3Backend).Prefix != "s1/" || cold.(*S3Backend).Prefix != "cold/s1/" {
+		t.Errorf("have hot %q and cold %q", hot.(*S3Backend).Prefix, cold.(*S3Backend).Prefix)
+	}
+}
+
+func TestFileServerOnS3(t *testing.T) {
+	b, _ := newFakeS3Backend(t)
+	s := NewFileServer(FileServerOpts{
+		ID:                "s1",
+		Keys:              newTestKeyManager(t),
+		StorageRoot:       t.TempDir(),
+		PathTransformFunc: HashPathTransformFunc,
+		Backend:           b,
+	})
+
+	data := bytes.Repeat([]byte("on object storage "), ChunkSize/9)
+	if _, err := s.WriteFile("alice", "big.bin", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if _, err := s.ReadFile("alice", "big.bin", &out); err != nil || !bytes.Equal(out.Bytes(), data) {
+		t.Fatalf("read back %d bytes, %v", out.Len(), err)
+	}
+	if _, used, err := s.Usage("alice"); used <= int64(len(data)) || err != nil {
+		t.Errorf("have %d bytes used, %v", used, err)
+	}
+	if err := s.DeleteFile("alice", "big.bin"); err != nil {
+		t.Fatal(err)
+	}
+	if keys, _ := s.store.List("alice"); len(keys) != 0 {
+		t.Errorf("chunks left after delete: %v", keys)
+	}
+}
+
+func TestNodesShareABucket(t *testing.T) {
+	_, fake := newFakeS3Backend(t)
+	t.Setenv("STORAGE_BACKEND", "s3")
+	t.Setenv("S3_ENDPOINT", fake.url)
+	t.Setenv("S3_BUCKET", fake.bucket)
+	t.Setenv("S3_ACCESS_KEY_ID", "test")
+	t.Setenv("S3_SECRET_ACCESS_KEY", "secret")
+
+	var servers []*FileServer
+	for _, id := range []string{"s1", "s2"} {
+		b, err := newBackendFromEnv("", id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := NewFileServer(FileServerOpts{
+			ID:                id,
+			Keys:              newTestKeyManager(t),
+			StorageRoot:       t.TempDir(),
+			PathTransformFunc: HashPathTransformFunc,
+			Backend:           b,
+		})
+		if _, err := s.WriteFile("alice", "notes.txt", strings.NewReader("written on "+id)); err != nil {
+			t.Fatal(err)
+		}
+		servers = append(servers, s)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	for _, s := range servers {
+		if n, err := s.CollectGarbage(0); err != nil || n != 0 {
+			t.Errorf("%s collected %d, %v", s.ID, n, err)
+		}
+	}
+	for _, s := range servers {
+		var out bytes.Buffer
+		if _, err := s.ReadFile("alice", "notes.txt", &out); err != nil || out.String() != "written on "+s.ID {
+			t.Errorf("%s has %q, %v", s.ID, out.String(), err)
+		}
+	}
+
+	for _, prefix := range []string{"shared/", "s1", "s10/"} {
+		t.Setenv("S3_PREFIX", prefix)
+		if _, err := newBackendFromEnv("", "s1"); err == nil {
+			t.Errorf("prefix %q was accepted", prefix)
+		}
+	}
+}
+
+// fakeS3 is just enough of S3 for S3Backend: objects in a map, and a
+// listing that pages every two keys.
+type fakeS3 struct {
+	mu            sync.Mutex
+	url           string
+	bucket        string
+	objects       map[string][]byte
+	modified      map[string]time.Time
+	signer        *S3Backend
+	badSignatures int
+}
+
+func newFakeS3Backend(t *testing.T) (*S3Backend, *fakeS3) {
+	fake := &fakeS3{
+		bucket:   "chunks",
+		objects:  map[string][]byte{},
+		modified: map[string]time.Time{},
+	}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+	fake.url = srv.URL
+
+	b, err := NewS3Backend(S3BackendOpts{
+		Endpoint:        srv.URL,
+		Bucket:          fake.bucket,
+		Prefix:          "node1/",
+		AccessKeyID:     "test",
+		SecretAccessKey: "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake.signer = b
+	return b, fake
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	body, _ := io.ReadAll(r.Body)
+	if !f.signedBy(r, body) {
+		f.badSignatures++
+		http.Error(w, "<Error><Code>SignatureDoesNotMatch</Code></Error>", http.StatusForbidden)
+		return
+	}
+
+	key, isObject := strings.CutPrefix(r.URL.Path, "/"+f.bucket+"/")
+	if !isObject {
+		f.list(w, r.URL.Query())
+		return
+	}
+	data, ok := f.objects[key]
+	switch r.Method {
+	case http.MethodPut:
+		f.objects[key] = body
+		f.modified[key] = time.Now()
+		return
+	case http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, "<Error><Code>NoSuchKey</Code><Message>not found</Message></Error>")
+		return
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Header().Set("Last-Modified", f.modified[key].UTC().Format(http.TimeFormat))
+	if r.Method == http.MethodGet {
+		w.Write(data)
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, query map[string][]string) {
+	get := func(k string) string {
+		if v := query[k]; len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+	var keys []string
+	for key := range f.objects {
+		if strings.HasPrefix(key, get("prefix")) && key > get("continuation-token") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var page listBucketResult
+	for _, key := range keys {
+		if len(page.Contents) == 2 {
+			page.IsTruncated = true
+			page.NextContinuationToken = page.Contents[1].Key
+			break
+		}
+		page.Contents = append(page.Contents, struct {
+			Key          string    `xml:"Key"`
+			Size         int64     `xml:"Size"`
+			LastModified time.Time `xml:"LastModified"`
+		}{key, int64(len(f.objects[key])), f.modified[key]})
+	}
+	xml.NewEncoder(w).Encode(page)
+}
+
+// signedBy signs a copy of r the way the backend would have at the time r
+// says it was sent, and compares the two.
+func (f *fakeS3) signedBy(r *http.Request, body []byte) bool {
+	sent, err := time.Parse("20060102T150405Z", r.Header.Get("X-Amz-Date"))
+	if err != nil {
+		return false
+	}
+	u := *r.URL
+	u.Scheme, u.Host = "http", r.Host
+	check := &http.Request{Method: r.Method, URL: &u, Header: http.Header{}}
+	f.signer.sign(check, body, sent)
+	return check.Header.Get("Authorization") == r.Header.Get("Authorization")
+}
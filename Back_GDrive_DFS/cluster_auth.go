@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+)
+
+// Peer routes are authenticated with an HMAC over the request, keyed by the
+// CLUSTER_SECRET every node is started with. The signature covers the method,
+// path with query, a timestamp, a random nonce, the sending node and a hash
+// of the body, so a captured request can't be replayed against another route
+// or outside the allowed clock skew. Within it, each nonce is accepted once.
+const (
+	headerClusterNode      = "X-Cluster-Node"
+	headerClusterTimestamp = "X-Cluster-Timestamp"
+	headerClusterNonce     = "X-Cluster-Nonce"
+	headerClusterBodyHash  = "X-Cluster-Content-SHA256"
+	headerClusterSignature = "X-Cluster-Signature"
+
+	clusterClockSkew = 5 * time.Minute
+	maxNonceLen      = 64
+)
+
+func clusterSecret() []byte {
+	return []byte(getEnv("CLUSTER_SECRET", ""))
+}
+
+func bodyHash(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+func clusterSignature(secret []byte, method, path string, ts int64, nonce, node, bodySum string) string {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%s\n%s\n%d\n%s\n%s\n%s", method, path, ts, nonce, node, bodySum)
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// nonceCache remembers the nonces of requests accepted in the last
+// clusterClockSkew. Older ones needn't be kept: their timestamp is refused.
+type nonceCache struct {
+	mu        sync.Mutex
+	seen      map[string]time.Time // nonce -> when its request goes stale
+	nextPrune time.Time
+}
+
+// clusterNonces are the nonces this node has accepted.
+var clusterNonces = &nonceCache{seen: make(map[string]time.Time)}
+
+// add records nonce, for a request stamped ts, and reports whether it was
+// new.
+func (n *nonceCache) add(nonce string, ts, now time.Time) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if now.After(n.nextPrune) {
+		for k, stale := range n.seen {
+			if now.After(stale) {
+				delete(n.seen, k)
+			}
+		}
+		n.nextPrune = now.Add(time.Minute)
+	}
+	if _, ok := n.seen[nonce]; ok {
+		return false
+	}
+	n.seen[nonce] = ts.Add(clusterClockSkew)
+	return true
+}
+
+// signClusterRequest stamps req as coming from this node. body must be the
+// exact bytes that will be sent.
+func signClusterRequest(req *http.Request, body []byte) error {
+	secret := clusterSecret()
+	if len(secret) == 0 {
+		return fmt.Errorf("CLUSTER_SECRET is not set")
+	}
+
+	ts := time.Now().Unix()
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	nonceHex := hex.EncodeToString(nonce)
+	node := getEnv("NODE_ID", "s1")
+	sum := bodyHash(body)
+
+	req.Header.Set(headerClusterNode, node)
+	req.Header.Set(headerClusterTimestamp, strconv.FormatInt(ts, 10))
+	req.Header.Set(headerClusterNonce, nonceHex)
+	req.Header.Set(headerClusterBodyHash, sum)
+	req.Header.Set(headerClusterSignature, clusterSignature(secret, req.Method, req.URL.RequestURI(), ts, nonceHex, node, sum))
+	return nil
+}
+
+// newClusterRequest builds a signed request to a peer's internal route.
+func newClusterRequest(method, url string, body []byte) (*http.Request, error) {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, url, r)
+	if err != nil {
+		return nil, err
+	}
+	if err := signClusterRequest(req, body); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// clusterGet is the signed equivalent of client.Get for peer routes.
+func clusterGet(client *http.Client, url string) (*http.Response, error) {
+	req, err := newClusterRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return client.Do(req)
+}
+
+// verifyClusterSignature checks a signed request, and records its nonce in
+// seen so that it is refused a second time.
+func verifyClusterSignature(secret []byte, method, path, node, tsRaw, nonce, sum, sig string, body []byte, now time.Time, seen *nonceCache) error {
+	if len(secret) == 0 {
+		return fmt.Errorf("cluster authentication is not configured")
+	}
+	if node == "" || sig == "" || nonce == "" {
+		return fmt.Errorf("missing cluster credentials")
+	}
+	if len(nonce) > maxNonceLen {
+		return fmt.Errorf("invalid cluster nonce")
+	}
+
+	ts, err := strconv.ParseInt(tsRaw, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid cluster timestamp")
+	}
+	if d := now.Sub(time.Unix(ts, 0)); d > clusterClockSkew || d < -clusterClockSkew {
+		return fmt.Errorf("cluster request outside allowed clock skew")
+	}
+
+	if !hmac.Equal([]byte(sum), []byte(bodyHash(body))) {
+		return fmt.Errorf("cluster request body does not match its hash")
+	}
+
+	want := clusterSignature(secret, method, path, ts, nonce, node, sum)
+	if !hmac.Equal([]byte(want), []byte(sig)) {
+		return fmt.Errorf("invalid cluster signature")
+	}
+	// Only signed nonces are recorded, so nobody can use up another's.
+	if !seen.add(nonce, time.Unix(ts, 0), now) {
+		return fmt.Errorf("cluster request replayed")
+	}
+	return nil
+}
+
+func clusterAuthMiddleware(c fiber.Ctx) error {
+	err := verifyClusterSignature(
+		clusterSecret(),
+		c.Method(),
+		string(c.Request().RequestURI()),
+		c.Get(headerClusterNode),
+		c.Get(headerClusterTimestamp),
+		c.Get(headerClusterNonce),
+		c.Get(headerClusterBodyHash),
+		c.Get(headerClusterSignature),
+		c.Body(),
+		time.Now(),
+		clusterNonces,
+	)
+	if err != nil {
+		log.Printf("[cluster-auth] rejected %s %s from %s: %v", c.Method(), c.Path(), c.IP(), err)
+		return c.Status(401).JSON(fiber.Map{"error": "cluster authentication required"})
+	}
+
+	c.Locals("peerNode", c.Get(headerClusterNode))
+	return c.Next()
+}
+
+// adminMiddleware must run after authMiddleware. It lets through
+// users whose token carries the custom claim admin: true.
+func adminMiddleware(c fiber.Ctx) error {
+	claims, _ := c.Locals("claims").(map[string]interface{})
+	if isAdmin, _ := claims["admin"].(bool); !isAdmin {
+		return c.Status(403).JSON(fiber.Map{"error": "admin access required"})
+	}
+	return c.Next()
+}
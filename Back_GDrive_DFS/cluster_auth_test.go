@@ -0,0 +1,123 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+)
+
+func newClusterTestApp() *fiber.App {
+	app := fiber.New()
+	app.Post("/store-local", clusterAuthMiddleware, func(c fiber.Ctx) error {
+		return c.SendString("stored")
+	})
+	app.Get("/files", clusterAuthMiddleware, func(c fiber.Ctx) error {
+		return c.SendString(c.Locals("peerNode").(string))
+	})
+	return app
+}
+
+func TestClusterAuthMiddleware(t *testing.T) {
+	t.Setenv("CLUSTER_SECRET", "s3cr3t")
+	t.Setenv("NODE_ID", "s2")
+	app := newClusterTestApp()
+
+	req, err := newClusterRequest(http.MethodGet, "http://s1:8080/files?detail=1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 200 {
+		t.Errorf("signed request: have status %d want 200", resp.StatusCode)
+	}
+
+	body := []byte("chunk bytes")
+	req, _ = newClusterRequest(http.MethodPost, "http://s1:8080/store-local", body)
+	if resp, _ := app.Test(req); resp.StatusCode != 200 {
+		t.Errorf("signed post: have status %d want 200", resp.StatusCode)
+	}
+	replayed, _ := http.NewRequest(http.MethodPost, "http://s1:8080/store-local", strings.NewReader("chunk bytes"))
+	replayed.Header = req.Header.Clone()
+	if resp, _ := app.Test(replayed); resp.StatusCode != 401 {
+		t.Errorf("replayed post: have status %d want 401", resp.StatusCode)
+	}
+
+	// Same signature, different body.
+	tampered, _ := http.NewRequest(http.MethodPost, "http://s1:8080/store-local", strings.NewReader("evil bytes!"))
+	tampered.Header = req.Header.Clone()
+	if resp, _ := app.Test(tampered); resp.StatusCode != 401 {
+		t.Errorf("tampered body: have status %d want 401", resp.StatusCode)
+	}
+
+	unsigned, _ := http.NewRequest(http.MethodGet, "http://s1:8080/files", nil)
+	if resp, _ := app.Test(unsigned); resp.StatusCode != 401 {
+		t.Errorf("unsigned request: have status %d want 401", resp.StatusCode)
+	}
+}
+
+func TestClusterAuthRejectsWithoutSecret(t *testing.T) {
+	t.Setenv("CLUSTER_SECRET", "")
+	if _, err := newClusterRequest(http.MethodGet, "http://s1:8080/files", nil); err == nil {
+		t.Error("expected signing to fail without a cluster secret")
+	}
+
+	app := newClusterTestApp()
+	req, _ := http.NewRequest(http.MethodGet, "http://s1:8080/files", nil)
+	if resp, _ := app.Test(req); resp.StatusCode != 401 {
+		t.Errorf("have status %d want 401", resp.StatusCode)
+	}
+}
+
+func TestVerifyClusterSignature(t *testing.T) {
+	secret := []byte("s3cr3t")
+	now := time.Now()
+	sum := bodyHash(nil)
+	sign := func(nonce string) string {
+		return clusterSignature(secret, "GET", "/files/raw/u/a.txt", now.Unix(), nonce, "s1", sum)
+	}
+	seen := &nonceCache{seen: make(map[string]time.Time)}
+
+	if err := verifyClusterSignature(secret, "GET", "/files/raw/u/a.txt", "s1", "", "n1", sum, sign("n1"), nil, now, seen); err == nil {
+		t.Error("expected missing timestamp to fail")
+	}
+
+	ts := func(t time.Time) string { return strconv.FormatInt(t.Unix(), 10) }
+	if err := verifyClusterSignature(secret, "GET", "/files/raw/u/a.txt", "s1", ts(now), "n1", sum, sign("n1"), nil, now, seen); err != nil {
+		t.Errorf("expected valid signature: %s", err)
+	}
+	if err := verifyClusterSignature(secret, "GET", "/files/raw/u/a.txt", "s1", ts(now), "n1", sum, sign("n1"), nil, now, seen); err == nil {
+		t.Error("expected replayed request to fail")
+	}
+	if err := verifyClusterSignature(secret, "GET", "/files/raw/u/a.txt", "s1", ts(now), "n3", sum, sign("n2"), nil, now, seen); err == nil {
+		t.Error("signature must be bound to the nonce")
+	}
+	if err := verifyClusterSignature(secret, "GET", "/files/raw/u/b.txt", "s1", ts(now), "n2", sum, sign("n2"), nil, now, seen); err == nil {
+		t.Error("signature must be bound to the path")
+	}
+	if err := verifyClusterSignature(secret, "HEAD", "/files/raw/u/a.txt", "s1", ts(now), "n2", sum, sign("n2"), nil, now, seen); err == nil {
+		t.Error("signature must be bound to the method")
+	}
+	if err := verifyClusterSignature(secret, "GET", "/files/raw/u/a.txt", "s1", ts(now), "n2", sum, sign("n2"), nil, now.Add(10*time.Minute), seen); err == nil {
+		t.Error("expected stale request to fail")
+	}
+}
+
+func TestNonceCacheForgetsStaleNonces(t *testing.T) {
+	seen := &nonceCache{seen: make(map[string]time.Time)}
+	now := time.Now()
+	if !seen.add("a", now, now) || seen.add("a", now, now) {
+		t.Fatal("nonce accepted twice")
+	}
+	later := now.Add(clusterClockSkew + 2*time.Minute)
+	seen.add("b", later, later)
+	if _, ok := seen.seen["a"]; ok {
+		t.Error("stale nonce kept")
+	}
+}
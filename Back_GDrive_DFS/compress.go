@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Chunks of files written since compression was added start, inside their
+// encryption, with a byte naming the codec the rest is in. A manifest says
+// its chunks have this header with Format.
+const chunkFormatCodec = 1
+
+const (
+	codecNone byte = 0
+	codecZstd byte = 1
+)
+
+// encodingZstd marks a file transfer between nodes as zstd compressed.
+const encodingZstd = "zstd"
+
+// EncodeAll and DecodeAll are safe to call from many goroutines at once.
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+// encodeChunk puts the codec header in front of raw, compressed if asked
+// and if that makes it smaller.
+func encodeChunk(raw []byte, compress bool) []byte {
+	if compress {
+		out := zstdEncoder.EncodeAll(raw, []byte{codecZstd})
+		if len(out) < len(raw)+1 {
+			return out
+		}
+	}
+	return append([]byte{codecNone}, raw...)
+}
+
+func decodeChunk(b []byte) ([]byte, error) {
+	if len(b) == 0 {
+		return nil, errors.New("chunk has no codec header")
+	}
+	switch b[0] {
+	case codecNone:
+		return b[1:], nil
+	case codecZstd:
+		return zstdDecoder.DecodeAll(b[1:], nil)
+	default:
+		return nil, fmt.Errorf("unknown chunk codec %d", b[0])
+	}
+}
+
+// sniffLen is how much of a file http.DetectContentType looks at.
+const sniffLen = 512
+
+// compressedTypes are the sniffed types whose contents are compressed
+// already; zstd would spend time on them for nothing.
+var compressedTypes = []string{
+	"image/jpeg", "image/png", "image/gif", "image/webp",
+	"audio/mpeg", "audio/aac", "application/ogg",
+	"video/",
+	"application/zip", "application/x-gzip", "application/x-rar-compressed",
+	"font/woff", "font/woff2",
+}
+
+// compressibleType reports whether a file of sniffed type contentType is
+// worth compressing. Files sniffed before compression have no type, and
+// are left alone.
+func compressibleType(contentType string) bool {
+	if contentType == "" {
+		return false
+	}
+	for _, t := range compressedTypes {
+		if strings.HasPrefix(contentType, t) {
+			return false
+		}
+	}
+	return true
+}
+
+func sniffContentType(head []byte) string {
+	if len(head) > sniffLen {
+		head = head[:sniffLen]
+	}
+	return http.DetectContentType(head)
+}
@@ -1,11 +1,16 @@
 package main
 
 import (
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/md5"
 	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
 )
 
@@ -26,10 +31,294 @@ func newEncryptionKey() []byte {
 	return keyBuf
 }
 
-func copyStream(stream cipher.Stream, blockSize int, src io.Reader, dst io.Writer) (int, error) {
+// Chunks are sealed in a framed AES-GCM format:
+//
+//	header:  "GDRV" | version (1) | key id (4) | segment size (4) | nonce prefix (7)
+//	segment: length (4, high bit set on the last segment) | GCM ciphertext
+//
+// Each segment's nonce is the prefix, a big-endian segment counter and a
+// last-segment flag, and the header is bound in as additional data. Tampering
+// fails the GCM check, reordering or dropping a segment breaks the counter,
+// and cutting the stream short is caught because no segment was marked last.
+// The key id names the key the stream was sealed with, so a reader holding
+// several keys knows which one to use.
+//
+// Version 1 headers have no key id. Data written by the old unauthenticated
+// CTR format (a bare 16 byte IV followed by ciphertext) has no header at all
+// and is only decrypted by openLegacyStream.
+const (
+	sealVersion      = 2
+	sealVersionNoID  = 1
+	sealSegmentSize  = 64 * 1024
+	sealPrefixSize   = 7
+	sealHeaderSize   = 4 + 1 + 4 + 4 + sealPrefixSize
+	sealHeaderSizeV1 = 4 + 1 + 4 + sealPrefixSize
+	sealLastFlag     = 1 << 31
+	sealFrameSize    = 4
+)
+
+var sealMagic = []byte("GDRV")
+
+var (
+	errSealTruncated = errors.New("encrypted stream is truncated")
+	errSealCorrupt   = errors.New("encrypted stream is corrupt or tampered with")
+)
+
+// KeyLookup returns the key a sealed stream was written with, by the id in
+// its header.
+type KeyLookup func(keyID uint32) ([]byte, error)
+
+// sealHeader is a parsed stream header. raw is the header as read, which is
+// authenticated with every segment.
+type sealHeader struct {
+	keyID   uint32
+	segSize uint32
+	prefix  []byte
+	raw     []byte
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func segmentNonce(prefix []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[sealPrefixSize:], counter)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// sealHeaderLen returns the header length for the version in head, or 0 if
+// head doesn't start a sealed stream.
+func sealHeaderLen(head []byte) int {
+	if len(head) < 5 || !bytes.Equal(head[:4], sealMagic) {
+		return 0
+	}
+	switch head[4] {
+	case sealVersion:
+		return sealHeaderSize
+	case sealVersionNoID:
+		return sealHeaderSizeV1
+	}
+	return 0
+}
+
+func parseSealHeader(raw []byte) sealHeader {
+	h := sealHeader{raw: raw}
+	rest := raw[5:]
+	if raw[4] == sealVersion {
+		h.keyID = binary.BigEndian.Uint32(rest)
+		rest = rest[4:]
+	}
+	h.segSize = binary.BigEndian.Uint32(rest)
+	h.prefix = rest[4:]
+	return h
+}
+
+// copyEncrypt seals src into dst under a key without an id and returns the
+// number of bytes written.
+func copyEncrypt(key []byte, src io.Reader, dst io.Writer) (int, error) {
+	return sealStream(0, key, src, dst)
+}
+
+// copyDecrypt opens a stream sealed under key, whatever id its header names.
+func copyDecrypt(key []byte, src io.Reader, dst io.Writer) (int, error) {
+	return openStream(func(uint32) ([]byte, error) { return key, nil }, src, dst)
+}
+
+// sealStream seals src into dst under key, recording keyID in the header. It
+// returns the number of bytes written.
+func sealStream(keyID uint32, key []byte, src io.Reader, dst io.Writer) (int, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return 0, err
+	}
+
+	header := make([]byte, sealHeaderSize)
+	copy(header, sealMagic)
+	header[4] = sealVersion
+	binary.BigEndian.PutUint32(header[5:9], keyID)
+	binary.BigEndian.PutUint32(header[9:13], sealSegmentSize)
+	prefix := header[13:]
+	if _, err := io.ReadFull(rand.Reader, prefix); err != nil {
+		return 0, err
+	}
+
+	nw, err := dst.Write(header)
+	if err != nil {
+		return nw, err
+	}
+
+	// Read one segment ahead so we know which one is last.
+	var (
+		cur     = make([]byte, sealSegmentSize)
+		next    = make([]byte, sealSegmentSize)
+		sealed  = make([]byte, 0, sealFrameSize+sealSegmentSize+gcm.Overhead())
+		counter uint32
+	)
+	n, err := io.ReadFull(src, cur)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nw, err
+	}
+	for {
+		m := 0
+		last := n < sealSegmentSize
+		if !last {
+			m, err = io.ReadFull(src, next)
+			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				return nw, err
+			}
+			last = m == 0
+		}
+
+		frameLen := uint32(n + gcm.Overhead())
+		if last {
+			frameLen |= sealLastFlag
+		}
+		sealed = binary.BigEndian.AppendUint32(sealed[:0], frameLen)
+		sealed = gcm.Seal(sealed, segmentNonce(prefix, counter, last), cur[:n], header)
+
+		nn, err := dst.Write(sealed)
+		nw += nn
+		if err != nil {
+			return nw, err
+		}
+		if last {
+			return nw, nil
+		}
+
+		if counter == ^uint32(0) {
+			return nw, fmt.Errorf("stream too long to encrypt")
+		}
+		counter++
+		cur, next, n = next, cur, m
+	}
+}
+
+// openStream decrypts src into dst with the key lookup returns for the
+// stream's key id, and returns the number of plaintext bytes written.
+// Segments are only written once they authenticate. Anything but a sealed
+// stream is refused; only openLegacyStream reads the old CTR format.
+func openStream(lookup KeyLookup, src io.Reader, dst io.Writer) (int, error) {
+	return openAnyStream(lookup, src, dst, false)
+}
+
+// openLegacyStream is openStream, except that a stream without a sealed
+// header is decrypted as unauthenticated CTR with key id 0. It is only for
+// data written before the sealed format, which is none of what manifests
+// name: they came later.
+func openLegacyStream(lookup KeyLookup, src io.Reader, dst io.Writer) (int, error) {
+	return openAnyStream(lookup, src, dst, true)
+}
+
+func openAnyStream(lookup KeyLookup, src io.Reader, dst io.Writer, ctr bool) (int, error) {
+	head := make([]byte, sealHeaderSize)
+	n, err := io.ReadFull(src, head[:5])
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return 0, err
+	}
+
+	hlen := sealHeaderLen(head[:n])
+	if hlen == 0 {
+		if !ctr {
+			return 0, errSealCorrupt
+		}
+		key, err := lookup(0)
+		if err != nil {
+			return 0, err
+		}
+		return copyDecryptCTR(key, io.MultiReader(bytes.NewReader(head[:n]), src), dst)
+	}
+	if _, err := io.ReadFull(src, head[5:hlen]); err != nil {
+		return 0, errSealTruncated
+	}
+	h := parseSealHeader(head[:hlen])
+	// Writers only use sealSegmentSize; a bigger one would only make us
+	// allocate what the header asks for.
+	if h.segSize == 0 || h.segSize > sealSegmentSize {
+		return 0, errSealCorrupt
+	}
+
+	key, err := lookup(h.keyID)
+	if err != nil {
+		return 0, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return 0, err
+	}
+
+	var (
+		frame   = make([]byte, sealFrameSize)
+		buf     = make([]byte, int(h.segSize)+gcm.Overhead())
+		nw      int
+		counter uint32
+	)
+	for {
+		if _, err := io.ReadFull(src, frame); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return nw, errSealTruncated
+			}
+			return nw, err
+		}
+		frameLen := binary.BigEndian.Uint32(frame)
+		last := frameLen&sealLastFlag != 0
+		size := int(frameLen &^ sealLastFlag)
+		if size < gcm.Overhead() || size > len(buf) {
+			return nw, errSealCorrupt
+		}
+
+		if _, err := io.ReadFull(src, buf[:size]); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return nw, errSealTruncated
+			}
+			return nw, err
+		}
+
+		plain, err := gcm.Open(buf[:0], segmentNonce(h.prefix, counter, last), buf[:size], h.raw)
+		if err != nil {
+			return nw, errSealCorrupt
+		}
+		nn, err := dst.Write(plain)
+		nw += nn
+		if err != nil {
+			return nw, err
+		}
+
+		if last {
+			return nw, nil
+		}
+		counter++
+	}
+}
+
+// sealedPlaintextSize works out how many plaintext bytes a sealed stream of
+// size bytes holds, given its first bytes. Legacy CTR streams carry just the
+// IV on top of the data.
+func sealedPlaintextSize(head []byte, size int64) int64 {
+	hlen := sealHeaderLen(head)
+	if hlen == 0 || len(head) < hlen {
+		return size - aes.BlockSize
+	}
+
+	const perSegment = sealFrameSize + 16 // frame length + GCM tag
+	segSize := int64(parseSealHeader(head[:hlen]).segSize)
+	body := size - int64(hlen)
+	segments := (body + segSize + perSegment - 1) / (segSize + perSegment)
+	return body - segments*perSegment
+}
+
+func copyStream(stream cipher.Stream, src io.Reader, dst io.Writer) (int, error) {
 	var (
 		buf = make([]byte, 32*1024)
-		nw  = blockSize
+		nw  int
 	)
 	for {
 		n, err := src.Read(buf)
@@ -51,37 +340,67 @@ func copyStream(stream cipher.Stream, blockSize int, src io.Reader, dst io.Write
 	return nw, nil
 }
 
-func copyDecrypt(key []byte, src io.Reader, dst io.Writer) (int, error) {
+// copyDecryptCTR reads the unauthenticated AES-CTR format chunks were written
+// in before the sealed format.
+func copyDecryptCTR(key []byte, src io.Reader, dst io.Writer) (int, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
 		return 0, err
 	}
 
 	iv := make([]byte, block.BlockSize())
-	if _, err := src.Read(iv); err != nil {
+	if _, err := io.ReadFull(src, iv); err != nil {
 		return 0, err
 	}
 
 	stream := cipher.NewCTR(block, iv)
-	return copyStream(stream, block.BlockSize(), src, dst)
+	return copyStream(stream, src, dst)
 }
 
-func copyEncrypt(key []byte, src io.Reader, dst io.Writer) (int, error) {
-	block, err := aes.NewCipher(key)
+// parseMasterKey accepts a 32 byte key as hex or base64.
+func parseMasterKey(s string) ([]byte, error) {
+	if key, err := hex.DecodeString(s); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(s); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	return nil, fmt.Errorf("master key must be 32 bytes, hex or base64 encoded")
+}
+
+// wrapKey seals a data key under a key-encryption key with AES-GCM, bound
+// to aad: unwrapping with any other aad fails. The output is nonce ||
+// ciphertext.
+func wrapKey(kek, dek, aad []byte) ([]byte, error) {
+	block, err := aes.NewCipher(kek)
 	if err != nil {
-		return 0, err
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
 	}
 
-	iv := make([]byte, block.BlockSize()) // 16 bytes
-	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
-		return 0, err
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
 	}
+	return gcm.Seal(nonce, nonce, dek, aad), nil
+}
 
-	// prepend the IV to the file.
-	if _, err := dst.Write(iv); err != nil {
-		return 0, err
+func unwrapKey(kek, wrapped, aad []byte) ([]byte, error) {
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
 	}
 
-	stream := cipher.NewCTR(block, iv)
-	return copyStream(stream, block.BlockSize(), src, dst)
+	if len(wrapped) < gcm.NonceSize() {
+		return nil, fmt.Errorf("wrapped key too short")
+	}
+	nonce, ciphertext := wrapped[:gcm.NonceSize()], wrapped[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, aad)
 }
@@ -2,7 +2,13 @@ package main
 
 import (
 	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"testing"
 )
 
@@ -25,11 +31,136 @@ func TestCopyEncryptDecrypt(t *testing.T) {
 		t.Error(err)
 	}
 
-	if nw != 16+len(payload) {
-		t.Fail()
+	if nw != len(payload) {
+		t.Errorf("have %d bytes want %d", nw, len(payload))
 	}
 
 	if out.String() != payload {
 		t.Errorf("decryption failed!!!")
 	}
 }
+
+func TestWrapKey(t *testing.T) {
+	kek := newEncryptionKey()
+	dek := newEncryptionKey()
+	aad := []byte("alice\x00a.txt")
+
+	wrapped, err := wrapKey(kek, dek, aad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(wrapped, dek) {
+		t.Error("wrapped key contains the plain key")
+	}
+
+	out, err := unwrapKey(kek, wrapped, aad)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, dek) {
+		t.Error("unwrapped key does not match")
+	}
+
+	if _, err := unwrapKey(newEncryptionKey(), wrapped, aad); err == nil {
+		t.Error("expected unwrap with the wrong key to fail")
+	}
+	if _, err := unwrapKey(kek, wrapped, []byte("alice\x00b.txt")); err == nil {
+		t.Error("expected unwrap with other associated data to fail")
+	}
+}
+
+func TestCopyEncryptSegments(t *testing.T) {
+	key := newEncryptionKey()
+	for _, size := range []int{0, 1, sealSegmentSize - 1, sealSegmentSize, sealSegmentSize + 1, 3*sealSegmentSize + 17} {
+		payload := make([]byte, size)
+		io.ReadFull(rand.Reader, payload)
+
+		sealed := new(bytes.Buffer)
+		nw, err := copyEncrypt(key, bytes.NewReader(payload), sealed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if nw != sealed.Len() {
+			t.Errorf("size %d: copyEncrypt reported %d bytes, wrote %d", size, nw, sealed.Len())
+		}
+		if have := sealedPlaintextSize(sealed.Bytes()[:sealHeaderSize], int64(sealed.Len())); have != int64(size) {
+			t.Errorf("size %d: sealedPlaintextSize = %d", size, have)
+		}
+
+		out := new(bytes.Buffer)
+		if _, err := copyDecrypt(key, bytes.NewReader(sealed.Bytes()), out); err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if !bytes.Equal(out.Bytes(), payload) {
+			t.Errorf("size %d: round trip mismatch", size)
+		}
+	}
+}
+
+func TestCopyDecryptRejectsTampering(t *testing.T) {
+	key := newEncryptionKey()
+	payload := make([]byte, 2*sealSegmentSize+100)
+	sealed := new(bytes.Buffer)
+	if _, err := copyEncrypt(key, bytes.NewReader(payload), sealed); err != nil {
+		t.Fatal(err)
+	}
+	data := sealed.Bytes()
+
+	flipped := bytes.Clone(data)
+	flipped[len(flipped)/2] ^= 1
+	if _, err := copyDecrypt(key, bytes.NewReader(flipped), io.Discard); !errors.Is(err, errSealCorrupt) {
+		t.Errorf("flipped bit: have %v", err)
+	}
+
+	header := bytes.Clone(data)
+	header[12] ^= 1
+	if _, err := copyDecrypt(key, bytes.NewReader(header), io.Discard); !errors.Is(err, errSealCorrupt) {
+		t.Errorf("modified header: have %v", err)
+	}
+
+	// A header asking for huge segments is refused before allocating them.
+	huge := bytes.Clone(data)
+	binary.BigEndian.PutUint32(huge[9:], 1<<31-1)
+	if _, err := copyDecrypt(key, bytes.NewReader(huge), io.Discard); !errors.Is(err, errSealCorrupt) {
+		t.Errorf("huge segment size: have %v", err)
+	}
+
+	// Dropping whole trailing segments must not pass as a shorter file.
+	segment := sealFrameSize + sealSegmentSize + 16
+	truncated := data[:sealHeaderSize+segment]
+	if _, err := copyDecrypt(key, bytes.NewReader(truncated), io.Discard); !errors.Is(err, errSealTruncated) {
+		t.Errorf("truncated stream: have %v", err)
+	}
+
+	if _, err := copyDecrypt(newEncryptionKey(), bytes.NewReader(data), io.Discard); !errors.Is(err, errSealCorrupt) {
+		t.Errorf("wrong key: have %v", err)
+	}
+}
+
+func TestCopyDecryptLegacyCTR(t *testing.T) {
+	key := newEncryptionKey()
+	payload := []byte("written before chunks were sealed")
+
+	block, _ := aes.NewCipher(key)
+	iv := make([]byte, aes.BlockSize)
+	io.ReadFull(rand.Reader, iv)
+	legacy := make([]byte, len(payload))
+	cipher.NewCTR(block, iv).XORKeyStream(legacy, payload)
+	legacy = append(iv, legacy...)
+
+	// Only read where data from before sealing can be.
+	if _, err := copyDecrypt(key, bytes.NewReader(legacy), io.Discard); !errors.Is(err, errSealCorrupt) {
+		t.Fatalf("CTR stream opened as sealed: %v", err)
+	}
+	out := new(bytes.Buffer)
+	nw, err := openLegacyStream(func(uint32) ([]byte, error) { return key, nil }, bytes.NewReader(legacy), out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nw != len(payload) || !bytes.Equal(out.Bytes(), payload) {
+		t.Errorf("have %q (%d bytes)", out.String(), nw)
+	}
+	if have := sealedPlaintextSize(legacy[:sealHeaderSize], int64(len(legacy))); have != int64(len(payload)) {
+		t.Errorf("sealedPlaintextSize = %d want %d", have, len(payload))
+	}
+}
@@ -0,0 +1,581 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// A node keeps each file as a manifest plus the chunks it names. Chunks are
+// sealed under the file's own data key and stored by the hash of their
+// sealed bytes; the manifest holds the data key, wrapped by one of the
+// node's master keys (see keys.go), so the storage volume alone is not
+// enough to read a file. On disk, under the node's StorageRoot:
+//
+//	blobs/<user>/<ab>/<cd>/<abcd... chunk hash>
+//	files/<user>/<file name>/manifest.json
+const (
+	blobsDir     = "blobs"
+	manifestsDir = "files"
+	manifestName = "manifest.json"
+)
+
+type Manifest struct {
+	Name     string     `json:"name"`
+	Size     int64      `json:"size"`
+	Modified time.Time  `json:"modified"`
+	FileKey  []byte     `json:"file_key"`
+	Chunks   []ChunkRef `json:"chunks"`
+	// Tier is where the chunks are, hot if empty; see tiers.go.
+	Tier     string    `json:"tier,omitempty"`
+	Accessed time.Time `json:"accessed,omitempty"`
+	// Format is chunkFormatCodec if the chunks start with a codec header.
+	// Either way they are sealed; CTR chunks predate manifests.
+	// ContentType is sniffed from the start of the file.
+	Format      int    `json:"format,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	// Checksum is the SHA-256 of the plaintext, which tells versions apart
+	// across nodes; see metadata.go.
+	Checksum string `json:"sha256,omitempty"`
+}
+
+type ChunkRef struct {
+	Key  string `json:"key"`
+	Size int64  `json:"size"`
+}
+
+func manifestPathTransformFunc(key string) PathKey {
+	return PathKey{
+		PathName: key,
+		Filename: manifestName,
+	}
+}
+
+func manifestKeyFunc(p PathKey) string {
+	return p.PathName
+}
+
+// WriteFile stores r as userID's file name, replacing any earlier version.
+// The manifest is swapped in only once every chunk is durably written, so
+// readers, and a node restarting after a crash, see either the old version
+// or the new one.
+func (s *FileServer) WriteFile(userID, name string, r io.Reader) (*Manifest, error) {
+	return s.writeFile(userID, name, r, time.Now())
+}
+
+func (s *FileServer) writeFile(userID, name string, r io.Reader, modified time.Time) (*Manifest, error) {
+	fk, err := s.Keys.NewFileKey()
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := s.Keys.WrapFileKey(fk, userID, name)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Manifest{Name: name, Modified: modified, Accessed: modified, FileKey: wrapped, Format: chunkFormatCodec}
+	if err := s.writeChunks(userID, fk, m, r); err != nil {
+		s.removeChunks(s.store, userID, m)
+		return nil, err
+	}
+
+	s.fileLock.Lock()
+	old, _ := s.readManifest(userID, name)
+	err = s.writeManifest(userID, m)
+	s.fileLock.Unlock()
+	if err != nil {
+		s.removeChunks(s.store, userID, m)
+		return nil, err
+	}
+
+	// A rewrite seals under a new data key, so no chunk is shared between
+	// versions and the old ones can go.
+	if old != nil {
+		s.removeChunks(s.tierStore(old.tier()), userID, old)
+	}
+	s.recordInBackground(storedOp(s.ID, userID, m))
+	return m, nil
+}
+
+// writeChunks cuts r into ChunkSize pieces, compresses each if the file is
+// worth it, seals it under fk and stores it by the hash of its sealed bytes,
+// adding it to m. Vault blobs are never sniffed, so they stay uncompressed.
+func (s *FileServer) writeChunks(userID string, fk *FileKey, m *Manifest, r io.Reader) error {
+	buf := make([]byte, ChunkSize)
+	digest := sha256.New()
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			digest.Write(buf[:n])
+			if len(m.Chunks) == 0 && !isVaultStorageUser(userID) {
+				m.ContentType = sniffContentType(buf[:n])
+			}
+			chunk := encodeChunk(buf[:n], s.Compress && compressibleType(m.ContentType))
+
+			var sealed bytes.Buffer
+			if _, err := sealStream(fk.ID, fk.Key, bytes.NewReader(chunk), &sealed); err != nil {
+				return err
+			}
+			sum := sha256.Sum256(sealed.Bytes())
+			key := hex.EncodeToString(sum[:])
+			if _, err := s.store.Write(userID, key, &sealed); err != nil {
+				return err
+			}
+			m.Chunks = append(m.Chunks, ChunkRef{Key: key, Size: int64(n)})
+			m.Size += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			m.Checksum = hex.EncodeToString(digest.Sum(nil))
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// ReadFile writes the plaintext of userID's file name to w, and counts it as
+// read for tiering.
+func (s *FileServer) ReadFile(userID, name string, w io.Writer) (int64, error) {
+	return s.readFile(userID, name, w, true)
+}
+
+// readFile is ReadFile, only recording the read if record is set. Background
+// copies to peers don't count, or replication would keep every file hot.
+func (s *FileServer) readFile(userID, name string, w io.Writer, record bool) (int64, error) {
+	m, err := s.StatFile(userID, name)
+	if err != nil {
+		return 0, err
+	}
+	fk, err := s.Keys.UnwrapFileKey(m.FileKey, userID, name)
+	if err != nil {
+		return 0, fmt.Errorf("unwrapping file key: %w", err)
+	}
+
+	var total int64
+	for i, chunk := range m.Chunks {
+		r, err := s.readChunk(userID, m.tier(), chunk.Key)
+		if err != nil {
+			return total, fmt.Errorf("chunk %d: %w", i, err)
+		}
+		n, err := openChunk(fk, m.Format, r, w)
+		r.Close()
+		total += n
+		if err != nil {
+			return total, fmt.Errorf("chunk %d: %w", i, err)
+		}
+	}
+	if record {
+		s.recordRead(userID, m)
+	}
+	return total, nil
+}
+
+// openChunk decrypts a stored chunk to w, decoding it if it has a codec
+// header.
+func openChunk(fk *FileKey, format int, r io.Reader, w io.Writer) (int64, error) {
+	if format != chunkFormatCodec {
+		n, err := openStream(fk.Lookup, r, w)
+		return int64(n), err
+	}
+
+	var buf bytes.Buffer
+	if _, err := openStream(fk.Lookup, r, &buf); err != nil {
+		return 0, err
+	}
+	raw, err := decodeChunk(buf.Bytes())
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(raw)
+	return int64(n), err
+}
+
+func (s *FileServer) readChunk(userID, tier, key string) (io.ReadCloser, error) {
+	_, r, err := s.tierStore(tier).readStream(userID, key)
+	if os.IsNotExist(err) && s.cold != nil {
+		// Moved to the other tier since the manifest was read.
+		other := tierCold
+		if tier == tierCold {
+			other = tierHot
+		}
+		_, r, err = s.tierStore(other).readStream(userID, key)
+	}
+	return r, err
+}
+
+// StatFile returns the manifest of userID's file name.
+func (s *FileServer) StatFile(userID, name string) (*Manifest, error) {
+	s.fileLock.Lock()
+	defer s.fileLock.Unlock()
+	return s.readManifest(userID, name)
+}
+
+func (s *FileServer) HasFile(userID, name string) bool {
+	return s.manifests.Has(userID, name)
+}
+
+// DeleteFile removes userID's file name and its chunks.
+func (s *FileServer) DeleteFile(userID, name string) error {
+	return s.deleteFile(userID, name, "")
+}
+
+// dropReplica deletes this node's copy of userID's file name if it is the
+// version checksum, and not one written since.
+func (s *FileServer) dropReplica(userID, name, checksum string) error {
+	return s.deleteFile(userID, name, checksum)
+}
+
+// deleteFile deletes userID's file name if it is the version checksum, or
+// whatever version it is when checksum is empty.
+func (s *FileServer) deleteFile(userID, name, checksum string) error {
+	s.fileLock.Lock()
+	m, err := s.readManifest(userID, name)
+	if err == nil && checksum != "" && m.Checksum != checksum {
+		err = fmt.Errorf("%s/%s: holding another version", userID, name)
+	}
+	if err == nil {
+		err = s.manifests.Delete(userID, name)
+	}
+	s.fileLock.Unlock()
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	s.removeChunks(s.tierStore(m.tier()), userID, m)
+	s.recordInBackground(metaOp{Op: opDropped, UserID: userID, Name: name, Node: s.ID, Checksum: m.Checksum})
+	return nil
+}
+
+// removeChunks deletes m's chunks from st.
+func (s *FileServer) removeChunks(st *Store, userID string, m *Manifest) {
+	for _, chunk := range m.Chunks {
+		if err := st.Delete(userID, chunk.Key); err != nil && !os.IsNotExist(err) {
+			log.Printf("[files] failed to remove chunk %s of %s: %v", chunk.Key, m.Name, err)
+		}
+	}
+}
+
+// Users lists the users this node holds files for.
+func (s *FileServer) Users() ([]string, error) {
+	return s.manifests.IDs()
+}
+
+// ListFiles lists the names of userID's files on this node.
+func (s *FileServer) ListFiles(userID string) ([]string, error) {
+	return s.manifests.List(userID)
+}
+
+// WalkFiles calls fn with the manifest of every file on this node, reading
+// them one at a time.
+func (s *FileServer) WalkFiles(fn func(userID string, m *Manifest) error) error {
+	return s.manifests.Walk(func(userID string, info KeyStat) error {
+		m, err := s.StatFile(userID, info.Key)
+		// Deleted since the walk found it.
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return fn(userID, m)
+	})
+}
+
+// Usage reports how many files userID has on this node and how many bytes
+// their chunks take up, in either tier.
+func (s *FileServer) Usage(userID string) (files int, bytes int64, err error) {
+	manifests, err := s.manifests.Usage(userID)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, st := range s.tierStores() {
+		chunks, err := st.Usage(userID)
+		if err != nil {
+			return 0, 0, err
+		}
+		bytes += chunks.Bytes
+	}
+	return manifests.Keys, bytes, nil
+}
+
+func listDirs(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if e.IsDir() {
+			names = append(names, e.Name())
+		}
+	}
+	return names, nil
+}
+
+// readManifest must be called with fileLock held.
+func (s *FileServer) readManifest(userID, name string) (*Manifest, error) {
+	_, r, err := s.manifests.Read(userID, name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.(io.Closer).Close()
+
+	var m Manifest
+	if err := json.NewDecoder(r).Decode(&m); err != nil {
+		return nil, fmt.Errorf("manifest of %s: %w", name, err)
+	}
+	return &m, nil
+}
+
+// writeManifest must be called with fileLock held.
+func (s *FileServer) writeManifest(userID string, m *Manifest) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	_, err = s.manifests.Write(userID, m.Name, bytes.NewReader(b))
+	return err
+}
+
+// rewrapFileKeys moves every file key wrapped by an older master key, or in
+// an older format, to the current one. Only the manifest is rewritten;
+// chunks are sealed under the file's own data key and don't change.
+func (s *FileServer) rewrapFileKeys() (int, error) {
+	current, _ := s.Keys.Current()
+
+	rewrapped := 0
+	err := s.manifests.Walk(func(userID string, info KeyStat) error {
+		ok, err := s.rewrapFileKey(userID, info.Key, current)
+		if ok {
+			rewrapped++
+		}
+		return err
+	})
+	return rewrapped, err
+}
+
+func (s *FileServer) rewrapFileKey(userID, name string, current uint32) (bool, error) {
+	s.fileLock.Lock()
+	defer s.fileLock.Unlock()
+
+	m, err := s.readManifest(userID, name)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	fk, err := s.Keys.UnwrapFileKey(m.FileKey, userID, name)
+	if err != nil {
+		log.Printf("[keys] skipping %s/%s: %v", userID, name, err)
+		return false, nil
+	}
+	if fk.MasterID == current && fk.version == fileKeyVersion {
+		return false, nil
+	}
+
+	fk.MasterID = current
+	if m.FileKey, err = s.Keys.WrapFileKey(fk, userID, name); err != nil {
+		return false, err
+	}
+	return true, s.writeManifest(userID, m)
+}
+
+// -------------------- Garbage Collection --------------------
+
+// CollectGarbage deletes chunks no manifest refers to, in the tier it names.
+// Chunks are written, or copied to another tier, before the manifest naming
+// them, so a chunk is only taken once it is older than grace, which must be
+// longer than any write or move takes.
+func (s *FileServer) CollectGarbage(grace time.Duration) (int, error) {
+	cutoff := time.Now().Add(-grace)
+
+	// Mark. A file written after this began has chunks newer than cutoff.
+	live := map[string]bool{}
+	err := s.WalkFiles(func(userID string, m *Manifest) error {
+		for _, chunk := range m.Chunks {
+			live[m.tier()+"/"+userID+"/"+chunk.Key] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// Sweep.
+	removed := 0
+	for tier, st := range s.tierStores() {
+		err = st.Walk(func(userID string, info KeyStat) error {
+			if live[tier+"/"+userID+"/"+info.Key] || info.ModTime.After(cutoff) {
+				return nil
+			}
+			err := st.Delete(userID, info.Key)
+			if os.IsNotExist(err) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			removed++
+			return nil
+		})
+		if err != nil {
+			return removed, err
+		}
+	}
+	return removed, nil
+}
+
+func (s *FileServer) tierStores() map[string]*Store {
+	stores := map[string]*Store{tierHot: s.store}
+	if s.cold != nil {
+		stores[tierCold] = s.cold
+	}
+	return stores
+}
+
+// runGC collects garbage every interval.
+func (s *FileServer) runGC(interval, grace time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			n, err := s.CollectGarbage(grace)
+			if err != nil {
+				log.Printf("[files] garbage collection failed: %v", err)
+			}
+			if n > 0 {
+				log.Printf("[files] collected %d unreferenced chunks", n)
+			}
+		case <-s.quitch:
+			return
+		}
+	}
+}
+
+// Recover cleans up after writes a crash interrupted. Chunks stored for a
+// file whose manifest never got written are left for garbage collection.
+func (s *FileServer) Recover() (int, error) {
+	removed, err := s.manifests.Recover()
+	if err != nil {
+		return removed, err
+	}
+	for _, st := range s.tierStores() {
+		n, err := st.Recover()
+		removed += n
+		if err != nil {
+			return removed, err
+		}
+	}
+	return removed, nil
+}
+
+// -------------------- Legacy Layout --------------------
+
+// Before the store, a file lived in <StorageRoot>/<user>/<file>/ as numbered
+// N.chunk files, with its wrapped data key in file.key next to them. Files
+// from before encryption at rest have no file.key and plaintext chunks.
+const legacyFileKeyName = "file.key"
+
+// migrateLegacyFiles moves every file still in the old layout into the
+// store, dropping the old directory once its copy is written.
+func (s *FileServer) migrateLegacyFiles() (int, error) {
+	users, err := listDirs(s.StorageRoot)
+	if err != nil {
+		return 0, err
+	}
+
+	migrated := 0
+	for _, userID := range users {
+		if userID == blobsDir || userID == manifestsDir || userID == metadataDir {
+			continue
+		}
+		userDir := filepath.Join(s.StorageRoot, userID)
+		names, err := listDirs(userDir)
+		if err != nil {
+			return migrated, err
+		}
+		for _, name := range names {
+			dir := filepath.Join(userDir, name)
+			var buf bytes.Buffer
+			modified, err := s.readLegacyFile(userID, name, dir, &buf)
+			if err != nil {
+				log.Printf("[files] cannot migrate %s: %v", dir, err)
+				continue
+			}
+			if _, err := s.writeFile(userID, name, &buf, modified); err != nil {
+				return migrated, err
+			}
+			if err := os.RemoveAll(dir); err != nil {
+				return migrated, err
+			}
+			migrated++
+		}
+		// Only goes if nothing was left behind.
+		os.Remove(userDir)
+	}
+	return migrated, nil
+}
+
+// readLegacyFile writes the plaintext of userID's file name from its
+// old-layout directory to w and returns when it was last written.
+func (s *FileServer) readLegacyFile(userID, name, dir string, w io.Writer) (time.Time, error) {
+	var (
+		fk       *FileKey
+		modified time.Time
+	)
+	wrapped, err := os.ReadFile(filepath.Join(dir, legacyFileKeyName))
+	if err != nil && !os.IsNotExist(err) {
+		return modified, err
+	}
+	if err == nil {
+		if fk, err = s.Keys.UnwrapFileKey(wrapped, userID, name); err != nil {
+			return modified, fmt.Errorf("unwrapping file key: %w", err)
+		}
+	}
+
+	for i := 0; ; i++ {
+		path := filepath.Join(dir, fmt.Sprintf("%d.chunk", i))
+		fi, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			if i == 0 {
+				return modified, fmt.Errorf("no chunks in %s", dir)
+			}
+			return modified, nil
+		}
+		if err != nil {
+			return modified, err
+		}
+		if fi.ModTime().After(modified) {
+			modified = fi.ModTime()
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return modified, err
+		}
+
+		if fk == nil {
+			_, err = w.Write(b)
+		} else {
+			_, err = openLegacyStream(fk.Lookup, bytes.NewReader(b), w)
+		}
+		if err != nil {
+			return modified, fmt.Errorf("chunk %d: %w", i, err)
+		}
+	}
+}
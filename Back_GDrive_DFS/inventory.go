@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sort"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+)
+
+// The web UI writes a file's nodeId list once, at upload, and nothing kept
+// it up to date as replicas moved. The inventory check compares the files
+// documents, and the vault blob documents, with the cluster's file map,
+// which each node keeps in step with what it actually stores: it rewrites
+// stale nodeId lists, and flags files stored with no document naming them
+// and documents for files no node holds.
+
+// maxListed bounds each list in an InventoryReport; the counts are exact.
+const maxListed = 500
+
+// fileDoc is a Firestore document naming a stored file.
+type fileDoc struct {
+	ref    *firestore.DocumentRef
+	userID string // the storage user
+	name   string
+	nodes  []string
+}
+
+type Discrepancy struct {
+	UserID string `json:"user_id"`
+	Name   string `json:"name"`
+	DocID  string `json:"doc_id,omitempty"`
+	// NodeID is the document's list, Replicas the nodes with a copy.
+	NodeID   []string `json:"nodeId,omitempty"`
+	Replicas []string `json:"replicas,omitempty"`
+
+	doc *fileDoc
+}
+
+type InventoryReport struct {
+	CheckedAt time.Time `json:"checked_at"`
+	Documents int       `json:"documents"`
+	Files     int       `json:"files"`
+
+	// Stale documents list other nodes than the ones holding the file.
+	Stale      []Discrepancy `json:"stale"`
+	StaleCount int           `json:"stale_count"`
+	Fixed      int           `json:"fixed"`
+	// Orphans are files stored with no document naming them.
+	Orphans      []Discrepancy `json:"orphans"`
+	OrphanCount  int           `json:"orphan_count"`
+	Missing      []Discrepancy `json:"missing"`
+	MissingCount int           `json:"missing_count"`
+
+	// toFix are all the stale documents, not only those listed.
+	toFix []Discrepancy
+}
+
+func listDiscrepancy(list *[]Discrepancy, count *int, d Discrepancy) {
+	*count++
+	if len(*list) < maxListed {
+		*list = append(*list, d)
+	}
+}
+
+// compareInventory matches docs with the map's records.
+func compareInventory(docs []fileDoc, records []FileRecord) *InventoryReport {
+	report := &InventoryReport{
+		CheckedAt: time.Now(),
+		Documents: len(docs),
+		Stale:     []Discrepancy{},
+		Orphans:   []Discrepancy{},
+		Missing:   []Discrepancy{},
+	}
+	held := make(map[string]FileRecord)
+	for _, r := range records {
+		if !r.Deleted && len(r.Replicas) > 0 {
+			held[recordKey(r.UserID, r.Name)] = r
+		}
+	}
+	report.Files = len(held)
+
+	named := make(map[string]bool)
+	for i := range docs {
+		doc := &docs[i]
+		key := recordKey(doc.userID, doc.name)
+		named[key] = true
+		d := Discrepancy{UserID: doc.userID, Name: doc.name, DocID: doc.ref.ID, NodeID: doc.nodes, doc: doc}
+		r, ok := held[key]
+		if !ok {
+			listDiscrepancy(&report.Missing, &report.MissingCount, d)
+			continue
+		}
+		if !sameNodes(doc.nodes, r.Replicas) {
+			d.Replicas = r.Replicas
+			listDiscrepancy(&report.Stale, &report.StaleCount, d)
+			report.toFix = append(report.toFix, d)
+		}
+	}
+
+	keys := make([]string, 0, len(held))
+	for key := range held {
+		if !named[key] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		r := held[key]
+		listDiscrepancy(&report.Orphans, &report.OrphanCount, Discrepancy{UserID: r.UserID, Name: r.Name, Replicas: r.Replicas})
+	}
+	return report
+}
+
+// sameNodes reports whether the nodeId list names exactly the replicas.
+func sameNodes(nodeIDs, replicas []string) bool {
+	ids := make([]string, 0, len(nodeIDs))
+	for _, node := range nodeIDs {
+		if id := parseNodeID(node); !slices.Contains(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return slices.Equal(ids, replicas)
+}
+
+// fixedNodeIDs is the nodeId list naming replicas, keeping the order of
+// the nodes already in it so the first stays first if it still holds the
+// file.
+func fixedNodeIDs(nodeIDs, replicas []string) []string {
+	fixed := []string{}
+	for _, node := range nodeIDs {
+		id := parseNodeID(node)
+		if slices.Contains(replicas, id) && !slices.Contains(fixed, nodeURL(id)) {
+			fixed = append(fixed, nodeURL(id))
+		}
+	}
+	for _, id := range replicas {
+		if !slices.Contains(fixed, nodeURL(id)) {
+			fixed = append(fixed, nodeURL(id))
+		}
+	}
+	return fixed
+}
+
+// listFileDocs reads every files document and vault blob document.
+func listFileDocs(ctx context.Context) ([]fileDoc, error) {
+	var docs []fileDoc
+	iter := firestoreClient.Collection("files").Documents(ctx)
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		var f FileMeta
+		if err := doc.DataTo(&f); err != nil || f.FileName == "" {
+			continue
+		}
+		docs = append(docs, fileDoc{ref: doc.Ref, userID: f.storageUser(), name: f.FileName, nodes: f.NodeID})
+	}
+
+	iter = firestoreClient.CollectionGroup("blobs").Documents(ctx)
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		vault := doc.Ref.Parent.Parent
+		if vault == nil || vault.Parent.ID != "vaults" {
+			continue
+		}
+		var b VaultBlob
+		if err := doc.DataTo(&b); err != nil {
+			continue
+		}
+		docs = append(docs, fileDoc{ref: doc.Ref, userID: vaultStorageUser(vault.ID), name: doc.Ref.ID, nodes: b.NodeID})
+	}
+	return docs, nil
+}
+
+// CheckInventory compares Firestore with the cluster's file map. With fix,
+// it also rewrites the stale nodeId lists; orphans and missing files are
+// only reported, since either side may be the one that is wrong.
+func CheckInventory(ctx context.Context, fix bool) (*InventoryReport, error) {
+	md := fileServer.Metadata()
+	if md == nil {
+		return nil, errors.New("this node keeps no metadata log")
+	}
+	if firestoreClient == nil {
+		return nil, errors.New("Firestore client not initialized")
+	}
+	docs, err := listFileDocs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	report := compareInventory(docs, md.Files())
+	if !fix {
+		return report, nil
+	}
+
+	for _, d := range report.toFix {
+		nodes := fixedNodeIDs(d.doc.nodes, d.Replicas)
+		if _, err := d.doc.ref.Update(ctx, []firestore.Update{{Path: "nodeId", Value: nodes}}); err != nil {
+			return report, err
+		}
+		report.Fixed++
+	}
+	return report, nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"slices"
+	"testing"
+
+	"cloud.google.com/go/firestore"
+)
+
+func TestCompareInventory(t *testing.T) {
+	doc := func(id, user, name string, nodes ...string) fileDoc {
+		return fileDoc{ref: &firestore.DocumentRef{ID: id}, userID: user, name: name, nodes: nodes}
+	}
+	docs := []fileDoc{
+		doc("d1", "alice", "kept.txt", "http://s1:8080", "http://s2:8080"),
+		doc("d2", "alice", "moved.txt", "http://s3:8080", "http://s1:8080"),
+		doc("d3", "alice", "lost.txt", "http://s1:8080"),
+		doc("d4", "alice", "gone.txt", "http://s2:8080"),
+	}
+	records := []FileRecord{
+		{UserID: "alice", Name: "kept.txt", Replicas: []string{"s1", "s2"}},
+		{UserID: "alice", Name: "moved.txt", Replicas: []string{"s1", "s2"}},
+		{UserID: "alice", Name: "lost.txt"},
+		{UserID: "alice", Name: "gone.txt", Deleted: true},
+		{UserID: "bob", Name: "stray.txt", Replicas: []string{"s3"}},
+	}
+
+	report := compareInventory(docs, records)
+	if report.StaleCount != 1 || report.Stale[0].DocID != "d2" {
+		t.Errorf("stale %+v", report.Stale)
+	}
+	if report.MissingCount != 2 || report.Missing[0].DocID != "d3" || report.Missing[1].DocID != "d4" {
+		t.Errorf("missing %+v", report.Missing)
+	}
+	if report.OrphanCount != 1 || report.Orphans[0].UserID != "bob" {
+		t.Errorf("orphans %+v", report.Orphans)
+	}
+	if report.Documents != 4 || report.Files != 3 {
+		t.Errorf("counted %d documents, %d files", report.Documents, report.Files)
+	}
+}
+
+func TestFixedNodeIDs(t *testing.T) {
+	// Nodes still holding the file keep their place.
+	got := fixedNodeIDs([]string{"http://s3:8080", "http://s2:8080", "s2"}, []string{"s1", "s2"})
+	if want := []string{"http://s2:8080", "http://s1:8080"}; !slices.Equal(got, want) {
+		t.Errorf("have %v want %v", got, want)
+	}
+	if !sameNodes(got, []string{"s1", "s2"}) || sameNodes(got, []string{"s2"}) {
+		t.Error("sameNodes disagrees with fixedNodeIDs")
+	}
+}
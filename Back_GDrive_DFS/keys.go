@@ -0,0 +1,486 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+	"golang.org/x/crypto/scrypt"
+)
+
+// The key manager keeps the node's master keys in a keyring file. Every
+// master key is stored wrapped by a key-encryption key that never touches
+// the disk next to the data: it is derived from a passphrase, or read from a
+// key file standing in for a KMS. Master keys get increasing ids; the newest
+// one is current and seals new data, older ones stay around to open what
+// was sealed before a rotation until the rewrapper has moved it over.
+const keyringVersion = 1
+
+var (
+	errUnknownKey   = errors.New("unknown key id")
+	errKeyringWrong = errors.New("cannot open keyring: wrong passphrase or key file")
+)
+
+// keys is the node's key manager, opened at startup.
+var keys *KeyManager
+
+// KeySource provides the key-encryption key protecting a keyring.
+type KeySource interface {
+	Name() string
+	KEK(salt []byte) ([]byte, error)
+}
+
+type passphraseSource struct {
+	passphrase string
+}
+
+func (passphraseSource) Name() string { return "passphrase" }
+
+func (s passphraseSource) KEK(salt []byte) ([]byte, error) {
+	return scrypt.Key([]byte(s.passphrase), salt, 1<<15, 8, 1, 32)
+}
+
+// staticSource is a key-encryption key held outside the keyring, e.g. in a
+// file mounted from a secrets manager.
+type staticSource struct {
+	name string
+	key  []byte
+}
+
+func (s staticSource) Name() string                    { return s.name }
+func (s staticSource) KEK(salt []byte) ([]byte, error) { return s.key, nil }
+
+// readKeyFile reads a 32 byte key stored raw, hex or base64 encoded.
+func readKeyFile(path string) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 32 {
+		return b, nil
+	}
+	return parseMasterKey(string(bytes.TrimSpace(b)))
+}
+
+type keyringEntry struct {
+	ID        uint32    `json:"id"`
+	Wrapped   []byte    `json:"wrapped"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type keyringFile struct {
+	Version int    `json:"version"`
+	Source  string `json:"source"`
+	Salt    []byte `json:"salt"`
+	Current uint32 `json:"current"`
+	// Legacy is the id the pre-keyring STORAGE_MASTER_KEY was imported
+	// under, for file keys wrapped before key ids existed.
+	Legacy uint32         `json:"legacy,omitempty"`
+	Keys   []keyringEntry `json:"keys"`
+}
+
+// KeyInfo describes a master key without revealing it.
+type KeyInfo struct {
+	ID        uint32    `json:"id"`
+	CreatedAt time.Time `json:"createdAt"`
+	Current   bool      `json:"current"`
+}
+
+type KeyManager struct {
+	path string
+	kek  []byte
+
+	mu      sync.RWMutex
+	file    keyringFile
+	plain   map[uint32][]byte
+	rotated chan struct{}
+}
+
+// OpenKeyManager loads the keyring at path, creating it with a fresh master
+// key if it doesn't exist. legacy, if set, is imported as the first key of a
+// new keyring so data wrapped by it stays readable.
+func OpenKeyManager(path string, src KeySource, legacy []byte) (*KeyManager, error) {
+	km := &KeyManager{
+		path:    path,
+		plain:   map[uint32][]byte{},
+		rotated: make(chan struct{}, 1),
+	}
+
+	b, err := os.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+		salt := make([]byte, 16)
+		if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+			return nil, err
+		}
+		km.file = keyringFile{Version: keyringVersion, Source: src.Name(), Salt: salt}
+		if km.kek, err = src.KEK(salt); err != nil {
+			return nil, err
+		}
+		first := newEncryptionKey()
+		if legacy != nil {
+			first = legacy
+		}
+		if _, err := km.addKey(first, time.Now()); err != nil {
+			return nil, err
+		}
+		if legacy != nil {
+			km.file.Legacy = km.file.Current
+		}
+		if err := km.save(); err != nil {
+			return nil, err
+		}
+		log.Printf("[keys] created keyring %s with key %d", path, km.file.Current)
+		return km, nil
+	case err != nil:
+		return nil, err
+	}
+
+	if err := json.Unmarshal(b, &km.file); err != nil {
+		return nil, fmt.Errorf("reading keyring %s: %w", path, err)
+	}
+	if km.file.Version != keyringVersion {
+		return nil, fmt.Errorf("keyring %s has unsupported version %d", path, km.file.Version)
+	}
+	if km.file.Source != src.Name() {
+		return nil, fmt.Errorf("keyring %s is protected by a %s, not a %s", path, km.file.Source, src.Name())
+	}
+	if km.kek, err = src.KEK(km.file.Salt); err != nil {
+		return nil, err
+	}
+	for _, e := range km.file.Keys {
+		key, err := unwrapKey(km.kek, e.Wrapped, nil)
+		if err != nil {
+			return nil, errKeyringWrong
+		}
+		km.plain[e.ID] = key
+	}
+	if _, ok := km.plain[km.file.Current]; !ok {
+		return nil, fmt.Errorf("keyring %s: current key %d is missing", path, km.file.Current)
+	}
+	return km, nil
+}
+
+// newKeyManagerFromEnv opens the keyring at KEYRING_PATH. It is protected by
+// KEYRING_PASSPHRASE or the key in KEYRING_KMS_KEY_FILE; nodes that only set
+// STORAGE_MASTER_KEY keep working with it as the keyring's wrapping key.
+func newKeyManagerFromEnv() (*KeyManager, error) {
+	var legacy []byte
+	if raw := getEnv("STORAGE_MASTER_KEY", ""); raw != "" {
+		key, err := parseMasterKey(raw)
+		if err != nil {
+			return nil, fmt.Errorf("STORAGE_MASTER_KEY: %w", err)
+		}
+		legacy = key
+	}
+
+	var src KeySource
+	switch {
+	case getEnv("KEYRING_PASSPHRASE", "") != "":
+		src = passphraseSource{passphrase: getEnv("KEYRING_PASSPHRASE", "")}
+	case getEnv("KEYRING_KMS_KEY_FILE", "") != "":
+		key, err := readKeyFile(getEnv("KEYRING_KMS_KEY_FILE", ""))
+		if err != nil {
+			return nil, fmt.Errorf("KEYRING_KMS_KEY_FILE: %w", err)
+		}
+		src = staticSource{name: "kms key file", key: key}
+	case legacy != nil:
+		src = staticSource{name: "master key", key: legacy}
+	default:
+		return nil, fmt.Errorf("set KEYRING_PASSPHRASE or KEYRING_KMS_KEY_FILE to protect the keyring")
+	}
+
+	path := getEnv("KEYRING_PATH", filepath.Join(storageRoot(), getEnv("NODE_ID", "s1"), "keyring.json"))
+	if err := ensureDir(filepath.Dir(path)); err != nil {
+		return nil, err
+	}
+	return OpenKeyManager(path, src, legacy)
+}
+
+// addKey records key as the newest master key. Callers hold mu or own km.
+func (km *KeyManager) addKey(key []byte, now time.Time) (uint32, error) {
+	wrapped, err := wrapKey(km.kek, key, nil)
+	if err != nil {
+		return 0, err
+	}
+	id := km.file.Current + 1
+	for _, e := range km.file.Keys {
+		if e.ID >= id {
+			id = e.ID + 1
+		}
+	}
+	km.file.Keys = append(km.file.Keys, keyringEntry{ID: id, Wrapped: wrapped, CreatedAt: now})
+	km.file.Current = id
+	km.plain[id] = key
+	return id, nil
+}
+
+// save writes the keyring atomically and durably. Data is sealed under a new
+// key as soon as this returns, so a crash must never bring back the keyring
+// from before it.
+func (km *KeyManager) save() error {
+	b, err := json.MarshalIndent(km.file, "", "  ")
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(km.path)
+	f, err := os.CreateTemp(dir, filepath.Base(km.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), km.path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return syncDir(dir)
+}
+
+// Current returns the id and value of the key new data is sealed with.
+func (km *KeyManager) Current() (uint32, []byte) {
+	km.mu.RLock()
+	defer km.mu.RUnlock()
+	return km.file.Current, km.plain[km.file.Current]
+}
+
+// Key returns the master key with the given id.
+func (km *KeyManager) Key(id uint32) ([]byte, error) {
+	km.mu.RLock()
+	defer km.mu.RUnlock()
+	key, ok := km.plain[id]
+	if !ok {
+		return nil, fmt.Errorf("%w %d", errUnknownKey, id)
+	}
+	return key, nil
+}
+
+// Keys lists the master keys, oldest first.
+func (km *KeyManager) Keys() []KeyInfo {
+	km.mu.RLock()
+	defer km.mu.RUnlock()
+	out := make([]KeyInfo, 0, len(km.file.Keys))
+	for _, e := range km.file.Keys {
+		out = append(out, KeyInfo{ID: e.ID, CreatedAt: e.CreatedAt, Current: e.ID == km.file.Current})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// Rotate makes a fresh master key current. Older keys are kept so existing
+// data stays readable; the rewrapper moves it to the new key.
+func (km *KeyManager) Rotate() (uint32, error) {
+	km.mu.Lock()
+	defer km.mu.Unlock()
+
+	prev := km.file
+	id, err := km.addKey(newEncryptionKey(), time.Now())
+	if err != nil {
+		return 0, err
+	}
+	if err := km.save(); err != nil {
+		delete(km.plain, id)
+		km.file = prev
+		return 0, err
+	}
+
+	select {
+	case km.rotated <- struct{}{}:
+	default:
+	}
+	log.Printf("[keys] rotated to key %d", id)
+	return id, nil
+}
+
+// currentCreatedAt reports when the current key was made.
+func (km *KeyManager) currentCreatedAt() time.Time {
+	km.mu.RLock()
+	defer km.mu.RUnlock()
+	for _, e := range km.file.Keys {
+		if e.ID == km.file.Current {
+			return e.CreatedAt
+		}
+	}
+	return time.Time{}
+}
+
+// -------------------- File Keys --------------------
+
+// A file key is a file's data key wrapped under a master key:
+//
+//	"GKEY" | version (1) | data key id (4) | master key id (4) | wrapped key
+//
+// The data key id is what the file's chunk headers name. From version 2 the
+// header and the owner and name of the file are the wrapped key's
+// associated data, so a file key only opens for the file it was made for.
+// Version 1 file keys, and those written before the keyring, which are a
+// bare wrapped key under the legacy master key, are bound to nothing; the
+// keys of the latter's chunks carry no id.
+var fileKeyMagic = []byte("GKEY")
+
+const (
+	fileKeyVersion    = 2
+	fileKeyHeaderSize = 4 + 1 + 4 + 4
+)
+
+type FileKey struct {
+	ID       uint32
+	MasterID uint32
+	Key      []byte
+
+	version byte // format it was read from, 0 for a bare legacy key
+}
+
+// NewFileKey makes a data key with a random non-zero id.
+func (km *KeyManager) NewFileKey() (*FileKey, error) {
+	var b [4]byte
+	for {
+		if _, err := io.ReadFull(rand.Reader, b[:]); err != nil {
+			return nil, err
+		}
+		if id := binary.BigEndian.Uint32(b[:]); id != 0 {
+			masterID, _ := km.Current()
+			return &FileKey{ID: id, MasterID: masterID, Key: newEncryptionKey(), version: fileKeyVersion}, nil
+		}
+	}
+}
+
+// fileKeyAAD is what a file key's wrapped key is bound to.
+func fileKeyAAD(header []byte, userID, name string) []byte {
+	aad := make([]byte, 0, len(header)+len(userID)+1+len(name))
+	aad = append(aad, header...)
+	aad = append(aad, userID...)
+	aad = append(aad, 0)
+	return append(aad, name...)
+}
+
+// WrapFileKey seals fk under its master key, for userID's file name.
+func (km *KeyManager) WrapFileKey(fk *FileKey, userID, name string) ([]byte, error) {
+	master, err := km.Key(fk.MasterID)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, fileKeyHeaderSize)
+	copy(header, fileKeyMagic)
+	header[4] = fileKeyVersion
+	binary.BigEndian.PutUint32(header[5:9], fk.ID)
+	binary.BigEndian.PutUint32(header[9:13], fk.MasterID)
+
+	wrapped, err := wrapKey(master, fk.Key, fileKeyAAD(header, userID, name))
+	if err != nil {
+		return nil, err
+	}
+	fk.version = fileKeyVersion
+	return append(header, wrapped...), nil
+}
+
+// UnwrapFileKey opens a file key of userID's file name written by
+// WrapFileKey or, before the keyring, by the legacy master key directly.
+func (km *KeyManager) UnwrapFileKey(b []byte, userID, name string) (*FileKey, error) {
+	fk := &FileKey{}
+	wrapped := b
+	var aad []byte
+	if len(b) >= fileKeyHeaderSize && bytes.Equal(b[:4], fileKeyMagic) {
+		fk.version = b[4]
+		switch fk.version {
+		case 1:
+		case fileKeyVersion:
+			aad = fileKeyAAD(b[:fileKeyHeaderSize], userID, name)
+		default:
+			return nil, fmt.Errorf("unsupported file key version %d", b[4])
+		}
+		fk.ID = binary.BigEndian.Uint32(b[5:9])
+		fk.MasterID = binary.BigEndian.Uint32(b[9:13])
+		wrapped = b[fileKeyHeaderSize:]
+	} else {
+		km.mu.RLock()
+		fk.MasterID = km.file.Legacy
+		km.mu.RUnlock()
+		if fk.MasterID == 0 {
+			return nil, fmt.Errorf("file key predates the keyring and no STORAGE_MASTER_KEY was imported")
+		}
+	}
+
+	master, err := km.Key(fk.MasterID)
+	if err != nil {
+		return nil, err
+	}
+	if fk.Key, err = unwrapKey(master, wrapped, aad); err != nil {
+		return nil, err
+	}
+	return fk, nil
+}
+
+// Lookup opens streams sealed under the file key. Chunks naming another key
+// belong to a different version of the file.
+func (fk *FileKey) Lookup(id uint32) ([]byte, error) {
+	if id != fk.ID {
+		return nil, fmt.Errorf("chunk sealed with data key %d, file key is %d", id, fk.ID)
+	}
+	return fk.Key, nil
+}
+
+// -------------------- Rewrapping --------------------
+
+// runKeyRotation rewraps file keys after every rotation and on each tick,
+// and rotates on its own once the current key is older than maxAge (if set).
+func (km *KeyManager) runKeyRotation(rewrapFileKeys func() (int, error), interval, maxAge time.Duration) {
+	rewrap := func() {
+		n, err := rewrapFileKeys()
+		if err != nil {
+			log.Printf("[keys] rewrap failed: %v", err)
+		}
+		if n > 0 {
+			log.Printf("[keys] rewrapped %d file keys", n)
+		}
+	}
+
+	rewrap()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-km.rotated:
+		case <-ticker.C:
+			if maxAge > 0 && time.Since(km.currentCreatedAt()) > maxAge {
+				if _, err := km.Rotate(); err != nil {
+					log.Printf("[keys] scheduled rotation failed: %v", err)
+				}
+			}
+		}
+		rewrap()
+	}
+}
+
+// -------------------- Key Endpoints --------------------
+
+func listKeysHandler(c fiber.Ctx) error {
+	return c.JSON(fiber.Map{"success": true, "keys": keys.Keys()})
+}
+
+func rotateKeyHandler(c fiber.Ctx) error {
+	id, err := keys.Rotate()
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(fiber.Map{"success": true, "current": id})
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestKeyManagerPersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keyring.json")
+	src := passphraseSource{passphrase: "correct horse"}
+
+	km, err := OpenKeyManager(path, src, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	firstID, first := km.Current()
+	secondID, err := km.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secondID == firstID {
+		t.Fatal("rotation kept the same key id")
+	}
+
+	reopened, err := OpenKeyManager(path, src, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, _ := reopened.Current(); id != secondID {
+		t.Errorf("have current %d want %d", id, secondID)
+	}
+	if key, err := reopened.Key(firstID); err != nil || !bytes.Equal(key, first) {
+		t.Errorf("old key lost across restart: %v", err)
+	}
+
+	raw, _ := os.ReadFile(path)
+	if bytes.Contains(raw, first) {
+		t.Error("keyring stores a master key in the clear")
+	}
+
+	if _, err := OpenKeyManager(path, passphraseSource{passphrase: "wrong"}, nil); !errors.Is(err, errKeyringWrong) {
+		t.Errorf("wrong passphrase: have %v", err)
+	}
+	if _, err := OpenKeyManager(path, staticSource{name: "kms key file", key: newEncryptionKey()}, nil); err == nil {
+		t.Error("expected a keyring to refuse another kind of key source")
+	}
+}
+
+func TestSealedStreamKeyIDs(t *testing.T) {
+	km := newTestKeyManager(t)
+	oldID, oldKey := km.Current()
+
+	var sealed bytes.Buffer
+	if _, err := sealStream(oldID, oldKey, bytes.NewReader([]byte("in flight")), &sealed); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := km.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Data sealed before the rotation opens with the key its header names.
+	var out bytes.Buffer
+	if _, err := openStream(km.Key, bytes.NewReader(sealed.Bytes()), &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "in flight" {
+		t.Errorf("have %q", out.String())
+	}
+
+	other := newTestKeyManager(t)
+	other.Rotate()
+	other.Rotate()
+	if _, err := openStream(other.Key, bytes.NewReader(sealed.Bytes()), &out); err == nil {
+		t.Error("expected opening under another keyring to fail")
+	}
+}
+
+func TestRewrapFileKeys(t *testing.T) {
+	s := newLocalFileServer(t, newTestKeyManager(t))
+
+	data := []byte("survives rotation")
+	m, err := s.WriteFile("alice", "a.txt", bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newID, err := s.Keys.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := s.rewrapFileKeys()
+	if err != nil || n != 1 {
+		t.Fatalf("have %d rewrapped, %v", n, err)
+	}
+	if n, _ := s.rewrapFileKeys(); n != 0 {
+		t.Errorf("second pass rewrapped %d keys", n)
+	}
+
+	after, err := s.StatFile("alice", "a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fk, err := s.Keys.UnwrapFileKey(after.FileKey, "alice", "a.txt")
+	if err != nil || fk.MasterID != newID {
+		t.Fatalf("file key not moved to key %d: %+v, %v", newID, fk, err)
+	}
+	if !reflect.DeepEqual(m.Chunks, after.Chunks) {
+		t.Error("rewrapping rewrote chunk data")
+	}
+
+	var out bytes.Buffer
+	if _, err := s.ReadFile("alice", "a.txt", &out); err != nil || !bytes.Equal(out.Bytes(), data) {
+		t.Errorf("have %q, %v", out.String(), err)
+	}
+}
+
+func TestLegacyFileKey(t *testing.T) {
+	legacy := newEncryptionKey()
+	km, err := OpenKeyManager(filepath.Join(t.TempDir(), "keyring.json"), staticSource{name: "master key", key: legacy}, legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dek := newEncryptionKey()
+	wrapped, _ := wrapKey(legacy, dek, nil)
+	fk, err := km.UnwrapFileKey(wrapped, "bob", "old.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(fk.Key, dek) || fk.ID != 0 {
+		t.Errorf("have %+v", fk)
+	}
+
+	// Chunks written before key ids name key 0, which a legacy file key opens.
+	var sealed, out bytes.Buffer
+	copyEncrypt(dek, bytes.NewReader([]byte("old chunk")), &sealed)
+	if _, err := openStream(fk.Lookup, &sealed, &out); err != nil || out.String() != "old chunk" {
+		t.Errorf("have %q, %v", out.String(), err)
+	}
+}
+
+func TestFileKeyBoundToFile(t *testing.T) {
+	km := newTestKeyManager(t)
+	fk, err := km.NewFileKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrapped, err := km.WrapFileKey(fk, "alice", "a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := km.UnwrapFileKey(wrapped, "alice", "a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct{ user, name string }{{"alice", "b.txt"}, {"bob", "a.txt"}} {
+		if _, err := km.UnwrapFileKey(wrapped, tc.user, tc.name); err == nil {
+			t.Errorf("key for alice/a.txt opened as %s/%s", tc.user, tc.name)
+		}
+	}
+
+	// Swapping the key id in the header breaks the seal too.
+	tampered := bytes.Clone(wrapped)
+	tampered[8] ^= 1
+	if _, err := km.UnwrapFileKey(tampered, "alice", "a.txt"); err == nil {
+		t.Error("key opened with a changed key id")
+	}
+}
+
+func TestRewrapUpgradesFileKeys(t *testing.T) {
+	s := newLocalFileServer(t, newTestKeyManager(t))
+
+	data := []byte("written before binding")
+	if _, err := s.WriteFile("alice", "a.txt", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rewrite the file key in the version 1 format, which had no AAD.
+	m, err := s.readManifest("alice", "a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fk, err := s.Keys.UnwrapFileKey(m.FileKey, "alice", "a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	master, _ := s.Keys.Key(fk.MasterID)
+	wrapped, _ := wrapKey(master, fk.Key, nil)
+	header := bytes.Clone(m.FileKey[:fileKeyHeaderSize])
+	header[4] = 1
+	m.FileKey = append(header, wrapped...)
+	if err := s.writeManifest("alice", m); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if _, err := s.ReadFile("alice", "a.txt", &out); err != nil || !bytes.Equal(out.Bytes(), data) {
+		t.Fatalf("version 1 key: have %q, %v", out.String(), err)
+	}
+
+	if n, err := s.rewrapFileKeys(); err != nil || n != 1 {
+		t.Fatalf("have %d rewrapped, %v", n, err)
+	}
+	after, _ := s.StatFile("alice", "a.txt")
+	if after.FileKey[4] != fileKeyVersion {
+		t.Errorf("file key still version %d", after.FileKey[4])
+	}
+	out.Reset()
+	if _, err := s.ReadFile("alice", "a.txt", &out); err != nil || !bytes.Equal(out.Bytes(), data) {
+		t.Errorf("have %q, %v", out.String(), err)
+	}
+}
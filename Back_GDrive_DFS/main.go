@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"mime"
 	"mime/multipart"
 	"net/http"
 	"net/url"
@@ -15,9 +16,9 @@ import (
 	"os/exec"
 	"path/filepath"
 	"regexp"
-	"sort"
+	"slices"
+	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"cloud.google.com/go/firestore"
@@ -29,13 +30,18 @@ import (
 )
 
 type FileMeta struct {
-	FileName   string      `json:"fileName"`
-	FilePath   string      `json:"filePath"`
-	NodeID     []string    `json:"nodeId"`
-	SharedWith string      `json:"sharedWith"`
-	Size       string      `json:"size"`
-	Timestamp  interface{} `json:"timestamp" firestore:"timestamp"`
-	UserID     string      `json:"userId"`
+	ID            string            `json:"id" firestore:"-"`
+	FileName      string            `json:"fileName"`
+	FilePath      string            `json:"filePath"`
+	NodeID        []string          `json:"nodeId"`
+	ShareWith     []string          `json:"shareWith" firestore:"shareWith"`
+	ACL           map[string]string `json:"acl" firestore:"acl"`
+	StorageUserID string            `json:"storageUserId,omitempty" firestore:"storageUserId,omitempty"`
+	FolderID      string            `json:"folderId" firestore:"folderId"`
+	Vault         string            `json:"vault,omitempty" firestore:"-"`
+	Size          string            `json:"size"`
+	Timestamp     interface{}       `json:"timestamp" firestore:"timestamp"`
+	UserID        string            `json:"userId"`
 }
 
 const (
@@ -53,20 +59,37 @@ func init() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 }
 
-func initFirebase() {
+// initFirebase connects to Firebase Auth, only if it is the provider, and
+// to Firestore, which holds file metadata whatever the provider. Firestore
+// is taken from the Firebase project unless FIRESTORE_PROJECT_ID names one,
+// which, like the Firestore emulator, needs no Firebase at all.
+func initFirebase(provider string) {
 	ctx := context.Background()
-	app, err := firebase.NewApp(ctx, nil)
-	if err != nil {
-		log.Fatalf("error initializing Firebase app: %v", err)
+	var app *firebase.App
+	if provider == "firebase" {
+		var err error
+		if app, err = firebase.NewApp(ctx, nil); err != nil {
+			log.Fatalf("error initializing Firebase app: %v", err)
+		}
+		client, err := app.Auth(ctx)
+		if err != nil {
+			log.Fatalf("error getting Auth client: %v", err)
+		}
+		firebaseAuth = client
 	}
 
-	client, err := app.Auth(ctx)
-	if err != nil {
-		log.Fatalf("error getting Auth client: %v", err)
+	var (
+		fsClient *firestore.Client
+		err      error
+	)
+	switch project := getEnv("FIRESTORE_PROJECT_ID", ""); {
+	case project != "":
+		fsClient, err = firestore.NewClient(ctx, project)
+	case app != nil:
+		fsClient, err = app.Firestore(ctx)
+	default:
+		log.Fatalf("AUTH_PROVIDER=%s needs FIRESTORE_PROJECT_ID for file metadata", provider)
 	}
-	firebaseAuth = client
-
-	fsClient, err := app.Firestore(ctx)
 	if err != nil {
 		log.Fatalf("error getting Firestore client: %v", err)
 	}
@@ -95,6 +118,7 @@ func getFileMetadataFromFirebase(userID, filename string) (*FileMeta, error) {
 	if err := doc.DataTo(&f); err != nil {
 		return nil, err
 	}
+	f.ID = doc.Ref.ID
 	return &f, nil
 }
 
@@ -129,6 +153,42 @@ func deleteFileMetadataFromFirebase(userID, filename string) error {
 	return err
 }
 
+// recordFileMetadata writes the files document for an upload that didn't come
+// through the web UI, which otherwise creates it itself. Re-uploads update the
+// existing document.
+func recordFileMetadata(userID, filename, filePath, folderID string, size int, nodes []string) error {
+	ctx := context.Background()
+
+	var folder interface{}
+	if folderID != "" {
+		folder = folderID
+	}
+
+	if existing, err := getFileMetadataFromFirebase(userID, filename); err == nil {
+		_, err := firestoreClient.Collection("files").Doc(existing.ID).Update(ctx, []firestore.Update{
+			{Path: "size", Value: fmt.Sprintf("%d", size)},
+			{Path: "nodeId", Value: nodes},
+			{Path: "timestamp", Value: firestore.ServerTimestamp},
+		})
+		return err
+	}
+
+	_, _, err := firestoreClient.Collection("files").Add(ctx, map[string]interface{}{
+		"fileName":  filename,
+		"filePath":  filePath,
+		"size":      fmt.Sprintf("%d", size),
+		"userId":    userID,
+		"nodeId":    nodes,
+		"folderId":  folder,
+		"deleted":   false,
+		"deletedAt": false,
+		"shareWith": nil,
+		"highlight": false,
+		"timestamp": firestore.ServerTimestamp,
+	})
+	return err
+}
+
 // -------------------- Helpers: ENV & Paths --------------------
 
 func getEnv(key, def string) string {
@@ -138,6 +198,36 @@ func getEnv(key, def string) string {
 	return def
 }
 
+// getEnvDuration reads a duration like "90m" or "720h" from the
+// environment, falling back to def when unset or invalid.
+func getEnvDuration(key string, def time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Printf("invalid %s=%q, using %s", key, v, def)
+		return def
+	}
+	return d
+}
+
+// getEnvInt64 reads a whole number from the environment, falling back to
+// def when unset or invalid.
+func getEnvInt64(key string, def int64) int64 {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		log.Printf("invalid %s=%q, using %d", key, v, def)
+		return def
+	}
+	return n
+}
+
 func storageRoot() string {
 	return getEnv("STORAGE_ROOT", "/app/storage")
 }
@@ -157,8 +247,12 @@ func peersList() []string {
 }
 
 func selfURL() string {
-	nodeID := getEnv("NODE_ID", "s1")
-	return fmt.Sprintf("http://%s:8080", nodeID)
+	return nodeURL(getEnv("NODE_ID", "s1"))
+}
+
+// nodeURL is the HTTP address of node id.
+func nodeURL(id string) string {
+	return fmt.Sprintf("http://%s:8080", id)
 }
 
 func ensureDir(path string) error {
@@ -178,69 +272,35 @@ func parseNodeID(node string) string {
 	return node
 }
 
-// -------------------- Chunks I/O --------------------
+// -------------------- File I/O --------------------
 
-func writeChunks(userID, filename string, data []byte) (int, error) {
-	filename = filepath.Base(filename)
-	dir := filepath.Join(storageRoot(), getEnv("NODE_ID", "s1"), userID, filename)
-	if err := ensureDir(dir); err != nil {
-		return 0, err
-	}
-	count := 0
-	for offset := 0; offset < len(data); offset += ChunkSize {
-		end := offset + ChunkSize
-		if end > len(data) {
-			end = len(data)
-		}
-		chunkPath := filepath.Join(dir, fmt.Sprintf("%d.chunk", count))
-		if err := os.WriteFile(chunkPath, data[offset:end], 0o644); err != nil {
-			return count, err
-		}
-		count++
-	}
-	return count, nil
-}
+// fileServer is this node's storage engine: chunking, encryption and the
+// store on disk, and the p2p transport other nodes reach it through.
+var fileServer *FileServer
 
-func reconstructToWriter(nodeID, userID, filename string, w io.Writer) (int64, error) {
-	dir := filepath.Join(storageRoot(), nodeID, userID, filename)
-	log.Printf("[reconstruct] reading dir: %s", dir)
+// fileTransferTimeout bounds moving one file between nodes.
+const fileTransferTimeout = 5 * time.Minute
 
-	var total int64
-	for i := 0; ; i++ {
-		chunkPath := filepath.Join(dir, fmt.Sprintf("%d.chunk", i))
-		log.Printf("[reconstruct] checking chunk: %s", chunkPath)
-		if _, err := os.Stat(chunkPath); os.IsNotExist(err) {
-			break
-		}
-		b, err := os.ReadFile(chunkPath)
-		if err != nil {
-			return total, err
-		}
-		n, err := w.Write(b)
-		if err != nil {
-			return total, err
-		}
-		total += int64(n)
-	}
+func isSelf(node string) bool {
+	return parseNodeID(node) == parseNodeID(getEnv("NODE_ID", "s1"))
+}
 
-	if total == 0 {
-		return 0, fmt.Errorf("no chunks for %s", filename)
+// readFileFrom copies userID's file from node, which may be this one, to w.
+func readFileFrom(ctx context.Context, node, userID, filename string, w io.Writer) (int64, error) {
+	if isSelf(node) {
+		return fileServer.readFile(userID, filename, w, !isBackground(ctx))
 	}
-	return total, nil
+	return fileServer.FetchFile(ctx, parseNodeID(node), userID, filename, w)
 }
 
-func hasAnyChunk(nodeID, userID, filename string) bool {
-	dir := filepath.Join(storageRoot(), nodeID, userID, filename)
-	entries, err := os.ReadDir(dir)
-	if err != nil {
-		return false
-	}
-	for _, e := range entries {
-		if !e.IsDir() && filepath.Ext(e.Name()) == ".chunk" {
-			return true
-		}
+// writeFileTo stores data as userID's file on node, which may be this one.
+// Every replica of one upload is given the same modified time.
+func writeFileTo(ctx context.Context, node, userID, filename string, data []byte, modified time.Time) error {
+	if isSelf(node) {
+		_, err := fileServer.writeFile(userID, filename, bytes.NewReader(data), modified)
+		return err
 	}
-	return false
+	return fileServer.SendFile(ctx, parseNodeID(node), userID, filename, bytes.NewReader(data), int64(len(data)), modified)
 }
 
 // -------------------- Health Check & Node Selection --------------------
@@ -275,22 +335,14 @@ func getHealthyNodes() []string {
 
 func getFileCount(nodeURL, userID string) int {
 	if nodeURL == selfURL() {
-		nodeID := getEnv("NODE_ID", "s1")
-		root := filepath.Join(storageRoot(), nodeID, userID)
-		entries, err := os.ReadDir(root)
+		files, _, err := fileServer.Usage(userID)
 		if err != nil {
 			return 0
 		}
-		count := 0
-		for _, e := range entries {
-			if e.IsDir() && hasAnyChunk(nodeID, userID, e.Name()) {
-				count++
-			}
-		}
-		return count
+		return files
 	} else {
 		client := &http.Client{Timeout: 5 * time.Second}
-		resp, err := client.Get(nodeURL + "/files")
+		resp, err := clusterGet(client, nodeURL+"/files")
 		if err != nil {
 			return 0
 		}
@@ -350,26 +402,17 @@ func chooseTargetNode(userID string) string {
 // -------------------- Replication --------------------
 
 func hasFileOnPeer(userID, peer, filename string) bool {
-	encoded := url.PathEscape(filename)
-	client := &http.Client{Timeout: 3 * time.Second}
-
-	urlStr := fmt.Sprintf("%s/files/raw/%s/%s", peer, url.PathEscape(userID), encoded)
-	req, err := http.NewRequest(http.MethodHead, urlStr, nil)
-	if err != nil {
-		log.Printf("[hasFileOnPeer] request creation failed: %v", err)
-		return false
-	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
 
-	resp, err := client.Do(req)
+	ok, err := fileServer.HasFileOn(ctx, parseNodeID(peer), userID, filename)
 	if err != nil {
-		return false
+		log.Printf("[hasFileOnPeer] %s: %v", peer, err)
 	}
-	defer resp.Body.Close()
-
-	return resp.StatusCode == http.StatusOK
+	return ok
 }
 
-func replicateToPeers(userID, filename string, data []byte) []string {
+func replicateToPeers(userID, filename string, data []byte, modified time.Time) []string {
 	healthy := getHealthyNodes()
 	storedNodes := []string{selfURL()}
 	count := 1
@@ -390,7 +433,10 @@ func replicateToPeers(userID, filename string, data []byte) []string {
 		var success bool
 		for attempt := 1; attempt <= ReplicateMaxRetries; attempt++ {
 			log.Printf("[replicate] sending %s to %s (attempt %d)", filename, peer, attempt)
-			if err := postMultipart(peer+"/store-local", "file", filename, userID, data, true); err != nil {
+			ctx, cancel := context.WithTimeout(withBackground(context.Background()), fileTransferTimeout)
+			err := writeFileTo(ctx, peer, userID, filename, data, modified)
+			cancel()
+			if err != nil {
 				log.Printf("[replicate] %s FAILED attempt %d: %v", peer, attempt, err)
 				time.Sleep(ReplicateRetryDelay * time.Duration(attempt))
 				continue
@@ -417,7 +463,7 @@ func replicateToPeers(userID, filename string, data []byte) []string {
 	return storedNodes
 }
 
-func postMultipart(url, fieldName, filename, userID string, data []byte, isReplica bool) error {
+func postMultipart(url, fieldName, filename, userID string, data []byte) error {
 	var buf bytes.Buffer
 	w := multipart.NewWriter(&buf)
 	part, err := w.CreateFormFile(fieldName, filename)
@@ -431,12 +477,8 @@ func postMultipart(url, fieldName, filename, userID string, data []byte, isRepli
 
 	_ = w.WriteField("user_id", userID)
 
-	if isReplica {
-		_ = w.WriteField("replica", "1")
-	}
-
 	w.Close()
-	req, err := http.NewRequest(http.MethodPost, url, &buf)
+	req, err := newClusterRequest(http.MethodPost, url, buf.Bytes())
 	if err != nil {
 		return err
 	}
@@ -455,62 +497,54 @@ func postMultipart(url, fieldName, filename, userID string, data []byte, isRepli
 	return nil
 }
 
-func tryProxyFromPeers(c fiber.Ctx, userID, filename, originalFilename string) error {
-	peers := strings.Split(getEnv("PEERS", ""), ",")
-
-	log.Printf("[DEBUG PEERS] Trying peers for file: %s", filename)
-
-	for _, peer := range peers {
-		peer = strings.TrimSpace(peer)
-		if peer == "" {
-			continue
+// readOrder is the nodes to try reading userID's file from: this one if it
+// has a copy, then the replicas in the cluster's file map, then the nodes in
+// the file's nodeId, which may be out of date, then any other peer.
+func readOrder(userID, filename string, nodeIDs []string) []string {
+	var order []string
+	add := func(node string) {
+		id := parseNodeID(node)
+		if !slices.Contains(order, id) {
+			order = append(order, id)
 		}
-
-		log.Printf("[DEBUG PEERS] Trying peer: %s", peer)
-
-		if !isNodeHealthy(peer) {
-			log.Printf("[DEBUG PEERS] Peer %s is unhealthy", peer)
-			continue
+	}
+	if fileServer.HasFile(userID, filename) {
+		add(getEnv("NODE_ID", "s1"))
+	}
+	if md := fileServer.Metadata(); md != nil {
+		if r, ok := md.Lookup(userID, filename); ok && !r.Deleted {
+			for _, id := range r.Replicas {
+				add(id)
+			}
 		}
+	}
+	for _, node := range nodeIDs {
+		add(node)
+	}
+	for _, peer := range peersList() {
+		add(peer)
+	}
+	return order
+}
 
-		client := &http.Client{Timeout: 30 * time.Second}
-		proxyURL := fmt.Sprintf("%s/files/raw/%s/%s",
-			peer,
-			url.PathEscape(userID),
-			url.PathEscape(filename))
-
-		log.Printf("[DEBUG PEERS] Proxy URL: %s", proxyURL)
-
-		resp, err := client.Get(proxyURL)
-		if err != nil {
-			log.Printf("[DEBUG PEERS] Peer %s failed: %v", peer, err)
+// readFromAny copies userID's file to w from the first node in readOrder
+// that can serve it.
+func readFromAny(userID, filename string, nodeIDs []string, w *bytes.Buffer) (int64, error) {
+	for _, node := range readOrder(userID, filename, nodeIDs) {
+		if isSelf(node) && !fileServer.HasFile(userID, filename) {
 			continue
 		}
-
-		log.Printf("[DEBUG PEERS] Peer %s response status: %d", peer, resp.StatusCode)
-
-		if resp.StatusCode == 200 {
-			defer resp.Body.Close()
-
-			c.Set("Content-Type", "application/octet-stream")
-			c.Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", originalFilename))
-
-			bytesWritten, err := io.Copy(c.Response().BodyWriter(), resp.Body)
-			if err != nil {
-				resp.Body.Close()
-				log.Printf("[DEBUG PEERS] Stream from peer %s failed: %v", peer, err)
-				continue
-			}
-
-			log.Printf("[DEBUG PEERS] Successfully proxied from peer %s, bytes: %d", peer, bytesWritten)
-			return nil
+		ctx, cancel := context.WithTimeout(context.Background(), fileTransferTimeout)
+		n, err := readFileFrom(ctx, node, userID, filename, w)
+		cancel()
+		if err == nil {
+			log.Printf("[download] read %s from %s, bytes: %d", filename, node, n)
+			return n, nil
 		}
-
-		resp.Body.Close()
+		log.Printf("[download] %s: %v", node, err)
+		w.Reset()
 	}
-
-	log.Printf("[DEBUG PEERS] No peers available")
-	return c.Status(404).JSON(fiber.Map{"error": "file not found on any available node"})
+	return 0, errors.New("file not found on any available node")
 }
 
 // -------------------- Auto Sync --------------------
@@ -527,256 +561,63 @@ func startAutoSync() {
 	}()
 }
 
-var lastSyncState = make(map[string]int)
-
-func deleteFileOnNode(nodeURL, filename string) {
-	if nodeURL == selfURL() {
-		nodeRoot := filepath.Join(storageRoot(), getEnv("NODE_ID", "s1"))
-		users, err := os.ReadDir(nodeRoot)
-		if err != nil {
-			log.Printf("[sync] failed to list users in %s: %v", nodeRoot, err)
-			return
-		}
-
-		for _, u := range users {
-			if !u.IsDir() {
-				continue
-			}
-			userID := u.Name()
-			fileDir := filepath.Join(nodeRoot, userID, filename)
-			if _, err := os.Stat(fileDir); os.IsNotExist(err) {
-				continue
-			}
-
-			if err := deleteFile(getEnv("NODE_ID", "s1"), userID, filename); err != nil {
-				log.Printf("[sync] failed to delete %s for user %s: %v", filename, userID, err)
-			} else {
-				log.Printf("[sync] deleted %s for user %s (over-replicated)", filename, userID)
-			}
-			return
-		}
-
-		log.Printf("[sync] file %s not found on self", filename)
-		return
-	}
-
-	ctx := context.Background()
-	users, err := getUserFilesFromFirebase(ctx, "")
-	if err != nil {
-		log.Printf("[sync] failed to get users from Firebase: %v", err)
-		return
-	}
-
-	for _, f := range users {
-		if fName, ok := f["fileName"].(string); ok && fName == filename {
-			if userID, ok := f["userId"].(string); ok {
-				reqURL := fmt.Sprintf("%s/api/files/%s?user_id=%s", nodeURL, url.PathEscape(filename), url.QueryEscape(userID))
-				client := &http.Client{Timeout: 5 * time.Second}
-				req, err := http.NewRequest("DELETE", reqURL, nil)
-				if err != nil {
-					log.Printf("[sync] failed to create DELETE request for %s on %s: %v", filename, nodeURL, err)
-					continue
-				}
-				resp, err := client.Do(req)
-				if err != nil {
-					log.Printf("[sync] failed to delete %s from %s: %v", filename, nodeURL, err)
-					continue
-				}
-				defer resp.Body.Close()
-
-				if resp.StatusCode >= 200 && resp.StatusCode < 300 {
-					log.Printf("[sync] deleted %s from %s (over-replicated)", filename, nodeURL)
-				} else {
-					body, _ := io.ReadAll(resp.Body)
-					log.Printf("[sync] failed to delete %s from %s, status: %d, body: %s", filename, nodeURL, resp.StatusCode, string(body))
-				}
-			}
-			break
-		}
-	}
-}
-
+// syncMissingFiles reconciles this node with the cluster's file map, which
+// also fetches the under-replicated files this node is next in line for.
+// The leader then trims files with more replicas than ReplicationFactor,
+// and brings the nodeId lists in Firestore up to date with the map.
 func syncMissingFiles() {
-	healthyPeers := getHealthyNodes()
-	allNodes := append(peersList(), selfURL())
-
-	peerFiles := make(map[string]map[string][]string)
-
-	for _, node := range allNodes {
-		client := &http.Client{Timeout: 5 * time.Second}
-		resp, err := client.Get(node + "/files")
-		if err != nil {
-			continue
-		}
-		var data struct {
-			Files []struct {
-				Name   string `json:"name"`
-				UserID string `json:"user_id"`
-			} `json:"files"`
-		}
-		json.NewDecoder(resp.Body).Decode(&data)
-		resp.Body.Close()
-
-		for _, f := range data.Files {
-			if _, ok := peerFiles[f.Name]; !ok {
-				peerFiles[f.Name] = make(map[string][]string)
-			}
-			peerFiles[f.Name][f.UserID] = append(peerFiles[f.Name][f.UserID], node)
-		}
-	}
-
-	// --- Limit concurrent replication ---
-	maxWorkers := 50
-	sem := make(chan struct{}, maxWorkers)
-	var wg sync.WaitGroup
-
-	for filename, users := range peerFiles {
-		for userID, nodes := range users {
-
-			if len(nodes) < ReplicationFactor {
-				wg.Add(1)
-				sem <- struct{}{}
-
-				go func(f, u string, nList []string) {
-					defer wg.Done()
-					defer func() { <-sem }()
-
-					log.Printf("[sync] file %s (user %s) under-replicated (%d/%d), replicating...", f, u, len(nList), ReplicationFactor)
-					sourceNode := nList[0]
-					data, err := downloadFileFromPeer(u, sourceNode, f)
-					if err != nil {
-						log.Printf("[sync] failed to download %s from %s: %v", f, sourceNode, err)
-						return
-					}
-
-					targets := []string{}
-					for _, peer := range healthyPeers {
-						if !contains(nList, peer) {
-							targets = append(targets, peer)
-						}
-					}
-					if len(targets) == 0 && !contains(nList, selfURL()) {
-						targets = append(targets, selfURL())
-					}
-
-					for _, t := range targets {
-						if t == selfURL() {
-							writeChunks(u, f, data)
-						} else {
-							err := postMultipart(t+"/store-local", "file", f, u, data, true)
-							if err != nil {
-								log.Printf("[sync] failed to replicate %s to %s: %v", f, t, err)
-								continue
-							}
-						}
-						nList = append(nList, t)
-					}
-					log.Printf("[sync] replication of %s (user %s) done, now %d replicas", f, u, len(nList))
-					lastSyncState[f] = len(nList)
-
-				}(filename, userID, nodes)
-			}
-
-			// --- Over-replicated ---
-			if len(nodes) > ReplicationFactor {
-				log.Printf("[sync] file %s (user %s) over-replicated (%d/%d), removing extra replicas...", filename, userID, len(nodes), ReplicationFactor)
-				sortedNodes := append([]string{}, nodes...)
-				sort.Strings(sortedNodes)
-				toDelete := sortedNodes[ReplicationFactor:]
-				for _, node := range toDelete {
-					deleteFileOnNode(node, filename)
-				}
-			}
-		}
-	}
-
-	wg.Wait()
-}
-
-func contains(arr []string, s string) bool {
-	for _, v := range arr {
-		if v == s {
-			return true
-		}
-	}
-	return false
-}
-
-func downloadFileFromPeer(userID, peer, filename string) ([]byte, error) {
-	encoded := url.PathEscape(filename)
-	url := fmt.Sprintf("%s/files/raw/%s/%s", peer, url.PathEscape(userID), encoded)
-	log.Printf("[sync] downloading %s from %s", filename, url)
-
-	client := &http.Client{Timeout: 30 * time.Second}
-	resp, err := client.Get(url)
+	report, err := fileServer.ReconcileMetadata(context.Background())
 	if err != nil {
-		return nil, fmt.Errorf("failed to get: %w", err)
+		log.Printf("[sync] reconciling with the metadata log: %v", err)
 	}
-	defer resp.Body.Close()
+	log.Printf("[sync] recorded %d changes, removed %d outdated copies, copied %d files",
+		report.Recorded, report.Removed, report.Copied)
 
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("peer returned %d", resp.StatusCode)
+	md := fileServer.Metadata()
+	if md == nil || !md.IsLeader() {
+		return
 	}
 
-	data, err := io.ReadAll(resp.Body)
+	trimmed, err := fileServer.TrimReplicas(context.Background())
 	if err != nil {
-		return nil, fmt.Errorf("failed to read body: %w", err)
+		log.Printf("[sync] removing extra replicas: %v", err)
 	}
+	log.Printf("[sync] removed %d extra replicas", trimmed)
 
-	chunks, err := writeChunks(userID, filename, data)
+	if firestoreClient == nil {
+		return
+	}
+	inv, err := CheckInventory(context.Background(), true)
 	if err != nil {
-		return nil, fmt.Errorf("failed to write chunks: %w", err)
+		log.Printf("[sync] checking Firestore against the file map: %v", err)
+		return
 	}
-
-	log.Printf("[sync] file %s downloaded and written %d chunks", filename, chunks)
-	return data, nil
+	log.Printf("[sync] fixed %d/%d stale nodeId lists; %d files without a document, %d documents without a stored file",
+		inv.Fixed, inv.StaleCount, inv.OrphanCount, inv.MissingCount)
 }
 
 // -------------------- File Operations --------------------
 
-func deleteFile(nodeID, userID, filename string) error {
-	dir := filepath.Join(storageRoot(), nodeID, userID, filename)
-	return os.RemoveAll(dir)
-}
-
-func getFileMetadata(nodeID, userID, filename string) (map[string]interface{}, error) {
-	dir := filepath.Join(storageRoot(), nodeID, userID, filename)
-
-	if !hasAnyChunk(nodeID, userID, filename) {
+func getFileMetadata(userID, filename string) (map[string]interface{}, error) {
+	m, err := fileServer.StatFile(userID, filename)
+	if err != nil {
 		return nil, fmt.Errorf("file not found")
 	}
+	return fileMetadata(userID, m), nil
+}
 
-	var totalSize int64
-	chunks := 0
-	var modTime time.Time
-
-	for i := 0; ; i++ {
-		chunkPath := filepath.Join(dir, fmt.Sprintf("%d.chunk", i))
-		fi, err := os.Stat(chunkPath)
-		if os.IsNotExist(err) {
-			break
-		}
-		if err != nil {
-			return nil, err
-		}
-		totalSize += fi.Size()
-		chunks++
-		if fi.ModTime().After(modTime) {
-			modTime = fi.ModTime()
-		}
-	}
-
+func fileMetadata(userID string, m *Manifest) map[string]interface{} {
 	return map[string]interface{}{
-		"filename":   filename,
+		"filename":   m.Name,
 		"user_id":    userID,
-		"size_bytes": totalSize,
-		"size_mb":    fmt.Sprintf("%.2f", float64(totalSize)/1024.0/1024.0),
-		"chunks":     chunks,
-		"modified":   modTime.Unix(),
-		"location":   nodeID,
+		"size_bytes": m.Size,
+		"size_mb":    fmt.Sprintf("%.2f", float64(m.Size)/1024.0/1024.0),
+		"chunks":     len(m.Chunks),
+		"modified":   m.Modified.Unix(),
+		"tier":       m.tier(),
+		"location":   getEnv("NODE_ID", "s1"),
 		"available":  true,
-		"path":       dir,
-	}, nil
+	}
 }
 
 func getUserFilesFromFirebase(ctx context.Context, userID string) ([]map[string]interface{}, error) {
@@ -795,22 +636,28 @@ func getUserFilesFromFirebase(ctx context.Context, userID string) ([]map[string]
 	return files, nil
 }
 
-// --------------------------  Middle Ware ----------------------------
-func firebaseAuthMiddleware(c fiber.Ctx) error {
-	authHeader := c.Get("Authorization")
-	if authHeader == "" {
-		return c.Status(401).JSON(fiber.Map{"error": "missing Authorization header"})
-	}
+// storeFile writes data to the node chosen for userID, which replicates it
+// to its peers. The bytes are stored as they are; nothing looks inside them.
+func storeFile(userID, filename string, data []byte) (storedNodes []string, chunks int, err error) {
+	targetNode := chooseTargetNode(userID)
+	log.Printf("[upload] target node for user %s, file %s: %s", userID, filename, targetNode)
 
-	idToken := strings.TrimPrefix(authHeader, "Bearer ")
+	if targetNode == selfURL() {
+		m, err := fileServer.WriteFile(userID, filename, bytes.NewReader(data))
+		if err != nil {
+			return nil, 0, err
+		}
+		chunks = len(m.Chunks)
 
-	decoded, err := firebaseAuth.VerifyIDToken(context.Background(), idToken)
-	if err != nil {
-		return c.Status(401).JSON(fiber.Map{"error": "invalid token"})
+		storedNodes = replicateToPeers(userID, filename, data, m.Modified)
+		log.Printf("[upload] replication finished: %v", storedNodes)
+		return storedNodes, chunks, nil
 	}
 
-	c.Locals("userID", decoded.UID)
-	return c.Next()
+	if err := postMultipart(targetNode+"/store-local", "file", filename, userID, data); err != nil {
+		return nil, 0, err
+	}
+	return []string{targetNode}, 0, nil
 }
 
 func uploadHandler(c fiber.Ctx) error {
@@ -826,6 +673,9 @@ func uploadHandler(c fiber.Ctx) error {
 	}
 
 	filename := filepath.Base(fileHeader.Filename)
+	if !validFileName(filename) {
+		return c.Status(400).JSON(fiber.Map{"error": "invalid file name"})
+	}
 	src, err := fileHeader.Open()
 	if err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": "failed to open file"})
@@ -837,30 +687,40 @@ func uploadHandler(c fiber.Ctx) error {
 		return c.Status(500).JSON(fiber.Map{"error": "failed to read file"})
 	}
 
-	targetNode := chooseTargetNode(userID)
-	log.Printf("[upload] target node for user %s, file %s: %s", userID, filename, targetNode)
-
-	var storedNodes []string
-	var chunks int
+	if owner := c.FormValue("owner"); owner != "" && owner != userID {
+		return replaceSharedFile(c, userID, owner, filename, data)
+	}
 
-	if targetNode == selfURL() {
-		chunks, err = writeChunks(userID, filename, data)
-		if err != nil {
-			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	// Uploads made with an access token stay inside the token's folder, and
+	// we record the metadata ourselves since no web UI is involved.
+	_, tokenFolder, viaToken := tokenGrant(c)
+	folderID := c.FormValue("folder_id")
+	if viaToken {
+		if tokenFolder != "" {
+			folderID = tokenFolder
 		}
-
-		storedNodes = replicateToPeers(userID, filename, data)
-		log.Printf("[upload] replication finished: %v", storedNodes)
-	} else {
-		err := postMultipart(targetNode+"/store-local", "file", filename, userID, data, false)
-		if err != nil {
-			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		if existing, err := getFileMetadataFromFirebase(userID, filename); err == nil {
+			folderID = existing.FolderID
 		}
-		storedNodes = []string{targetNode}
+		if err := checkTokenAccess(c, ScopeWrite, folderID); err != nil {
+			return accessErrorResponse(c, err)
+		}
+	}
+
+	storedNodes, chunks, err := storeFile(userID, filename, data)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
 	}
 
 	filePath := fmt.Sprintf("%s/%s/%s", selfURL(), userID, filename)
 
+	if viaToken {
+		if err := recordFileMetadata(userID, filename, filePath, folderID, len(data), storedNodes); err != nil {
+			log.Printf("[upload] failed to record metadata for %s: %v", filename, err)
+			return c.Status(500).JSON(fiber.Map{"error": "stored file but failed to record metadata"})
+		}
+	}
+
 	return c.JSON(fiber.Map{
 		"success":    true,
 		"filename":   filename,
@@ -872,6 +732,103 @@ func uploadHandler(c fiber.Ctx) error {
 	})
 }
 
+// replaceSharedFile overwrites another user's file on behalf of an editor.
+// The new contents go to every node that already holds a replica, so no stale
+// copy is left behind for the sync loop to pick up.
+func replaceSharedFile(c fiber.Ctx, userID, owner, filename string, data []byte) error {
+	meta, err := authorizeFile(userID, owner, filename, RoleEditor)
+	if err == nil {
+		err = checkTokenAccess(c, ScopeWrite, meta.FolderID)
+	}
+	if err != nil {
+		return accessErrorResponse(c, err)
+	}
+
+	storageUserID := meta.storageUser()
+	storedNodes := []string{}
+	modified := time.Now()
+	for _, node := range meta.NodeID {
+		ctx, cancel := context.WithTimeout(context.Background(), fileTransferTimeout)
+		err := writeFileTo(ctx, node, storageUserID, filename, data, modified)
+		cancel()
+		if err != nil {
+			log.Printf("[upload] failed to replace %s on %s: %v", filename, node, err)
+			continue
+		}
+		storedNodes = append(storedNodes, node)
+	}
+	if len(storedNodes) == 0 {
+		return c.Status(500).JSON(fiber.Map{"error": "no replica could be updated"})
+	}
+
+	_, err = fileDocRef(meta).Update(context.Background(), []firestore.Update{
+		{Path: "size", Value: fmt.Sprintf("%d", len(data))},
+		{Path: "timestamp", Value: firestore.ServerTimestamp},
+	})
+	if err != nil {
+		log.Printf("[upload] replaced %s on %v but failed to update its metadata: %v", filename, storedNodes, err)
+		return c.Status(500).JSON(fiber.Map{"error": "failed to update metadata"})
+	}
+
+	log.Printf("[upload] %s replaced %s owned by %s on %v", userID, filename, meta.UserID, storedNodes)
+	return c.JSON(fiber.Map{
+		"success":    true,
+		"filename":   filename,
+		"owner":      meta.UserID,
+		"size_bytes": len(data),
+		"stored_on":  storedNodes,
+		"status":     "replaced",
+	})
+}
+
+// contentType is taken from the file name, never from the contents: vault
+// blobs are ciphertext, and the server has no business reading files to
+// guess what they are.
+func (f *FileMeta) contentType() string {
+	if f.Vault == "" {
+		if t := mime.TypeByExtension(filepath.Ext(f.FileName)); t != "" {
+			return t
+		}
+	}
+	return "application/octet-stream"
+}
+
+func setDownloadHeaders(c fiber.Ctx, contentType, filename string) {
+	c.Set("Content-Type", contentType)
+	c.Set("X-Content-Type-Options", "nosniff")
+	c.Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	c.Set("Cache-Control", "no-cache")
+}
+
+// sendFile streams a file to the client from the first node that has it,
+// this one included; see readOrder.
+func sendFile(c fiber.Ctx, fileMeta *FileMeta, filename string) error {
+	fileUserID := fileMeta.storageUser()
+	actualFilename := fileMeta.FileName
+
+	log.Printf("[download] fileUserID=%s, actualFilename=%s, nodeId=%v", fileUserID, actualFilename, fileMeta.NodeID)
+
+	contentType := fileMeta.contentType()
+
+	var buffer bytes.Buffer
+	bytesWritten, err := readFromAny(fileUserID, actualFilename, fileMeta.NodeID, &buffer)
+	if err != nil {
+		log.Printf("[download] ERROR: %v", err)
+		return c.Status(404).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	setDownloadHeaders(c, contentType, filename)
+
+	_, err = io.Copy(c.Response().BodyWriter(), &buffer)
+	if err != nil {
+		log.Printf("[download] ERROR: failed to write response: %v", err)
+		return c.Status(500).JSON(fiber.Map{"error": "failed to write response: " + err.Error()})
+	}
+
+	log.Printf("[download] SUCCESS: sent %d bytes with Content-Type: %s", bytesWritten, contentType)
+	return nil
+}
+
 // ----------------------  Admin page ---------------------------
 
 func toggleDockerNode(node, action string) error {
@@ -896,15 +853,66 @@ func getDockerLogs(containerName string) (string, error) {
 // -------------------- Main & API Endpoints --------------------
 
 func main() {
-	initFirebase()
-	nodeID := getEnv("NODE_ID", "s1")
-	if err := ensureDir(filepath.Join(storageRoot(), nodeID)); err != nil {
+	initFirebase(getEnv("AUTH_PROVIDER", "firebase"))
+
+	provider, err := newAuthenticatorFromEnv()
+	if err != nil {
+		log.Fatalf("error initializing authentication: %v", err)
+	}
+	userDirectory, _ = provider.(UserDirectory)
+	authenticator = NewTokenAuthenticator(provider, firestoreTokenStore{})
+	if keys, err = newKeyManagerFromEnv(); err != nil {
+		log.Fatalf("error opening keyring: %v", err)
+	}
+
+	nodeID := getEnv("NODE_ID", "s1")
+	if err := ensureDir(filepath.Join(storageRoot(), nodeID)); err != nil {
 		log.Fatalf("cannot create node storage: %v", err)
 	}
+	if fileServer, err = newFileServerFromEnv(keys); err != nil {
+		log.Fatalf("error setting up file server: %v", err)
+	}
+	if n, err := fileServer.Recover(); err != nil {
+		log.Fatalf("error recovering storage: %v", err)
+	} else if n > 0 {
+		log.Printf("cleaned up %d unfinished writes", n)
+	}
+	if n, err := fileServer.migrateLegacyFiles(); err != nil {
+		log.Fatalf("error migrating stored files: %v", err)
+	} else if n > 0 {
+		log.Printf("migrated %d files to the store", n)
+	}
+	go func() {
+		if err := fileServer.Start(); err != nil {
+			log.Fatalf("error starting file server: %v", err)
+		}
+	}()
+
+	go fileServer.runGC(
+		getEnvDuration("GC_INTERVAL", time.Hour),
+		getEnvDuration("GC_GRACE_PERIOD", 24*time.Hour),
+	)
+
+	go fileServer.runTiering(
+		getEnvDuration("TIER_INTERVAL", time.Hour),
+		TieringPolicy{
+			ColdAfter: getEnvDuration("TIER_COLD_AFTER", 7*24*time.Hour),
+			MinSize:   getEnvInt64("TIER_MIN_SIZE", 0),
+		},
+	)
+
+	go keys.runKeyRotation(
+		fileServer.rewrapFileKeys,
+		getEnvDuration("KEY_REWRAP_INTERVAL", time.Hour),
+		getEnvDuration("KEY_ROTATION_MAX_AGE", 0),
+	)
 
 	log.Printf("NODE_ID=%s storage=%s", getEnv("NODE_ID", "s1"), storageRoot())
 	log.Printf("SELF_URL=%s", selfURL())
 	log.Printf("PEERS=%v", peersList())
+	if len(clusterSecret()) == 0 {
+		log.Printf("WARNING: CLUSTER_SECRET is not set, peer routes will reject every request")
+	}
 
 	startAutoSync()
 
@@ -915,7 +923,7 @@ func main() {
 	app.Use(cors.New(cors.Config{
 		AllowOrigins: []string{"*"},
 		AllowMethods: []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowHeaders: []string{"Origin", "Content-Type", "Accept", "Authorization"},
+		AllowHeaders: []string{"Origin", "Content-Type", "Accept", "Authorization", "X-Link-Password"},
 	}))
 
 	// API: Health check
@@ -931,10 +939,15 @@ func main() {
 	})
 
 	// API: Smart upload
-	app.Post("/api/upload", firebaseAuthMiddleware, uploadHandler)
+	app.Post("/api/upload", authMiddleware, requireScope(ScopeWrite), uploadHandler)
+
+	// API: Personal access tokens
+	app.Post("/api/tokens", authMiddleware, requireInteractive, createTokenHandler)
+	app.Get("/api/tokens", authMiddleware, requireInteractive, listTokensHandler)
+	app.Delete("/api/tokens/:tokenID", authMiddleware, requireInteractive, revokeTokenHandler)
 
 	// Internal: Store local (used by other nodes)
-	app.Post("/store-local", func(c fiber.Ctx) error {
+	app.Post("/store-local", clusterAuthMiddleware, func(c fiber.Ctx) error {
 		fileHeader, err := c.FormFile("file")
 		if err != nil {
 			return c.Status(400).JSON(map[string]interface{}{"error": "file required"})
@@ -957,12 +970,15 @@ func main() {
 		}
 
 		filename := filepath.Base(fileHeader.Filename)
+		if !validFileName(userID) || !validFileName(filename) {
+			return c.Status(400).JSON(map[string]interface{}{"error": "invalid file name"})
+		}
 		data, err := io.ReadAll(src)
 		if err != nil {
 			return c.Status(500).JSON(map[string]interface{}{"error": err.Error()})
 		}
 
-		chunks, err := writeChunks(userID, filename, data)
+		m, err := fileServer.WriteFile(userID, filename, bytes.NewReader(data))
 		if err != nil {
 			return c.Status(500).JSON(map[string]interface{}{"error": err.Error()})
 		}
@@ -971,7 +987,7 @@ func main() {
 
 		isReplicaRequest := c.FormValue("replica") == "1"
 		if !isReplicaRequest {
-			storedNodes = replicateToPeers(userID, filename, data)
+			storedNodes = replicateToPeers(userID, filename, data, m.Modified)
 		} else {
 			storedNodes = append(storedNodes, c.IP())
 		}
@@ -981,141 +997,155 @@ func main() {
 			"node":      getEnv("NODE_ID", "s1"),
 			"filename":  filename,
 			"user_id":   userID,
-			"chunks":    chunks,
+			"chunks":    len(m.Chunks),
 			"stored_on": storedNodes,
 			"status":    "stored locally",
 		})
 	})
 
-	// API: Download file
-	app.Get("/api/files/:filename", firebaseAuthMiddleware, func(c fiber.Ctx) error {
-		encoded := c.Params("filename")
-		filename, err := url.PathUnescape(encoded)
-		if err != nil {
-			log.Printf("[download] ERROR: invalid filename encoding: %v", err)
-			return c.Status(400).JSON(fiber.Map{"error": "invalid filename"})
-		}
-
-		userIDIface := c.Locals("userID")
-		userID, ok := userIDIface.(string)
-		if !ok || userID == "" {
-			log.Printf("[download] ERROR: missing or invalid userID")
-			return c.Status(401).JSON(fiber.Map{"error": "unauthorized"})
+	// Static /api/files/* routes must be registered before /api/files/:filename,
+	// Fiber matches in registration order.
+	app.Get("/api/files/count", func(c fiber.Ctx) error {
+		nodeID := c.Query("node", getEnv("NODE_ID", "s1"))
+		if nodeID != getEnv("NODE_ID", "s1") {
+			return c.Status(404).JSON(map[string]interface{}{
+				"error": "node folder not found",
+				"node":  nodeID,
+			})
 		}
 
-		log.Printf("[download] START: user=%s, filename=%s", userID, filename)
-
-		fileMeta, err := getFileMetadataFromFirebase(userID, filename)
+		users, err := fileServer.Users()
 		if err != nil {
-			log.Printf("[download] ERROR: file not found in database: %v", err)
-			return c.Status(404).JSON(fiber.Map{"error": "file not found"})
+			return c.Status(500).JSON(map[string]interface{}{"error": err.Error()})
 		}
 
-		if len(fileMeta.NodeID) == 0 {
-			log.Printf("[download] ERROR: no nodeID in metadata")
-			return c.Status(500).JSON(fiber.Map{"error": "no nodeID in metadata"})
+		var fileCount int
+		var bytesUsed int64
+		for _, userID := range users {
+			files, used, err := fileServer.Usage(userID)
+			if err != nil {
+				return c.Status(500).JSON(map[string]interface{}{"error": err.Error()})
+			}
+			fileCount += files
+			bytesUsed += used
 		}
 
-		targetNodeRaw := fileMeta.NodeID[0]
-		targetNodeID := parseNodeID(targetNodeRaw)
-		currentNodeID := parseNodeID(getEnv("NODE_ID", ""))
-		fileUserID := fileMeta.UserID
-		actualFilename := fileMeta.FileName
-
-		log.Printf("[download] targetNodeID=%s, currentNodeID=%s, fileUserID=%s, actualFilename=%s",
-			targetNodeID, currentNodeID, fileUserID, actualFilename)
+		return c.JSON(map[string]interface{}{
+			"node":  nodeID,
+			"count": fileCount,
+			"bytes": bytesUsed,
+		})
+	})
 
-		// Helper function for min
-		min := func(a, b int) int {
-			if a < b {
-				return a
-			}
-			return b
+	// API: Global file list (from all nodes)
+	app.Get("/api/files/global", authMiddleware, adminMiddleware, func(c fiber.Ctx) error {
+		type NodeFiles struct {
+			Node   string                   `json:"node"`
+			Files  []map[string]interface{} `json:"files"`
+			Status string                   `json:"status"`
 		}
 
-		if targetNodeID == currentNodeID {
-			if !hasAnyChunk(currentNodeID, fileUserID, actualFilename) {
-				log.Printf("[download] ERROR: no chunks found on current node")
-				return c.Status(404).JSON(fiber.Map{"error": "file not found on current node"})
-			}
-
-			// read buffer
-			var buffer bytes.Buffer
-			bytesWritten, err := reconstructToWriter(currentNodeID, fileUserID, actualFilename, &buffer)
-			if err != nil {
-				log.Printf("[download] ERROR: reconstruct failed: %v", err)
-				return c.Status(500).JSON(fiber.Map{"error": "failed to read file: " + err.Error()})
-			}
+		results := []NodeFiles{}
 
-			// Auto-detect Content-Type
-			bufferBytes := buffer.Bytes()
-			detectedType := http.DetectContentType(bufferBytes[:min(512, len(bufferBytes))])
+		localFiles := []map[string]interface{}{}
+		nodeID := getEnv("NODE_ID", "s1")
+		err := fileServer.WalkFiles(func(userID string, m *Manifest) error {
+			localFiles = append(localFiles, fileMetadata(userID, m))
+			return nil
+		})
+		if err != nil {
+			log.Printf("[global] listing local files: %v", err)
+		}
 
-			c.Set("Content-Type", detectedType)
-			c.Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
-			c.Set("Cache-Control", "no-cache")
+		results = append(results, NodeFiles{
+			Node:   nodeID,
+			Files:  localFiles,
+			Status: "local",
+		})
 
-			_, err = io.Copy(c.Response().BodyWriter(), &buffer)
+		for _, peer := range peersList() {
+			client := &http.Client{Timeout: 5 * time.Second}
+			resp, err := clusterGet(client, peer+"/files?detail=1")
 			if err != nil {
-				log.Printf("[download] ERROR: failed to write response: %v", err)
-				return c.Status(500).JSON(fiber.Map{"error": "failed to write response: " + err.Error()})
+				results = append(results, NodeFiles{
+					Node:   peer,
+					Files:  []map[string]interface{}{},
+					Status: "unreachable",
+				})
+				continue
 			}
+			defer resp.Body.Close()
 
-			log.Printf("[download] SUCCESS: sent %d bytes with Content-Type: %s", bytesWritten, detectedType)
-			return nil
-		}
-
-		targetNodeURL := targetNodeRaw
-		if !isNodeHealthy(targetNodeURL) {
-			log.Printf("[download] Target node %s not healthy, trying peers...", targetNodeURL)
-			return tryProxyFromPeers(c, fileUserID, actualFilename, filename)
+			if resp.StatusCode == 200 {
+				var peerData struct {
+					Files []map[string]interface{} `json:"files"`
+				}
+				if err := json.NewDecoder(resp.Body).Decode(&peerData); err == nil {
+					results = append(results, NodeFiles{
+						Node:   peer,
+						Files:  peerData.Files,
+						Status: "healthy",
+					})
+				}
+			}
 		}
 
-		proxyURL := fmt.Sprintf("%s/files/raw/%s/%s",
-			targetNodeURL, url.PathEscape(fileUserID), url.PathEscape(actualFilename))
+		return c.JSON(map[string]interface{}{
+			"success":       true,
+			"nodes":         results,
+			"healthy_count": len(getHealthyNodes()) + 1,
+			"total_nodes":   len(peersList()) + 1,
+			"replication":   ReplicationFactor,
+		})
+	})
 
-		client := &http.Client{Timeout: 30 * time.Second}
-		resp, err := client.Get(proxyURL)
+	// API: Download file
+	app.Get("/api/files/:filename", authMiddleware, func(c fiber.Ctx) error {
+		encoded := c.Params("filename")
+		filename, err := url.PathUnescape(encoded)
 		if err != nil {
-			log.Printf("[download] ERROR: proxy request failed: %v", err)
-			return c.Status(500).JSON(fiber.Map{"error": "failed to proxy file: " + err.Error()})
-		}
-		defer resp.Body.Close()
-
-		if resp.StatusCode != 200 {
-			bodyBytes, _ := io.ReadAll(resp.Body)
-			log.Printf("[download] ERROR: target node returned %d: %s", resp.StatusCode, string(bodyBytes))
-			return c.Status(resp.StatusCode).JSON(fiber.Map{
-				"error": fmt.Sprintf("target node returned %d: %s", resp.StatusCode, string(bodyBytes)),
-			})
+			log.Printf("[download] ERROR: invalid filename encoding: %v", err)
+			return c.Status(400).JSON(fiber.Map{"error": "invalid filename"})
 		}
 
-		bodyBytes, err := io.ReadAll(resp.Body)
-		if err != nil {
-			log.Printf("[download] ERROR: failed to read response body: %v", err)
-			return c.Status(500).JSON(fiber.Map{"error": "failed to read response body: " + err.Error()})
+		userIDIface := c.Locals("userID")
+		userID, ok := userIDIface.(string)
+		if !ok || userID == "" {
+			log.Printf("[download] ERROR: missing or invalid userID")
+			return c.Status(401).JSON(fiber.Map{"error": "unauthorized"})
 		}
 
-		// Auto-detect Content-Type for proxied file
-		detectedType := http.DetectContentType(bodyBytes[:min(512, len(bodyBytes))])
-		log.Printf("[download] Auto-detected Content-Type for proxied file: %s", detectedType)
-
-		c.Set("Content-Type", detectedType)
-		c.Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
-		c.Set("Cache-Control", "no-cache")
+		log.Printf("[download] START: user=%s, filename=%s", userID, filename)
 
-		bytesWritten, err := c.Response().BodyWriter().Write(bodyBytes)
+		fileMeta, err := authorizeFileParam(c, RoleViewer)
 		if err != nil {
-			log.Printf("[download] ERROR: failed to stream file: %v", err)
-			return c.Status(500).JSON(fiber.Map{"error": "failed to stream file: " + err.Error()})
+			log.Printf("[download] ERROR: access check failed: %v", err)
+			return accessErrorResponse(c, err)
 		}
 
-		log.Printf("[download] SUCCESS: proxied %d bytes with Content-Type: %s", bytesWritten, detectedType)
-		return nil
+		return sendFile(c, fileMeta, filename)
 	})
 
+	// API: Sharing. Changing who has access needs a browser session: an
+	// access token's write scope doesn't reach that far.
+	app.Get("/api/shared", authMiddleware, requireScope(ScopeRead), sharedWithMeHandler)
+	app.Get("/api/files/:filename/shares", authMiddleware, listSharesHandler)
+	app.Post("/api/files/:filename/shares", authMiddleware, requireInteractive, shareFileHandler)
+	app.Delete("/api/files/:filename/shares/:userID", authMiddleware, requireInteractive, revokeShareHandler)
+	app.Post("/api/files/:filename/owner", authMiddleware, requireInteractive, transferOwnerHandler)
+	app.Post("/api/folders/:folderID/shares", authMiddleware, requireInteractive, shareFolderHandler)
+	app.Get("/api/files/:filename/comments", authMiddleware, listCommentsHandler)
+	app.Post("/api/files/:filename/comments", authMiddleware, addCommentHandler)
+
+	// API: Public share links
+	app.Post("/api/files/:filename/links", authMiddleware, requireInteractive, createLinkHandler)
+	app.Get("/api/links", authMiddleware, requireInteractive, listLinksHandler)
+	app.Delete("/api/links/:linkID", authMiddleware, requireInteractive, revokeLinkHandler)
+	app.Get("/s/:linkID", publicLinkHandler)
+	app.Post("/s/:linkID", publicLinkHandler)
+
 	// Internal: Raw download (for peer-to-peer)
-	app.Get("/files/raw/:userID/:filename", func(c fiber.Ctx) error {
+	app.Get("/files/raw/:userID/:filename", clusterAuthMiddleware, func(c fiber.Ctx) error {
 		userID := c.Params("userID")
 		filename := c.Params("filename")
 
@@ -1124,12 +1154,11 @@ func main() {
 			return c.Status(400).JSON(fiber.Map{"error": "invalid filename"})
 		}
 
-		currentNodeID := getEnv("NODE_ID", "s1")
-
-		if hasAnyChunk(currentNodeID, userID, decodedFilename) {
+		if fileServer.HasFile(userID, decodedFilename) {
 			c.Set("Content-Type", "application/octet-stream")
 
-			_, err := reconstructToWriter(currentNodeID, userID, decodedFilename, c.Response().BodyWriter())
+			// Copies between nodes aren't reads by a user.
+			_, err := fileServer.readFile(userID, decodedFilename, c.Response().BodyWriter(), false)
 			if err != nil {
 				return c.Status(500).JSON(fiber.Map{"error": "failed to read file: " + err.Error()})
 			}
@@ -1140,67 +1169,56 @@ func main() {
 	})
 
 	// API: Delete file
-	app.Delete("/api/files/:filename", firebaseAuthMiddleware, func(c fiber.Ctx) error {
-		userIDIface := c.Locals("userID")
-		userID, ok := userIDIface.(string)
-		if !ok || userID == "" {
-			userID = c.Query("user_id")
-			if userID == "" {
-				return c.Status(400).JSON(fiber.Map{"error": "missing user_id"})
-			}
-		}
-
-		encoded := c.Params("filename")
-		filename, err := url.PathUnescape(encoded)
+	app.Delete("/api/files/:filename", authMiddleware, func(c fiber.Ctx) error {
+		fileMeta, err := authorizeFileParam(c, RoleOwner)
 		if err != nil {
-			log.Printf("invalid filename: %v", err)
-			return c.Status(400).JSON(fiber.Map{"error": "invalid filename"})
+			return accessErrorResponse(c, err)
 		}
 
-		if err := deleteFile(getEnv("NODE_ID", "s1"), userID, filename); err != nil {
+		userID := fileMeta.UserID
+		storageUserID := fileMeta.storageUser()
+		filename := fileMeta.FileName
+
+		// The delete goes into the metadata log first, so any copy that
+		// can't be dropped now is dropped by its node's next reconcile.
+		fileServer.RecordDelete(storageUserID, filename)
+
+		var pending []string
+		if err := fileServer.DeleteFile(storageUserID, filename); err != nil {
 			log.Printf("failed to delete local file: %v", err)
+			pending = append(pending, fileServer.ID)
 		}
-
-		firebaseToken := c.Get("Authorization")
 		for _, peer := range peersList() {
-			reqURL := fmt.Sprintf("%s/files/raw/%s/%s",
-				peer, url.PathEscape(userID), url.PathEscape(filename))
-			req, _ := http.NewRequest("DELETE", reqURL, nil)
-			if firebaseToken != "" {
-				req.Header.Set("Authorization", firebaseToken)
-			}
-			client := &http.Client{Timeout: 5 * time.Second}
-			resp, err := client.Do(req)
+			node := parseNodeID(peer)
+			ctx, cancel := context.WithTimeout(context.Background(), proposeTimeout)
+			err := fileServer.DropReplicaOn(ctx, node, storageUserID, filename, "")
+			cancel()
 			if err != nil {
-				log.Printf("peer %s delete failed: %v", peer, err)
-				continue
-			}
-			resp.Body.Close()
-			if resp.StatusCode >= 300 {
-				log.Printf("peer %s returned status %d", peer, resp.StatusCode)
+				log.Printf("[delete] dropping %s on %s: %v", filename, node, err)
+				pending = append(pending, node)
 			}
 		}
 
 		if err := deleteFileMetadataFromFirebase(userID, filename); err != nil {
 			log.Printf("failed to delete metadata: %v", err)
+			return c.Status(500).JSON(fiber.Map{"error": "failed to delete metadata"})
 		}
 
+		if len(pending) > 0 {
+			return c.Status(202).JSON(fiber.Map{"success": true, "status": "partial", "pending": pending})
+		}
 		return c.JSON(fiber.Map{"success": true})
 	})
 
-	// DELETE /files/raw/:userID/:filename
-	app.Delete("/files/raw/:userID/:filename", firebaseAuthMiddleware, func(c fiber.Ctx) error {
+	// DELETE /files/raw/:userID/:filename drops this node's copy for a peer.
+	app.Delete("/files/raw/:userID/:filename", clusterAuthMiddleware, func(c fiber.Ctx) error {
 		userID := c.Params("userID")
-		encoded := c.Params("filename")
-		filename, err := url.PathUnescape(encoded)
-		if err != nil {
-			log.Printf("invalid filename: %v", err)
+		filename, err := url.PathUnescape(c.Params("filename"))
+		if err != nil || !validFileName(userID) || !validFileName(filename) {
 			return c.Status(400).JSON(fiber.Map{"error": "invalid filename"})
 		}
 
-		nodeID := getEnv("NODE_ID", "s1")
-
-		if err := deleteFile(nodeID, userID, filename); err != nil {
+		if err := fileServer.DeleteFile(userID, filename); err != nil {
 			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
 		}
 
@@ -1208,7 +1226,7 @@ func main() {
 	})
 
 	// API: List local files
-	app.Get("/api/files", firebaseAuthMiddleware, func(c fiber.Ctx) error {
+	app.Get("/api/files", authMiddleware, requireScope(ScopeRead), func(c fiber.Ctx) error {
 		userIDIface := c.Locals("userID")
 		userID, _ := userIDIface.(string)
 		if userID == "" {
@@ -1221,6 +1239,17 @@ func main() {
 			return c.Status(500).JSON(fiber.Map{"success": false, "error": err.Error()})
 		}
 
+		// Folder-bound access tokens only see their folder.
+		if _, tokenFolder, ok := tokenGrant(c); ok && tokenFolder != "" {
+			inFolder := []map[string]interface{}{}
+			for _, f := range files {
+				if folderID, _ := f["folderId"].(string); folderID == tokenFolder {
+					inFolder = append(inFolder, f)
+				}
+			}
+			files = inFolder
+		}
+
 		if files == nil {
 			files = []map[string]interface{}{}
 		}
@@ -1232,170 +1261,39 @@ func main() {
 		})
 	})
 
-	// Internal: List files (used by peers)
-	app.Get("/files", func(c fiber.Ctx) error {
+	// Internal: List files (used by peers). ?detail=1 adds per-file metadata.
+	app.Get("/files", clusterAuthMiddleware, func(c fiber.Ctx) error {
 		nodeID := getEnv("NODE_ID", "s1")
-		nodeRoot := filepath.Join(storageRoot(), nodeID)
 
-		entries, err := os.ReadDir(nodeRoot)
-		if err != nil {
-			return c.Status(500).JSON(map[string]interface{}{
-				"error": err.Error(),
-			})
-		}
+		detail := c.Query("detail") == "1"
 
 		files := []map[string]interface{}{}
-		for _, userDir := range entries {
-			if !userDir.IsDir() {
-				continue
+		err := fileServer.WalkFiles(func(userID string, m *Manifest) error {
+			if detail {
+				files = append(files, fileMetadata(userID, m))
+				return nil
 			}
-			userID := userDir.Name()
-			userPath := filepath.Join(nodeRoot, userID)
-
-			fileDirs, err := os.ReadDir(userPath)
-			if err != nil {
-				continue
-			}
-
-			for _, fileDir := range fileDirs {
-				if !fileDir.IsDir() {
-					continue
-				}
-				files = append(files, map[string]interface{}{
-					"user_id": userID,
-					"name":    fileDir.Name(),
-				})
-			}
-		}
-
-		return c.JSON(map[string]interface{}{
-			"node":  nodeID,
-			"files": files,
-		})
-	})
-
-	app.Get("/api/files/count", func(c fiber.Ctx) error {
-		nodeID := c.Query("node", getEnv("NODE_ID", "s1"))
-		nodeRoot := filepath.Join(storageRoot(), nodeID)
-
-		if _, err := os.Stat(nodeRoot); os.IsNotExist(err) {
-			return c.Status(404).JSON(map[string]interface{}{
-				"error": "node folder not found",
-				"node":  nodeID,
+			files = append(files, map[string]interface{}{
+				"user_id": userID,
+				"name":    m.Name,
 			})
-		}
-
-		entries, err := os.ReadDir(nodeRoot)
+			return nil
+		})
 		if err != nil {
-			return c.Status(500).JSON(map[string]interface{}{"error": err.Error()})
-		}
-
-		fileCount := 0
-		for _, userDir := range entries {
-			if !userDir.IsDir() {
-				continue
-			}
-			userPath := filepath.Join(nodeRoot, userDir.Name())
-			fileDirs, err := os.ReadDir(userPath)
-			if err != nil {
-				continue
-			}
-			for _, fileDir := range fileDirs {
-				if fileDir.IsDir() {
-					fileCount++
-				}
-			}
+			return c.Status(500).JSON(map[string]interface{}{
+				"error": err.Error(),
+			})
 		}
 
 		return c.JSON(map[string]interface{}{
 			"node":  nodeID,
-			"count": fileCount,
-		})
-	})
-
-	// API: Global file list (from all nodes)
-	app.Get("/api/files/global", func(c fiber.Ctx) error {
-		type NodeFiles struct {
-			Node   string                   `json:"node"`
-			Files  []map[string]interface{} `json:"files"`
-			Status string                   `json:"status"`
-		}
-
-		results := []NodeFiles{}
-
-		localFiles := []map[string]interface{}{}
-		nodeID := getEnv("NODE_ID", "s1")
-		root := filepath.Join(storageRoot(), nodeID)
-		if entries, err := os.ReadDir(root); err == nil {
-			for _, userDir := range entries {
-				if !userDir.IsDir() {
-					continue
-				}
-				userID := userDir.Name()
-				userPath := filepath.Join(root, userID)
-
-				fileDirs, err := os.ReadDir(userPath)
-				if err != nil {
-					continue
-				}
-
-				for _, fileDir := range fileDirs {
-					if !fileDir.IsDir() {
-						continue
-					}
-					filename := fileDir.Name()
-					if metadata, err := getFileMetadata(nodeID, userID, filename); err == nil {
-						localFiles = append(localFiles, metadata)
-					}
-				}
-			}
-		}
-
-		results = append(results, NodeFiles{
-			Node:   nodeID,
-			Files:  localFiles,
-			Status: "local",
-		})
-
-		for _, peer := range peersList() {
-			client := &http.Client{Timeout: 5 * time.Second}
-			resp, err := client.Get(peer + "/api/files")
-			if err != nil {
-				results = append(results, NodeFiles{
-					Node:   peer,
-					Files:  []map[string]interface{}{},
-					Status: "unreachable",
-				})
-				continue
-			}
-			defer resp.Body.Close()
-
-			if resp.StatusCode == 200 {
-				var peerData struct {
-					Files []map[string]interface{} `json:"files"`
-				}
-				if err := json.NewDecoder(resp.Body).Decode(&peerData); err == nil {
-					results = append(results, NodeFiles{
-						Node:   peer,
-						Files:  peerData.Files,
-						Status: "healthy",
-					})
-				}
-			}
-		}
-
-		return c.JSON(map[string]interface{}{
-			"success":       true,
-			"nodes":         results,
-			"healthy_count": len(getHealthyNodes()) + 1,
-			"total_nodes":   len(peersList()) + 1,
-			"replication":   ReplicationFactor,
+			"files": files,
 		})
 	})
 
 	// API: File info
-	app.Get("/api/files/:userID/:filename/info", func(c fiber.Ctx) error {
-		userID := c.Params("userID")
+	app.Get("/api/files/:userID/:filename/info", authMiddleware, func(c fiber.Ctx) error {
+		ownerID := c.Params("userID")
 		encoded := c.Params("filename")
 		filename, err := url.PathUnescape(encoded)
 		if err != nil {
@@ -1404,10 +1302,17 @@ func main() {
 			})
 		}
 
-		nodeID := getEnv("NODE_ID", "s1")
+		fileMeta, err := authorizeFile(localUserID(c), ownerID, filename, RoleViewer)
+		if err == nil {
+			err = checkTokenAccess(c, ScopeRead, fileMeta.FolderID)
+		}
+		if err != nil {
+			return accessErrorResponse(c, err)
+		}
+		userID := fileMeta.storageUser()
 
-		if hasAnyChunk(nodeID, userID, filename) {
-			metadata, err := getFileMetadata(nodeID, userID, filename)
+		if fileServer.HasFile(userID, filename) {
+			metadata, err := getFileMetadata(userID, filename)
 			if err != nil {
 				return c.Status(500).JSON(map[string]interface{}{
 					"error": err.Error(),
@@ -1421,8 +1326,13 @@ func main() {
 
 		for _, peer := range getHealthyNodes() {
 			client := &http.Client{Timeout: 5 * time.Second}
-			url := fmt.Sprintf("%s/api/files/%s/%s/info", peer, userID, url.PathEscape(filename))
-			resp, err := client.Get(url)
+			url := fmt.Sprintf("%s/api/files/%s/%s/info", peer, ownerID, url.PathEscape(filename))
+			req, err := http.NewRequest(http.MethodGet, url, nil)
+			if err != nil {
+				continue
+			}
+			req.Header.Set("Authorization", c.Get("Authorization"))
+			resp, err := client.Do(req)
 			if err != nil {
 				continue
 			}
@@ -1442,7 +1352,7 @@ func main() {
 	})
 
 	// API: Manual sync
-	app.Post("/api/sync", func(c fiber.Ctx) error {
+	app.Post("/api/sync", authMiddleware, adminMiddleware, func(c fiber.Ctx) error {
 		go syncMissingFiles()
 		return c.JSON(map[string]interface{}{
 			"success": true,
@@ -1505,8 +1415,88 @@ func main() {
 		})
 	})
 
+	// Vaults: end-to-end encrypted folders
+	app.Put("/api/vault/keys", authMiddleware, requireInteractive, putVaultKeysHandler)
+	app.Get("/api/vault/keys/:userID", authMiddleware, getVaultKeysHandler)
+	app.Post("/api/vaults", authMiddleware, requireInteractive, createVaultHandler)
+	app.Get("/api/vaults", authMiddleware, requireScope(ScopeRead), listVaultsHandler)
+	app.Post("/api/vaults/:vaultID/members", authMiddleware, requireInteractive, addVaultMemberHandler)
+	app.Delete("/api/vaults/:vaultID/members/:userID", authMiddleware, requireInteractive, removeVaultMemberHandler)
+	app.Post("/api/vaults/:vaultID/blobs", authMiddleware, uploadVaultBlobHandler)
+	app.Get("/api/vaults/:vaultID/blobs", authMiddleware, listVaultBlobsHandler)
+	app.Get("/api/vaults/:vaultID/blobs/:blobID", authMiddleware, downloadVaultBlobHandler)
+	app.Delete("/api/vaults/:vaultID/blobs/:blobID", authMiddleware, deleteVaultBlobHandler)
+	app.Delete("/vault/raw/:vaultID/:blobID", clusterAuthMiddleware, deleteVaultBlobLocalHandler)
+
+	// The cluster's file map as this node has it, with the state of the
+	// log. ?user_id= lists that user's records.
+	app.Get("/api/cluster/metadata", authMiddleware, adminMiddleware, func(c fiber.Ctx) error {
+		md := fileServer.Metadata()
+		if md == nil {
+			return c.Status(404).JSON(fiber.Map{"error": "this node keeps no metadata log"})
+		}
+		resp := fiber.Map{
+			"success": true,
+			"node":    getEnv("NODE_ID", "s1"),
+			"log":     md.Status(),
+			"files":   md.Stats(),
+		}
+		if userID := c.Query("user_id"); userID != "" {
+			records := []FileRecord{}
+			for _, r := range md.Files() {
+				if r.UserID == userID {
+					records = append(records, r)
+				}
+			}
+			resp["records"] = records
+		}
+		return c.JSON(resp)
+	})
+
+	// Firestore documents that disagree with what the nodes store. POST also
+	// rewrites the stale nodeId lists.
+	inventoryHandler := func(c fiber.Ctx) error {
+		report, err := CheckInventory(context.Background(), c.Method() == fiber.MethodPost)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.JSON(fiber.Map{
+			"success": true,
+			"node":    getEnv("NODE_ID", "s1"),
+			"report":  report,
+		})
+	}
+	app.Get("/api/cluster/inventory", authMiddleware, adminMiddleware, inventoryHandler)
+	app.Post("/api/cluster/inventory", authMiddleware, adminMiddleware, inventoryHandler)
+
+	// Traffic this node moved to and from peers, and its limits
+	app.Get("/api/cluster/bandwidth", authMiddleware, adminMiddleware, func(c fiber.Ctx) error {
+		return c.JSON(fiber.Map{
+			"success":   true,
+			"node":      getEnv("NODE_ID", "s1"),
+			"bandwidth": fileServer.Throttle.Stats(),
+		})
+	})
+
+	// Bytes this node keeps in each storage tier
+	app.Get("/api/storage/tiers", authMiddleware, adminMiddleware, func(c fiber.Ctx) error {
+		usage, err := fileServer.TierUsage()
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.JSON(fiber.Map{
+			"success": true,
+			"node":    getEnv("NODE_ID", "s1"),
+			"tiers":   usage,
+		})
+	})
+
+	// Master keys of this node
+	app.Get("/api/keys", authMiddleware, adminMiddleware, listKeysHandler)
+	app.Post("/api/keys/rotate", authMiddleware, adminMiddleware, rotateKeyHandler)
+
 	// docker log
-	app.Get("/api/cluster/logs", func(c fiber.Ctx) error {
+	app.Get("/api/cluster/logs", authMiddleware, adminMiddleware, func(c fiber.Ctx) error {
 		nodes := peersList()
 		nodes = append(nodes, getEnv("NODE_ID", "s1"))
 
@@ -1537,7 +1527,7 @@ func main() {
 		})
 	})
 
-	app.Post("/api/node/toggle", func(c fiber.Ctx) error {
+	app.Post("/api/node/toggle", authMiddleware, adminMiddleware, func(c fiber.Ctx) error {
 		body := struct {
 			Node   string `json:"node"`
 			Action string `json:"action"`
@@ -1546,6 +1536,10 @@ func main() {
 			return c.Status(400).JSON(fiber.Map{"error": "invalid request"})
 		}
 
+		if body.Action != "start" && body.Action != "stop" && body.Action != "restart" {
+			return c.Status(400).JSON(fiber.Map{"error": "action must be start, stop or restart"})
+		}
+
 		err := toggleDockerNode(body.Node, body.Action)
 		if err != nil {
 			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"mime/multipart"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+)
+
+// setupFileServer points the node's storage engine at a fresh directory.
+func setupFileServer(t *testing.T) {
+	t.Setenv("NODE_ID", "s1")
+
+	prevKeys, prevServer := keys, fileServer
+	keys = newTestKeyManager(t)
+	fileServer = newLocalFileServer(t, keys)
+	t.Cleanup(func() { keys, fileServer = prevKeys, prevServer })
+}
+
+func newTestKeyManager(t *testing.T) *KeyManager {
+	t.Helper()
+	km, err := OpenKeyManager(filepath.Join(t.TempDir(), "keyring.json"), staticSource{name: "test", key: newEncryptionKey()}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return km
+}
+
+func TestGetFileMetadata(t *testing.T) {
+	setupFileServer(t)
+
+	data := bytes.Repeat([]byte("x"), ChunkSize+10)
+	if err := writeFileTo(context.Background(), "http://s1:8080", "alice", "notes.txt", data, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	meta, err := getFileMetadata("alice", "notes.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta["size_bytes"] != int64(len(data)) || meta["chunks"] != 2 || meta["location"] != "s1" {
+		t.Errorf("have %v", meta)
+	}
+
+	if _, err := getFileMetadata("alice", "missing.txt"); err == nil {
+		t.Error("expected metadata of a missing file to fail")
+	}
+}
+
+func TestReadOrder(t *testing.T) {
+	setupFileServer(t)
+
+	// The first node in nodeId is tried, but after one that has the file.
+	stale := []string{"http://s3:8080", "http://s2:8080"}
+	if got := readOrder("alice", "notes.txt", stale); !slices.Equal(got, []string{"s3", "s2"}) {
+		t.Errorf("have %v", got)
+	}
+	if err := writeFileTo(context.Background(), "http://s1:8080", "alice", "notes.txt", []byte("hi"), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if got := readOrder("alice", "notes.txt", stale); !slices.Equal(got, []string{"s1", "s3", "s2"}) {
+		t.Errorf("have %v", got)
+	}
+}
+
+func TestUploadRefusesBadNames(t *testing.T) {
+	setupFileServer(t)
+
+	app := fiber.New()
+	app.Post("/upload", func(c fiber.Ctx) error {
+		c.Locals("userID", "alice")
+		return uploadHandler(c)
+	})
+	for _, name := range []string{"..", ".", `a\b`} {
+		var body bytes.Buffer
+		w := multipart.NewWriter(&body)
+		part, _ := w.CreateFormFile("file", name)
+		part.Write([]byte("escape"))
+		w.Close()
+
+		req := httptest.NewRequest("POST", "/upload", &body)
+		req.Header.Set("Content-Type", w.FormDataContentType())
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != 400 {
+			t.Errorf("%q: have %d want 400", name, resp.StatusCode)
+		}
+	}
+	if files, _ := fileServer.ListFiles("alice"); len(files) != 0 {
+		t.Errorf("stored %v", files)
+	}
+}
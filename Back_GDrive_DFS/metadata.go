@@ -0,0 +1,521 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/anthdm/foreverstore/raft"
+)
+
+// The nodes keep the cluster's map of files to the nodes holding them in a
+// log they replicate among themselves with Raft, under metadataDir in each
+// node's StorageRoot. Every node applies the same commands in the same
+// order, so all agree on what exists without a database; each then
+// reconciles its own storage against the map, see ReconcileMetadata.
+//
+// A file's version is the SHA-256 of its contents. The map names the
+// current version of every file and the nodes holding it, and keeps a
+// record of deleted files so a node that missed the delete drops its copy
+// instead of bringing the file back.
+const metadataDir = "raft"
+
+// proposeTimeout bounds recording one change in the log.
+const proposeTimeout = 10 * time.Second
+
+// maxOpsPerCommand bounds how many changes reconciling puts in one entry.
+const maxOpsPerCommand = 100
+
+type FileRecord struct {
+	UserID   string    `json:"user_id"`
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	Checksum string    `json:"sha256"`
+	Modified time.Time `json:"modified"`
+	// Replicas are the nodes with the current version, sorted.
+	Replicas []string `json:"replicas"`
+	// Deleted files keep their record, with Modified the time of the
+	// delete.
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+// A command in the log is a list of metaOps.
+type metaOp struct {
+	Op       string    `json:"op"`
+	UserID   string    `json:"user_id"`
+	Name     string    `json:"name"`
+	Node     string    `json:"node,omitempty"`
+	Size     int64     `json:"size,omitempty"`
+	Checksum string    `json:"sha256,omitempty"`
+	Modified time.Time `json:"modified"`
+}
+
+const (
+	// opStored: Node has the version Checksum of the file, written at
+	// Modified. It becomes the current version unless the map has a newer
+	// one.
+	opStored = "stored"
+	// opDropped: Node no longer has version Checksum.
+	opDropped = "dropped"
+	// opDeleted: the file was deleted at Modified.
+	opDeleted = "deleted"
+)
+
+// Metadata is the map, as far as this node has applied the log.
+type Metadata struct {
+	raft *raft.Node
+
+	mu    sync.RWMutex
+	files map[string]*FileRecord
+}
+
+func NewMetadata() *Metadata {
+	return &Metadata{files: make(map[string]*FileRecord)}
+}
+
+func recordKey(userID, name string) string {
+	return userID + "/" + name
+}
+
+// Apply is called by the log with each committed command.
+func (md *Metadata) Apply(cmd []byte) {
+	var ops []metaOp
+	if err := json.Unmarshal(cmd, &ops); err != nil {
+		log.Printf("[meta] skipping bad command: %v", err)
+		return
+	}
+	md.mu.Lock()
+	defer md.mu.Unlock()
+	for _, op := range ops {
+		md.apply(op)
+	}
+}
+
+func (md *Metadata) apply(op metaOp) {
+	key := recordKey(op.UserID, op.Name)
+	r := md.files[key]
+
+	switch op.Op {
+	case opStored:
+		switch {
+		case r == nil || (r.Deleted || r.Checksum != op.Checksum) && op.Modified.After(r.Modified):
+			md.files[key] = &FileRecord{
+				UserID:   op.UserID,
+				Name:     op.Name,
+				Size:     op.Size,
+				Checksum: op.Checksum,
+				Modified: op.Modified,
+				Replicas: []string{op.Node},
+			}
+		case !r.Deleted && r.Checksum == op.Checksum && !slices.Contains(r.Replicas, op.Node):
+			r.Replicas = append(r.Replicas, op.Node)
+			sort.Strings(r.Replicas)
+		}
+	case opDropped:
+		if r != nil && !r.Deleted && r.Checksum == op.Checksum {
+			r.Replicas = slices.DeleteFunc(r.Replicas, func(n string) bool { return n == op.Node })
+		}
+	case opDeleted:
+		if r == nil || !op.Modified.Before(r.Modified) {
+			md.files[key] = &FileRecord{UserID: op.UserID, Name: op.Name, Modified: op.Modified, Deleted: true}
+		}
+	default:
+		log.Printf("[meta] skipping unknown op %q", op.Op)
+	}
+}
+
+// Snapshot and Restore carry the map as zstd compressed JSON.
+func (md *Metadata) Snapshot() ([]byte, error) {
+	b, err := json.Marshal(md.Files())
+	if err != nil {
+		return nil, err
+	}
+	return zstdEncoder.EncodeAll(b, nil), nil
+}
+
+func (md *Metadata) Restore(snapshot []byte) error {
+	b, err := zstdDecoder.DecodeAll(snapshot, nil)
+	if err != nil {
+		return err
+	}
+	var records []FileRecord
+	if err := json.Unmarshal(b, &records); err != nil {
+		return err
+	}
+	files := make(map[string]*FileRecord, len(records))
+	for i := range records {
+		r := &records[i]
+		files[recordKey(r.UserID, r.Name)] = r
+	}
+
+	md.mu.Lock()
+	md.files = files
+	md.mu.Unlock()
+	return nil
+}
+
+// Lookup returns the record of userID's file name.
+func (md *Metadata) Lookup(userID, name string) (FileRecord, bool) {
+	md.mu.RLock()
+	defer md.mu.RUnlock()
+	r, ok := md.files[recordKey(userID, name)]
+	if !ok {
+		return FileRecord{}, false
+	}
+	return r.copy(), true
+}
+
+// Files returns every record, deleted ones too, sorted by user and name.
+func (md *Metadata) Files() []FileRecord {
+	md.mu.RLock()
+	records := make([]FileRecord, 0, len(md.files))
+	for _, r := range md.files {
+		records = append(records, r.copy())
+	}
+	md.mu.RUnlock()
+
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].UserID != records[j].UserID {
+			return records[i].UserID < records[j].UserID
+		}
+		return records[i].Name < records[j].Name
+	})
+	return records
+}
+
+func (r *FileRecord) copy() FileRecord {
+	c := *r
+	c.Replicas = slices.Clone(r.Replicas)
+	return c
+}
+
+func (md *Metadata) propose(ctx context.Context, ops ...metaOp) error {
+	cmd, err := json.Marshal(ops)
+	if err != nil {
+		return err
+	}
+	return md.raft.Propose(ctx, cmd)
+}
+
+// Status is the state of this node's copy of the log.
+func (md *Metadata) Status() raft.Status {
+	return md.raft.Status()
+}
+
+// IsLeader reports whether this node leads the log.
+func (md *Metadata) IsLeader() bool {
+	return md.raft.IsLeader()
+}
+
+// MetadataStats counts the records of files that aren't deleted.
+type MetadataStats struct {
+	Files           int `json:"files"`
+	UnderReplicated int `json:"under_replicated"`
+	OverReplicated  int `json:"over_replicated"`
+	// Lost files have no replica left.
+	Lost    int `json:"lost"`
+	Deleted int `json:"deleted"`
+}
+
+func (md *Metadata) Stats() MetadataStats {
+	md.mu.RLock()
+	defer md.mu.RUnlock()
+	var st MetadataStats
+	for _, r := range md.files {
+		switch {
+		case r.Deleted:
+			st.Deleted++
+			continue
+		case len(r.Replicas) == 0:
+			st.Lost++
+		case len(r.Replicas) < ReplicationFactor:
+			st.UnderReplicated++
+		case len(r.Replicas) > ReplicationFactor:
+			st.OverReplicated++
+		}
+		st.Files++
+	}
+	return st
+}
+
+// -------------------- File Server --------------------
+
+// openMetadata opens this node's copy of the log, with peers the ids of the
+// other nodes. It takes part once the file server starts.
+func (s *FileServer) openMetadata(peers []string) error {
+	md := NewMetadata()
+	node, err := raft.New(raft.Config{
+		ID:           s.ID,
+		Peers:        peers,
+		Dir:          filepath.Join(s.StorageRoot, metadataDir),
+		Transport:    peerCaller{s},
+		StateMachine: md,
+	})
+	if err != nil {
+		return err
+	}
+	md.raft = node
+	s.meta = md
+	return nil
+}
+
+// peerCaller carries the log's calls over the file server's connections.
+type peerCaller struct {
+	s *FileServer
+}
+
+func (c peerCaller) Call(ctx context.Context, peer, method string, body []byte) ([]byte, error) {
+	p, err := c.s.peer(peer)
+	if err != nil {
+		return nil, err
+	}
+	return p.Call(ctx, method, body)
+}
+
+// Metadata returns the cluster's file map, or nil if this node keeps none.
+func (s *FileServer) Metadata() *Metadata {
+	return s.meta
+}
+
+func storedOp(node, userID string, m *Manifest) metaOp {
+	return metaOp{
+		Op:       opStored,
+		UserID:   userID,
+		Name:     m.Name,
+		Node:     node,
+		Size:     m.Size,
+		Checksum: m.Checksum,
+		Modified: m.Modified,
+	}
+}
+
+// recordInBackground adds ops to the log without holding up the caller.
+// Whatever doesn't make it is put right by the next reconcile.
+func (s *FileServer) recordInBackground(ops ...metaOp) {
+	if s.meta == nil {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), proposeTimeout)
+		defer cancel()
+		if err := s.meta.propose(ctx, ops...); err != nil {
+			log.Printf("[meta] recording %s of %s/%s: %v", ops[0].Op, ops[0].UserID, ops[0].Name, err)
+		}
+	}()
+}
+
+// RecordDelete notes in the map that userID's file name was deleted, so
+// that every node drops its copy.
+func (s *FileServer) RecordDelete(userID, name string) {
+	s.recordInBackground(metaOp{Op: opDeleted, UserID: userID, Name: name, Modified: time.Now()})
+}
+
+// ReconcileReport is what one run of ReconcileMetadata did.
+type ReconcileReport struct {
+	// Recorded is how many changes to the map this node proposed.
+	Recorded int `json:"recorded"`
+	// Removed are local copies of deleted files or of older versions.
+	Removed int `json:"removed"`
+	// Copied are files this node fetched to bring them up to
+	// ReplicationFactor.
+	Copied int `json:"copied"`
+}
+
+// ReconcileMetadata brings this node's files and the map into line. The map
+// learns of any file here it doesn't list this node for, and stops listing
+// this node for files it no longer has. Copies of deleted files and older
+// versions are removed. Last, this node fetches the under-replicated files
+// it is next in line for.
+func (s *FileServer) ReconcileMetadata(ctx context.Context) (ReconcileReport, error) {
+	var report ReconcileReport
+	if s.meta == nil {
+		return report, nil
+	}
+
+	var ops []metaOp
+	local := map[string]string{}
+	err := s.WalkFiles(func(userID string, m *Manifest) error {
+		r, ok := s.meta.Lookup(userID, m.Name)
+		stale := ok && !m.Modified.After(r.Modified) &&
+			(r.Deleted || r.Checksum != m.Checksum && len(r.Replicas) > 0)
+		if stale {
+			if err := s.DeleteFile(userID, m.Name); err != nil {
+				return err
+			}
+			log.Printf("[meta] removed outdated copy of %s/%s", userID, m.Name)
+			report.Removed++
+			return nil
+		}
+		local[recordKey(userID, m.Name)] = m.Checksum
+		if !ok || r.Checksum != m.Checksum || r.Deleted || !slices.Contains(r.Replicas, s.ID) {
+			ops = append(ops, storedOp(s.ID, userID, m))
+		}
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+
+	for _, r := range s.meta.Files() {
+		if !slices.Contains(r.Replicas, s.ID) {
+			continue
+		}
+		if sum, ok := local[recordKey(r.UserID, r.Name)]; ok && sum == r.Checksum {
+			continue
+		}
+		// Written since the walk passed it?
+		if m, err := s.StatFile(r.UserID, r.Name); err == nil && m.Checksum == r.Checksum {
+			continue
+		}
+		ops = append(ops, metaOp{Op: opDropped, UserID: r.UserID, Name: r.Name, Node: s.ID, Checksum: r.Checksum})
+	}
+
+	for len(ops) > 0 {
+		batch := ops[:min(len(ops), maxOpsPerCommand)]
+		ops = ops[len(batch):]
+		pctx, cancel := context.WithTimeout(ctx, proposeTimeout)
+		err := s.meta.propose(pctx, batch...)
+		cancel()
+		if err != nil {
+			return report, fmt.Errorf("recording in the map: %w", err)
+		}
+		report.Recorded += len(batch)
+	}
+
+	report.Copied, err = s.repairReplicas(ctx)
+	return report, err
+}
+
+// repairReplicas copies here the under-replicated files this node is next
+// in line for. Every node ranks the nodes without a copy the same way, so
+// each missing replica is made by one of them.
+func (s *FileServer) repairReplicas(ctx context.Context) (int, error) {
+	ctx = withBackground(ctx)
+	up := map[string]bool{s.ID: true}
+	for _, p := range s.peerList() {
+		up[peerID(p)] = true
+	}
+
+	copied := 0
+	for _, r := range s.meta.Files() {
+		missing := ReplicationFactor - len(r.Replicas)
+		if r.Deleted || len(r.Replicas) == 0 || missing <= 0 || slices.Contains(r.Replicas, s.ID) {
+			continue
+		}
+		var candidates []string
+		for id := range up {
+			if !slices.Contains(r.Replicas, id) {
+				candidates = append(candidates, id)
+			}
+		}
+		if !slices.Contains(placement(r.UserID, r.Name, candidates, missing), s.ID) {
+			continue
+		}
+
+		for _, src := range r.Replicas {
+			if !up[src] {
+				continue
+			}
+			m, err := s.CopyFile(ctx, src, r.UserID, r.Name)
+			if err != nil {
+				log.Printf("[meta] copying %s/%s from %s: %v", r.UserID, r.Name, src, err)
+				continue
+			}
+			if m.Checksum != r.Checksum {
+				// The source had moved on; the map will catch up.
+				log.Printf("[meta] copied %s/%s from %s, but not the version the map names", r.UserID, r.Name, src)
+			}
+			copied++
+			break
+		}
+		if err := ctx.Err(); err != nil {
+			return copied, err
+		}
+	}
+	return copied, nil
+}
+
+// TrimReplicas removes the copies of files held by more than
+// ReplicationFactor nodes. The replicas are ranked by placement, and the
+// first ones found holding the version the map names are kept; the others
+// are removed only once that many have been confirmed. Only the leader
+// trims, so two nodes never each remove a different copy.
+func (s *FileServer) TrimReplicas(ctx context.Context) (int, error) {
+	if s.meta == nil || !s.meta.IsLeader() {
+		return 0, nil
+	}
+
+	removed := 0
+	for _, r := range s.meta.Files() {
+		if r.Deleted || len(r.Replicas) <= ReplicationFactor {
+			continue
+		}
+		var keep, extra []string
+		for _, id := range placement(r.UserID, r.Name, r.Replicas, len(r.Replicas)) {
+			if len(keep) < ReplicationFactor && s.holdsVersion(ctx, id, r) {
+				keep = append(keep, id)
+			} else {
+				extra = append(extra, id)
+			}
+		}
+		if len(keep) < ReplicationFactor {
+			log.Printf("[meta] not trimming %s/%s: only %v confirmed holding it", r.UserID, r.Name, keep)
+			continue
+		}
+
+		for _, id := range extra {
+			var err error
+			if id == s.ID {
+				err = s.dropReplica(r.UserID, r.Name, r.Checksum)
+			} else {
+				err = s.DropReplicaOn(ctx, id, r.UserID, r.Name, r.Checksum)
+			}
+			if err != nil {
+				log.Printf("[meta] removing extra copy of %s/%s from %s: %v", r.UserID, r.Name, id, err)
+				continue
+			}
+			log.Printf("[meta] removed extra copy of %s/%s from %s, keeping %v", r.UserID, r.Name, id, keep)
+			removed++
+		}
+		if err := ctx.Err(); err != nil {
+			return removed, err
+		}
+	}
+	return removed, nil
+}
+
+// holdsVersion checks with node id that it has the version of r's file the
+// map names.
+func (s *FileServer) holdsVersion(ctx context.Context, id string, r FileRecord) bool {
+	if id == s.ID {
+		m, err := s.StatFile(r.UserID, r.Name)
+		return err == nil && m.Checksum == r.Checksum
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	info, err := s.StatFileOn(ctx, id, r.UserID, r.Name)
+	return err == nil && info.Exists && info.Checksum == r.Checksum
+}
+
+// placement picks n of nodes to hold userID's file name, by rendezvous
+// hashing: the same file goes to the same nodes, and a node coming or going
+// moves few files.
+func placement(userID, name string, nodes []string, n int) []string {
+	score := func(node string) uint64 {
+		h := fnv.New64a()
+		fmt.Fprintf(h, "%s/%s/%s", userID, name, node)
+		return h.Sum64()
+	}
+	ranked := slices.Clone(nodes)
+	sort.Slice(ranked, func(i, j int) bool {
+		return score(ranked[i]) > score(ranked[j])
+	})
+	return ranked[:min(n, len(ranked))]
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"slices"
+	"testing"
+	"time"
+)
+
+func applyOps(md *Metadata, ops ...metaOp) {
+	cmd, _ := json.Marshal(ops)
+	md.Apply(cmd)
+}
+
+func TestMetadataApply(t *testing.T) {
+	md := NewMetadata()
+	t0 := time.Now()
+	stored := func(node, sum string, at time.Time) metaOp {
+		return metaOp{Op: opStored, UserID: "alice", Name: "a.txt", Node: node, Checksum: sum, Size: 1, Modified: at}
+	}
+	replicas := func() []string {
+		r, _ := md.Lookup("alice", "a.txt")
+		return r.Replicas
+	}
+
+	applyOps(md, stored("s2", "v1", t0), stored("s1", "v1", t0.Add(time.Second)))
+	if got := replicas(); !slices.Equal(got, []string{"s1", "s2"}) {
+		t.Fatalf("replicas %v", got)
+	}
+
+	// A newer version starts over; an older one reported late is ignored.
+	applyOps(md, stored("s3", "v2", t0.Add(time.Minute)), stored("s1", "v1", t0.Add(2*time.Second)))
+	if r, _ := md.Lookup("alice", "a.txt"); r.Checksum != "v2" || !slices.Equal(r.Replicas, []string{"s3"}) {
+		t.Fatalf("have %+v", r)
+	}
+
+	// Dropping names the version, so a stale drop does nothing.
+	applyOps(md, metaOp{Op: opDropped, UserID: "alice", Name: "a.txt", Node: "s3", Checksum: "v1"})
+	if got := replicas(); len(got) != 1 {
+		t.Fatalf("stale drop removed a replica: %v", got)
+	}
+	applyOps(md, metaOp{Op: opDropped, UserID: "alice", Name: "a.txt", Node: "s3", Checksum: "v2"})
+	if st := md.Stats(); st.Lost != 1 {
+		t.Fatalf("stats %+v", st)
+	}
+
+	// A delete sticks against copies written before it, not after.
+	applyOps(md,
+		metaOp{Op: opDeleted, UserID: "alice", Name: "a.txt", Modified: t0.Add(time.Hour)},
+		stored("s1", "v2", t0.Add(time.Minute)))
+	if r, _ := md.Lookup("alice", "a.txt"); !r.Deleted || len(r.Replicas) != 0 {
+		t.Fatalf("have %+v", r)
+	}
+	applyOps(md, stored("s2", "v3", t0.Add(2*time.Hour)))
+	if r, _ := md.Lookup("alice", "a.txt"); r.Deleted || r.Checksum != "v3" {
+		t.Fatalf("have %+v", r)
+	}
+
+	snap, err := md.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := NewMetadata()
+	if err := restored.Restore(snap); err != nil {
+		t.Fatal(err)
+	}
+	if r, ok := restored.Lookup("alice", "a.txt"); !ok || r.Checksum != "v3" || !slices.Equal(r.Replicas, []string{"s2"}) {
+		t.Fatalf("restored %+v", r)
+	}
+}
+
+func TestPlacementIsStable(t *testing.T) {
+	nodes := []string{"s1", "s2", "s3", "s4"}
+	first := placement("alice", "a.txt", nodes, 2)
+	if len(first) != 2 {
+		t.Fatalf("placed on %v", first)
+	}
+	reversed := slices.Clone(nodes)
+	slices.Reverse(reversed)
+	if again := placement("alice", "a.txt", reversed, 2); !slices.Equal(first, again) {
+		t.Errorf("placed on %v, then %v", first, again)
+	}
+	if all := placement("alice", "a.txt", nodes[:1], 2); !slices.Equal(all, nodes[:1]) {
+		t.Errorf("placed on %v", all)
+	}
+}
+
+// startMetadataCluster starts three connected nodes keeping the log, and
+// waits for one to lead.
+func startMetadataCluster(t *testing.T) []*FileServer {
+	ids := []string{"s1", "s2", "s3"}
+	var servers []*FileServer
+	var addrs []string
+	for _, id := range ids {
+		s := newTestServer(t, id, newTestKeyManager(t), addrs...)
+		var peers []string
+		for _, other := range ids {
+			if other != id {
+				peers = append(peers, other)
+			}
+		}
+		if err := s.openMetadata(peers); err != nil {
+			t.Fatal(err)
+		}
+		go s.Start()
+		t.Cleanup(s.Stop)
+		servers = append(servers, s)
+		addrs = append(addrs, s.Transport.Addr())
+		time.Sleep(20 * time.Millisecond)
+	}
+	waitFor(t, "all nodes to connect", func() bool {
+		for _, s := range servers {
+			if len(s.peerList()) != 2 {
+				return false
+			}
+		}
+		return true
+	})
+	waitFor(t, "a leader", func() bool {
+		for _, s := range servers {
+			if s.Metadata().IsLeader() {
+				return true
+			}
+		}
+		return false
+	})
+	return servers
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestReconcileMetadata(t *testing.T) {
+	servers := startMetadataCluster(t)
+	s1 := servers[0]
+	ctx := context.Background()
+
+	reconcileAll := func() {
+		for _, s := range servers {
+			if _, err := s.ReconcileMetadata(ctx); err != nil {
+				t.Fatalf("%s: %v", s.ID, err)
+			}
+		}
+	}
+	// Followers apply the log a little after the leader, so like the sync
+	// loop this reconciles again until every node's map agrees.
+	settle := func(what string, cond func(r FileRecord) bool) {
+		t.Helper()
+		waitFor(t, what, func() bool {
+			reconcileAll()
+			for _, s := range servers {
+				if r, _ := s.Metadata().Lookup("alice", "a.txt"); !cond(r) {
+					return false
+				}
+			}
+			return true
+		})
+	}
+	holders := func() []string {
+		var ids []string
+		for _, s := range servers {
+			if s.HasFile("alice", "a.txt") {
+				ids = append(ids, s.ID)
+			}
+		}
+		return ids
+	}
+
+	data := bytes.Repeat([]byte("kept by the cluster "), 1000)
+	m, err := s1.WriteFile("alice", "a.txt", bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// One more node fetched it, and every node's map says which.
+	settle("a second replica", func(r FileRecord) bool {
+		return len(r.Replicas) == ReplicationFactor && slices.Equal(r.Replicas, holders())
+	})
+	for _, s := range servers {
+		if got, err := s.StatFile("alice", "a.txt"); err == nil &&
+			(got.Checksum != m.Checksum || !got.Modified.Equal(m.Modified)) {
+			t.Errorf("%s has a different version: %+v", s.ID, got)
+		}
+	}
+
+	// A node that lost its copy is taken off the map, and the file is
+	// copied again to make up for it.
+	other := holders()[1]
+	for _, s := range servers {
+		if s.ID == other {
+			if err := s.manifests.Delete("alice", "a.txt"); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	settle("the file to be re-replicated", func(r FileRecord) bool {
+		return len(r.Replicas) == ReplicationFactor && slices.Equal(r.Replicas, holders())
+	})
+
+	// A delete reaches the copies made since, even without being sent
+	// to each node.
+	s1.RecordDelete("alice", "a.txt")
+	settle("the delete to be recorded", func(r FileRecord) bool { return r.Deleted })
+	reconcileAll()
+	if got := holders(); len(got) != 0 {
+		t.Errorf("deleted file still on %v", got)
+	}
+}
+
+func TestTrimReplicas(t *testing.T) {
+	servers := startMetadataCluster(t)
+	ctx := context.Background()
+	modified := time.Now()
+	for _, name := range []string{"a.txt", "b.txt"} {
+		for _, s := range servers {
+			if _, err := s.writeFile("alice", name, bytes.NewReader([]byte("everywhere")), modified); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// Writes are recorded in the background, and one that misses a leader
+	// is left to the next reconcile, so reconcile until they're all in.
+	waitFor(t, "every copy to be recorded", func() bool {
+		for _, s := range servers {
+			if _, err := s.ReconcileMetadata(ctx); err != nil {
+				t.Fatalf("%s: %v", s.ID, err)
+			}
+		}
+		for _, s := range servers {
+			for _, name := range []string{"a.txt", "b.txt"} {
+				if r, _ := s.Metadata().Lookup("alice", name); len(r.Replicas) != 3 {
+					return false
+				}
+			}
+		}
+		return true
+	})
+	holders := func(name string) []string {
+		var ids []string
+		for _, s := range servers {
+			if s.HasFile("alice", name) {
+				ids = append(ids, s.ID)
+			}
+		}
+		return ids
+	}
+	ids := []string{"s1", "s2", "s3"}
+
+	// The node placement ranks first for b.txt lost its copy without
+	// telling anyone, so it can't count as one of the two kept.
+	ranked := placement("alice", "b.txt", ids, 3)
+	for _, s := range servers {
+		if s.ID == ranked[0] {
+			if err := s.manifests.Delete("alice", "b.txt"); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	var leader *FileServer
+	waitFor(t, "a leader", func() bool {
+		for _, s := range servers {
+			if s.Metadata().IsLeader() {
+				leader = s
+			}
+		}
+		return leader != nil
+	})
+	if _, err := leader.TrimReplicas(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	want := placement("alice", "a.txt", ids, 2)
+	slices.Sort(want)
+	if got := holders("a.txt"); !slices.Equal(got, want) {
+		t.Errorf("a.txt kept on %v, want %v", got, want)
+	}
+	want = slices.Clone(ranked[1:])
+	slices.Sort(want)
+	if got := holders("b.txt"); !slices.Equal(got, want) {
+		t.Errorf("b.txt kept on %v, want %v", got, want)
+	}
+	waitFor(t, "the removed copies to be dropped from the map", func() bool {
+		r, _ := leader.Metadata().Lookup("alice", "a.txt")
+		return slices.Equal(r.Replicas, holders("a.txt"))
+	})
+}
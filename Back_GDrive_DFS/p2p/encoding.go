@@ -1,41 +1,96 @@
 package p2p
 
 import (
-	"encoding/gob"
+	"encoding/binary"
+	"fmt"
 	"io"
 )
 
-type Decoder interface {
-	Decode(io.Reader, *RPC) error
-}
+// Every frame on a connection starts with a fixed header:
+//
+//	type (1) | flags (1) | stream id (4) | length (4)
+//
+// followed by length bytes of payload. Messages travel whole in a single
+// frame on stream 0; streams are carried as data frames that the peer
+// reassembles per stream id, so many transfers share one connection.
+// Requests, responses and cancels also use stream 0 and carry their call id
+// in the payload, see rpc.go. Pings are answered with a pong echoing their
+// payload.
+const (
+	FrameMessage      byte = 0x1
+	FrameData         byte = 0x2
+	FrameWindowUpdate byte = 0x3
+	FrameRequest      byte = 0x4
+	FrameResponse     byte = 0x5
+	FrameCancel       byte = 0x6
+	FramePing         byte = 0x7
+	FramePong         byte = 0x8
+)
+
+// Flags on data frames.
+const (
+	FlagSYN byte = 1 << 0 // first frame of a new stream
+	FlagFIN byte = 1 << 1 // sender will write no more on the stream
+	FlagRST byte = 1 << 2 // stream aborted
+)
 
-type GOBDecoder struct{}
+const (
+	frameHeaderSize = 10
+	// MaxFramePayload bounds a single frame, and so a single message.
+	MaxFramePayload = 16 << 20
+)
 
-func (dec GOBDecoder) Decode(r io.Reader, msg *RPC) error {
-	return gob.NewDecoder(r).Decode(msg)
+type Frame struct {
+	Type     byte
+	Flags    byte
+	StreamID uint32
+	Payload  []byte
 }
 
+type Decoder interface {
+	Decode(io.Reader, *Frame) error
+}
+
+// DefaultDecoder reads one frame, however the bytes were split across TCP
+// reads.
 type DefaultDecoder struct{}
 
-func (dec DefaultDecoder) Decode(r io.Reader, msg *RPC) error {
-	peekBuf := make([]byte, 1)
-	if _, err := r.Read(peekBuf); err != nil {
-		return nil
+func (dec DefaultDecoder) Decode(r io.Reader, f *Frame) error {
+	var hdr [frameHeaderSize]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return err
 	}
 
-	stream := peekBuf[0] == IncomingStream
-	if stream {
-		msg.Stream = true
-		return nil
+	f.Type = hdr[0]
+	f.Flags = hdr[1]
+	f.StreamID = binary.BigEndian.Uint32(hdr[2:6])
+	size := binary.BigEndian.Uint32(hdr[6:10])
+	if size > MaxFramePayload {
+		return fmt.Errorf("p2p: frame of %d bytes exceeds limit", size)
 	}
 
-	buf := make([]byte, 1028)
-	n, err := r.Read(buf)
-	if err != nil {
+	f.Payload = make([]byte, size)
+	if _, err := io.ReadFull(r, f.Payload); err != nil {
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
 		return err
 	}
-
-	msg.Payload = buf[:n]
-
 	return nil
 }
+
+// EncodeFrame writes f with a single Write, so frames written under a lock
+// never interleave.
+func EncodeFrame(w io.Writer, f *Frame) error {
+	if len(f.Payload) > MaxFramePayload {
+		return fmt.Errorf("p2p: frame of %d bytes exceeds limit", len(f.Payload))
+	}
+	buf := make([]byte, frameHeaderSize+len(f.Payload))
+	buf[0] = f.Type
+	buf[1] = f.Flags
+	binary.BigEndian.PutUint32(buf[2:6], f.StreamID)
+	binary.BigEndian.PutUint32(buf[6:10], uint32(len(f.Payload)))
+	copy(buf[frameHeaderSize:], f.Payload)
+	_, err := w.Write(buf)
+	return err
+}
@@ -1,5 +1,110 @@
 package p2p
 
-type HandshakeFunc func(Peer) error
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"time"
+)
 
-func NOPHandshakeFunc(Peer) error { return nil }
+// ProtocolVersion is the wire protocol this package speaks. Peers accept
+// anything from MinProtocolVersion up to their own version.
+const (
+	ProtocolVersion    uint16 = 1
+	MinProtocolVersion uint16 = 1
+)
+
+// Features a node can advertise in its hello.
+const (
+	FeatureStreams = "streams"
+)
+
+const (
+	handshakeTimeout = 10 * time.Second
+	maxHelloSize     = 16 * 1024
+)
+
+var (
+	ErrIncompatibleVersion = errors.New("p2p: incompatible protocol version")
+	ErrMissingNodeID       = errors.New("p2p: peer did not send a node id")
+)
+
+// PeerInfo is what a node says about itself in the handshake.
+type PeerInfo struct {
+	NodeID     string
+	Version    uint16
+	ListenAddr string
+	Features   []string
+}
+
+func (i PeerInfo) Supports(feature string) bool {
+	return slices.Contains(i.Features, feature)
+}
+
+// HandshakeFunc runs on a new connection before any frames are exchanged.
+// local is this node's hello; it returns what the remote said about itself.
+type HandshakeFunc func(conn net.Conn, local PeerInfo) (PeerInfo, error)
+
+func NOPHandshakeFunc(net.Conn, PeerInfo) (PeerInfo, error) { return PeerInfo{}, nil }
+
+// HelloHandshakeFunc swaps hellos with the remote, both sides writing at once,
+// and rejects peers with no node id or a version outside what we support.
+func HelloHandshakeFunc(conn net.Conn, local PeerInfo) (PeerInfo, error) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	local.Version = ProtocolVersion
+	errc := make(chan error, 1)
+	go func() {
+		errc <- writeHello(conn, &local)
+	}()
+
+	var remote PeerInfo
+	if err := readHello(conn, &remote); err != nil {
+		return PeerInfo{}, err
+	}
+	if err := <-errc; err != nil {
+		return PeerInfo{}, err
+	}
+	if remote.Version < MinProtocolVersion || remote.Version > ProtocolVersion {
+		return remote, fmt.Errorf("%w: %s speaks %d, we support %d-%d",
+			ErrIncompatibleVersion, remote.NodeID, remote.Version, MinProtocolVersion, ProtocolVersion)
+	}
+	if remote.NodeID == "" {
+		return remote, ErrMissingNodeID
+	}
+
+	return remote, nil
+}
+
+func writeHello(conn net.Conn, info *PeerInfo) error {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(info); err != nil {
+		return err
+	}
+	if err := binary.Write(conn, binary.BigEndian, uint32(buf.Len())); err != nil {
+		return err
+	}
+	_, err := conn.Write(buf.Bytes())
+	return err
+}
+
+func readHello(conn net.Conn, info *PeerInfo) error {
+	var size uint32
+	if err := binary.Read(conn, binary.BigEndian, &size); err != nil {
+		return err
+	}
+	if size > maxHelloSize {
+		return fmt.Errorf("p2p: hello of %d bytes is too large", size)
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return err
+	}
+	return gob.NewDecoder(bytes.NewReader(buf)).Decode(info)
+}
@@ -0,0 +1,163 @@
+package p2p
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"time"
+)
+
+const (
+	DefaultKeepaliveInterval = 15 * time.Second
+	DefaultIdleTimeout       = 45 * time.Second
+	DefaultReconnectMin      = 500 * time.Millisecond
+	DefaultReconnectMax      = 30 * time.Second
+
+	dialTimeout = 10 * time.Second
+)
+
+type PeerEventType int
+
+const (
+	// PeerConnected: the handshake succeeded and OnPeer accepted the peer.
+	PeerConnected PeerEventType = iota
+	// PeerDisconnected: a connected peer's connection died.
+	PeerDisconnected
+	// PeerReconnecting: a persistent dial is about to wait Delay and retry.
+	PeerReconnecting
+)
+
+func (t PeerEventType) String() string {
+	switch t {
+	case PeerConnected:
+		return "connected"
+	case PeerDisconnected:
+		return "disconnected"
+	case PeerReconnecting:
+		return "reconnecting"
+	}
+	return fmt.Sprintf("PeerEventType(%d)", int(t))
+}
+
+// PeerEvent reports a change in a peer's connection. Peer is nil for
+// reconnecting events, which are about an address rather than a connection.
+type PeerEvent struct {
+	Type    PeerEventType
+	Peer    Peer
+	Addr    string
+	Err     error
+	Attempt int
+	Delay   time.Duration
+}
+
+func (t *TCPTransport) emit(ev PeerEvent) {
+	if t.OnPeerEvent != nil {
+		t.OnPeerEvent(ev)
+	}
+}
+
+// DialPersistent keeps a connection to addr up until the transport closes,
+// redialing with exponential backoff whenever it drops. Once we know which
+// node lives at addr we stop dialing while it is connected to us the other
+// way round.
+func (t *TCPTransport) DialPersistent(addr string) {
+	go t.redialLoop(addr)
+}
+
+func (t *TCPTransport) redialLoop(addr string) {
+	var (
+		nodeID  string
+		attempt int
+	)
+
+	for {
+		if nodeID != "" && t.connectedTo(nodeID) {
+			attempt = 0
+			if !t.sleep(t.ReconnectMax) {
+				return
+			}
+			continue
+		}
+
+		var err error
+		var conn net.Conn
+		if conn, err = net.DialTimeout("tcp", addr, dialTimeout); err == nil {
+			var peer *TCPPeer
+			peer, err = t.handleConn(conn, true)
+			if peer != nil && peer.info.NodeID != "" {
+				nodeID = peer.info.NodeID
+			}
+			if peer != nil && peer.accepted {
+				attempt = 0
+			}
+		}
+
+		select {
+		case <-t.quitch:
+			return
+		default:
+		}
+
+		attempt++
+		delay := backoff(attempt, t.ReconnectMin, t.ReconnectMax)
+		log.Printf("[%s] reconnecting to %s in %s (attempt %d): %v", t.ListenAddr, addr, delay, attempt, err)
+		t.emit(PeerEvent{Type: PeerReconnecting, Addr: addr, Err: err, Attempt: attempt, Delay: delay})
+		if !t.sleep(delay) {
+			return
+		}
+	}
+}
+
+// backoff doubles from lo on each attempt, up to hi.
+func backoff(attempt int, lo, hi time.Duration) time.Duration {
+	d := lo
+	for i := 1; i < attempt && d < hi; i++ {
+		d *= 2
+	}
+	return min(d, hi)
+}
+
+// sleep waits d, reporting false if the transport closed meanwhile.
+func (t *TCPTransport) sleep(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-t.quitch:
+		return false
+	}
+}
+
+func (t *TCPTransport) connectedTo(nodeID string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for p := range t.peers {
+		if p.info.NodeID == nodeID {
+			return true
+		}
+	}
+	return false
+}
+
+// keepalive pings the peer so that an otherwise quiet connection still
+// sees traffic inside the idle timeout. A dead one is caught by the read
+// deadline instead.
+func (p *TCPPeer) keepalive(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var seq uint64
+	for {
+		select {
+		case <-ticker.C:
+			seq++
+			if err := p.writeFrame(&Frame{Type: FramePing, Payload: binary.BigEndian.AppendUint64(nil, seq)}); err != nil {
+				return
+			}
+		case <-p.closed:
+			return
+		}
+	}
+}
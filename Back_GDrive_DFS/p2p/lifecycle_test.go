@@ -0,0 +1,117 @@
+package p2p
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackoff(t *testing.T) {
+	lo, hi := 100*time.Millisecond, time.Second
+	assert.Equal(t, lo, backoff(1, lo, hi))
+	assert.Equal(t, 200*time.Millisecond, backoff(2, lo, hi))
+	assert.Equal(t, 800*time.Millisecond, backoff(4, lo, hi))
+	assert.Equal(t, hi, backoff(5, lo, hi))
+	assert.Equal(t, hi, backoff(50, lo, hi))
+}
+
+// eventLog collects a transport's peer events.
+type eventLog chan PeerEvent
+
+func (l eventLog) record(ev PeerEvent) { l <- ev }
+
+func (l eventLog) wait(t *testing.T, typ PeerEventType) PeerEvent {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case ev := <-l:
+			if ev.Type == typ {
+				return ev
+			}
+		case <-timeout:
+			t.Fatalf("no %s event", typ)
+		}
+	}
+}
+
+func TestDialPersistentReconnects(t *testing.T) {
+	serverEvents := make(eventLog, 16)
+	server := NewTCPTransport(TCPTransportOpts{
+		ListenAddr:    "127.0.0.1:0",
+		NodeID:        "s1",
+		HandshakeFunc: HelloHandshakeFunc,
+		Decoder:       DefaultDecoder{},
+		OnPeerEvent:   serverEvents.record,
+	})
+	assert.Nil(t, server.ListenAndAccept())
+	t.Cleanup(func() { server.Close() })
+
+	clientEvents := make(eventLog, 16)
+	client := NewTCPTransport(TCPTransportOpts{
+		NodeID:        "s2",
+		HandshakeFunc: HelloHandshakeFunc,
+		Decoder:       DefaultDecoder{},
+		OnPeerEvent:   clientEvents.record,
+		ReconnectMin:  10 * time.Millisecond,
+		ReconnectMax:  50 * time.Millisecond,
+	})
+	t.Cleanup(func() { client.Close() })
+	client.DialPersistent(server.listener.Addr().String())
+
+	ev := clientEvents.wait(t, PeerConnected)
+	assert.Equal(t, "s1", ev.Peer.Info().NodeID)
+
+	// Kill the connection from the server's side.
+	serverEvents.wait(t, PeerConnected).Peer.Close()
+
+	ev = clientEvents.wait(t, PeerDisconnected)
+	assert.Equal(t, "s1", ev.Peer.Info().NodeID)
+	ev = clientEvents.wait(t, PeerReconnecting)
+	assert.Equal(t, 1, ev.Attempt)
+	clientEvents.wait(t, PeerConnected)
+}
+
+func TestIdleTimeout(t *testing.T) {
+	events := make(eventLog, 16)
+	server := NewTCPTransport(TCPTransportOpts{
+		ListenAddr:    "127.0.0.1:0",
+		HandshakeFunc: NOPHandshakeFunc,
+		Decoder:       DefaultDecoder{},
+		OnPeerEvent:   events.record,
+		IdleTimeout:   100 * time.Millisecond,
+	})
+	assert.Nil(t, server.ListenAndAccept())
+	t.Cleanup(func() { server.Close() })
+
+	// A peer that connects and then goes silent.
+	conn, err := net.Dial("tcp", server.listener.Addr().String())
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	events.wait(t, PeerConnected)
+	ev := events.wait(t, PeerDisconnected)
+	var nerr net.Error
+	assert.ErrorAs(t, ev.Err, &nerr)
+	assert.True(t, nerr.Timeout())
+}
+
+func TestKeepaliveHoldsQuietConnection(t *testing.T) {
+	events := make(eventLog, 16)
+	opts := TCPTransportOpts{
+		HandshakeFunc:     NOPHandshakeFunc,
+		OnPeerEvent:       events.record,
+		KeepaliveInterval: 20 * time.Millisecond,
+		IdleTimeout:       100 * time.Millisecond,
+	}
+	_, peer, err := connect(t, opts, opts)
+	assert.Nil(t, err)
+
+	time.Sleep(400 * time.Millisecond)
+	for len(events) > 0 {
+		assert.NotEqual(t, PeerDisconnected, (<-events).Type)
+	}
+	assert.Nil(t, peer.Send([]byte("still here")))
+}
@@ -1,12 +1,10 @@
 package p2p
 
-const (
-	IncomingMessage = 0x1
-	IncomingStream  = 0x2
-)
-
+// RPC is something a peer sent us: a whole message in Payload, a stream it
+// opened, which the receiver reads until EOF, or a request to answer.
 type RPC struct {
 	From    string
 	Payload []byte
-	Stream  bool
+	Stream  Stream
+	Request *Request
 }
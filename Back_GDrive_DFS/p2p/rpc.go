@@ -0,0 +1,216 @@
+package p2p
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Calls are matched to their responses by a call id chosen by the caller.
+// Frame payloads:
+//
+//	request:  call id (8) | deadline, unix nanos or 0 (8) | method length (2) | method | body
+//	response: call id (8) | status (1) | body, or the error text if status is 1
+//	cancel:   call id (8)
+//
+// The deadline travels with the request so the remote can give up when the
+// caller will. A caller whose context ends sends a cancel.
+const (
+	responseOK    byte = 0
+	responseError byte = 1
+)
+
+var errMalformedCall = errors.New("p2p: malformed request or response")
+
+// RemoteError is an error the remote's handler returned for a call.
+type RemoteError struct {
+	Method  string
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("p2p: %s failed on peer: %s", e.Method, e.Message)
+}
+
+type callResult struct {
+	body []byte
+	err  error
+}
+
+// Request is a call a peer made to us. The handler must Respond exactly
+// once; its context ends when the caller gives up or the peer goes away.
+type Request struct {
+	Method  string
+	Payload []byte
+
+	id     uint64
+	peer   *TCPPeer
+	ctx    context.Context
+	cancel context.CancelFunc
+	once   sync.Once
+}
+
+func (r *Request) Context() context.Context {
+	return r.ctx
+}
+
+// Respond sends body back to the caller, or err if it is non-nil.
+func (r *Request) Respond(body []byte, err error) error {
+	sent := false
+	r.once.Do(func() { sent = true })
+	if !sent {
+		return errors.New("p2p: request already answered")
+	}
+
+	r.peer.mu.Lock()
+	delete(r.peer.inbound, r.id)
+	r.peer.mu.Unlock()
+	r.cancel()
+
+	payload := binary.BigEndian.AppendUint64(nil, r.id)
+	if err != nil {
+		payload = append(payload, responseError)
+		payload = append(payload, err.Error()...)
+	} else {
+		payload = append(payload, responseOK)
+		payload = append(payload, body...)
+	}
+	return r.peer.writeFrame(&Frame{Type: FrameResponse, Payload: payload})
+}
+
+// Call sends a request to the peer and waits for its response until ctx is
+// done. An error from the remote handler comes back as a *RemoteError.
+func (p *TCPPeer) Call(ctx context.Context, method string, body []byte) ([]byte, error) {
+	if len(method) > 0xffff {
+		return nil, fmt.Errorf("p2p: method name too long")
+	}
+
+	ch := make(chan callResult, 1)
+	p.mu.Lock()
+	select {
+	case <-p.closed:
+		p.mu.Unlock()
+		return nil, ErrPeerClosed
+	default:
+	}
+	p.nextCall++
+	id := p.nextCall
+	p.calls[id] = ch
+	p.mu.Unlock()
+
+	var deadline int64
+	if d, ok := ctx.Deadline(); ok {
+		deadline = d.UnixNano()
+	}
+	payload := binary.BigEndian.AppendUint64(nil, id)
+	payload = binary.BigEndian.AppendUint64(payload, uint64(deadline))
+	payload = binary.BigEndian.AppendUint16(payload, uint16(len(method)))
+	payload = append(payload, method...)
+	payload = append(payload, body...)
+
+	if err := p.writeFrame(&Frame{Type: FrameRequest, Payload: payload}); err != nil {
+		p.dropCall(id)
+		return nil, err
+	}
+
+	select {
+	case res := <-ch:
+		if re, ok := res.err.(*RemoteError); ok {
+			re.Method = method
+		}
+		return res.body, res.err
+	case <-ctx.Done():
+		if p.dropCall(id) {
+			p.writeFrame(&Frame{Type: FrameCancel, Payload: binary.BigEndian.AppendUint64(nil, id)})
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// dropCall forgets a pending call, reporting whether it was still waiting.
+func (p *TCPPeer) dropCall(id uint64) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, ok := p.calls[id]
+	delete(p.calls, id)
+	return ok
+}
+
+func (p *TCPPeer) handleRequest(payload []byte) (*RPC, error) {
+	if len(payload) < 18 {
+		return nil, errMalformedCall
+	}
+	id := binary.BigEndian.Uint64(payload[0:8])
+	deadline := int64(binary.BigEndian.Uint64(payload[8:16]))
+	n := int(binary.BigEndian.Uint16(payload[16:18]))
+	if len(payload) < 18+n {
+		return nil, errMalformedCall
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if deadline != 0 {
+		cancel()
+		ctx, cancel = context.WithDeadline(context.Background(), time.Unix(0, deadline))
+	}
+	req := &Request{
+		Method:  string(payload[18 : 18+n]),
+		Payload: payload[18+n:],
+		id:      id,
+		peer:    p,
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+
+	p.mu.Lock()
+	if _, dup := p.inbound[id]; dup {
+		p.mu.Unlock()
+		cancel()
+		return nil, fmt.Errorf("p2p: duplicate call id %d from peer", id)
+	}
+	p.inbound[id] = req
+	p.mu.Unlock()
+
+	return &RPC{Request: req}, nil
+}
+
+func (p *TCPPeer) handleResponse(payload []byte) error {
+	if len(payload) < 9 {
+		return errMalformedCall
+	}
+	id := binary.BigEndian.Uint64(payload[0:8])
+
+	p.mu.Lock()
+	ch, ok := p.calls[id]
+	delete(p.calls, id)
+	p.mu.Unlock()
+
+	// The caller may have given up already.
+	if !ok {
+		return nil
+	}
+	body := payload[9:]
+	if payload[8] == responseError {
+		ch <- callResult{err: &RemoteError{Message: string(body)}}
+	} else {
+		ch <- callResult{body: body}
+	}
+	return nil
+}
+
+func (p *TCPPeer) handleCancel(payload []byte) error {
+	if len(payload) != 8 {
+		return errMalformedCall
+	}
+	id := binary.BigEndian.Uint64(payload)
+
+	p.mu.Lock()
+	req := p.inbound[id]
+	p.mu.Unlock()
+	if req != nil {
+		req.cancel()
+	}
+	return nil
+}
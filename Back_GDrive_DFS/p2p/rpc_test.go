@@ -0,0 +1,132 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// serve answers requests arriving at tr with handle until the test ends.
+func serve(t *testing.T, tr Transport, handle func(*Request) ([]byte, error)) {
+	done := make(chan struct{})
+	t.Cleanup(func() { close(done) })
+	go func() {
+		for {
+			select {
+			case rpc := <-tr.Consume():
+				if rpc.Request != nil {
+					go func(req *Request) {
+						body, err := handle(req)
+						req.Respond(body, err)
+					}(rpc.Request)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+}
+
+func TestCall(t *testing.T) {
+	server, peer := connectedPair(t)
+	serve(t, server, func(req *Request) ([]byte, error) {
+		switch req.Method {
+		case "echo":
+			return req.Payload, nil
+		case "slow":
+			// Answer out of order, after later calls.
+			time.Sleep(50 * time.Millisecond)
+			return append([]byte("slow "), req.Payload...), nil
+		}
+		return nil, fmt.Errorf("no chunk %s", req.Payload)
+	})
+	ctx := context.Background()
+
+	body, err := peer.Call(ctx, "echo", []byte("ping"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("ping"), body)
+
+	_, err = peer.Call(ctx, "get", []byte("abc"))
+	var remote *RemoteError
+	assert.True(t, errors.As(err, &remote))
+	assert.Equal(t, "get", remote.Method)
+	assert.Equal(t, "no chunk abc", remote.Message)
+
+	// Concurrent calls each get their own answer.
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			method := "echo"
+			want := fmt.Sprint(i)
+			if i%2 == 0 {
+				method = "slow"
+				want = "slow " + want
+			}
+			body, err := peer.Call(ctx, method, []byte(fmt.Sprint(i)))
+			assert.Nil(t, err)
+			assert.Equal(t, want, string(body))
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestCallDeadlineAndCancel(t *testing.T) {
+	server, peer := connectedPair(t)
+	cancelled := make(chan error, 1)
+	serve(t, server, func(req *Request) ([]byte, error) {
+		// Never answer on our own; wait for the caller to give up.
+		<-req.Context().Done()
+		cancelled <- req.Context().Err()
+		return nil, req.Context().Err()
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := peer.Call(ctx, "hang", nil)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	select {
+	case err := <-cancelled:
+		assert.ErrorIs(t, err, context.DeadlineExceeded, "deadline travels with the request")
+	case <-time.After(5 * time.Second):
+		t.Fatal("remote handler never saw the deadline")
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	_, err = peer.Call(ctx, "hang", nil)
+	assert.ErrorIs(t, err, context.Canceled)
+	select {
+	case err := <-cancelled:
+		assert.ErrorIs(t, err, context.Canceled, "cancel is sent to the remote")
+	case <-time.After(5 * time.Second):
+		t.Fatal("remote handler was not cancelled")
+	}
+}
+
+func TestCallFailsWhenPeerCloses(t *testing.T) {
+	server, peer := connectedPair(t)
+	serve(t, server, func(req *Request) ([]byte, error) {
+		<-req.Context().Done()
+		return nil, nil
+	})
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		peer.Close()
+	}()
+	_, err := peer.Call(context.Background(), "hang", nil)
+	assert.ErrorIs(t, err, ErrPeerClosed)
+
+	_, err = peer.Call(context.Background(), "echo", nil)
+	assert.ErrorIs(t, err, ErrPeerClosed)
+}
@@ -0,0 +1,232 @@
+package p2p
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+)
+
+// Streams get flow control so that a reader who falls behind only holds up
+// its own stream: a sender may have at most a window's worth of unread data
+// in flight, and the receiver hands out more as it reads. The connection's
+// read loop therefore never blocks on a stream.
+const (
+	initialWindow = 256 * 1024
+	maxDataFrame  = 32 * 1024
+)
+
+var (
+	ErrStreamReset  = errors.New("p2p: stream reset")
+	ErrStreamClosed = errors.New("p2p: write on closed stream")
+	ErrPeerClosed   = errors.New("p2p: peer connection closed")
+)
+
+// Stream is one logical connection multiplexed over a peer. Close ends the
+// write side only; the remote can still send until it closes too. Reset
+// aborts the stream in both directions.
+type Stream interface {
+	io.ReadWriteCloser
+	ID() uint32
+	Reset() error
+}
+
+type stream struct {
+	id   uint32
+	peer *TCPPeer
+
+	mu          sync.Mutex
+	recvBuf     bytes.Buffer
+	recvUnacked uint32 // read by the application but not yet credited back
+	sendWindow  uint32
+	localFIN    bool
+	remoteFIN   bool
+	err         error
+	writeErr    error
+
+	readReady  chan struct{}
+	writeReady chan struct{}
+}
+
+func newStream(id uint32, peer *TCPPeer) *stream {
+	return &stream{
+		id:         id,
+		peer:       peer,
+		sendWindow: initialWindow,
+		readReady:  make(chan struct{}, 1),
+		writeReady: make(chan struct{}, 1),
+	}
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+func (s *stream) ID() uint32 {
+	return s.id
+}
+
+func (s *stream) Read(p []byte) (int, error) {
+	for {
+		s.mu.Lock()
+		if s.recvBuf.Len() > 0 {
+			n, _ := s.recvBuf.Read(p)
+			s.recvUnacked += uint32(n)
+			var credit uint32
+			if s.recvUnacked >= initialWindow/2 {
+				credit, s.recvUnacked = s.recvUnacked, 0
+			}
+			s.mu.Unlock()
+
+			if credit > 0 {
+				s.peer.sendWindowUpdate(s.id, credit)
+			}
+			return n, nil
+		}
+		if s.err != nil {
+			err := s.err
+			s.mu.Unlock()
+			return 0, err
+		}
+		if s.remoteFIN {
+			s.mu.Unlock()
+			return 0, io.EOF
+		}
+		s.mu.Unlock()
+
+		<-s.readReady
+	}
+}
+
+func (s *stream) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		s.mu.Lock()
+		if s.err != nil {
+			err := s.err
+			s.mu.Unlock()
+			return written, err
+		}
+		if s.writeErr != nil {
+			err := s.writeErr
+			s.mu.Unlock()
+			return written, err
+		}
+		if s.localFIN {
+			s.mu.Unlock()
+			return written, ErrStreamClosed
+		}
+		if s.sendWindow == 0 {
+			s.mu.Unlock()
+			<-s.writeReady
+			continue
+		}
+
+		n := min(len(p), int(s.sendWindow), maxDataFrame)
+		s.sendWindow -= uint32(n)
+		s.mu.Unlock()
+
+		if err := s.peer.writeFrame(&Frame{Type: FrameData, StreamID: s.id, Payload: p[:n]}); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (s *stream) Close() error {
+	s.mu.Lock()
+	if s.localFIN || s.err != nil {
+		s.mu.Unlock()
+		return nil
+	}
+	s.localFIN = true
+	done := s.remoteFIN
+	s.mu.Unlock()
+
+	err := s.peer.writeFrame(&Frame{Type: FrameData, Flags: FlagFIN, StreamID: s.id})
+	if done {
+		s.peer.removeStream(s.id)
+	}
+	return err
+}
+
+func (s *stream) Reset() error {
+	if !s.fail(ErrStreamReset) {
+		return nil
+	}
+	s.peer.removeStream(s.id)
+	return s.peer.writeFrame(&Frame{Type: FrameData, Flags: FlagRST, StreamID: s.id})
+}
+
+// fail ends the stream with err, dropping anything unread. It reports
+// whether the stream was still open.
+func (s *stream) fail(err error) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return false
+	}
+	s.err = err
+	s.recvBuf.Reset()
+	notify(s.readReady)
+	notify(s.writeReady)
+	return true
+}
+
+// peerClosed wakes everyone up once the connection is gone. Data already
+// received, up to a FIN, can still be read.
+func (s *stream) peerClosed() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.writeErr = ErrPeerClosed
+	if s.err == nil && !s.remoteFIN {
+		s.err = ErrPeerClosed
+	}
+	notify(s.readReady)
+	notify(s.writeReady)
+}
+
+// receive handles a data frame for the stream from the read loop.
+func (s *stream) receive(f *Frame) error {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return nil
+	}
+	if len(f.Payload) > 0 {
+		if s.remoteFIN || uint32(s.recvBuf.Len())+s.recvUnacked+uint32(len(f.Payload)) > initialWindow {
+			s.mu.Unlock()
+			return s.Reset()
+		}
+		s.recvBuf.Write(f.Payload)
+	}
+	done := false
+	if f.Flags&FlagFIN != 0 {
+		s.remoteFIN = true
+		done = s.localFIN
+	}
+	notify(s.readReady)
+	s.mu.Unlock()
+
+	if done {
+		s.peer.removeStream(s.id)
+	}
+	return nil
+}
+
+func (s *stream) addCredit(n uint32) {
+	s.mu.Lock()
+	s.sendWindow += n
+	notify(s.writeReady)
+	s.mu.Unlock()
+}
+
+func windowUpdatePayload(n uint32) []byte {
+	return binary.BigEndian.AppendUint32(nil, n)
+}
@@ -1,54 +1,287 @@
 package p2p
 
 import (
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"log"
 	"net"
 	"sync"
+	"time"
 )
 
+// TCPPeer is a remote node over one TCP connection. Messages and any number
+// of concurrent streams share the connection as frames.
 type TCPPeer struct {
-	net.Conn
+	conn     net.Conn
 	outbound bool
-
-	wg *sync.WaitGroup
+	info     PeerInfo
+	accepted bool
+
+	// writeTimeout bounds each frame write; a peer that stops reading
+	// for that long is cut off.
+	writeTimeout time.Duration
+
+	writeMu sync.Mutex
+
+	mu        sync.Mutex
+	streams   map[uint32]*stream
+	nextID    uint32
+	calls     map[uint64]chan callResult
+	nextCall  uint64
+	inbound   map[uint64]*Request
+	closed    chan struct{}
+	closeOnce sync.Once
 }
 
 func NewTCPPeer(conn net.Conn, outbound bool) *TCPPeer {
+	// The dialer uses odd stream ids and the listener even ones, so both
+	// sides can open streams without coordinating.
+	nextID := uint32(2)
+	if outbound {
+		nextID = 1
+	}
 	return &TCPPeer{
-		Conn:     conn,
+		conn:     conn,
 		outbound: outbound,
-		wg:       &sync.WaitGroup{},
+		streams:  make(map[uint32]*stream),
+		nextID:   nextID,
+		calls:    make(map[uint64]chan callResult),
+		inbound:  make(map[uint64]*Request),
+		closed:   make(chan struct{}),
 	}
 }
 
-func (p *TCPPeer) CloseStream() {
-	p.wg.Done()
+func (p *TCPPeer) RemoteAddr() net.Addr {
+	return p.conn.RemoteAddr()
+}
+
+func (p *TCPPeer) LocalAddr() net.Addr {
+	return p.conn.LocalAddr()
+}
+
+func (p *TCPPeer) Info() PeerInfo {
+	return p.info
+}
+
+func (p *TCPPeer) Outbound() bool {
+	return p.outbound
+}
+
+// name identifies the peer in RPCs: its node id once the handshake gave us
+// one, its address otherwise.
+func (p *TCPPeer) name() string {
+	if p.info.NodeID != "" {
+		return p.info.NodeID
+	}
+	return p.conn.RemoteAddr().String()
+}
+
+func (p *TCPPeer) Close() error {
+	return p.conn.Close()
+}
+
+func (p *TCPPeer) writeFrame(f *Frame) error {
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+
+	select {
+	case <-p.closed:
+		return ErrPeerClosed
+	default:
+	}
+	if p.writeTimeout > 0 {
+		p.conn.SetWriteDeadline(time.Now().Add(p.writeTimeout))
+	}
+	if err := EncodeFrame(p.conn, f); err != nil {
+		// A frame may be half written, so the connection is no use now.
+		p.conn.Close()
+		return err
+	}
+	return nil
 }
 
 func (p *TCPPeer) Send(b []byte) error {
-	_, err := p.Conn.Write(b)
-	return err
+	return p.writeFrame(&Frame{Type: FrameMessage, Payload: b})
+}
+
+func (p *TCPPeer) OpenStream() (Stream, error) {
+	p.mu.Lock()
+	select {
+	case <-p.closed:
+		p.mu.Unlock()
+		return nil, ErrPeerClosed
+	default:
+	}
+	id := p.nextID
+	p.nextID += 2
+	s := newStream(id, p)
+	p.streams[id] = s
+	p.mu.Unlock()
+
+	if err := p.writeFrame(&Frame{Type: FrameData, Flags: FlagSYN, StreamID: id}); err != nil {
+		p.removeStream(id)
+		return nil, err
+	}
+	return s, nil
+}
+
+func (p *TCPPeer) removeStream(id uint32) {
+	p.mu.Lock()
+	delete(p.streams, id)
+	p.mu.Unlock()
+}
+
+func (p *TCPPeer) sendWindowUpdate(id, credit uint32) {
+	p.writeFrame(&Frame{Type: FrameWindowUpdate, StreamID: id, Payload: windowUpdatePayload(credit)})
+}
+
+// handleFrame dispatches a frame from the read loop. It returns a non-nil
+// RPC for frames the transport's consumer should see.
+func (p *TCPPeer) handleFrame(f *Frame) (*RPC, error) {
+	switch f.Type {
+	case FrameMessage:
+		return &RPC{Payload: f.Payload}, nil
+
+	case FrameData:
+		p.mu.Lock()
+		s, ok := p.streams[f.StreamID]
+		var rpc *RPC
+		if f.Flags&FlagSYN != 0 {
+			if ok || f.StreamID == 0 || (f.StreamID%2 == 1) != !p.outbound {
+				p.mu.Unlock()
+				return nil, fmt.Errorf("p2p: invalid stream id %d from peer", f.StreamID)
+			}
+			s = newStream(f.StreamID, p)
+			p.streams[f.StreamID] = s
+			rpc = &RPC{Stream: s}
+		}
+		p.mu.Unlock()
+
+		// Frames for streams we already dropped are late and harmless.
+		if s == nil {
+			return nil, nil
+		}
+		if f.Flags&FlagRST != 0 {
+			s.fail(ErrStreamReset)
+			p.removeStream(f.StreamID)
+			return rpc, nil
+		}
+		return rpc, s.receive(f)
+
+	case FrameWindowUpdate:
+		if len(f.Payload) != 4 {
+			return nil, fmt.Errorf("p2p: malformed window update")
+		}
+		p.mu.Lock()
+		s := p.streams[f.StreamID]
+		p.mu.Unlock()
+		if s != nil {
+			s.addCredit(binary.BigEndian.Uint32(f.Payload))
+		}
+		return nil, nil
+
+	case FrameRequest:
+		return p.handleRequest(f.Payload)
+
+	case FrameResponse:
+		return nil, p.handleResponse(f.Payload)
+
+	case FrameCancel:
+		return nil, p.handleCancel(f.Payload)
+
+	case FramePing:
+		return nil, p.writeFrame(&Frame{Type: FramePong, Payload: f.Payload})
+
+	case FramePong:
+		return nil, nil
+	}
+
+	return nil, fmt.Errorf("p2p: unknown frame type %#x", f.Type)
+}
+
+// shutdown fails every open stream and pending call once the connection is
+// gone, and cancels the requests we were still serving.
+func (p *TCPPeer) shutdown() {
+	p.closeOnce.Do(func() {
+		p.mu.Lock()
+		close(p.closed)
+		streams := p.streams
+		p.streams = make(map[uint32]*stream)
+		calls := p.calls
+		p.calls = make(map[uint64]chan callResult)
+		inbound := p.inbound
+		p.inbound = make(map[uint64]*Request)
+		p.mu.Unlock()
+
+		for _, s := range streams {
+			s.peerClosed()
+		}
+		for _, ch := range calls {
+			ch <- callResult{err: ErrPeerClosed}
+		}
+		for _, req := range inbound {
+			req.cancel()
+		}
+	})
 }
 
 type TCPTransportOpts struct {
-	ListenAddr    string
+	ListenAddr string
+	// NodeID and Features are what we announce in the handshake.
+	NodeID        string
+	Features      []string
 	HandshakeFunc HandshakeFunc
-	Decoder       Decoder
-	OnPeer        func(Peer) error
+	// Security, if set, secures and authenticates every connection before
+	// the handshake. Without it traffic between nodes is in the clear.
+	Security Security
+	Decoder  Decoder
+	// OnPeer decides whether to keep a peer that completed the handshake;
+	// returning an error drops it.
+	OnPeer func(Peer) error
+	// OnPeerEvent, if set, hears about peers connecting, disconnecting and
+	// being redialed.
+	OnPeerEvent func(PeerEvent)
+
+	// We ping every KeepaliveInterval and drop a peer we hear nothing from
+	// for IdleTimeout. Persistent dials back off from ReconnectMin up to
+	// ReconnectMax. Zero values get the defaults.
+	KeepaliveInterval time.Duration
+	IdleTimeout       time.Duration
+	ReconnectMin      time.Duration
+	ReconnectMax      time.Duration
 }
 
 type TCPTransport struct {
 	TCPTransportOpts
 	listener net.Listener
 	rpcch    chan RPC
+
+	mu        sync.Mutex
+	peers     map[*TCPPeer]struct{}
+	quitch    chan struct{}
+	closeOnce sync.Once
 }
 
 func NewTCPTransport(opts TCPTransportOpts) *TCPTransport {
+	if opts.KeepaliveInterval == 0 {
+		opts.KeepaliveInterval = DefaultKeepaliveInterval
+	}
+	if opts.IdleTimeout == 0 {
+		opts.IdleTimeout = DefaultIdleTimeout
+	}
+	if opts.ReconnectMin == 0 {
+		opts.ReconnectMin = DefaultReconnectMin
+	}
+	if opts.ReconnectMax == 0 {
+		opts.ReconnectMax = DefaultReconnectMax
+	}
+
 	return &TCPTransport{
 		TCPTransportOpts: opts,
 		rpcch:            make(chan RPC, 1024),
+		peers:            make(map[*TCPPeer]struct{}),
+		quitch:           make(chan struct{}),
 	}
 }
 
@@ -60,12 +293,28 @@ func (t *TCPTransport) Consume() <-chan RPC {
 	return t.rpcch
 }
 
+// Close stops listening and redialing, and drops every connected peer.
 func (t *TCPTransport) Close() error {
-	return t.listener.Close()
+	var err error
+	t.closeOnce.Do(func() {
+		close(t.quitch)
+		if t.listener != nil {
+			err = t.listener.Close()
+		}
+
+		t.mu.Lock()
+		for p := range t.peers {
+			p.Close()
+		}
+		t.mu.Unlock()
+	})
+	return err
 }
 
+// Dial connects to addr once. See DialPersistent for a connection that is
+// kept up.
 func (t *TCPTransport) Dial(addr string) error {
-	conn, err := net.Dial("tcp", addr)
+	conn, err := net.DialTimeout("tcp", addr, dialTimeout)
 	if err != nil {
 		return err
 	}
@@ -99,50 +348,100 @@ func (t *TCPTransport) startAcceptLoop() {
 
 		if err != nil {
 			fmt.Printf("TCP accept error: %s\n", err)
+			continue
 		}
 
 		go t.handleConn(conn, false)
 	}
 }
 
-func (t *TCPTransport) handleConn(conn net.Conn, outbound bool) {
-	var err error
+// handleConn runs a connection until it dies. It returns the peer, if we
+// got as far as making one, and why the connection ended.
+func (t *TCPTransport) handleConn(conn net.Conn, outbound bool) (*TCPPeer, error) {
+	var (
+		err  error
+		peer *TCPPeer
+	)
 
 	defer func() {
-		fmt.Printf("dropping peer connection: %s", err)
+		fmt.Printf("dropping peer connection: %s\n", err)
 		conn.Close()
+		if peer == nil {
+			return
+		}
+		peer.shutdown()
+		if peer.accepted {
+			t.mu.Lock()
+			delete(t.peers, peer)
+			t.mu.Unlock()
+			t.emit(PeerEvent{Type: PeerDisconnected, Peer: peer, Addr: conn.RemoteAddr().String(), Err: err})
+		}
 	}()
 
-	peer := NewTCPPeer(conn, outbound)
+	var identity string
+	if t.Security != nil {
+		var secured net.Conn
+		if secured, identity, err = t.Security.Secure(conn, outbound); err != nil {
+			return nil, err
+		}
+		conn = secured
+	}
+
+	peer = NewTCPPeer(conn, outbound)
+	peer.writeTimeout = t.IdleTimeout
 
-	if err = t.HandshakeFunc(peer); err != nil {
-		return
+	local := PeerInfo{
+		NodeID:     t.NodeID,
+		ListenAddr: t.ListenAddr,
+		Features:   t.Features,
+	}
+	if peer.info, err = t.HandshakeFunc(conn, local); err != nil {
+		return peer, err
+	}
+	if identity != "" && peer.info.NodeID != identity {
+		err = fmt.Errorf("%w: hello says %q, authenticated as %q", ErrIdentityMismatch, peer.info.NodeID, identity)
+		return peer, err
 	}
 
 	if t.OnPeer != nil {
 		if err = t.OnPeer(peer); err != nil {
-			return
+			return peer, err
 		}
 	}
 
-	// Read loop
-	for {
-		rpc := RPC{}
-		err = t.Decoder.Decode(conn, &rpc)
-		if err != nil {
-			return
-		}
+	t.mu.Lock()
+	select {
+	case <-t.quitch:
+		t.mu.Unlock()
+		err = net.ErrClosed
+		return peer, err
+	default:
+	}
+	t.peers[peer] = struct{}{}
+	peer.accepted = true
+	t.mu.Unlock()
+	t.emit(PeerEvent{Type: PeerConnected, Peer: peer, Addr: conn.RemoteAddr().String()})
 
-		rpc.From = conn.RemoteAddr().String()
+	go peer.keepalive(t.KeepaliveInterval)
 
-		if rpc.Stream {
-			peer.wg.Add(1)
-			fmt.Printf("[%s] incoming stream, waiting...\n", conn.RemoteAddr())
-			peer.wg.Wait()
-			fmt.Printf("[%s] stream closed, resuming read loop\n", conn.RemoteAddr())
-			continue
+	// Read loop. It only ever hands frames off, so a slow stream can't hold
+	// up messages or other streams from the same peer. Any frame, pongs
+	// included, counts as a sign of life.
+	for {
+		conn.SetReadDeadline(time.Now().Add(t.IdleTimeout))
+
+		var frame Frame
+		if err = t.Decoder.Decode(conn, &frame); err != nil {
+			return peer, err
 		}
 
-		t.rpcch <- rpc
+		var rpc *RPC
+		if rpc, err = peer.handleFrame(&frame); err != nil {
+			return peer, err
+		}
+		if rpc != nil {
+			rpc.From = peer.name()
+			t.rpcch <- *rpc
+		}
 	}
 }
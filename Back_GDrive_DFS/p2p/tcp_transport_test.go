@@ -1,7 +1,20 @@
 package p2p
 
 import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"math/big"
+	"net"
 	"testing"
+	"testing/iotest"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -17,3 +30,320 @@ func TestTCPTransport(t *testing.T) {
 
 	assert.Nil(t, tr.ListenAndAccept())
 }
+
+// connect dials a listening transport from a second one. It returns the
+// listener and the dialer's peer once both sides have accepted the
+// connection.
+func connect(t *testing.T, serverOpts, clientOpts TCPTransportOpts) (*TCPTransport, Peer, error) {
+	t.Helper()
+
+	accepted := make(chan Peer, 1)
+	serverOpts.ListenAddr = "127.0.0.1:0"
+	serverOpts.Decoder = DefaultDecoder{}
+	serverOpts.OnPeer = func(p Peer) error {
+		accepted <- p
+		return nil
+	}
+	server := NewTCPTransport(serverOpts)
+	if err := server.ListenAndAccept(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+
+	dialed := make(chan Peer, 1)
+	clientOpts.Decoder = DefaultDecoder{}
+	clientOpts.OnPeer = func(p Peer) error {
+		dialed <- p
+		return nil
+	}
+	client := NewTCPTransport(clientOpts)
+	t.Cleanup(func() { client.Close() })
+	if err := client.Dial(server.listener.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+
+	timeout := time.After(2 * time.Second)
+	var peer Peer
+	for got := 0; got < 2; got++ {
+		select {
+		case p := <-dialed:
+			peer = p
+			t.Cleanup(func() { p.Close() })
+		case p := <-accepted:
+			t.Cleanup(func() { p.Close() })
+		case <-timeout:
+			return server, nil, errors.New("not connected")
+		}
+	}
+	return server, peer, nil
+}
+
+func connectedPair(t *testing.T) (*TCPTransport, Peer) {
+	t.Helper()
+	server, peer, err := connect(t,
+		TCPTransportOpts{HandshakeFunc: NOPHandshakeFunc},
+		TCPTransportOpts{HandshakeFunc: NOPHandshakeFunc})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server, peer
+}
+
+func nextRPC(t *testing.T, tr Transport) RPC {
+	t.Helper()
+	select {
+	case rpc := <-tr.Consume():
+		return rpc
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for rpc")
+	}
+	return RPC{}
+}
+
+func TestDecodeFrameFromShortReads(t *testing.T) {
+	var buf bytes.Buffer
+	payload := bytes.Repeat([]byte("framed"), 1000)
+	assert.Nil(t, EncodeFrame(&buf, &Frame{Type: FrameData, Flags: FlagFIN, StreamID: 7, Payload: payload}))
+	assert.Nil(t, EncodeFrame(&buf, &Frame{Type: FrameMessage, Payload: []byte("next")}))
+
+	r := iotest.OneByteReader(&buf)
+	var f Frame
+	assert.Nil(t, DefaultDecoder{}.Decode(r, &f))
+	assert.Equal(t, FrameData, f.Type)
+	assert.Equal(t, FlagFIN, f.Flags)
+	assert.Equal(t, uint32(7), f.StreamID)
+	assert.Equal(t, payload, f.Payload)
+
+	assert.Nil(t, DefaultDecoder{}.Decode(r, &f))
+	assert.Equal(t, []byte("next"), f.Payload)
+
+	assert.Equal(t, io.EOF, DefaultDecoder{}.Decode(r, &f))
+}
+
+func TestLargeMessage(t *testing.T) {
+	server, peer := connectedPair(t)
+
+	msg := bytes.Repeat([]byte{0xab}, 3*1024*1024)
+	assert.Nil(t, peer.Send(msg))
+
+	rpc := nextRPC(t, server)
+	assert.Nil(t, rpc.Stream)
+	assert.Equal(t, msg, rpc.Payload)
+}
+
+func TestStalledStreamDoesNotBlockPeer(t *testing.T) {
+	server, peer := connectedPair(t)
+
+	// Nobody reads this stream, so the writer runs out of window and blocks.
+	stalled, err := peer.OpenStream()
+	assert.Nil(t, err)
+	written := make(chan struct{})
+	go func() {
+		stalled.Write(make([]byte, 4*initialWindow))
+		close(written)
+	}()
+	assert.NotNil(t, nextRPC(t, server).Stream)
+
+	// Messages and other streams still get through.
+	assert.Nil(t, peer.Send([]byte("hello")))
+	assert.Equal(t, []byte("hello"), nextRPC(t, server).Payload)
+
+	other, err := peer.OpenStream()
+	assert.Nil(t, err)
+	data := bytes.Repeat([]byte("data"), initialWindow)
+	go func() {
+		other.Write(data)
+		other.Close()
+	}()
+
+	rpc := nextRPC(t, server)
+	assert.NotNil(t, rpc.Stream)
+	got, err := io.ReadAll(rpc.Stream)
+	assert.Nil(t, err)
+	assert.Equal(t, data, got)
+
+	select {
+	case <-written:
+		t.Fatal("stalled stream wrote past its window")
+	default:
+	}
+
+	// Resetting it frees the blocked writer.
+	stalled.Reset()
+	select {
+	case <-written:
+	case <-time.After(5 * time.Second):
+		t.Fatal("writer still blocked after reset")
+	}
+}
+
+func TestHelloHandshake(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	type result struct {
+		info PeerInfo
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		info, err := HelloHandshakeFunc(c2, PeerInfo{NodeID: "s2", ListenAddr: ":4000"})
+		done <- result{info, err}
+	}()
+
+	info, err := HelloHandshakeFunc(c1, PeerInfo{NodeID: "s1", ListenAddr: ":3000", Features: []string{FeatureStreams}})
+	assert.Nil(t, err)
+	assert.Equal(t, "s2", info.NodeID)
+	assert.Equal(t, ":4000", info.ListenAddr)
+	assert.Equal(t, ProtocolVersion, info.Version)
+
+	other := <-done
+	assert.Nil(t, other.err)
+	assert.Equal(t, "s1", other.info.NodeID)
+	assert.True(t, other.info.Supports(FeatureStreams))
+}
+
+func TestHelloRejectsIncompatibleVersion(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	go func() {
+		// A node from the future, speaking a version we don't know.
+		writeHello(c2, &PeerInfo{NodeID: "s2", Version: ProtocolVersion + 1})
+		var info PeerInfo
+		readHello(c2, &info)
+	}()
+
+	_, err := HelloHandshakeFunc(c1, PeerInfo{NodeID: "s1"})
+	assert.ErrorIs(t, err, ErrIncompatibleVersion)
+}
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "cluster ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+// issue signs a certificate for nodeID and returns TLS security using it.
+func (ca *testCA) issue(t *testing.T, nodeID string) *TLSSecurity {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: nodeID},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewTLSSecurity(tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, ca.pool)
+}
+
+func TestTransportSecurityModes(t *testing.T) {
+	ca := newTestCA(t)
+	modes := map[string][2]TCPTransportOpts{
+		"plain": {
+			{NodeID: "s1", HandshakeFunc: HelloHandshakeFunc},
+			{NodeID: "s2", HandshakeFunc: HelloHandshakeFunc},
+		},
+		"tls": {
+			{NodeID: "s1", HandshakeFunc: HelloHandshakeFunc, Security: ca.issue(t, "s1")},
+			{NodeID: "s2", HandshakeFunc: HelloHandshakeFunc, Security: ca.issue(t, "s2")},
+		},
+		"secret": {
+			{NodeID: "s1", HandshakeFunc: HelloHandshakeFunc, Security: NewSecretSecurity([]byte("shh"), "s1")},
+			{NodeID: "s2", HandshakeFunc: HelloHandshakeFunc, Security: NewSecretSecurity([]byte("shh"), "s2")},
+		},
+	}
+
+	for name, opts := range modes {
+		t.Run(name, func(t *testing.T) {
+			server, peer, err := connect(t, opts[0], opts[1])
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, "s1", peer.Info().NodeID)
+
+			assert.Nil(t, peer.Send([]byte("hello")))
+			rpc := nextRPC(t, server)
+			assert.Equal(t, "s2", rpc.From)
+			assert.Equal(t, []byte("hello"), rpc.Payload)
+
+			st, err := peer.OpenStream()
+			assert.Nil(t, err)
+			data := bytes.Repeat([]byte("chunk"), 100000)
+			go func() {
+				st.Write(data)
+				st.Close()
+			}()
+			got, err := io.ReadAll(nextRPC(t, server).Stream)
+			assert.Nil(t, err)
+			assert.Equal(t, data, got)
+		})
+	}
+}
+
+func TestTLSRejectsUntrustedPeer(t *testing.T) {
+	ca, other := newTestCA(t), newTestCA(t)
+
+	_, _, err := connect(t,
+		TCPTransportOpts{NodeID: "s1", HandshakeFunc: HelloHandshakeFunc, Security: ca.issue(t, "s1")},
+		TCPTransportOpts{NodeID: "s2", HandshakeFunc: HelloHandshakeFunc, Security: other.issue(t, "s2")})
+	assert.NotNil(t, err, "certificate from another CA must be refused")
+}
+
+func TestTLSRejectsNodeIDNotInCertificate(t *testing.T) {
+	ca := newTestCA(t)
+
+	// s3 holds a valid certificate, but for s2.
+	_, _, err := connect(t,
+		TCPTransportOpts{NodeID: "s1", HandshakeFunc: HelloHandshakeFunc, Security: ca.issue(t, "s1")},
+		TCPTransportOpts{NodeID: "s3", HandshakeFunc: HelloHandshakeFunc, Security: ca.issue(t, "s2")})
+	assert.NotNil(t, err, "node must not claim an id its certificate isn't for")
+}
+
+func TestSecretRejectsWrongSecret(t *testing.T) {
+	_, _, err := connect(t,
+		TCPTransportOpts{NodeID: "s1", HandshakeFunc: HelloHandshakeFunc, Security: NewSecretSecurity([]byte("shh"), "s1")},
+		TCPTransportOpts{NodeID: "s2", HandshakeFunc: HelloHandshakeFunc, Security: NewSecretSecurity([]byte("guess"), "s2")})
+	assert.NotNil(t, err, "peer without the secret must be refused")
+
+	// Nor can a node authenticate as one id and then say hello as another.
+	_, _, err = connect(t,
+		TCPTransportOpts{NodeID: "s1", HandshakeFunc: HelloHandshakeFunc, Security: NewSecretSecurity([]byte("shh"), "s1")},
+		TCPTransportOpts{NodeID: "s3", HandshakeFunc: HelloHandshakeFunc, Security: NewSecretSecurity([]byte("shh"), "s2")})
+	assert.NotNil(t, err, "hello must match the authenticated id")
+}
@@ -1,16 +1,30 @@
 package p2p
 
-import "net"
+import (
+	"context"
+	"net"
+)
 
 type Peer interface {
-	net.Conn
+	RemoteAddr() net.Addr
+	// Info is what the remote said about itself in the handshake.
+	Info() PeerInfo
+	// Outbound reports whether we dialed the connection.
+	Outbound() bool
+	// Send delivers b to the remote as one message.
 	Send([]byte) error
-	CloseStream()
+	// OpenStream starts a new stream multiplexed over the connection.
+	OpenStream() (Stream, error)
+	// Call sends a request and waits for the response until ctx is done.
+	Call(ctx context.Context, method string, body []byte) ([]byte, error)
+	Close() error
 }
 
 type Transport interface {
 	Addr() string
 	Dial(string) error
+	// DialPersistent keeps redialing addr whenever the connection drops.
+	DialPersistent(addr string)
 	ListenAndAccept() error
 	Consume() <-chan RPC
 	Close() error
@@ -0,0 +1,844 @@
+// Package raft keeps a log of commands replicated across a fixed set of
+// nodes with the Raft consensus algorithm, and applies the commands, once a
+// majority has them, to a state machine on every node in the same order.
+//
+// Nodes reach each other through a Transport and answer through Handle, so
+// the package brings no networking of its own. The log, term and vote are
+// kept on disk, and the log is compacted into a snapshot of the state
+// machine as it grows.
+package raft
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNotLeader = errors.New("raft: not the leader")
+	ErrNoLeader  = errors.New("raft: no leader elected")
+	// ErrLostLeadership means the command was dropped by a newer leader.
+	// It may be proposed again.
+	ErrLostLeadership = errors.New("raft: leadership lost before the command was committed")
+	ErrStopped        = errors.New("raft: node stopped")
+	// ErrUnknownPeer refuses calls from nodes not in Config.Peers.
+	ErrUnknownPeer = errors.New("raft: call from a node outside the cluster")
+)
+
+const (
+	DefaultElectionTimeout   = time.Second
+	DefaultHeartbeatInterval = 100 * time.Millisecond
+	DefaultSnapshotThreshold = 4096
+
+	// maxAppendEntries bounds the entries sent in one call.
+	maxAppendEntries = 256
+)
+
+// StateMachine is what the log drives. Apply is called with each committed
+// command in log order, never concurrently with the others.
+type StateMachine interface {
+	Apply(cmd []byte)
+	// Snapshot returns the state as of the last command applied.
+	Snapshot() ([]byte, error)
+	// Restore replaces the state with a snapshot.
+	Restore(snapshot []byte) error
+}
+
+type Config struct {
+	// ID is this node's id, and Peers the ids of the others. Every node
+	// must be configured with the same set.
+	ID    string
+	Peers []string
+	// Dir is where the log is kept.
+	Dir          string
+	Transport    Transport
+	StateMachine StateMachine
+
+	// A follower that hears nothing from a leader for ElectionTimeout to
+	// twice that stands for election. Leaders send heartbeats every
+	// HeartbeatInterval, which should be well below ElectionTimeout.
+	ElectionTimeout   time.Duration
+	HeartbeatInterval time.Duration
+	// SnapshotThreshold is how many applied entries the log keeps before
+	// they are compacted into a snapshot.
+	SnapshotThreshold int
+}
+
+// Entry is one command in the log. Leaders start their term with an entry
+// that has no command.
+type Entry struct {
+	Index uint64 `json:"index"`
+	Term  uint64 `json:"term"`
+	Cmd   []byte `json:"cmd,omitempty"`
+}
+
+type role int
+
+const (
+	follower role = iota
+	candidate
+	leader
+)
+
+func (r role) String() string {
+	switch r {
+	case follower:
+		return "follower"
+	case candidate:
+		return "candidate"
+	case leader:
+		return "leader"
+	}
+	return fmt.Sprintf("role(%d)", int(r))
+}
+
+type Node struct {
+	cfg   Config
+	store *storage
+
+	// applyMu is held while the state machine is used, so that installing
+	// a snapshot doesn't race with applying entries. It is taken before mu.
+	applyMu sync.Mutex
+
+	mu       sync.Mutex
+	term     uint64
+	votedFor string
+	// log[0] stands for the last entry the snapshot covers, and has no
+	// command.
+	log          []Entry
+	snapshotData []byte
+	commitIndex  uint64
+	lastApplied  uint64
+	// dirty means a write of the log failed, so what's on disk may not
+	// match log and the next write must replace it all.
+	dirty   bool
+	stopped bool
+
+	role     role
+	leader   string
+	deadline time.Time
+	// Only while leading: what each peer is known to have and is sent
+	// next, and a channel waking the goroutine replicating to it.
+	matchIndex map[string]uint64
+	nextIndex  map[string]uint64
+	wake       map[string]chan struct{}
+	// waiters are proposals waiting for their entry to be applied.
+	waiters map[uint64]waiter
+
+	applych chan struct{}
+	quitch  chan struct{}
+	wg      sync.WaitGroup
+}
+
+type waiter struct {
+	term uint64
+	done chan error
+}
+
+// New opens the log in cfg.Dir and restores the state machine from its
+// snapshot. The node takes part once started.
+func New(cfg Config) (*Node, error) {
+	if cfg.ID == "" || cfg.Transport == nil || cfg.StateMachine == nil {
+		return nil, errors.New("raft: config needs an ID, a Transport and a StateMachine")
+	}
+	if cfg.ElectionTimeout <= 0 {
+		cfg.ElectionTimeout = DefaultElectionTimeout
+	}
+	if cfg.HeartbeatInterval <= 0 {
+		cfg.HeartbeatInterval = DefaultHeartbeatInterval
+	}
+	if cfg.SnapshotThreshold <= 0 {
+		cfg.SnapshotThreshold = DefaultSnapshotThreshold
+	}
+
+	st, hs, snap, entries, err := openStorage(cfg.Dir)
+	if err != nil {
+		return nil, err
+	}
+	if snap.Data != nil {
+		if err := cfg.StateMachine.Restore(snap.Data); err != nil {
+			st.close()
+			return nil, fmt.Errorf("raft: restoring snapshot: %w", err)
+		}
+	}
+
+	n := &Node{
+		cfg:          cfg,
+		store:        st,
+		term:         hs.Term,
+		votedFor:     hs.VotedFor,
+		log:          append([]Entry{{Index: snap.Index, Term: snap.Term}}, entries...),
+		snapshotData: snap.Data,
+		commitIndex:  snap.Index,
+		lastApplied:  snap.Index,
+		waiters:      make(map[uint64]waiter),
+		applych:      make(chan struct{}, 1),
+		quitch:       make(chan struct{}),
+	}
+	n.resetDeadlineLocked()
+	return n, nil
+}
+
+func (n *Node) Start() {
+	n.wg.Add(2)
+	go n.run()
+	go n.applier()
+}
+
+// Stop halts the node and closes its log. Proposals still waiting fail with
+// ErrStopped.
+func (n *Node) Stop() {
+	n.mu.Lock()
+	n.stopped = true
+	n.mu.Unlock()
+	close(n.quitch)
+	n.wg.Wait()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for index, w := range n.waiters {
+		w.done <- ErrStopped
+		delete(n.waiters, index)
+	}
+	n.store.close()
+}
+
+// Status is a node's view of the cluster.
+type Status struct {
+	ID          string `json:"id"`
+	Role        string `json:"role"`
+	Term        uint64 `json:"term"`
+	Leader      string `json:"leader"`
+	LastIndex   uint64 `json:"last_index"`
+	CommitIndex uint64 `json:"commit_index"`
+	LastApplied uint64 `json:"last_applied"`
+	// Snapshot is the last index compacted into the snapshot.
+	Snapshot uint64 `json:"snapshot"`
+}
+
+func (n *Node) Status() Status {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return Status{
+		ID:          n.cfg.ID,
+		Role:        n.role.String(),
+		Term:        n.term,
+		Leader:      n.leader,
+		LastIndex:   n.lastIndexLocked(),
+		CommitIndex: n.commitIndex,
+		LastApplied: n.lastApplied,
+		Snapshot:    n.log[0].Index,
+	}
+}
+
+// IsLeader reports whether this node believes it leads. A leader cut off
+// from the others keeps believing so until it hears of a newer term.
+func (n *Node) IsLeader() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.role == leader
+}
+
+// Propose adds cmd to the log, by way of the leader, and returns once it has
+// been applied here or on the leader. An error doesn't mean cmd won't be
+// applied: it may have been committed just as the leader failed.
+func (n *Node) Propose(ctx context.Context, cmd []byte) error {
+	if len(cmd) == 0 {
+		return errors.New("raft: empty command")
+	}
+	n.mu.Lock()
+	isLeader, to := n.role == leader, n.leader
+	n.mu.Unlock()
+
+	if isLeader {
+		return n.proposeLocal(ctx, cmd)
+	}
+	if to == "" {
+		return ErrNoLeader
+	}
+	_, err := n.cfg.Transport.Call(ctx, to, MethodPropose, cmd)
+	return err
+}
+
+func (n *Node) proposeLocal(ctx context.Context, cmd []byte) error {
+	n.mu.Lock()
+	if n.role != leader {
+		n.mu.Unlock()
+		return ErrNotLeader
+	}
+	e := Entry{Index: n.lastIndexLocked() + 1, Term: n.term, Cmd: cmd}
+	if err := n.appendLocked(e); err != nil {
+		n.mu.Unlock()
+		return err
+	}
+	done := make(chan error, 1)
+	n.waiters[e.Index] = waiter{term: e.Term, done: done}
+	n.mu.Unlock()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-n.quitch:
+		return ErrStopped
+	}
+}
+
+// appendLocked adds e to the leader's log and sends it on.
+func (n *Node) appendLocked(e Entry) error {
+	n.log = append(n.log, e)
+	if err := n.persistLocked([]Entry{e}, false); err != nil {
+		n.log = n.log[:len(n.log)-1]
+		return err
+	}
+	for _, wake := range n.wake {
+		select {
+		case wake <- struct{}{}:
+		default:
+		}
+	}
+	n.advanceCommitLocked()
+	return nil
+}
+
+func (n *Node) lastIndexLocked() uint64 {
+	return n.log[len(n.log)-1].Index
+}
+
+func (n *Node) lastTermLocked() uint64 {
+	return n.log[len(n.log)-1].Term
+}
+
+// termAtLocked is the term of the entry at index, or 0 if it has been
+// compacted away or isn't there yet.
+func (n *Node) termAtLocked(index uint64) uint64 {
+	first := n.log[0].Index
+	if index < first || index > n.lastIndexLocked() {
+		return 0
+	}
+	return n.log[index-first].Term
+}
+
+// entriesLocked copies the entries from index from up to and including to.
+func (n *Node) entriesLocked(from, to uint64) []Entry {
+	first := n.log[0].Index
+	return append([]Entry(nil), n.log[from-first:to-first+1]...)
+}
+
+// persistLocked writes added, just put at the end of log, to disk, or the
+// whole log if rewrite or if a write failed before.
+func (n *Node) persistLocked(added []Entry, rewrite bool) error {
+	var err error
+	if rewrite || n.dirty {
+		err = n.store.rewrite(n.log[1:])
+	} else {
+		err = n.store.append(added)
+	}
+	n.dirty = err != nil
+	return err
+}
+
+func (n *Node) saveStateLocked() error {
+	return n.store.saveState(hardState{Term: n.term, VotedFor: n.votedFor})
+}
+
+func (n *Node) resetDeadlineLocked() {
+	timeout := n.cfg.ElectionTimeout + time.Duration(rand.Int63n(int64(n.cfg.ElectionTimeout)))
+	n.deadline = time.Now().Add(timeout)
+}
+
+// -------------------- Elections --------------------
+
+func (n *Node) run() {
+	defer n.wg.Done()
+	ticker := time.NewTicker(n.cfg.ElectionTimeout / 10)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			n.mu.Lock()
+			if n.role != leader && time.Now().After(n.deadline) {
+				n.startElectionLocked()
+			}
+			n.mu.Unlock()
+		case <-n.quitch:
+			return
+		}
+	}
+}
+
+func (n *Node) startElectionLocked() {
+	n.role = candidate
+	n.term++
+	n.votedFor = n.cfg.ID
+	n.leader = ""
+	n.resetDeadlineLocked()
+	if err := n.saveStateLocked(); err != nil {
+		log.Printf("[raft] %s: saving state: %v", n.cfg.ID, err)
+		return
+	}
+	if n.quorum(1) {
+		n.becomeLeaderLocked()
+		return
+	}
+
+	term := n.term
+	req := requestVoteRequest{
+		Term:         term,
+		Candidate:    n.cfg.ID,
+		LastLogIndex: n.lastIndexLocked(),
+		LastLogTerm:  n.lastTermLocked(),
+	}
+	votes := 1
+	for _, peer := range n.cfg.Peers {
+		go func(peer string) {
+			var reply requestVoteReply
+			if err := n.call(context.Background(), peer, MethodRequestVote, req, &reply); err != nil {
+				return
+			}
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			if n.stopped {
+				return
+			}
+			if reply.Term > n.term {
+				n.becomeFollowerLocked(reply.Term)
+				return
+			}
+			if !reply.Granted || n.role != candidate || n.term != term {
+				return
+			}
+			votes++
+			if n.quorum(votes) {
+				n.becomeLeaderLocked()
+			}
+		}(peer)
+	}
+}
+
+// quorum reports whether count nodes, this one included, are a majority.
+func (n *Node) quorum(count int) bool {
+	return count*2 > len(n.cfg.Peers)+1
+}
+
+func (n *Node) becomeLeaderLocked() {
+	log.Printf("[raft] %s: leading in term %d", n.cfg.ID, n.term)
+	n.role = leader
+	n.leader = n.cfg.ID
+	n.matchIndex = make(map[string]uint64)
+	n.nextIndex = make(map[string]uint64)
+	n.wake = make(map[string]chan struct{})
+	for _, peer := range n.cfg.Peers {
+		n.nextIndex[peer] = n.lastIndexLocked() + 1
+		n.wake[peer] = make(chan struct{}, 1)
+		n.wg.Add(1)
+		go n.replicate(peer, n.term, n.wake[peer])
+	}
+
+	// Entries from earlier terms only count as committed once one from
+	// this term is, so commit one straight away.
+	if err := n.appendLocked(Entry{Index: n.lastIndexLocked() + 1, Term: n.term}); err != nil {
+		log.Printf("[raft] %s: appending to log: %v", n.cfg.ID, err)
+	}
+}
+
+// becomeFollowerLocked steps down, moving to term if it is newer.
+func (n *Node) becomeFollowerLocked(term uint64) {
+	if term > n.term {
+		n.term = term
+		n.votedFor = ""
+		n.leader = ""
+		if err := n.saveStateLocked(); err != nil {
+			log.Printf("[raft] %s: saving state: %v", n.cfg.ID, err)
+		}
+	}
+	if n.role == leader {
+		log.Printf("[raft] %s: stepping down in term %d", n.cfg.ID, n.term)
+	}
+	n.role = follower
+	n.wake = nil
+	n.resetDeadlineLocked()
+}
+
+func (n *Node) handleRequestVote(req requestVoteRequest) requestVoteReply {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if req.Term > n.term {
+		n.becomeFollowerLocked(req.Term)
+	}
+	reply := requestVoteReply{Term: n.term}
+	if req.Term < n.term || (n.votedFor != "" && n.votedFor != req.Candidate) {
+		return reply
+	}
+	// Only a candidate with every committed entry may win, and a majority
+	// has each of those.
+	lastTerm := n.lastTermLocked()
+	upToDate := req.LastLogTerm > lastTerm ||
+		(req.LastLogTerm == lastTerm && req.LastLogIndex >= n.lastIndexLocked())
+	if !upToDate {
+		return reply
+	}
+
+	n.votedFor = req.Candidate
+	if err := n.saveStateLocked(); err != nil {
+		log.Printf("[raft] %s: saving state: %v", n.cfg.ID, err)
+		n.votedFor = ""
+		return reply
+	}
+	n.resetDeadlineLocked()
+	reply.Granted = true
+	return reply
+}
+
+// -------------------- Replication --------------------
+
+// replicate sends peer what it is missing, and a heartbeat when there is
+// nothing, for as long as this node leads in term.
+func (n *Node) replicate(peer string, term uint64, wake chan struct{}) {
+	defer n.wg.Done()
+	ticker := time.NewTicker(n.cfg.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		if !n.sendTo(peer, term, wake) {
+			return
+		}
+		select {
+		case <-wake:
+		case <-ticker.C:
+		case <-n.quitch:
+			return
+		}
+	}
+}
+
+// sendTo makes one call to bring peer up to date, and reports whether this
+// node still leads in term.
+func (n *Node) sendTo(peer string, term uint64, wake chan struct{}) bool {
+	n.mu.Lock()
+	if n.role != leader || n.term != term {
+		n.mu.Unlock()
+		return false
+	}
+	next := n.nextIndex[peer]
+	if next <= n.log[0].Index {
+		n.mu.Unlock()
+		return n.sendSnapshot(peer, term)
+	}
+
+	last := min(n.lastIndexLocked(), next+maxAppendEntries-1)
+	req := appendEntriesRequest{
+		Term:         term,
+		Leader:       n.cfg.ID,
+		PrevLogIndex: next - 1,
+		PrevLogTerm:  n.termAtLocked(next - 1),
+		LeaderCommit: n.commitIndex,
+	}
+	if next <= last {
+		req.Entries = n.entriesLocked(next, last)
+	}
+	n.mu.Unlock()
+
+	var reply appendEntriesReply
+	if err := n.call(context.Background(), peer, MethodAppendEntries, req, &reply); err != nil {
+		return true
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if reply.Term > n.term {
+		n.becomeFollowerLocked(reply.Term)
+		return false
+	}
+	if n.role != leader || n.term != term {
+		return false
+	}
+	if reply.Success {
+		match := req.PrevLogIndex + uint64(len(req.Entries))
+		if match > n.matchIndex[peer] {
+			n.matchIndex[peer] = match
+			n.advanceCommitLocked()
+		}
+		n.nextIndex[peer] = max(n.nextIndex[peer], match+1)
+	} else {
+		n.nextIndex[peer] = max(1, min(reply.ConflictIndex, next-1))
+	}
+	if n.nextIndex[peer] <= n.lastIndexLocked() {
+		select {
+		case wake <- struct{}{}:
+		default:
+		}
+	}
+	return true
+}
+
+func (n *Node) sendSnapshot(peer string, term uint64) bool {
+	n.mu.Lock()
+	req := installSnapshotRequest{
+		Term:      term,
+		Leader:    n.cfg.ID,
+		LastIndex: n.log[0].Index,
+		LastTerm:  n.log[0].Term,
+		Data:      n.snapshotData,
+	}
+	n.mu.Unlock()
+
+	var reply installSnapshotReply
+	if err := n.call(context.Background(), peer, MethodInstallSnapshot, req, &reply); err != nil {
+		return true
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if reply.Term > n.term {
+		n.becomeFollowerLocked(reply.Term)
+		return false
+	}
+	if n.role != leader || n.term != term {
+		return false
+	}
+	n.matchIndex[peer] = max(n.matchIndex[peer], req.LastIndex)
+	n.nextIndex[peer] = max(n.nextIndex[peer], req.LastIndex+1)
+	return true
+}
+
+// advanceCommitLocked commits the newest entry of this term that a majority
+// has.
+func (n *Node) advanceCommitLocked() {
+	for index := n.lastIndexLocked(); index > n.commitIndex; index-- {
+		if n.termAtLocked(index) != n.term {
+			return
+		}
+		count := 1
+		for _, match := range n.matchIndex {
+			if match >= index {
+				count++
+			}
+		}
+		if n.quorum(count) {
+			n.commitIndex = index
+			n.signalApply()
+			return
+		}
+	}
+}
+
+func (n *Node) handleAppendEntries(req appendEntriesRequest) appendEntriesReply {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if req.Term < n.term {
+		return appendEntriesReply{Term: n.term}
+	}
+	if req.Term > n.term || n.role != follower {
+		n.becomeFollowerLocked(req.Term)
+	}
+	n.leader = req.Leader
+	n.resetDeadlineLocked()
+	reply := appendEntriesReply{Term: n.term}
+
+	first, last := n.log[0].Index, n.lastIndexLocked()
+	if req.PrevLogIndex > last {
+		reply.ConflictIndex = last + 1
+		return reply
+	}
+	// Entries the snapshot covers are committed, so they match.
+	if req.PrevLogIndex >= first {
+		if term := n.termAtLocked(req.PrevLogIndex); term != req.PrevLogTerm {
+			// Skip back over the whole of the conflicting term.
+			index := req.PrevLogIndex
+			for index > first+1 && n.termAtLocked(index-1) == term {
+				index--
+			}
+			reply.ConflictIndex = index
+			return reply
+		}
+	}
+
+	// Append what we don't have, first dropping anything from where our
+	// log parts ways with the leader's.
+	var added []Entry
+	truncated := false
+	for i, e := range req.Entries {
+		if e.Index <= first {
+			continue
+		}
+		if e.Index <= n.lastIndexLocked() && n.termAtLocked(e.Index) == e.Term {
+			continue
+		}
+		if e.Index <= n.lastIndexLocked() {
+			n.log = n.log[:e.Index-first]
+			truncated = true
+		}
+		added = req.Entries[i:]
+		break
+	}
+	if len(added) > 0 {
+		n.log = append(n.log, added...)
+		if err := n.persistLocked(added, truncated); err != nil {
+			log.Printf("[raft] %s: writing log: %v", n.cfg.ID, err)
+			n.log = n.log[:len(n.log)-len(added)]
+			reply.ConflictIndex = n.lastIndexLocked() + 1
+			return reply
+		}
+	}
+
+	if req.LeaderCommit > n.commitIndex {
+		lastNew := req.PrevLogIndex + uint64(len(req.Entries))
+		n.commitIndex = max(n.commitIndex, min(req.LeaderCommit, lastNew))
+		n.signalApply()
+	}
+	reply.Success = true
+	return reply
+}
+
+// -------------------- Snapshots --------------------
+
+func (n *Node) handleInstallSnapshot(req installSnapshotRequest) installSnapshotReply {
+	n.mu.Lock()
+	if req.Term < n.term {
+		defer n.mu.Unlock()
+		return installSnapshotReply{Term: n.term}
+	}
+	if req.Term > n.term || n.role != follower {
+		n.becomeFollowerLocked(req.Term)
+	}
+	n.leader = req.Leader
+	n.resetDeadlineLocked()
+	reply := installSnapshotReply{Term: n.term}
+	n.mu.Unlock()
+
+	n.applyMu.Lock()
+	defer n.applyMu.Unlock()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if req.LastIndex <= n.lastApplied {
+		return reply
+	}
+
+	snap := snapshot{Index: req.LastIndex, Term: req.LastTerm, Data: req.Data}
+	if err := n.store.saveSnapshot(snap); err != nil {
+		log.Printf("[raft] %s: saving snapshot: %v", n.cfg.ID, err)
+		return reply
+	}
+	if err := n.cfg.StateMachine.Restore(req.Data); err != nil {
+		log.Printf("[raft] %s: restoring snapshot: %v", n.cfg.ID, err)
+		return reply
+	}
+
+	// Keep whatever follows the snapshot if it agrees with it.
+	rest := []Entry(nil)
+	if n.termAtLocked(req.LastIndex) == req.LastTerm {
+		rest = n.log[req.LastIndex-n.log[0].Index+1:]
+	}
+	n.log = append([]Entry{{Index: req.LastIndex, Term: req.LastTerm}}, rest...)
+	if err := n.persistLocked(nil, true); err != nil {
+		log.Printf("[raft] %s: writing log: %v", n.cfg.ID, err)
+	}
+	n.snapshotData = req.Data
+	n.commitIndex = max(n.commitIndex, req.LastIndex)
+	n.lastApplied = req.LastIndex
+
+	// Whether their entries made it into the snapshot can't be told.
+	for index, w := range n.waiters {
+		if index <= req.LastIndex {
+			w.done <- ErrLostLeadership
+			delete(n.waiters, index)
+		}
+	}
+	return reply
+}
+
+// compact saves a snapshot of the state machine and drops the entries it
+// covers. The caller holds applyMu, so the state machine is as of
+// lastApplied.
+func (n *Node) compact() {
+	data, err := n.cfg.StateMachine.Snapshot()
+	if err != nil {
+		log.Printf("[raft] %s: taking snapshot: %v", n.cfg.ID, err)
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	snap := snapshot{Index: n.lastApplied, Term: n.termAtLocked(n.lastApplied), Data: data}
+	if err := n.store.saveSnapshot(snap); err != nil {
+		log.Printf("[raft] %s: saving snapshot: %v", n.cfg.ID, err)
+		return
+	}
+	n.log = append([]Entry{{Index: snap.Index, Term: snap.Term}}, n.log[snap.Index-n.log[0].Index+1:]...)
+	n.snapshotData = data
+	if err := n.persistLocked(nil, true); err != nil {
+		log.Printf("[raft] %s: writing log: %v", n.cfg.ID, err)
+	}
+}
+
+// -------------------- Applying --------------------
+
+func (n *Node) signalApply() {
+	select {
+	case n.applych <- struct{}{}:
+	default:
+	}
+}
+
+func (n *Node) applier() {
+	defer n.wg.Done()
+	for {
+		select {
+		case <-n.applych:
+		case <-n.quitch:
+			return
+		}
+		for n.applyCommitted() {
+		}
+	}
+}
+
+// applyCommitted applies the entries committed since it last ran, and
+// reports whether it did anything.
+func (n *Node) applyCommitted() bool {
+	n.applyMu.Lock()
+	defer n.applyMu.Unlock()
+
+	n.mu.Lock()
+	if n.lastApplied >= n.commitIndex {
+		n.mu.Unlock()
+		return false
+	}
+	entries := n.entriesLocked(n.lastApplied+1, n.commitIndex)
+	n.mu.Unlock()
+
+	for _, e := range entries {
+		if e.Cmd != nil {
+			n.cfg.StateMachine.Apply(e.Cmd)
+		}
+	}
+
+	n.mu.Lock()
+	n.lastApplied = entries[len(entries)-1].Index
+	for _, e := range entries {
+		w, ok := n.waiters[e.Index]
+		if !ok {
+			continue
+		}
+		delete(n.waiters, e.Index)
+		if w.term == e.Term {
+			w.done <- nil
+		} else {
+			w.done <- ErrLostLeadership
+		}
+	}
+	due := n.lastApplied-n.log[0].Index >= uint64(n.cfg.SnapshotThreshold)
+	n.mu.Unlock()
+
+	if due {
+		n.compact()
+	}
+	return true
+}
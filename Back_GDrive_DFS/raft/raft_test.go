@@ -0,0 +1,372 @@
+package raft
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// network connects test nodes in memory, and can cut one off.
+type network struct {
+	mu    sync.Mutex
+	nodes map[string]*Node
+	down  map[string]bool
+}
+
+type netTransport struct {
+	net  *network
+	from string
+}
+
+func (t netTransport) Call(ctx context.Context, peer, method string, body []byte) ([]byte, error) {
+	t.net.mu.Lock()
+	n := t.net.nodes[peer]
+	cut := t.net.down[peer] || t.net.down[t.from]
+	t.net.mu.Unlock()
+	if n == nil || cut {
+		return nil, fmt.Errorf("%s unreachable", peer)
+	}
+	return n.Handle(ctx, t.from, method, body)
+}
+
+func (nw *network) setDown(id string, down bool) {
+	nw.mu.Lock()
+	nw.down[id] = down
+	nw.mu.Unlock()
+}
+
+// counter is a state machine adding up the numbers it is given.
+type counter struct {
+	mu      sync.Mutex
+	applied []int
+}
+
+func (c *counter) Apply(cmd []byte) {
+	var v int
+	json.Unmarshal(cmd, &v)
+	c.mu.Lock()
+	c.applied = append(c.applied, v)
+	c.mu.Unlock()
+}
+
+func (c *counter) Snapshot() ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return json.Marshal(c.applied)
+}
+
+func (c *counter) Restore(b []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.applied = nil
+	return json.Unmarshal(b, &c.applied)
+}
+
+func (c *counter) values() []int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]int(nil), c.applied...)
+}
+
+type cluster struct {
+	net   *network
+	ids   []string
+	dirs  map[string]string
+	sms   map[string]*counter
+	nodes map[string]*Node
+	t     *testing.T
+}
+
+func newCluster(t *testing.T, size, snapshotThreshold int) *cluster {
+	c := &cluster{
+		net:   &network{nodes: map[string]*Node{}, down: map[string]bool{}},
+		dirs:  map[string]string{},
+		sms:   map[string]*counter{},
+		nodes: map[string]*Node{},
+		t:     t,
+	}
+	for i := 1; i <= size; i++ {
+		c.ids = append(c.ids, fmt.Sprintf("n%d", i))
+	}
+	for _, id := range c.ids {
+		c.dirs[id] = t.TempDir()
+		c.start(id, snapshotThreshold)
+	}
+	t.Cleanup(func() {
+		for _, n := range c.nodes {
+			n.Stop()
+		}
+	})
+	return c
+}
+
+// start opens node id from its directory, as after a restart.
+func (c *cluster) start(id string, snapshotThreshold int) {
+	var peers []string
+	for _, other := range c.ids {
+		if other != id {
+			peers = append(peers, other)
+		}
+	}
+	sm := &counter{}
+	n, err := New(Config{
+		ID:                id,
+		Peers:             peers,
+		Dir:               c.dirs[id],
+		Transport:         netTransport{net: c.net, from: id},
+		StateMachine:      sm,
+		ElectionTimeout:   50 * time.Millisecond,
+		HeartbeatInterval: 10 * time.Millisecond,
+		SnapshotThreshold: snapshotThreshold,
+	})
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.net.mu.Lock()
+	c.net.nodes[id] = n
+	c.net.mu.Unlock()
+	c.sms[id] = sm
+	c.nodes[id] = n
+	n.Start()
+}
+
+func (c *cluster) stop(id string) {
+	c.nodes[id].Stop()
+	delete(c.nodes, id)
+	c.net.mu.Lock()
+	delete(c.net.nodes, id)
+	c.net.mu.Unlock()
+}
+
+// leader waits for exactly one reachable node to lead.
+func (c *cluster) leader() string {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		var leaders []string
+		for id, n := range c.nodes {
+			c.net.mu.Lock()
+			down := c.net.down[id]
+			c.net.mu.Unlock()
+			if !down && n.IsLeader() {
+				leaders = append(leaders, id)
+			}
+		}
+		if len(leaders) == 1 {
+			return leaders[0]
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.t.Fatal("no leader elected")
+	return ""
+}
+
+func (c *cluster) propose(via string, v int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	cmd, _ := json.Marshal(v)
+	for {
+		err := c.nodes[via].Propose(ctx, cmd)
+		if !errors.Is(err, ErrNoLeader) {
+			return err
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// waitApplied waits for node id to have applied want.
+func (c *cluster) waitApplied(id string, want []int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if fmt.Sprint(c.sms[id].values()) == fmt.Sprint(want) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.t.Fatalf("%s applied %v, want %v", id, c.sms[id].values(), want)
+}
+
+func TestReplicatesToEveryNode(t *testing.T) {
+	c := newCluster(t, 3, 0)
+	leader := c.leader()
+
+	var follower string
+	for _, id := range c.ids {
+		if id != leader {
+			follower = id
+		}
+	}
+	// Proposing through a follower goes by way of the leader.
+	for i, via := range []string{leader, follower, leader} {
+		if err := c.propose(via, i+1); err != nil {
+			t.Fatalf("proposing via %s: %v", via, err)
+		}
+	}
+	for _, id := range c.ids {
+		c.waitApplied(id, []int{1, 2, 3})
+	}
+}
+
+func TestSingleNode(t *testing.T) {
+	c := newCluster(t, 1, 0)
+	c.leader()
+	if err := c.propose("n1", 7); err != nil {
+		t.Fatal(err)
+	}
+	c.waitApplied("n1", []int{7})
+}
+
+func TestNewLeaderAfterPartition(t *testing.T) {
+	c := newCluster(t, 3, 0)
+	old := c.leader()
+	if err := c.propose(old, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	c.net.setDown(old, true)
+	leader := c.leader()
+	if leader == old {
+		t.Fatal("cut off node still leads")
+	}
+	// The old leader can't commit anything alone.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	err := c.nodes[old].Propose(ctx, []byte("99"))
+	cancel()
+	if err == nil {
+		t.Fatal("cut off leader committed a proposal")
+	}
+	if err := c.propose(leader, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	// Back on the network it drops its uncommitted entry and catches up.
+	c.net.setDown(old, false)
+	if err := c.propose(leader, 3); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range c.ids {
+		c.waitApplied(id, []int{1, 2, 3})
+	}
+}
+
+func TestRestartKeepsLog(t *testing.T) {
+	c := newCluster(t, 3, 0)
+	leader := c.leader()
+	for i := 1; i <= 3; i++ {
+		if err := c.propose(leader, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, id := range c.ids {
+		c.waitApplied(id, []int{1, 2, 3})
+	}
+
+	for _, id := range c.ids {
+		c.stop(id)
+	}
+	for _, id := range c.ids {
+		c.start(id, 0)
+	}
+	if err := c.propose(c.leader(), 4); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range c.ids {
+		c.waitApplied(id, []int{1, 2, 3, 4})
+	}
+}
+
+func TestSnapshotCatchesUpLaggingNode(t *testing.T) {
+	c := newCluster(t, 3, 5)
+	leader := c.leader()
+	var lagging string
+	for _, id := range c.ids {
+		if id != leader {
+			lagging = id
+		}
+	}
+	c.stop(lagging)
+
+	var want []int
+	for i := 1; i <= 20; i++ {
+		if err := c.propose(leader, i); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, i)
+	}
+	c.waitApplied(leader, want)
+	if st := c.nodes[leader].Status(); st.Snapshot == 0 {
+		t.Fatalf("log was never compacted: %+v", st)
+	}
+
+	// What it missed is no longer in the log, so it gets the snapshot.
+	c.start(lagging, 5)
+	c.waitApplied(lagging, want)
+
+	// And the snapshot is what it restarts from.
+	c.stop(lagging)
+	c.start(lagging, 5)
+	c.waitApplied(lagging, want)
+}
+
+func TestRefusesCallsFromOutsiders(t *testing.T) {
+	c := newCluster(t, 3, 0)
+	leader := c.leader()
+	ctx := context.Background()
+
+	// A stranger, even one claiming to lead with a higher term, is ignored.
+	body, _ := encode(appendEntriesRequest{Term: 1 << 20, Leader: "mallory"})
+	if _, err := c.nodes[leader].Handle(ctx, "mallory", MethodAppendEntries, body); !errors.Is(err, ErrUnknownPeer) {
+		t.Fatalf("append from outsider: %v", err)
+	}
+	if _, err := c.nodes[leader].Handle(ctx, "mallory", MethodPropose, []byte("1")); !errors.Is(err, ErrUnknownPeer) {
+		t.Fatalf("propose from outsider: %v", err)
+	}
+	// And a member cannot speak for another.
+	var other string
+	for _, id := range c.ids {
+		if id != leader {
+			other = id
+		}
+	}
+	body, _ = encode(requestVoteRequest{Term: 1 << 20, Candidate: leader})
+	if _, err := c.nodes[leader].Handle(ctx, other, MethodRequestVote, body); err == nil {
+		t.Fatal("vote request for another node was answered")
+	}
+	if term := c.nodes[leader].Status().Term; term >= 1<<20 {
+		t.Fatalf("took term %d from a refused call", term)
+	}
+}
+
+func TestTornLogRecordIsDropped(t *testing.T) {
+	dir := t.TempDir()
+	st, _, _, _, err := openStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := []Entry{{Index: 1, Term: 1}, {Index: 2, Term: 1, Cmd: []byte("2")}}
+	if err := st.append(entries); err != nil {
+		t.Fatal(err)
+	}
+	// Half of a third record, as a crash mid-write leaves it.
+	st.log.Write([]byte{0, 0, 0, 40, 1, 2})
+	st.close()
+
+	st, _, _, got, err := openStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || string(got[1].Cmd) != "2" {
+		t.Fatalf("read back %+v", got)
+	}
+	// Appending goes after the good records.
+	if err := st.append([]Entry{{Index: 3, Term: 2}}); err != nil {
+		t.Fatal(err)
+	}
+	st.close()
+	if _, _, _, got, err = openStorage(dir); err != nil || len(got) != 3 {
+		t.Fatalf("read back %+v, %v", got, err)
+	}
+}
@@ -0,0 +1,148 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Methods nodes call each other with. Bodies are the gob of the request and
+// reply types below, except for MethodPropose, whose body is the command and
+// whose reply is empty.
+const (
+	MethodRequestVote     = "raft-request-vote"
+	MethodAppendEntries   = "raft-append-entries"
+	MethodInstallSnapshot = "raft-install-snapshot"
+	MethodPropose         = "raft-propose"
+)
+
+// IsMethod reports whether a call for method belongs to Handle.
+func IsMethod(method string) bool {
+	return strings.HasPrefix(method, "raft-")
+}
+
+// Transport carries calls to the other nodes, by id. The node at the other
+// end passes them to its Handle.
+type Transport interface {
+	Call(ctx context.Context, peer, method string, body []byte) ([]byte, error)
+}
+
+type requestVoteRequest struct {
+	Term         uint64
+	Candidate    string
+	LastLogIndex uint64
+	LastLogTerm  uint64
+}
+
+type requestVoteReply struct {
+	Term    uint64
+	Granted bool
+}
+
+type appendEntriesRequest struct {
+	Term         uint64
+	Leader       string
+	PrevLogIndex uint64
+	PrevLogTerm  uint64
+	Entries      []Entry
+	LeaderCommit uint64
+}
+
+// ConflictIndex, on a failure, is where the leader should try from next.
+type appendEntriesReply struct {
+	Term          uint64
+	Success       bool
+	ConflictIndex uint64
+}
+
+type installSnapshotRequest struct {
+	Term      uint64
+	Leader    string
+	LastIndex uint64
+	LastTerm  uint64
+	Data      []byte
+}
+
+type installSnapshotReply struct {
+	Term uint64
+}
+
+// Handle answers a call node from made through its Transport. from must
+// be the id the transport authenticated the caller as; calls from nodes
+// outside Config.Peers, or naming another node as candidate or leader,
+// are refused.
+func (n *Node) Handle(ctx context.Context, from, method string, body []byte) ([]byte, error) {
+	n.mu.Lock()
+	stopped := n.stopped
+	n.mu.Unlock()
+	if stopped {
+		return nil, ErrStopped
+	}
+	if !slices.Contains(n.cfg.Peers, from) {
+		return nil, ErrUnknownPeer
+	}
+
+	switch method {
+	case MethodRequestVote:
+		var req requestVoteRequest
+		if err := decode(body, &req); err != nil {
+			return nil, err
+		}
+		if req.Candidate != from {
+			return nil, fmt.Errorf("raft: %s asked for votes for %s", from, req.Candidate)
+		}
+		return encode(n.handleRequestVote(req))
+	case MethodAppendEntries:
+		var req appendEntriesRequest
+		if err := decode(body, &req); err != nil {
+			return nil, err
+		}
+		if req.Leader != from {
+			return nil, fmt.Errorf("raft: %s claims to send for leader %s", from, req.Leader)
+		}
+		return encode(n.handleAppendEntries(req))
+	case MethodInstallSnapshot:
+		var req installSnapshotRequest
+		if err := decode(body, &req); err != nil {
+			return nil, err
+		}
+		if req.Leader != from {
+			return nil, fmt.Errorf("raft: %s claims to send for leader %s", from, req.Leader)
+		}
+		return encode(n.handleInstallSnapshot(req))
+	case MethodPropose:
+		// Forwarded once only: a node that lost the lead since refuses.
+		return nil, n.proposeLocal(ctx, body)
+	}
+	return nil, fmt.Errorf("raft: unknown method %q", method)
+}
+
+// call makes a typed call to peer.
+func (n *Node) call(ctx context.Context, peer, method string, req, reply any) error {
+	body, err := encode(req)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, n.cfg.ElectionTimeout)
+	defer cancel()
+	resp, err := n.cfg.Transport.Call(ctx, peer, method, body)
+	if err != nil {
+		return err
+	}
+	return decode(resp, reply)
+}
+
+func encode(v any) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decode(b []byte, v any) error {
+	return gob.NewDecoder(bytes.NewReader(b)).Decode(v)
+}
@@ -0,0 +1,230 @@
+package raft
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// A node keeps, in its Dir:
+//
+//	state.json     the current term and who it voted for
+//	log            the entries after the snapshot, appended as records
+//	snapshot.json  the state machine as of the last compaction
+//
+// Each log record is a 4-byte length and a 4-byte CRC-32 of a JSON Entry,
+// then the JSON. A crash halfway through an append leaves a torn last
+// record, which is cut off on the next start.
+const (
+	stateFile    = "state.json"
+	logFile      = "log"
+	snapshotFile = "snapshot.json"
+)
+
+type hardState struct {
+	Term     uint64 `json:"term"`
+	VotedFor string `json:"voted_for"`
+}
+
+// snapshot is the state machine with every entry up to Index applied.
+type snapshot struct {
+	Index uint64 `json:"index"`
+	Term  uint64 `json:"term"`
+	Data  []byte `json:"data"`
+}
+
+type storage struct {
+	dir string
+	log *os.File
+}
+
+// openStorage reads what dir holds, creating it if need be. The entries it
+// returns follow on from the snapshot with no gaps.
+func openStorage(dir string) (*storage, hardState, snapshot, []Entry, error) {
+	var (
+		hs   hardState
+		snap snapshot
+	)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, hs, snap, nil, err
+	}
+	if err := readJSON(filepath.Join(dir, stateFile), &hs); err != nil {
+		return nil, hs, snap, nil, err
+	}
+	if err := readJSON(filepath.Join(dir, snapshotFile), &snap); err != nil {
+		return nil, hs, snap, nil, err
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, logFile), os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, hs, snap, nil, err
+	}
+	entries, good, err := readLog(f)
+	if err != nil {
+		f.Close()
+		return nil, hs, snap, nil, err
+	}
+	if err := f.Truncate(good); err != nil {
+		f.Close()
+		return nil, hs, snap, nil, err
+	}
+	if _, err := f.Seek(good, io.SeekStart); err != nil {
+		f.Close()
+		return nil, hs, snap, nil, err
+	}
+
+	// A crash between saving a snapshot and rewriting the log leaves
+	// entries the snapshot already covers.
+	for len(entries) > 0 && entries[0].Index <= snap.Index {
+		entries = entries[1:]
+	}
+	for i, e := range entries {
+		if e.Index != snap.Index+uint64(i)+1 {
+			f.Close()
+			return nil, hs, snap, nil, fmt.Errorf("raft log: entry %d where %d was expected", e.Index, snap.Index+uint64(i)+1)
+		}
+	}
+	return &storage{dir: dir, log: f}, hs, snap, entries, nil
+}
+
+// readLog reads records until the end of f or the first one that is torn,
+// and returns the entries and the offset they end at.
+func readLog(f *os.File) ([]Entry, int64, error) {
+	var (
+		entries []Entry
+		good    int64
+		header  [8]byte
+	)
+	r := bufio.NewReader(f)
+	for {
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return entries, good, nil
+		}
+		size := binary.BigEndian.Uint32(header[:4])
+		body := make([]byte, size)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return entries, good, nil
+		}
+		if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(header[4:]) {
+			return entries, good, nil
+		}
+		var e Entry
+		if err := json.Unmarshal(body, &e); err != nil {
+			return nil, 0, fmt.Errorf("raft log at %d: %w", good, err)
+		}
+		entries = append(entries, e)
+		good += int64(len(header) + len(body))
+	}
+}
+
+func (st *storage) saveState(hs hardState) error {
+	return writeJSON(filepath.Join(st.dir, stateFile), hs)
+}
+
+// append adds entries to the end of the log, durably.
+func (st *storage) append(entries []Entry) error {
+	var buf []byte
+	for _, e := range entries {
+		body, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(body)))
+		buf = binary.BigEndian.AppendUint32(buf, crc32.ChecksumIEEE(body))
+		buf = append(buf, body...)
+	}
+	if _, err := st.log.Write(buf); err != nil {
+		return err
+	}
+	return st.log.Sync()
+}
+
+// rewrite replaces the whole log with entries.
+func (st *storage) rewrite(entries []Entry) error {
+	path := filepath.Join(st.dir, logFile)
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	next := &storage{dir: st.dir, log: f}
+	if err := next.append(entries); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	st.log.Close()
+	st.log = f
+	return syncDir(st.dir)
+}
+
+func (st *storage) saveSnapshot(snap snapshot) error {
+	return writeJSON(filepath.Join(st.dir, snapshotFile), snap)
+}
+
+func (st *storage) close() error {
+	return st.log.Close()
+}
+
+// readJSON leaves v alone if path doesn't exist.
+func readJSON(path string, v any) error {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// writeJSON replaces path with v by way of a synced temp file.
+func writeJSON(path string, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
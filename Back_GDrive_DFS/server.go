@@ -1,25 +1,51 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/binary"
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
+	"path/filepath"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/anthdm/foreverstore/p2p"
+	"github.com/anthdm/foreverstore/raft"
+	"github.com/klauspost/compress/zstd"
 )
 
 type FileServerOpts struct {
-	ID                string
-	EncKey            []byte
+	// ID is the node id. It must match the NodeID the transport announces
+	// so that duplicate connections are resolved the same way on both ends.
+	ID   string
+	Keys *KeyManager
+	// StorageRoot is this node's own directory; see files.go for what goes
+	// under it. PathTransformFunc lays out chunk blobs, and Backend holds
+	// them if they shouldn't go on the local disk. ColdBackend, if set,
+	// holds the chunks of files in the cold tier.
 	StorageRoot       string
 	PathTransformFunc PathTransformFunc
-	Transport         p2p.Transport
-	BootstrapNodes    []string
+	Backend           Backend
+	ColdBackend       Backend
+	// Compress turns on zstd for chunks and transfers of files that aren't
+	// compressed already.
+	Compress bool
+	// Throttle limits background transfers to and from peers; nil is
+	// unlimited.
+	Throttle *Throttle
+	// Cluster are the ids of the nodes allowed to connect. Only tests leave
+	// it empty, to allow any.
+	Cluster        []string
+	Transport      p2p.Transport
+	BootstrapNodes []string
 }
 
 type FileServer struct {
@@ -28,36 +54,145 @@ type FileServer struct {
 	peerLock sync.Mutex
 	peers    map[string]p2p.Peer
 
-	store  *Store
+	// fileLock covers reading and replacing manifests.
+	fileLock  sync.Mutex
+	store     *Store
+	cold      *Store
+	manifests *Store
+	// moving holds the files being moved between tiers, by user/name.
+	moving map[string]bool
+	// meta is this node's copy of the cluster's file map, if it keeps one.
+	meta   *Metadata
 	quitch chan struct{}
 }
 
 func NewFileServer(opts FileServerOpts) *FileServer {
-	storeOpts := StoreOpts{
-		Root:              opts.StorageRoot,
-		PathTransformFunc: opts.PathTransformFunc,
-	}
-
 	if len(opts.ID) == 0 {
 		opts.ID = generateID()
 	}
+	if opts.Throttle == nil {
+		opts.Throttle = NewThrottle(0, 0)
+	}
+
+	var cold *Store
+	if opts.ColdBackend != nil {
+		cold = NewStore(StoreOpts{
+			Backend:           opts.ColdBackend,
+			PathTransformFunc: opts.PathTransformFunc,
+		})
+	}
 
 	return &FileServer{
 		FileServerOpts: opts,
-		store:          NewStore(storeOpts),
-		quitch:         make(chan struct{}),
-		peers:          make(map[string]p2p.Peer),
+		cold:           cold,
+		moving:         make(map[string]bool),
+		store: NewStore(StoreOpts{
+			Root:              filepath.Join(opts.StorageRoot, blobsDir),
+			Backend:           opts.Backend,
+			PathTransformFunc: opts.PathTransformFunc,
+		}),
+		manifests: NewStore(StoreOpts{
+			Root:              filepath.Join(opts.StorageRoot, manifestsDir),
+			PathTransformFunc: manifestPathTransformFunc,
+			KeyFunc:           manifestKeyFunc,
+		}),
+		quitch: make(chan struct{}),
+		peers:  make(map[string]p2p.Peer),
 	}
 }
 
+// newFileServerFromEnv builds this node's file server. Nodes talk on
+// P2P_ADDR and dial P2P_PEERS, which defaults to the HTTP peers' hosts on
+// the same port. P2P_TLS_CERT, P2P_TLS_KEY and P2P_TLS_CA turn on mutual
+// TLS; the certificate's common name must be the node id. Without them,
+// nodes prove to each other that they know CLUSTER_SECRET, and a node with
+// neither refuses to start. Chunks go where
+// STORAGE_BACKEND says, or COLD_STORAGE_BACKEND once they go cold; manifests
+// always stay on the local disk. CHUNK_COMPRESSION=none turns off zstd.
+// BACKGROUND_BANDWIDTH and BACKGROUND_PEER_BANDWIDTH limit background
+// transfers, in bytes per second.
+func newFileServerFromEnv(keys *KeyManager) (*FileServer, error) {
+	nodeID := getEnv("NODE_ID", "s1")
+	listenAddr := getEnv("P2P_ADDR", ":3000")
+
+	var bootstrap []string
+	if peers := getEnv("P2P_PEERS", ""); peers != "" {
+		for _, addr := range strings.Split(peers, ",") {
+			bootstrap = append(bootstrap, strings.TrimSpace(addr))
+		}
+	} else {
+		_, port, err := net.SplitHostPort(listenAddr)
+		if err != nil {
+			return nil, fmt.Errorf("P2P_ADDR: %w", err)
+		}
+		for _, peer := range peersList() {
+			bootstrap = append(bootstrap, net.JoinHostPort(parseNodeID(peer), port))
+		}
+	}
+
+	opts := p2p.TCPTransportOpts{
+		ListenAddr:    listenAddr,
+		NodeID:        nodeID,
+		HandshakeFunc: p2p.HelloHandshakeFunc,
+		Decoder:       p2p.DefaultDecoder{},
+	}
+	if cert := getEnv("P2P_TLS_CERT", ""); cert != "" {
+		sec, err := p2p.LoadTLSSecurity(cert, getEnv("P2P_TLS_KEY", ""), getEnv("P2P_TLS_CA", ""))
+		if err != nil {
+			return nil, fmt.Errorf("p2p tls: %w", err)
+		}
+		opts.Security = sec
+	} else if secret := clusterSecret(); len(secret) > 0 {
+		opts.Security = p2p.NewSecretSecurity(secret, nodeID)
+	} else {
+		return nil, errors.New("set P2P_TLS_CERT, P2P_TLS_KEY and P2P_TLS_CA, or CLUSTER_SECRET, so that peers are authenticated")
+	}
+	tr := p2p.NewTCPTransport(opts)
+
+	var cluster []string
+	for _, peer := range peersList() {
+		cluster = append(cluster, parseNodeID(peer))
+	}
+
+	root := filepath.Join(storageRoot(), nodeID)
+	backend, err := newBackendFromEnv(filepath.Join(root, blobsDir), nodeID)
+	if err != nil {
+		return nil, err
+	}
+	cold, err := newColdBackendFromEnv(nodeID, filepath.Join(root, blobsDir))
+	if err != nil {
+		return nil, err
+	}
+
+	s := NewFileServer(FileServerOpts{
+		ID:                nodeID,
+		Keys:              keys,
+		StorageRoot:       root,
+		PathTransformFunc: HashPathTransformFunc,
+		Backend:           backend,
+		ColdBackend:       cold,
+		Compress:          getEnv("CHUNK_COMPRESSION", encodingZstd) == encodingZstd,
+		Throttle:          NewThrottle(getEnvInt64("BACKGROUND_BANDWIDTH", 0), getEnvInt64("BACKGROUND_PEER_BANDWIDTH", 0)),
+		Cluster:           cluster,
+		Transport:         tr,
+		BootstrapNodes:    bootstrap,
+	})
+	tr.OnPeer = s.OnPeer
+	tr.OnPeerEvent = s.OnPeerEvent
+
+	if err := s.openMetadata(cluster); err != nil {
+		return nil, fmt.Errorf("metadata log: %w", err)
+	}
+	return s, nil
+}
+
 func (s *FileServer) broadcast(msg *Message) error {
 	buf := new(bytes.Buffer)
 	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
 		return err
 	}
 
-	for _, peer := range s.peers {
-		peer.Send([]byte{p2p.IncomingMessage})
+	for _, peer := range s.peerList() {
 		if err := peer.Send(buf.Bytes()); err != nil {
 			return err
 		}
@@ -66,148 +201,431 @@ func (s *FileServer) broadcast(msg *Message) error {
 	return nil
 }
 
+func (s *FileServer) peerList() []p2p.Peer {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	peers := make([]p2p.Peer, 0, len(s.peers))
+	for _, p := range s.peers {
+		peers = append(peers, p)
+	}
+	return peers
+}
+
 type Message struct {
 	Payload any
 }
 
+// MessageStoreFile opens a stream carrying Size bytes of a file's plaintext
+// for the peer to store, compressed if Encoding says so. It answers with a
+// MessageResult once written. Modified is when the file was written, so
+// that every replica has the same version. Background transfers are
+// throttled; see Throttle.
 type MessageStoreFile struct {
-	ID   string
-	Key  string
-	Size int64
+	UserID     string
+	Name       string
+	Size       int64
+	Encoding   string
+	Modified   time.Time
+	Background bool
 }
 
+// MessageGetFile asks for a file, on a stream or with methodStatFile. On a
+// stream, Encoding is a compression the asking node can take.
 type MessageGetFile struct {
-	ID  string
-	Key string
+	UserID     string
+	Name       string
+	Encoding   string
+	Background bool
 }
 
-func (s *FileServer) Get(key string) (io.Reader, error) {
-	var fullData bytes.Buffer
-	chunkID := 0
+// MessageResult closes a transfer: on a MessageGetFile stream it comes first
+// and Size bytes follow, in Encoding if set, of the file written at
+// Modified; on a MessageStoreFile stream it is the reply.
+type MessageResult struct {
+	Size     int64
+	Error    string
+	Encoding string
+	Modified time.Time
+}
 
-	for {
-		chunkKey := fmt.Sprintf("%s_chunk_%d", key, chunkID)
+func (r MessageResult) err() error {
+	if r.Error == "" {
+		return nil
+	}
+	return errors.New(r.Error)
+}
 
-		if s.store.Has(s.ID, chunkKey) {
-			fmt.Printf("[%s] serving chunk (%s) from local disk\n", s.Transport.Addr(), chunkKey)
-			_, r, err := s.store.Read(s.ID, chunkKey)
-			if err != nil {
-				return nil, err
-			}
-			io.Copy(&fullData, r)
-		} else {
-			fmt.Printf("[%s] chunk (%s) not found locally, fetching from network...\n", s.Transport.Addr(), chunkKey)
-
-			msg := Message{
-				Payload: MessageGetFile{
-					ID:  s.ID,
-					Key: hashKey(chunkKey),
-				},
-			}
+// MessageFileInfo answers methodStatFile.
+type MessageFileInfo struct {
+	Exists   bool
+	Size     int64
+	Checksum string
+}
 
-			if err := s.broadcast(&msg); err != nil {
-				return nil, err
-			}
+// MessageDropReplica asks a node to delete its copy of a file, if it is the
+// version Checksum.
+type MessageDropReplica struct {
+	UserID   string
+	Name     string
+	Checksum string
+}
 
-			time.Sleep(500 * time.Millisecond)
+// Requests peers answer with Call. The body is the gob of the request type
+// noted next to each method, and so is the response.
+const (
+	methodStatFile    = "stat-file"    // MessageGetFile -> MessageFileInfo
+	methodDropReplica = "drop-replica" // MessageDropReplica -> MessageResult
+)
 
-			for _, peer := range s.peers {
-				var fileSize int64
-				binary.Read(peer, binary.LittleEndian, &fileSize)
+// call makes a typed request to peer, decoding the answer into resp.
+func (s *FileServer) call(ctx context.Context, peer p2p.Peer, method string, req, resp any) error {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(req); err != nil {
+		return err
+	}
+	body, err := peer.Call(ctx, method, buf.Bytes())
+	if err != nil {
+		return err
+	}
+	return gob.NewDecoder(bytes.NewReader(body)).Decode(resp)
+}
 
-				n, err := s.store.WriteDecrypt(s.EncKey, s.ID, chunkKey, io.LimitReader(peer, fileSize))
-				if err != nil {
-					return nil, err
-				}
-				fmt.Printf("[%s] received chunk (%d bytes) from %s\n", s.Transport.Addr(), n, peer.RemoteAddr())
-				peer.CloseStream()
-			}
+// File transfers each get their own stream: a length-prefixed gob Message
+// saying what it is, then the raw bytes.
+const maxStreamHeader = 64 * 1024
 
-			_, r, err := s.store.Read(s.ID, chunkKey)
-			if err != nil {
-				return nil, err
-			}
-			io.Copy(&fullData, r)
-		}
+func writeStreamHeader(w io.Writer, msg *Message) error {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, uint32(buf.Len())); err != nil {
+		return err
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
 
-		chunkID++
+func readStreamHeader(r io.Reader, msg *Message) error {
+	var size uint32
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return err
+	}
+	if size > maxStreamHeader {
+		return fmt.Errorf("stream header of %d bytes is too large", size)
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return err
+	}
+	return gob.NewDecoder(bytes.NewReader(buf)).Decode(msg)
+}
 
-		if !s.store.Has(s.ID, fmt.Sprintf("%s_chunk_%d", key, chunkID)) {
-			break
-		}
+// peer returns the connection to node id.
+func (s *FileServer) peer(id string) (p2p.Peer, error) {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	p, ok := s.peers[id]
+	if !ok {
+		return nil, fmt.Errorf("not connected to %s", id)
 	}
+	return p, nil
+}
 
-	return bytes.NewReader(fullData.Bytes()), nil
+// openStream opens a stream to node id that is reset if ctx ends first.
+func (s *FileServer) openStream(ctx context.Context, id string) (p2p.Stream, func() bool, error) {
+	p, err := s.peer(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	stream, err := p.OpenStream()
+	if err != nil {
+		return nil, nil, err
+	}
+	stop := context.AfterFunc(ctx, func() { stream.Reset() })
+	return stream, stop, nil
 }
 
-func (s *FileServer) Store(key string, r io.Reader) error {
-	const chunkSize = 4 * 1024 * 1024 // 4MB ต่อ chunk
-	buf := make([]byte, chunkSize)
-	chunkID := 0
+// SendFile stores size bytes of r as userID's file name, written at
+// modified, on node id, and returns once the peer has written it.
+func (s *FileServer) SendFile(ctx context.Context, id, userID, name string, r io.Reader, size int64, modified time.Time) error {
+	stream, stop, err := s.openStream(ctx, id)
+	if err != nil {
+		return err
+	}
+	defer stop()
+
+	// Look at the start of the file to see if it's worth compressing.
+	br := bufio.NewReaderSize(r, sniffLen)
+	head, _ := br.Peek(min(sniffLen, int(size)))
+	req := MessageStoreFile{UserID: userID, Name: name, Size: size, Modified: modified, Background: isBackground(ctx)}
+	if s.Compress && !isVaultStorageUser(userID) && compressibleType(sniffContentType(head)) {
+		req.Encoding = encodingZstd
+	}
 
-	for {
-		n, err := r.Read(buf)
-		if n == 0 {
-			break
-		}
+	if err := writeStreamHeader(stream, &Message{Payload: req}); err != nil {
+		stream.Reset()
+		return err
+	}
+	w := s.Throttle.Writer(ctx, id, req.Background, stream)
+	if err := copyEncoded(w, br, size, req.Encoding); err != nil {
+		stream.Reset()
+		return err
+	}
+	if err := stream.Close(); err != nil {
+		return err
+	}
 
-		chunkKey := fmt.Sprintf("%s_chunk_%d", key, chunkID)
-		chunkData := buf[:n]
-		chunkReader := bytes.NewReader(chunkData)
+	var reply Message
+	if err := readStreamHeader(stream, &reply); err != nil {
+		return fmt.Errorf("storing %s on %s: %w", name, id, err)
+	}
+	res, ok := reply.Payload.(MessageResult)
+	if !ok {
+		return fmt.Errorf("unexpected reply %T from %s", reply.Payload, id)
+	}
+	if err := res.err(); err != nil {
+		return fmt.Errorf("storing %s on %s: %w", name, id, err)
+	}
+	return nil
+}
 
-		_, err = s.store.Write(s.ID, chunkKey, chunkReader)
-		if err != nil {
-			return err
-		}
+// FetchFile copies userID's file name from node id to w.
+func (s *FileServer) FetchFile(ctx context.Context, id, userID, name string, w io.Writer) (int64, error) {
+	f, err := s.getFile(ctx, id, userID, name)
+	if err != nil {
+		return 0, err
+	}
+	defer f.close()
+	n, err := io.CopyN(w, f.body, f.Size)
+	if err != nil {
+		f.stream.Reset()
+		return n, fmt.Errorf("fetching %s from %s: %w", name, id, err)
+	}
+	return n, nil
+}
 
-		msg := Message{
-			Payload: MessageStoreFile{
-				ID:   s.ID,
-				Key:  hashKey(chunkKey),
-				Size: int64(n),
-			},
-		}
-		if err := s.broadcast(&msg); err != nil {
-			return err
-		}
+// CopyFile fetches userID's file name from node id and stores it here as
+// the same version, written at the same time.
+func (s *FileServer) CopyFile(ctx context.Context, id, userID, name string) (*Manifest, error) {
+	f, err := s.getFile(ctx, id, userID, name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.close()
+	modified := f.Modified
+	if modified.IsZero() {
+		modified = time.Now()
+	}
+	m, err := s.writeFile(userID, name, &sizedReader{r: f.body, n: f.Size}, modified)
+	if err != nil {
+		f.stream.Reset()
+		return nil, fmt.Errorf("copying %s from %s: %w", name, id, err)
+	}
+	return m, nil
+}
 
-		for _, peer := range s.peers {
-			peer.Send([]byte{p2p.IncomingStream})
-			_, err := chunkReader.Seek(0, io.SeekStart)
-			if err != nil {
-				return err
-			}
-			_, err = copyEncrypt(s.EncKey, chunkReader, peer)
-			if err != nil {
-				return err
-			}
-		}
+// remoteFile is a file a peer has started sending: Size bytes to read from
+// body.
+type remoteFile struct {
+	MessageResult
+	body   io.Reader
+	stream p2p.Stream
+	close  func()
+}
+
+func (s *FileServer) getFile(ctx context.Context, id, userID, name string) (*remoteFile, error) {
+	stream, stop, err := s.openStream(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	fail := func(err error) (*remoteFile, error) {
+		stream.Reset()
+		stop()
+		return nil, err
+	}
 
-		chunkID++
-		if err == io.EOF {
-			break
+	req := MessageGetFile{UserID: userID, Name: name, Background: isBackground(ctx)}
+	if s.Compress {
+		req.Encoding = encodingZstd
+	}
+	if err := writeStreamHeader(stream, &Message{Payload: req}); err != nil {
+		return fail(err)
+	}
+
+	var reply Message
+	if err := readStreamHeader(stream, &reply); err != nil {
+		return fail(fmt.Errorf("fetching %s from %s: %w", name, id, err))
+	}
+	res, ok := reply.Payload.(MessageResult)
+	if !ok {
+		return fail(fmt.Errorf("unexpected reply %T from %s", reply.Payload, id))
+	}
+	if err := res.err(); err != nil {
+		return fail(fmt.Errorf("fetching %s from %s: %w", name, id, err))
+	}
+
+	body, done, err := decodedReader(s.Throttle.Reader(ctx, id, req.Background, stream), res.Encoding)
+	if err != nil {
+		return fail(err)
+	}
+	return &remoteFile{
+		MessageResult: res,
+		body:          body,
+		stream:        stream,
+		close: func() {
+			done()
+			stream.Close()
+			stop()
+		},
+	}, nil
+}
+
+// copyEncoded writes size bytes of r to w in encoding.
+func copyEncoded(w io.Writer, r io.Reader, size int64, encoding string) error {
+	if encoding != encodingZstd {
+		_, err := io.CopyN(w, r, size)
+		return err
+	}
+	enc, err := zstd.NewWriter(w)
+	if err != nil {
+		return err
+	}
+	if _, err := io.CopyN(enc, r, size); err != nil {
+		enc.Close()
+		return err
+	}
+	return enc.Close()
+}
+
+// decodedReader reads what r carries in encoding. done frees the decoder.
+func decodedReader(r io.Reader, encoding string) (io.Reader, func(), error) {
+	switch encoding {
+	case "":
+		return r, func() {}, nil
+	case encodingZstd:
+		dec, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, nil, err
 		}
+		return dec, dec.Close, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown transfer encoding %q", encoding)
 	}
+}
 
-	fmt.Printf("[%s] finished storing file (%s) in %d chunks\n", s.Transport.Addr(), key, chunkID)
-	return nil
+// HasFileOn asks node id whether it holds userID's file name.
+func (s *FileServer) HasFileOn(ctx context.Context, id, userID, name string) (bool, error) {
+	info, err := s.StatFileOn(ctx, id, userID, name)
+	return info.Exists, err
+}
+
+// StatFileOn asks node id about its copy of userID's file name.
+func (s *FileServer) StatFileOn(ctx context.Context, id, userID, name string) (MessageFileInfo, error) {
+	var info MessageFileInfo
+	p, err := s.peer(id)
+	if err != nil {
+		return info, err
+	}
+	err = s.call(ctx, p, methodStatFile, MessageGetFile{UserID: userID, Name: name}, &info)
+	return info, err
+}
+
+// DropReplicaOn has node id delete its copy of userID's file name, as long
+// as it is the version checksum. A node without a copy has nothing to do.
+func (s *FileServer) DropReplicaOn(ctx context.Context, id, userID, name, checksum string) error {
+	p, err := s.peer(id)
+	if err != nil {
+		return err
+	}
+	var res MessageResult
+	if err := s.call(ctx, p, methodDropReplica, MessageDropReplica{UserID: userID, Name: name, Checksum: checksum}, &res); err != nil {
+		return err
+	}
+	return res.err()
 }
 
 func (s *FileServer) Stop() {
+	if s.meta != nil {
+		s.meta.raft.Stop()
+	}
 	close(s.quitch)
 }
 
+// OnPeer registers a connected peer under its node id. When two nodes dial
+// each other at once they end up with two connections, and both sides must
+// drop the same one: we keep the connection dialed by the lower node id.
 func (s *FileServer) OnPeer(p p2p.Peer) error {
+	id := peerID(p)
+	if id == s.ID {
+		return fmt.Errorf("refusing connection to ourselves (%s)", p.RemoteAddr())
+	}
+	if len(s.Cluster) > 0 && !slices.Contains(s.Cluster, id) {
+		return fmt.Errorf("refusing connection from %q (%s), which is not in the cluster", id, p.RemoteAddr())
+	}
+
 	s.peerLock.Lock()
 	defer s.peerLock.Unlock()
 
-	s.peers[p.RemoteAddr().String()] = p
+	if old, ok := s.peers[id]; ok {
+		if !s.preferConn(id, p, old) {
+			return fmt.Errorf("already connected to %s, dropping duplicate from %s", id, p.RemoteAddr())
+		}
+		log.Printf("replacing connection to %s (%s) with %s", id, old.RemoteAddr(), p.RemoteAddr())
+		old.Close()
+	}
+	s.peers[id] = p
 
-	log.Printf("connected with remote %s", p.RemoteAddr())
+	log.Printf("connected with remote %s (%s)", id, p.RemoteAddr())
 
 	return nil
 }
 
+// OnPeerEvent keeps the peer map in step with the transport: a peer whose
+// connection died is forgotten, unless it was already replaced.
+func (s *FileServer) OnPeerEvent(ev p2p.PeerEvent) {
+	switch ev.Type {
+	case p2p.PeerDisconnected:
+		id := peerID(ev.Peer)
+
+		s.peerLock.Lock()
+		if s.peers[id] == ev.Peer {
+			delete(s.peers, id)
+		}
+		s.peerLock.Unlock()
+
+		log.Printf("disconnected from %s (%s): %v", id, ev.Addr, ev.Err)
+	case p2p.PeerReconnecting:
+		log.Printf("redialing %s in %s (attempt %d)", ev.Addr, ev.Delay, ev.Attempt)
+	}
+}
+
+// peerID is the peer's node id, or its address if the handshake didn't
+// exchange one.
+func peerID(p p2p.Peer) string {
+	if id := p.Info().NodeID; id != "" {
+		return id
+	}
+	return p.RemoteAddr().String()
+}
+
+// preferConn reports whether conn should replace old, both to node id.
+func (s *FileServer) preferConn(id string, conn, old p2p.Peer) bool {
+	dialer := func(p p2p.Peer) string {
+		if p.Outbound() {
+			return s.ID
+		}
+		return id
+	}
+	// The same side dialing again means the old connection is stale.
+	if dialer(conn) == dialer(old) {
+		return true
+	}
+	return dialer(conn) < dialer(old)
+}
+
 func (s *FileServer) loop() {
 	defer func() {
 		log.Println("file server stopped due to error or user quit action")
@@ -217,9 +635,19 @@ func (s *FileServer) loop() {
 	for {
 		select {
 		case rpc := <-s.Transport.Consume():
+			if rpc.Stream != nil {
+				go s.handleStream(rpc.From, rpc.Stream)
+				continue
+			}
+			if rpc.Request != nil {
+				go s.handleRequest(rpc.From, rpc.Request)
+				continue
+			}
+
 			var msg Message
 			if err := gob.NewDecoder(bytes.NewReader(rpc.Payload)).Decode(&msg); err != nil {
 				log.Println("decoding error: ", err)
+				continue
 			}
 			if err := s.handleMessage(rpc.From, &msg); err != nil {
 				log.Println("handle message error: ", err)
@@ -231,67 +659,193 @@ func (s *FileServer) loop() {
 	}
 }
 
+// handleMessage handles messages sent with broadcast. Chunk uploads come in
+// on streams and fetches as requests, see handleStream and handleRequest.
 func (s *FileServer) handleMessage(from string, msg *Message) error {
-	switch v := msg.Payload.(type) {
-	case MessageStoreFile:
-		return s.handleMessageStoreFile(from, v)
-	case MessageGetFile:
-		return s.handleMessageGetFile(from, v)
+	return fmt.Errorf("unexpected message %T from %s", msg.Payload, from)
+}
+
+// handleStream serves a stream a peer opened. Each one runs in its own
+// goroutine so a slow transfer doesn't hold up the others.
+func (s *FileServer) handleStream(from string, stream p2p.Stream) {
+	var msg Message
+	err := readStreamHeader(stream, &msg)
+	if err == nil {
+		switch v := msg.Payload.(type) {
+		case MessageStoreFile:
+			err = s.handleStoreFile(from, v, stream)
+		case MessageGetFile:
+			err = s.handleGetFile(from, v, stream)
+		default:
+			err = fmt.Errorf("unexpected stream message %T", v)
+		}
 	}
 
-	return nil
+	if err != nil {
+		log.Println("handle stream error: ", err)
+		stream.Reset()
+		return
+	}
+	stream.Close()
 }
 
-func (s *FileServer) handleMessageGetFile(from string, msg MessageGetFile) error {
-	if !s.store.Has(msg.ID, msg.Key) {
-		return fmt.Errorf("[%s] need to serve file (%s) but it does not exist on disk", s.Transport.Addr(), msg.Key)
+// handleRequest answers a call from a peer.
+func (s *FileServer) handleRequest(from string, req *p2p.Request) {
+	if raft.IsMethod(req.Method) && s.meta != nil {
+		body, err := s.meta.raft.Handle(req.Context(), from, req.Method, req.Payload)
+		if err := req.Respond(body, err); err != nil {
+			log.Printf("[%s] failed to answer %s from %s: %v", s.Transport.Addr(), req.Method, from, err)
+		}
+		return
 	}
 
-	fmt.Printf("[%s] serving file (%s) over the network\n", s.Transport.Addr(), msg.Key)
+	var (
+		resp any
+		err  error
+	)
+	switch req.Method {
+	case methodStatFile:
+		var msg MessageGetFile
+		if err = gob.NewDecoder(bytes.NewReader(req.Payload)).Decode(&msg); err == nil {
+			resp = s.handleStatFile(msg)
+		}
+	case methodDropReplica:
+		var msg MessageDropReplica
+		if err = gob.NewDecoder(bytes.NewReader(req.Payload)).Decode(&msg); err == nil {
+			resp = s.handleDropReplica(from, msg)
+		}
+	default:
+		err = fmt.Errorf("unknown method %q", req.Method)
+	}
 
-	fileSize, r, err := s.store.Read(msg.ID, msg.Key)
+	var body []byte
+	if err == nil {
+		buf := new(bytes.Buffer)
+		err = gob.NewEncoder(buf).Encode(resp)
+		body = buf.Bytes()
+	}
+	if err := req.Respond(body, err); err != nil {
+		log.Printf("[%s] failed to answer %s from %s: %v", s.Transport.Addr(), req.Method, from, err)
+	}
+}
+
+func (s *FileServer) handleStatFile(msg MessageGetFile) *MessageFileInfo {
+	if !validFileName(msg.UserID) || !validFileName(msg.Name) {
+		return &MessageFileInfo{}
+	}
+	m, err := s.StatFile(msg.UserID, msg.Name)
 	if err != nil {
-		return err
+		return &MessageFileInfo{}
 	}
+	return &MessageFileInfo{Exists: true, Size: m.Size, Checksum: m.Checksum}
+}
 
-	if rc, ok := r.(io.ReadCloser); ok {
-		fmt.Println("closing readCloser")
-		defer rc.Close()
+func (s *FileServer) handleDropReplica(from string, msg MessageDropReplica) *MessageResult {
+	if !validFileName(msg.UserID) || !validFileName(msg.Name) {
+		return &MessageResult{Error: "invalid file name"}
 	}
+	if err := s.dropReplica(msg.UserID, msg.Name, msg.Checksum); err != nil {
+		return &MessageResult{Error: err.Error()}
+	}
+	log.Printf("[%s] dropped %s/%s for %s", s.Transport.Addr(), msg.UserID, msg.Name, from)
+	return &MessageResult{}
+}
 
-	peer, ok := s.peers[from]
-	if !ok {
-		return fmt.Errorf("peer %s not in map", from)
+func (s *FileServer) handleStoreFile(from string, msg MessageStoreFile, stream p2p.Stream) error {
+	if !validFileName(msg.UserID) || !validFileName(msg.Name) {
+		return fmt.Errorf("[%s] refusing to store %q/%q from %s", s.Transport.Addr(), msg.UserID, msg.Name, from)
 	}
 
-	peer.Send([]byte{p2p.IncomingStream})
-	binary.Write(peer, binary.LittleEndian, fileSize)
-	n, err := io.Copy(peer, r)
+	var res MessageResult
+	in := s.Throttle.Reader(context.Background(), from, msg.Background, stream)
+	body, done, err := decodedReader(in, msg.Encoding)
 	if err != nil {
-		return err
+		res.Error = err.Error()
+		return writeStreamHeader(stream, &Message{Payload: res})
 	}
-
-	fmt.Printf("[%s] written (%d) bytes over the network to %s\n", s.Transport.Addr(), n, from)
-
-	return nil
+	defer done()
+	modified := msg.Modified
+	if modified.IsZero() {
+		modified = time.Now()
+	}
+	m, err := s.writeFile(msg.UserID, msg.Name, &sizedReader{r: body, n: msg.Size}, modified)
+	if err != nil {
+		res.Error = err.Error()
+	} else {
+		res.Size = m.Size
+		log.Printf("[%s] stored %s/%s (%d bytes) from %s", s.Transport.Addr(), msg.UserID, msg.Name, m.Size, from)
+	}
+	return writeStreamHeader(stream, &Message{Payload: res})
 }
 
-func (s *FileServer) handleMessageStoreFile(from string, msg MessageStoreFile) error {
-	peer, ok := s.peers[from]
-	if !ok {
-		return fmt.Errorf("peer (%s) could not be found in the peer list", from)
+func (s *FileServer) handleGetFile(from string, msg MessageGetFile, stream p2p.Stream) error {
+	if !validFileName(msg.UserID) || !validFileName(msg.Name) {
+		return writeStreamHeader(stream, &Message{Payload: MessageResult{Error: "invalid file name"}})
+	}
+	m, err := s.StatFile(msg.UserID, msg.Name)
+	if err != nil {
+		return writeStreamHeader(stream, &Message{Payload: MessageResult{Error: "file not found"}})
+	}
+	res := MessageResult{Size: m.Size, Modified: m.Modified}
+	if s.Compress && msg.Encoding == encodingZstd && compressibleType(m.ContentType) {
+		res.Encoding = encodingZstd
+	}
+	if err := writeStreamHeader(stream, &Message{Payload: res}); err != nil {
+		return err
 	}
 
-	n, err := s.store.Write(msg.ID, msg.Key, io.LimitReader(peer, msg.Size))
+	w := s.Throttle.Writer(context.Background(), from, msg.Background, stream)
+	var enc *zstd.Encoder
+	if res.Encoding == encodingZstd {
+		if enc, err = zstd.NewWriter(w); err != nil {
+			return err
+		}
+		w = enc
+	}
+	n, err := s.readFile(msg.UserID, msg.Name, w, !msg.Background)
+	if enc != nil {
+		if cerr := enc.Close(); err == nil {
+			err = cerr
+		}
+	}
 	if err != nil {
 		return err
 	}
+	log.Printf("[%s] served %s/%s (%d bytes) to %s", s.Transport.Addr(), msg.UserID, msg.Name, n, from)
+	return nil
+}
 
-	fmt.Printf("[%s] written %d bytes to disk\n", s.Transport.Addr(), n)
+var errTruncated = errors.New("transfer ended early")
 
-	peer.CloseStream()
+// sizedReader reads exactly n bytes of r. Running out early is an error
+// rather than EOF, so a cut transfer is never stored as a shorter file.
+type sizedReader struct {
+	r io.Reader
+	n int64
+}
 
-	return nil
+func (s *sizedReader) Read(p []byte) (int, error) {
+	if s.n <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > s.n {
+		p = p[:s.n]
+	}
+	n, err := s.r.Read(p)
+	s.n -= int64(n)
+	if err == io.EOF && s.n > 0 {
+		err = errTruncated
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+// validFileName reports whether a user id or file name from a peer is a
+// single path element.
+func validFileName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, `/\`)
 }
 
 func (s *FileServer) bootstrapNetwork() error {
@@ -300,12 +854,8 @@ func (s *FileServer) bootstrapNetwork() error {
 			continue
 		}
 
-		go func(addr string) {
-			fmt.Printf("[%s] attemping to connect with remote %s\n", s.Transport.Addr(), addr)
-			if err := s.Transport.Dial(addr); err != nil {
-				log.Println("dial error: ", err)
-			}
-		}(addr)
+		fmt.Printf("[%s] attemping to connect with remote %s\n", s.Transport.Addr(), addr)
+		s.Transport.DialPersistent(addr)
 	}
 
 	return nil
@@ -319,6 +869,9 @@ func (s *FileServer) Start() error {
 	}
 
 	s.bootstrapNetwork()
+	if s.meta != nil {
+		s.meta.raft.Start()
+	}
 
 	s.loop()
 
@@ -328,4 +881,5 @@ func (s *FileServer) Start() error {
 func init() {
 	gob.Register(MessageStoreFile{})
 	gob.Register(MessageGetFile{})
+	gob.Register(MessageResult{})
 }
@@ -0,0 +1,491 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/anthdm/foreverstore/p2p"
+)
+
+type fakePeer struct {
+	id       string
+	outbound bool
+	closed   bool
+}
+
+func (p *fakePeer) RemoteAddr() net.Addr            { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)} }
+func (p *fakePeer) Info() p2p.PeerInfo              { return p2p.PeerInfo{NodeID: p.id} }
+func (p *fakePeer) Outbound() bool                  { return p.outbound }
+func (p *fakePeer) Send([]byte) error               { return nil }
+func (p *fakePeer) OpenStream() (p2p.Stream, error) { return nil, p2p.ErrPeerClosed }
+func (p *fakePeer) Close() error                    { p.closed = true; return nil }
+func (p *fakePeer) Call(context.Context, string, []byte) ([]byte, error) {
+	return nil, p2p.ErrPeerClosed
+}
+
+func TestOnPeerDedupesByNodeID(t *testing.T) {
+	// Both nodes dialed each other. Whichever order the connections arrive
+	// in, both ends must keep the one dialed by the lower id, "a".
+	a := &FileServer{FileServerOpts: FileServerOpts{ID: "a"}, peers: map[string]p2p.Peer{}}
+	b := &FileServer{FileServerOpts: FileServerOpts{ID: "b"}, peers: map[string]p2p.Peer{}}
+
+	aDialed := &fakePeer{id: "b", outbound: true}
+	bDialed := &fakePeer{id: "b"}
+	if err := a.OnPeer(aDialed); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.OnPeer(bDialed); err == nil {
+		t.Error("a should drop the connection b dialed")
+	}
+	if a.peers["b"] != aDialed || len(a.peers) != 1 {
+		t.Errorf("a kept the wrong connection: %+v", a.peers)
+	}
+
+	aDialedAtB := &fakePeer{id: "a"}
+	bDialedAtB := &fakePeer{id: "a", outbound: true}
+	if err := b.OnPeer(bDialedAtB); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.OnPeer(aDialedAtB); err != nil {
+		t.Fatal(err)
+	}
+	if b.peers["a"] != aDialedAtB || !bDialedAtB.closed {
+		t.Errorf("b kept the wrong connection: %+v", b.peers)
+	}
+
+	// A redial from the same side replaces the stale connection.
+	again := &fakePeer{id: "b", outbound: true}
+	if err := a.OnPeer(again); err != nil {
+		t.Fatal(err)
+	}
+	if a.peers["b"] != again || !aDialed.closed {
+		t.Error("redial should replace the old connection")
+	}
+
+	if err := a.OnPeer(&fakePeer{id: "a"}); err == nil {
+		t.Error("expected a connection to ourselves to be refused")
+	}
+}
+
+func TestOnPeerRefusesUnknownNode(t *testing.T) {
+	s := &FileServer{FileServerOpts: FileServerOpts{ID: "s1", Cluster: []string{"s2", "s3"}}, peers: map[string]p2p.Peer{}}
+	if err := s.OnPeer(&fakePeer{id: "s2"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.OnPeer(&fakePeer{id: "s9"}); err == nil || len(s.peers) != 1 {
+		t.Errorf("a node outside the cluster was let in: %v", err)
+	}
+}
+
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+func newLocalFileServer(t *testing.T, keys *KeyManager) *FileServer {
+	t.Helper()
+	return NewFileServer(FileServerOpts{
+		ID:                "s1",
+		Keys:              keys,
+		StorageRoot:       t.TempDir(),
+		PathTransformFunc: HashPathTransformFunc,
+		Compress:          true,
+	})
+}
+
+// blobsOnDisk returns the contents of every chunk blob s has stored.
+func blobsOnDisk(t *testing.T, s *FileServer) [][]byte {
+	t.Helper()
+	var blobs [][]byte
+	filepath.WalkDir(s.store.Root, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			b, _ := os.ReadFile(path)
+			blobs = append(blobs, b)
+		}
+		return err
+	})
+	return blobs
+}
+
+func TestWriteFileEncryptsAtRest(t *testing.T) {
+	s := newLocalFileServer(t, newTestKeyManager(t))
+
+	data := bytes.Repeat([]byte("plaintext secret "), (ChunkSize*5/2)/17)
+	m, err := s.WriteFile("alice", "notes.txt", bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Chunks) != 3 || m.Size != int64(len(data)) {
+		t.Errorf("have %d chunks of %d bytes, want 3 of %d", len(m.Chunks), m.Size, len(data))
+	}
+
+	blobs := blobsOnDisk(t, s)
+	if len(blobs) != 3 {
+		t.Fatalf("have %d blobs on disk", len(blobs))
+	}
+	for _, b := range blobs {
+		if bytes.Contains(b, []byte("plaintext secret")) {
+			t.Error("chunk is stored in the clear")
+		}
+	}
+	// Blobs are addressed by their content.
+	sum := sha256.Sum256(blobs[0])
+	if !s.store.Has("alice", hex.EncodeToString(sum[:])) {
+		t.Error("blob is not stored under its hash")
+	}
+
+	var out bytes.Buffer
+	n, err := s.ReadFile("alice", "notes.txt", &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(data)) || !bytes.Equal(out.Bytes(), data) {
+		t.Errorf("round trip mismatch: have %d bytes want %d", n, len(data))
+	}
+
+	// Without the right master key the file can't be read.
+	s.Keys = newTestKeyManager(t)
+	if _, err := s.ReadFile("alice", "notes.txt", &bytes.Buffer{}); err == nil {
+		t.Error("expected reading under the wrong master key to fail")
+	}
+}
+
+func TestWriteFileReplacesAndDeletes(t *testing.T) {
+	s := newLocalFileServer(t, newTestKeyManager(t))
+
+	long := make([]byte, ChunkSize*2+10)
+	rand.Read(long)
+	if _, err := s.WriteFile("alice", "a.bin", bytes.NewReader(long)); err != nil {
+		t.Fatal(err)
+	}
+	short := []byte("short")
+	if _, err := s.WriteFile("alice", "a.bin", bytes.NewReader(short)); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if _, err := s.ReadFile("alice", "a.bin", &out); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), short) {
+		t.Errorf("rewrite left old data behind: have %d bytes", out.Len())
+	}
+	if n := len(blobsOnDisk(t, s)); n != 1 {
+		t.Errorf("have %d blobs after rewrite, want 1", n)
+	}
+
+	s.WriteFile("bob", "a.bin", bytes.NewReader(short))
+	if files, _ := s.ListFiles("alice"); len(files) != 1 || files[0] != "a.bin" {
+		t.Errorf("have files %v", files)
+	}
+	if files, used, err := s.Usage("alice"); files != 1 || used == 0 || err != nil {
+		t.Errorf("have %d files using %d bytes, %v", files, used, err)
+	}
+	walked := map[string]string{}
+	s.WalkFiles(func(userID string, m *Manifest) error {
+		walked[userID] = m.Name
+		return nil
+	})
+	if len(walked) != 2 || walked["alice"] != "a.bin" || walked["bob"] != "a.bin" {
+		t.Errorf("walked %v", walked)
+	}
+
+	if err := s.DeleteFile("alice", "a.bin"); err != nil {
+		t.Fatal(err)
+	}
+	if s.HasFile("alice", "a.bin") || !s.HasFile("bob", "a.bin") {
+		t.Error("delete removed the wrong file")
+	}
+	if n := len(blobsOnDisk(t, s)); n != 1 {
+		t.Errorf("have %d blobs after delete, want 1", n)
+	}
+	if err := s.DeleteFile("alice", "a.bin"); err != nil {
+		t.Errorf("deleting a missing file: %v", err)
+	}
+}
+
+func TestWriteFileCompresses(t *testing.T) {
+	s := newLocalFileServer(t, newTestKeyManager(t))
+	stored := func() (n int) {
+		for _, b := range blobsOnDisk(t, s) {
+			n += len(b)
+		}
+		return n
+	}
+
+	text := bytes.Repeat([]byte("2026-10-18 12:00:00 GET /api/files 200\n"), ChunkSize/20)
+	m, err := s.WriteFile("alice", "access.log", bytes.NewReader(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := stored(); n > len(text)/10 {
+		t.Errorf("%d bytes of text stored as %d", len(text), n)
+	}
+	if m.ContentType != "text/plain; charset=utf-8" || len(m.Chunks) != 2 {
+		t.Errorf("have %q in %d chunks", m.ContentType, len(m.Chunks))
+	}
+
+	// Looks like a PNG, so isn't compressed, however well it would.
+	png := append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, ChunkSize/2)...)
+	before := stored()
+	if _, err := s.WriteFile("alice", "image.png", bytes.NewReader(png)); err != nil {
+		t.Fatal(err)
+	}
+	if n := stored() - before; n < len(png) {
+		t.Errorf("%d byte image stored as %d", len(png), n)
+	}
+
+	for name, want := range map[string][]byte{"access.log": text, "image.png": png} {
+		var out bytes.Buffer
+		if _, err := s.ReadFile("alice", name, &out); err != nil || !bytes.Equal(out.Bytes(), want) {
+			t.Errorf("%s: read %d bytes, %v", name, out.Len(), err)
+		}
+	}
+}
+
+func TestVaultBlobsAreNotSniffed(t *testing.T) {
+	s := newLocalFileServer(t, newTestKeyManager(t))
+	text := bytes.Repeat([]byte("looks like text, but it is a vault blob\n"), ChunkSize/40)
+	m, err := s.WriteFile(vaultStorageUser("v1"), "blob1", bytes.NewReader(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.ContentType != "" {
+		t.Errorf("vault blob sniffed as %q", m.ContentType)
+	}
+	if n := len(blobsOnDisk(t, s)[0]); n < len(text) {
+		t.Errorf("%d byte vault blob stored as %d", len(text), n)
+	}
+}
+
+func TestReadFileWithoutCodecHeader(t *testing.T) {
+	s := newLocalFileServer(t, newTestKeyManager(t))
+
+	// Written before chunks had a codec header.
+	fk, _ := s.Keys.NewFileKey()
+	wrapped, _ := s.Keys.WrapFileKey(fk, "alice", "old.txt")
+	var sealed bytes.Buffer
+	sealStream(fk.ID, fk.Key, strings.NewReader("old chunk"), &sealed)
+	sum := sha256.Sum256(sealed.Bytes())
+	key := hex.EncodeToString(sum[:])
+	s.store.Write("alice", key, &sealed)
+	m := &Manifest{Name: "old.txt", Size: 9, FileKey: wrapped, Chunks: []ChunkRef{{Key: key, Size: 9}}}
+	if err := s.writeManifest("alice", m); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if _, err := s.ReadFile("alice", "old.txt", &out); err != nil || out.String() != "old chunk" {
+		t.Errorf("have %q, %v", out.String(), err)
+	}
+}
+
+func TestCollectGarbage(t *testing.T) {
+	s := newLocalFileServer(t, newTestKeyManager(t))
+
+	if _, err := s.WriteFile("alice", "kept.txt", bytes.NewReader([]byte("kept"))); err != nil {
+		t.Fatal(err)
+	}
+	// Left by writes that never got as far as a manifest, one long ago and
+	// one that may still be going.
+	old, fresh := strings.Repeat("a", 64), strings.Repeat("b", 64)
+	s.store.Write("alice", old, strings.NewReader("orphan"))
+	s.store.Write("alice", fresh, strings.NewReader("in flight"))
+	past := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(filepath.Join(s.store.Root, "alice", "aa", "aa", old), past, past)
+
+	n, err := s.CollectGarbage(time.Hour)
+	if err != nil || n != 1 {
+		t.Fatalf("collected %d, %v", n, err)
+	}
+	if s.store.Has("alice", old) || !s.store.Has("alice", fresh) {
+		t.Error("collected the wrong chunk")
+	}
+	if _, err := os.Stat(filepath.Join(s.store.Root, "alice", "aa")); !os.IsNotExist(err) {
+		t.Errorf("empty directories left behind: %v", err)
+	}
+
+	var out bytes.Buffer
+	if _, err := s.ReadFile("alice", "kept.txt", &out); err != nil || out.String() != "kept" {
+		t.Errorf("have %q, %v", out.String(), err)
+	}
+}
+
+func TestMigrateLegacyFiles(t *testing.T) {
+	s := newLocalFileServer(t, newTestKeyManager(t))
+
+	// Written before encryption at rest.
+	plain := filepath.Join(s.StorageRoot, "bob", "old.txt")
+	os.MkdirAll(plain, 0o755)
+	os.WriteFile(filepath.Join(plain, "0.chunk"), []byte("written before "), 0o644)
+	os.WriteFile(filepath.Join(plain, "1.chunk"), []byte("encryption"), 0o644)
+
+	// Encrypted, with the data key in file.key.
+	sealed := filepath.Join(s.StorageRoot, "alice", "new.txt")
+	os.MkdirAll(sealed, 0o755)
+	fk, _ := s.Keys.NewFileKey()
+	wrapped, _ := s.Keys.WrapFileKey(fk, "alice", "new.txt")
+	os.WriteFile(filepath.Join(sealed, legacyFileKeyName), wrapped, 0o600)
+	var chunk bytes.Buffer
+	sealStream(fk.ID, fk.Key, strings.NewReader("sealed in place"), &chunk)
+	os.WriteFile(filepath.Join(sealed, "0.chunk"), chunk.Bytes(), 0o644)
+
+	n, err := s.migrateLegacyFiles()
+	if err != nil || n != 2 {
+		t.Fatalf("have %d migrated, %v", n, err)
+	}
+	for _, f := range []struct{ user, name, want string }{
+		{"bob", "old.txt", "written before encryption"},
+		{"alice", "new.txt", "sealed in place"},
+	} {
+		var out bytes.Buffer
+		if _, err := s.ReadFile(f.user, f.name, &out); err != nil || out.String() != f.want {
+			t.Errorf("%s: have %q, %v", f.name, out.String(), err)
+		}
+		if _, err := os.Stat(filepath.Join(s.StorageRoot, f.user)); !os.IsNotExist(err) {
+			t.Errorf("old directory of %s is still there", f.user)
+		}
+	}
+
+	if n, err := s.migrateLegacyFiles(); n != 0 || err != nil {
+		t.Errorf("second pass migrated %d, %v", n, err)
+	}
+}
+
+func startTestServer(t *testing.T, id string, keys *KeyManager, bootstrap ...string) *FileServer {
+	t.Helper()
+	s := newTestServer(t, id, keys, bootstrap...)
+	go s.Start()
+	t.Cleanup(s.Stop)
+	return s
+}
+
+// newTestServer makes a file server on a free port, to be started.
+func newTestServer(t *testing.T, id string, keys *KeyManager, bootstrap ...string) *FileServer {
+	t.Helper()
+	tr := p2p.NewTCPTransport(p2p.TCPTransportOpts{
+		ListenAddr:    freeAddr(t),
+		NodeID:        id,
+		HandshakeFunc: p2p.HelloHandshakeFunc,
+		Security:      p2p.NewSecretSecurity([]byte("test secret"), id),
+		Decoder:       p2p.DefaultDecoder{},
+	})
+	s := NewFileServer(FileServerOpts{
+		ID:                id,
+		Cluster:           []string{"s1", "s2", "s3"},
+		Keys:              keys,
+		StorageRoot:       t.TempDir(),
+		PathTransformFunc: HashPathTransformFunc,
+		Transport:         tr,
+		BootstrapNodes:    bootstrap,
+		Compress:          true,
+	})
+	tr.OnPeer = s.OnPeer
+	tr.OnPeerEvent = s.OnPeerEvent
+	return s
+}
+
+func waitForPeers(t *testing.T, servers ...*FileServer) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for _, s := range servers {
+		for len(s.peerList()) == 0 {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s never connected", s.ID)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func TestSendAndFetchFile(t *testing.T) {
+	// Each node seals files under its own keys.
+	s1 := startTestServer(t, "s1", newTestKeyManager(t))
+	time.Sleep(50 * time.Millisecond)
+	s2 := startTestServer(t, "s2", newTestKeyManager(t), s1.Transport.Addr())
+	waitForPeers(t, s1, s2)
+	ctx := context.Background()
+
+	data := bytes.Repeat([]byte("replicated "), ChunkSize/5)
+	if err := s2.SendFile(ctx, "s1", "alice", "report.txt", bytes.NewReader(data), int64(len(data)), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := s2.HasFileOn(ctx, "s1", "alice", "report.txt"); !ok || err != nil {
+		t.Fatalf("peer does not have the file: %v", err)
+	}
+
+	var got bytes.Buffer
+	if _, err := s2.FetchFile(ctx, "s1", "alice", "report.txt", &got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Bytes(), data) {
+		t.Errorf("have %d bytes, want %d", got.Len(), len(data))
+	}
+
+	if ok, _ := s2.HasFileOn(ctx, "s1", "alice", "missing.txt"); ok {
+		t.Error("peer claims a file it never got")
+	}
+	if _, err := s2.FetchFile(ctx, "s1", "alice", "missing.txt", io.Discard); err == nil {
+		t.Error("expected fetching an unknown file to fail")
+	}
+	if err := s2.SendFile(ctx, "s3", "alice", "report.txt", bytes.NewReader(data), int64(len(data)), time.Now()); err == nil {
+		t.Error("expected sending to an unknown node to fail")
+	}
+}
+
+func TestSendFileCutShortKeepsOldVersion(t *testing.T) {
+	s1 := startTestServer(t, "s1", newTestKeyManager(t))
+	time.Sleep(50 * time.Millisecond)
+	s2 := startTestServer(t, "s2", newTestKeyManager(t), s1.Transport.Addr())
+	waitForPeers(t, s1, s2)
+	ctx := context.Background()
+
+	if err := s2.SendFile(ctx, "s1", "alice", "a.txt", strings.NewReader("first"), 5, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	// The sender claims more than it has.
+	if err := s2.SendFile(ctx, "s1", "alice", "a.txt", strings.NewReader("second"), 100, time.Now()); err == nil {
+		t.Fatal("expected a short transfer to fail")
+	}
+
+	var got bytes.Buffer
+	if _, err := s1.ReadFile("alice", "a.txt", &got); err != nil || got.String() != "first" {
+		t.Errorf("have %q, %v", got.String(), err)
+	}
+}
+
+func TestOnPeerEventRemovesDeadPeers(t *testing.T) {
+	s := &FileServer{FileServerOpts: FileServerOpts{ID: "a"}, peers: map[string]p2p.Peer{}}
+
+	first := &fakePeer{id: "b", outbound: true}
+	second := &fakePeer{id: "b", outbound: true}
+	s.OnPeer(first)
+	s.OnPeer(second)
+
+	// The replaced connection dying must not drop its replacement.
+	s.OnPeerEvent(p2p.PeerEvent{Type: p2p.PeerDisconnected, Peer: first})
+	if s.peers["b"] != second {
+		t.Fatal("live connection was removed")
+	}
+
+	s.OnPeerEvent(p2p.PeerEvent{Type: p2p.PeerDisconnected, Peer: second})
+	if len(s.peers) != 0 {
+		t.Errorf("dead peer still in map: %+v", s.peers)
+	}
+}
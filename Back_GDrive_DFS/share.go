@@ -0,0 +1,565 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"firebase.google.com/go/auth"
+	"github.com/gofiber/fiber/v3"
+	"google.golang.org/api/iterator"
+)
+
+// Role is the level of access a user holds on a file. Roles are ordered, so
+// an editor can do everything a commenter can, and so on up to the owner.
+type Role string
+
+const (
+	RoleNone      Role = ""
+	RoleViewer    Role = "viewer"
+	RoleCommenter Role = "commenter"
+	RoleEditor    Role = "editor"
+	RoleOwner     Role = "owner"
+)
+
+var roleRank = map[Role]int{
+	RoleViewer:    1,
+	RoleCommenter: 2,
+	RoleEditor:    3,
+	RoleOwner:     4,
+}
+
+var (
+	errFileNotFound = errors.New("file not found")
+	errForbidden    = errors.New("insufficient permissions")
+	errInvalidRole  = errors.New("role must be viewer, commenter or editor")
+)
+
+// Allows reports whether r grants at least the access of need.
+func (r Role) Allows(need Role) bool {
+	rank, ok := roleRank[r]
+	return ok && rank >= roleRank[need]
+}
+
+// parseGrantRole parses a role that can be granted to another user. Ownership
+// is never granted, only transferred.
+func parseGrantRole(s string) (Role, error) {
+	switch r := Role(s); r {
+	case RoleViewer, RoleCommenter, RoleEditor:
+		return r, nil
+	}
+	return RoleNone, errInvalidRole
+}
+
+// RoleOf returns the role userID holds on the file.
+func (f *FileMeta) RoleOf(userID string) Role {
+	if userID == "" {
+		return RoleNone
+	}
+	if f.UserID == userID {
+		return RoleOwner
+	}
+	return Role(f.ACL[userID])
+}
+
+// storageUser is the user directory the chunks live under. It only differs
+// from UserID after the file changed owner.
+func (f *FileMeta) storageUser() string {
+	if f.StorageUserID != "" {
+		return f.StorageUserID
+	}
+	return f.UserID
+}
+
+func localUserID(c fiber.Ctx) string {
+	userID, _ := c.Locals("userID").(string)
+	return userID
+}
+
+// authorizeFile loads ownerID's file and checks that userID holds at least
+// need on it. Callers without any role get errFileNotFound so file names are
+// not leaked to them.
+func authorizeFile(userID, ownerID, filename string, need Role) (*FileMeta, error) {
+	if ownerID == "" {
+		ownerID = userID
+	}
+
+	meta, err := getFileMetadataFromFirebase(ownerID, filename)
+	if err != nil {
+		return nil, errFileNotFound
+	}
+
+	role := meta.RoleOf(userID)
+	if role == RoleNone {
+		return nil, errFileNotFound
+	}
+	if !role.Allows(need) {
+		return nil, errForbidden
+	}
+	return meta, nil
+}
+
+// authorizeFileID is authorizeFile for a file known by its document id.
+func authorizeFileID(ctx context.Context, userID, fileID string, need Role) (*FileMeta, error) {
+	doc, err := firestoreClient.Collection("files").Doc(fileID).Get(ctx)
+	if err != nil {
+		return nil, errFileNotFound
+	}
+	var meta FileMeta
+	if err := doc.DataTo(&meta); err != nil {
+		return nil, err
+	}
+	meta.ID = doc.Ref.ID
+
+	role := meta.RoleOf(userID)
+	if role == RoleNone {
+		return nil, errFileNotFound
+	}
+	if !role.Allows(need) {
+		return nil, errForbidden
+	}
+	return &meta, nil
+}
+
+func accessErrorResponse(c fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, errFileNotFound):
+		return c.Status(404).JSON(fiber.Map{"error": err.Error()})
+	case errors.Is(err, errForbidden):
+		return c.Status(403).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+}
+
+// authorizeFileParam authorizes the caller against the :filename route param,
+// taking the owner from the ?owner= query so shared users can address files
+// outside their own namespace.
+func authorizeFileParam(c fiber.Ctx, need Role) (*FileMeta, error) {
+	userID := localUserID(c)
+	if userID == "" {
+		return nil, errFileNotFound
+	}
+
+	filename, err := url.PathUnescape(c.Params("filename"))
+	if err != nil {
+		return nil, errFileNotFound
+	}
+
+	meta, err := authorizeFile(userID, c.Query("owner"), filename, need)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkTokenAccess(c, scopeForRole(need), meta.FolderID); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// lookupUser resolves a grant target by email or uid through the user
+// directory, so grants can only be made to accounts that exist. Without a
+// directory a uid is taken as it is, and an email can't be resolved.
+func lookupUser(ctx context.Context, email, uid string) (*auth.UserRecord, error) {
+	switch {
+	case uid != "" && userDirectory == nil:
+		return rawUser(uid), nil
+	case uid != "":
+		return userDirectory.GetUser(ctx, uid)
+	case email != "" && userDirectory == nil:
+		return nil, fmt.Errorf("sharing by email needs AUTH_PROVIDER=firebase")
+	case email != "":
+		return userDirectory.GetUserByEmail(ctx, email)
+	}
+	return nil, fmt.Errorf("email or user_id required")
+}
+
+// userOrRaw looks uid up if there is a directory, and otherwise, or if
+// the account is gone, returns a record with only the uid.
+func userOrRaw(ctx context.Context, uid string) *auth.UserRecord {
+	if userDirectory != nil {
+		if u, err := userDirectory.GetUser(ctx, uid); err == nil {
+			return u
+		}
+	}
+	return rawUser(uid)
+}
+
+func rawUser(uid string) *auth.UserRecord {
+	return &auth.UserRecord{UserInfo: &auth.UserInfo{UID: uid}}
+}
+
+func fileDocRef(meta *FileMeta) *firestore.DocumentRef {
+	return firestoreClient.Collection("files").Doc(meta.ID)
+}
+
+func grantFileRole(ctx context.Context, meta *FileMeta, grantee *auth.UserRecord, role Role) error {
+	updates := []firestore.Update{
+		{FieldPath: firestore.FieldPath{"acl", grantee.UID}, Value: string(role)},
+	}
+	if grantee.Email != "" {
+		updates = append(updates, firestore.Update{Path: "shareWith", Value: firestore.ArrayUnion(grantee.Email)})
+	}
+	_, err := fileDocRef(meta).Update(ctx, updates)
+	return err
+}
+
+func revokeFileRole(ctx context.Context, meta *FileMeta, grantee *auth.UserRecord) error {
+	updates := []firestore.Update{
+		{FieldPath: firestore.FieldPath{"acl", grantee.UID}, Value: firestore.Delete},
+	}
+	if grantee.Email != "" {
+		updates = append(updates, firestore.Update{Path: "shareWith", Value: firestore.ArrayRemove(grantee.Email)})
+	}
+	_, err := fileDocRef(meta).Update(ctx, updates)
+	return err
+}
+
+// transferFileOwner hands the file to newOwner. The chunks stay where they
+// are, so the original storage user is pinned on the document, and the
+// previous owner keeps editor access.
+func transferFileOwner(ctx context.Context, meta *FileMeta, prevOwner, newOwner *auth.UserRecord) error {
+	return firestoreClient.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		clash := firestoreClient.Collection("files").
+			Where("userId", "==", newOwner.UID).
+			Where("fileName", "==", meta.FileName).
+			Limit(1)
+		docs, err := tx.Documents(clash).GetAll()
+		if err != nil {
+			return err
+		}
+		if len(docs) > 0 {
+			return fmt.Errorf("%s already owns a file named %s", newOwner.UID, meta.FileName)
+		}
+
+		updates := []firestore.Update{
+			{Path: "userId", Value: newOwner.UID},
+			{Path: "storageUserId", Value: meta.storageUser()},
+			{FieldPath: firestore.FieldPath{"acl", newOwner.UID}, Value: firestore.Delete},
+			{FieldPath: firestore.FieldPath{"acl", prevOwner.UID}, Value: string(RoleEditor)},
+		}
+		return tx.Update(fileDocRef(meta), updates)
+	})
+}
+
+// -------------------- Share Endpoints --------------------
+
+type shareRequest struct {
+	Email  string `json:"email"`
+	UserID string `json:"user_id"`
+	Role   string `json:"role"`
+}
+
+func listSharesHandler(c fiber.Ctx) error {
+	meta, err := authorizeFileParam(c, RoleEditor)
+	if err != nil {
+		return accessErrorResponse(c, err)
+	}
+
+	ctx := context.Background()
+	shares := []fiber.Map{{"user_id": meta.UserID, "role": RoleOwner}}
+	for uid, role := range meta.ACL {
+		entry := fiber.Map{"user_id": uid, "role": role}
+		if u := userOrRaw(ctx, uid); u.Email != "" {
+			entry["email"] = u.Email
+		}
+		shares = append(shares, entry)
+	}
+
+	return c.JSON(fiber.Map{
+		"success":  true,
+		"filename": meta.FileName,
+		"shares":   shares,
+	})
+}
+
+func shareFileHandler(c fiber.Ctx) error {
+	meta, err := authorizeFileParam(c, RoleOwner)
+	if err != nil {
+		return accessErrorResponse(c, err)
+	}
+
+	var body shareRequest
+	if err := c.Bind().JSON(&body); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "invalid request"})
+	}
+	role, err := parseGrantRole(body.Role)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	ctx := context.Background()
+	grantee, err := lookupUser(ctx, body.Email, body.UserID)
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "user not found"})
+	}
+	if grantee.UID == meta.UserID {
+		return c.Status(400).JSON(fiber.Map{"error": "owner already has full access"})
+	}
+
+	if err := grantFileRole(ctx, meta, grantee, role); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	log.Printf("[share] %s granted %s on %s to %s", meta.UserID, role, meta.FileName, grantee.UID)
+	return c.JSON(fiber.Map{
+		"success":  true,
+		"filename": meta.FileName,
+		"user_id":  grantee.UID,
+		"email":    grantee.Email,
+		"role":     role,
+	})
+}
+
+func revokeShareHandler(c fiber.Ctx) error {
+	granteeID := c.Params("userID")
+	callerID := localUserID(c)
+
+	// Grantees may always drop their own access.
+	need := RoleOwner
+	if granteeID == callerID {
+		need = RoleViewer
+	}
+
+	meta, err := authorizeFileParam(c, need)
+	if err != nil {
+		return accessErrorResponse(c, err)
+	}
+	if _, ok := meta.ACL[granteeID]; !ok {
+		return c.Status(404).JSON(fiber.Map{"error": "share not found"})
+	}
+
+	ctx := context.Background()
+	// The account may be gone; the ACL entry still goes.
+	grantee := userOrRaw(ctx, granteeID)
+
+	if err := revokeFileRole(ctx, meta, grantee); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	log.Printf("[share] revoked %s on %s for %s", meta.ACL[granteeID], meta.FileName, granteeID)
+	return c.JSON(fiber.Map{"success": true, "filename": meta.FileName, "user_id": granteeID})
+}
+
+func transferOwnerHandler(c fiber.Ctx) error {
+	meta, err := authorizeFileParam(c, RoleOwner)
+	if err != nil {
+		return accessErrorResponse(c, err)
+	}
+
+	var body shareRequest
+	if err := c.Bind().JSON(&body); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "invalid request"})
+	}
+
+	ctx := context.Background()
+	newOwner, err := lookupUser(ctx, body.Email, body.UserID)
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "user not found"})
+	}
+	if newOwner.UID == meta.UserID {
+		return c.Status(400).JSON(fiber.Map{"error": "user already owns this file"})
+	}
+	prevOwner := userOrRaw(ctx, meta.UserID)
+
+	if err := transferFileOwner(ctx, meta, prevOwner, newOwner); err != nil {
+		return c.Status(409).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	// Keep the email list the UI queries on in step with the new ACL. A
+	// single update can't touch the same field twice.
+	if newOwner.Email != "" {
+		_, err := fileDocRef(meta).Update(ctx, []firestore.Update{{Path: "shareWith", Value: firestore.ArrayRemove(newOwner.Email)}})
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+	}
+	if prevOwner.Email != "" {
+		_, err := fileDocRef(meta).Update(ctx, []firestore.Update{{Path: "shareWith", Value: firestore.ArrayUnion(prevOwner.Email)}})
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+	}
+
+	log.Printf("[share] ownership of %s moved from %s to %s", meta.FileName, meta.UserID, newOwner.UID)
+	return c.JSON(fiber.Map{
+		"success":  true,
+		"filename": meta.FileName,
+		"owner":    newOwner.UID,
+	})
+}
+
+// shareFolderHandler grants a role on every file the caller keeps in one of
+// their folders. Folders only exist in Firestore, so the grant lands in each
+// file's ACL; the folder's email list just lets the recipient's UI show it.
+func shareFolderHandler(c fiber.Ctx) error {
+	userID := localUserID(c)
+	folderID := c.Params("folderID")
+
+	var body shareRequest
+	if err := c.Bind().JSON(&body); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "invalid request"})
+	}
+	role, err := parseGrantRole(body.Role)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	ctx := context.Background()
+	folderRef := firestoreClient.Collection("folders").Doc(folderID)
+	doc, err := folderRef.Get(ctx)
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "folder not found"})
+	}
+	if owner, _ := doc.Data()["userId"].(string); owner != userID {
+		return c.Status(404).JSON(fiber.Map{"error": "folder not found"})
+	}
+
+	grantee, err := lookupUser(ctx, body.Email, body.UserID)
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "user not found"})
+	}
+	if grantee.UID == userID {
+		return c.Status(400).JSON(fiber.Map{"error": "owner already has full access"})
+	}
+
+	docs, err := firestoreClient.Collection("files").
+		Where("userId", "==", userID).
+		Where("folderId", "==", folderID).
+		Documents(ctx).GetAll()
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	shared := 0
+	for _, d := range docs {
+		var meta FileMeta
+		if err := d.DataTo(&meta); err != nil {
+			continue
+		}
+		meta.ID = d.Ref.ID
+		if err := grantFileRole(ctx, &meta, grantee, role); err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error(), "shared": shared})
+		}
+		shared++
+	}
+
+	if grantee.Email != "" {
+		_, err := folderRef.Update(ctx, []firestore.Update{{Path: "shareWith", Value: firestore.ArrayUnion(grantee.Email)}})
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error(), "shared": shared})
+		}
+	}
+
+	log.Printf("[share] %s granted %s on folder %s (%d files) to %s", userID, role, folderID, shared, grantee.UID)
+	return c.JSON(fiber.Map{
+		"success":   true,
+		"folder_id": folderID,
+		"user_id":   grantee.UID,
+		"email":     grantee.Email,
+		"role":      role,
+		"shared":    shared,
+	})
+}
+
+// sharedWithMeHandler lists every file the caller holds a grant on.
+func sharedWithMeHandler(c fiber.Ctx) error {
+	userID := localUserID(c)
+	if userID == "" {
+		return c.Status(401).JSON(fiber.Map{"error": "unauthorized"})
+	}
+
+	ctx := context.Background()
+	iter := firestoreClient.Collection("files").
+		WherePath(firestore.FieldPath{"acl", userID}, "in", []string{string(RoleViewer), string(RoleCommenter), string(RoleEditor)}).
+		Documents(ctx)
+
+	files := []fiber.Map{}
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"success": false, "error": err.Error()})
+		}
+		var f FileMeta
+		if err := doc.DataTo(&f); err != nil {
+			continue
+		}
+		if checkTokenAccess(c, ScopeRead, f.FolderID) != nil {
+			continue
+		}
+		files = append(files, fiber.Map{
+			"id":       doc.Ref.ID,
+			"fileName": f.FileName,
+			"owner":    f.UserID,
+			"size":     f.Size,
+			"role":     f.RoleOf(userID),
+		})
+	}
+
+	return c.JSON(fiber.Map{"success": true, "user_id": userID, "files": files})
+}
+
+// -------------------- Comments --------------------
+
+type FileComment struct {
+	UserID    string    `json:"userId" firestore:"userId"`
+	Text      string    `json:"text" firestore:"text"`
+	Timestamp time.Time `json:"timestamp" firestore:"timestamp"`
+}
+
+func listCommentsHandler(c fiber.Ctx) error {
+	meta, err := authorizeFileParam(c, RoleViewer)
+	if err != nil {
+		return accessErrorResponse(c, err)
+	}
+
+	ctx := context.Background()
+	iter := fileDocRef(meta).Collection("comments").OrderBy("timestamp", firestore.Asc).Documents(ctx)
+
+	comments := []FileComment{}
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		var fc FileComment
+		if err := doc.DataTo(&fc); err == nil {
+			comments = append(comments, fc)
+		}
+	}
+
+	return c.JSON(fiber.Map{"success": true, "comments": comments})
+}
+
+func addCommentHandler(c fiber.Ctx) error {
+	meta, err := authorizeFileParam(c, RoleCommenter)
+	if err != nil {
+		return accessErrorResponse(c, err)
+	}
+
+	body := struct {
+		Text string `json:"text"`
+	}{}
+	if err := c.Bind().JSON(&body); err != nil || body.Text == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "text required"})
+	}
+
+	comment := FileComment{
+		UserID:    localUserID(c),
+		Text:      body.Text,
+		Timestamp: time.Now(),
+	}
+	if _, _, err := fileDocRef(meta).Collection("comments").Add(context.Background(), comment); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.JSON(fiber.Map{"success": true, "comment": comment})
+}
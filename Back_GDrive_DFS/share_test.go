@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestRoleAllows(t *testing.T) {
+	cases := []struct {
+		role Role
+		need Role
+		want bool
+	}{
+		{RoleViewer, RoleViewer, true},
+		{RoleViewer, RoleCommenter, false},
+		{RoleCommenter, RoleViewer, true},
+		{RoleEditor, RoleCommenter, true},
+		{RoleEditor, RoleOwner, false},
+		{RoleOwner, RoleEditor, true},
+		{RoleNone, RoleViewer, false},
+		{Role("admin"), RoleViewer, false},
+	}
+
+	for _, tc := range cases {
+		if have := tc.role.Allows(tc.need); have != tc.want {
+			t.Errorf("%q.Allows(%q): have %v want %v", tc.role, tc.need, have, tc.want)
+		}
+	}
+}
+
+func TestParseGrantRole(t *testing.T) {
+	for _, s := range []string{"viewer", "commenter", "editor"} {
+		if _, err := parseGrantRole(s); err != nil {
+			t.Errorf("expected %s to be grantable: %s", s, err)
+		}
+	}
+
+	for _, s := range []string{"owner", "", "Editor"} {
+		if _, err := parseGrantRole(s); err == nil {
+			t.Errorf("expected %q to be rejected", s)
+		}
+	}
+}
+
+func TestFileMetaRoleOf(t *testing.T) {
+	meta := &FileMeta{
+		UserID: "alice",
+		ACL: map[string]string{
+			"bob":   "viewer",
+			"carol": "editor",
+		},
+	}
+
+	if role := meta.RoleOf("alice"); role != RoleOwner {
+		t.Errorf("have %s want owner", role)
+	}
+	if role := meta.RoleOf("bob"); role != RoleViewer {
+		t.Errorf("have %s want viewer", role)
+	}
+	if role := meta.RoleOf("carol"); role != RoleEditor {
+		t.Errorf("have %s want editor", role)
+	}
+	if role := meta.RoleOf("mallory"); role != RoleNone {
+		t.Errorf("have %s want no role", role)
+	}
+	if role := meta.RoleOf(""); role != RoleNone {
+		t.Errorf("empty user must have no role, have %s", role)
+	}
+
+	if meta.storageUser() != "alice" {
+		t.Errorf("have %s want alice", meta.storageUser())
+	}
+	meta.UserID, meta.StorageUserID = "bob", "alice"
+	if meta.storageUser() != "alice" {
+		t.Errorf("transferred file must keep its storage user, have %s", meta.storageUser())
+	}
+}
+
+func TestLookupUserWithoutDirectory(t *testing.T) {
+	saved := userDirectory
+	userDirectory = nil
+	defer func() { userDirectory = saved }()
+
+	ctx := context.Background()
+	if u, err := lookupUser(ctx, "", "bob"); err != nil || u.UID != "bob" {
+		t.Errorf("have %+v, %v", u, err)
+	}
+	if _, err := lookupUser(ctx, "bob@example.com", ""); err == nil {
+		t.Error("email resolved without a directory")
+	}
+	if u := userOrRaw(ctx, "carol"); u.UID != "carol" || u.Email != "" {
+		t.Errorf("have %+v", u.UserInfo)
+	}
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gofiber/fiber/v3"
+	"golang.org/x/crypto/bcrypt"
+	"google.golang.org/api/iterator"
+)
+
+// ShareLink lets anyone holding its signed URL download a file without an
+// account. The URL only proves the link was issued by us; expiry, password,
+// download limit and revocation are always checked against the stored link.
+type ShareLink struct {
+	ID           string    `json:"id" firestore:"-"`
+	OwnerID      string    `json:"ownerId" firestore:"ownerId"`
+	FileID       string    `json:"fileId" firestore:"fileId"`
+	FileName     string    `json:"fileName" firestore:"fileName"`
+	ExpiresAt    time.Time `json:"expiresAt" firestore:"expiresAt"` // zero means never
+	PasswordHash string    `json:"-" firestore:"passwordHash"`
+	MaxDownloads int       `json:"maxDownloads" firestore:"maxDownloads"` // 0 means unlimited
+	Downloads    int       `json:"downloads" firestore:"downloads"`
+	Revoked      bool      `json:"revoked" firestore:"revoked"`
+	CreatedAt    time.Time `json:"createdAt" firestore:"createdAt"`
+	// Wrong passwords in a row, and until when the link refuses any
+	// password after too many.
+	PasswordFailures int       `json:"-" firestore:"passwordFailures"`
+	LockedUntil      time.Time `json:"-" firestore:"lockedUntil"`
+}
+
+const (
+	// linkPasswordAttempts wrong passwords in a row lock a link for
+	// linkLockout, so its password can't be guessed at bcrypt speed.
+	linkPasswordAttempts = 5
+	linkLockout          = 15 * time.Minute
+)
+
+var (
+	errLinkInvalid   = errors.New("invalid or tampered link")
+	errLinkExpired   = errors.New("link has expired")
+	errLinkRevoked   = errors.New("link has been revoked")
+	errLinkExhausted = errors.New("link download limit reached")
+	errLinkPassword  = errors.New("password required or incorrect")
+	errLinkLocked    = errors.New("too many wrong passwords, try again later")
+)
+
+func linkSigningKey() ([]byte, error) {
+	secret := getEnv("SHARE_LINK_SECRET", "")
+	if secret == "" {
+		return nil, fmt.Errorf("link sharing is not configured")
+	}
+	return []byte(secret), nil
+}
+
+func linkSignature(key []byte, linkID string, exp int64) string {
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%s\n%d", linkID, exp)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func verifyLinkSignature(key []byte, linkID string, exp int64, sig string) bool {
+	want := linkSignature(key, linkID, exp)
+	return hmac.Equal([]byte(want), []byte(sig))
+}
+
+func (l *ShareLink) expUnix() int64 {
+	if l.ExpiresAt.IsZero() {
+		return 0
+	}
+	return l.ExpiresAt.Unix()
+}
+
+// signedURL builds the public URL for the link under base.
+func (l *ShareLink) signedURL(key []byte, base string) string {
+	exp := l.expUnix()
+	q := url.Values{}
+	q.Set("exp", strconv.FormatInt(exp, 10))
+	q.Set("sig", linkSignature(key, l.ID, exp))
+	return fmt.Sprintf("%s/s/%s?%s", base, url.PathEscape(l.ID), q.Encode())
+}
+
+func (l *ShareLink) setPassword(password string) error {
+	if password == "" {
+		l.PasswordHash = ""
+		return nil
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	l.PasswordHash = string(hash)
+	return nil
+}
+
+func (l *ShareLink) checkPassword(password string) bool {
+	if l.PasswordHash == "" {
+		return true
+	}
+	return bcrypt.CompareHashAndPassword([]byte(l.PasswordHash), []byte(password)) == nil
+}
+
+// tryPassword checks password like checkPassword, but counts wrong ones:
+// after linkPasswordAttempts in a row every password is refused until
+// linkLockout has passed. It returns the changes to store on the link.
+func (l *ShareLink) tryPassword(password string, now time.Time) ([]firestore.Update, error) {
+	if l.PasswordHash == "" {
+		return nil, nil
+	}
+	if now.Before(l.LockedUntil) {
+		return nil, errLinkLocked
+	}
+	if l.checkPassword(password) {
+		if l.PasswordFailures == 0 {
+			return nil, nil
+		}
+		l.PasswordFailures = 0
+		return []firestore.Update{{Path: "passwordFailures", Value: 0}}, nil
+	}
+
+	l.PasswordFailures++
+	if l.PasswordFailures >= linkPasswordAttempts {
+		l.PasswordFailures = 0
+		l.LockedUntil = now.Add(linkLockout)
+	}
+	return []firestore.Update{
+		{Path: "passwordFailures", Value: l.PasswordFailures},
+		{Path: "lockedUntil", Value: l.LockedUntil},
+	}, errLinkPassword
+}
+
+// checkUsable reports why the link can no longer be used at now, if at all.
+func (l *ShareLink) checkUsable(now time.Time) error {
+	switch {
+	case l.Revoked:
+		return errLinkRevoked
+	case !l.ExpiresAt.IsZero() && now.After(l.ExpiresAt):
+		return errLinkExpired
+	case l.MaxDownloads > 0 && l.Downloads >= l.MaxDownloads:
+		return errLinkExhausted
+	}
+	return nil
+}
+
+func linkErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errLinkInvalid):
+		return 403
+	case errors.Is(err, errLinkPassword):
+		return 401
+	case errors.Is(err, errLinkLocked):
+		return 429
+	case errors.Is(err, errLinkExpired), errors.Is(err, errLinkRevoked), errors.Is(err, errLinkExhausted):
+		return 410
+	case errors.Is(err, errFileNotFound):
+		return 404
+	}
+	return 500
+}
+
+func publicBaseURL() string {
+	return getEnv("PUBLIC_URL", "http://localhost:8080")
+}
+
+func linksCollection() *firestore.CollectionRef {
+	return firestoreClient.Collection("shareLinks")
+}
+
+// reserveLinkDownload counts one download against the link and returns the
+// file it shares, failing if the link is no longer usable, is not the one
+// signed with exp, or its creator can no longer edit the file. Doing it in
+// a transaction keeps concurrent downloads from overrunning the limit, and
+// nothing is counted for a refused download. A wrong password is counted
+// against the link, though.
+func reserveLinkDownload(ctx context.Context, linkID, password string, exp int64) (*ShareLink, *FileMeta, error) {
+	var (
+		link    ShareLink
+		meta    FileMeta
+		refused error
+	)
+	err := firestoreClient.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		refused = nil
+		ref := linksCollection().Doc(linkID)
+		doc, err := tx.Get(ref)
+		if err != nil {
+			return errLinkInvalid
+		}
+		if err := doc.DataTo(&link); err != nil {
+			return err
+		}
+		link.ID = doc.Ref.ID
+
+		now := time.Now()
+		if err := link.checkUsable(now); err != nil {
+			return err
+		}
+		// The signature is bound to the expiry the link was issued with.
+		if link.expUnix() != exp {
+			return errLinkInvalid
+		}
+		updates, err := link.tryPassword(password, now)
+		if errors.Is(err, errLinkPassword) {
+			// Keep the failure, but don't fail the transaction over it.
+			refused = err
+			return tx.Update(ref, updates)
+		}
+		if err != nil {
+			return err
+		}
+
+		fileDoc, err := tx.Get(firestoreClient.Collection("files").Doc(link.FileID))
+		if err != nil {
+			return errFileNotFound
+		}
+		if err := fileDoc.DataTo(&meta); err != nil {
+			return err
+		}
+		meta.ID = fileDoc.Ref.ID
+		// Creators who lost edit rights on the file no longer vouch for the link.
+		if !meta.RoleOf(link.OwnerID).Allows(RoleEditor) {
+			return errLinkRevoked
+		}
+
+		updates = append(updates, firestore.Update{Path: "downloads", Value: firestore.Increment(1)})
+		return tx.Update(ref, updates)
+	})
+	if err == nil {
+		err = refused
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return &link, &meta, nil
+}
+
+// releaseLinkDownload gives back a download reserveLinkDownload counted but
+// that could not be served.
+func releaseLinkDownload(ctx context.Context, linkID string) {
+	_, err := linksCollection().Doc(linkID).Update(ctx, []firestore.Update{{Path: "downloads", Value: firestore.Increment(-1)}})
+	if err != nil {
+		log.Printf("[link] could not give back a download on %s: %v", linkID, err)
+	}
+}
+
+// -------------------- Link Endpoints --------------------
+
+func createLinkHandler(c fiber.Ctx) error {
+	meta, err := authorizeFileParam(c, RoleOwner)
+	if err != nil {
+		return accessErrorResponse(c, err)
+	}
+	key, err := linkSigningKey()
+	if err != nil {
+		return c.Status(503).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	body := struct {
+		ExpiresIn    int64  `json:"expires_in"` // seconds, 0 for no expiry
+		Password     string `json:"password"`
+		MaxDownloads int    `json:"max_downloads"`
+	}{}
+	if len(c.Body()) > 0 {
+		if err := c.Bind().JSON(&body); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "invalid request"})
+		}
+	}
+	if body.ExpiresIn < 0 || body.MaxDownloads < 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "expires_in and max_downloads must not be negative"})
+	}
+
+	link := ShareLink{
+		OwnerID:      meta.UserID,
+		FileID:       meta.ID,
+		FileName:     meta.FileName,
+		MaxDownloads: body.MaxDownloads,
+		CreatedAt:    time.Now(),
+	}
+	if body.ExpiresIn > 0 {
+		link.ExpiresAt = link.CreatedAt.Add(time.Duration(body.ExpiresIn) * time.Second)
+	}
+	if err := link.setPassword(body.Password); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	ref, _, err := linksCollection().Add(context.Background(), link)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	link.ID = ref.ID
+
+	log.Printf("[link] %s created link %s for %s", meta.UserID, link.ID, meta.FileName)
+	return c.JSON(fiber.Map{
+		"success": true,
+		"link":    link,
+		"url":     link.signedURL(key, publicBaseURL()),
+	})
+}
+
+// listLinksHandler lists the links on every file the caller owns now,
+// whoever created them.
+func listLinksHandler(c fiber.Ctx) error {
+	userID := localUserID(c)
+	if userID == "" {
+		return c.Status(401).JSON(fiber.Map{"error": "unauthorized"})
+	}
+	key, _ := linkSigningKey()
+
+	ctx := context.Background()
+	fileDocs, err := firestoreClient.Collection("files").Where("userId", "==", userID).Documents(ctx).GetAll()
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	var fileIDs []string
+	for _, doc := range fileDocs {
+		fileIDs = append(fileIDs, doc.Ref.ID)
+	}
+
+	links := []fiber.Map{}
+	// Firestore takes at most 30 values in one "in" filter.
+	for ids := range slices.Chunk(fileIDs, 30) {
+		iter := linksCollection().Where("fileId", "in", ids).Documents(ctx)
+		for {
+			doc, err := iter.Next()
+			if err == iterator.Done {
+				break
+			}
+			if err != nil {
+				return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+			}
+			var link ShareLink
+			if err := doc.DataTo(&link); err != nil {
+				continue
+			}
+			link.ID = doc.Ref.ID
+
+			entry := fiber.Map{"link": link, "active": link.checkUsable(time.Now()) == nil}
+			if key != nil {
+				entry["url"] = link.signedURL(key, publicBaseURL())
+			}
+			links = append(links, entry)
+		}
+	}
+
+	return c.JSON(fiber.Map{"success": true, "links": links})
+}
+
+// revokeLinkHandler lets the file's current owner revoke any link on it.
+func revokeLinkHandler(c fiber.Ctx) error {
+	userID := localUserID(c)
+	linkID := c.Params("linkID")
+
+	ctx := context.Background()
+	ref := linksCollection().Doc(linkID)
+	doc, err := ref.Get(ctx)
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "link not found"})
+	}
+	var link ShareLink
+	if err := doc.DataTo(&link); err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "link not found"})
+	}
+	if _, err := authorizeFileID(ctx, userID, link.FileID, RoleOwner); err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "link not found"})
+	}
+
+	if _, err := ref.Update(ctx, []firestore.Update{{Path: "revoked", Value: true}}); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	log.Printf("[link] %s revoked link %s", userID, linkID)
+	return c.JSON(fiber.Map{"success": true, "id": linkID})
+}
+
+// publicLinkHandler serves GET and POST /s/:linkID without authentication.
+// A password may be sent as the X-Link-Password header or a "password" form
+// field; it is never read from the query string so it stays out of logs.
+func publicLinkHandler(c fiber.Ctx) error {
+	key, err := linkSigningKey()
+	if err != nil {
+		return c.Status(503).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	linkID := c.Params("linkID")
+	exp, err := strconv.ParseInt(c.Query("exp"), 10, 64)
+	if err != nil || !verifyLinkSignature(key, linkID, exp, c.Query("sig")) {
+		return c.Status(linkErrorStatus(errLinkInvalid)).JSON(fiber.Map{"error": errLinkInvalid.Error()})
+	}
+	if exp > 0 && time.Now().Unix() > exp {
+		return c.Status(linkErrorStatus(errLinkExpired)).JSON(fiber.Map{"error": errLinkExpired.Error()})
+	}
+
+	password := c.Get("X-Link-Password")
+	if password == "" && c.Method() == fiber.MethodPost {
+		password = c.FormValue("password")
+	}
+
+	ctx := context.Background()
+	link, meta, err := reserveLinkDownload(ctx, linkID, password, exp)
+	if err != nil {
+		log.Printf("[link] download via %s refused: %v", linkID, err)
+		return c.Status(linkErrorStatus(err)).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	log.Printf("[link] serving %s via link %s (%d/%d)", meta.FileName, link.ID, link.Downloads+1, link.MaxDownloads)
+	err = sendFile(c, meta, meta.FileName)
+	if err != nil || c.Response().StatusCode() >= 400 {
+		releaseLinkDownload(ctx, link.ID)
+	}
+	return err
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestLinkSignature(t *testing.T) {
+	key := []byte("cluster secret")
+	exp := time.Now().Add(time.Hour).Unix()
+	sig := linkSignature(key, "abc123", exp)
+
+	if !verifyLinkSignature(key, "abc123", exp, sig) {
+		t.Error("expected signature to verify")
+	}
+	if verifyLinkSignature(key, "abc124", exp, sig) {
+		t.Error("signature must be bound to the link id")
+	}
+	if verifyLinkSignature(key, "abc123", exp+1, sig) {
+		t.Error("signature must be bound to the expiry")
+	}
+	if verifyLinkSignature([]byte("other secret"), "abc123", exp, sig) {
+		t.Error("signature must be bound to the key")
+	}
+}
+
+func TestShareLinkSignedURL(t *testing.T) {
+	key := []byte("cluster secret")
+	link := &ShareLink{ID: "abc123", ExpiresAt: time.Unix(1700000000, 0)}
+
+	u, err := url.Parse(link.signedURL(key, "http://drive.local"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Path != "/s/abc123" {
+		t.Errorf("have path %s", u.Path)
+	}
+
+	exp, _ := strconv.ParseInt(u.Query().Get("exp"), 10, 64)
+	if exp != 1700000000 {
+		t.Errorf("have exp %d", exp)
+	}
+	if !verifyLinkSignature(key, "abc123", exp, u.Query().Get("sig")) {
+		t.Error("signed url does not verify")
+	}
+}
+
+func TestShareLinkCheckUsable(t *testing.T) {
+	now := time.Now()
+
+	link := &ShareLink{}
+	if err := link.checkUsable(now); err != nil {
+		t.Errorf("link without limits should be usable: %s", err)
+	}
+
+	link = &ShareLink{ExpiresAt: now.Add(-time.Minute)}
+	if err := link.checkUsable(now); err != errLinkExpired {
+		t.Errorf("have %v want %v", err, errLinkExpired)
+	}
+
+	link = &ShareLink{MaxDownloads: 2, Downloads: 2}
+	if err := link.checkUsable(now); err != errLinkExhausted {
+		t.Errorf("have %v want %v", err, errLinkExhausted)
+	}
+
+	link = &ShareLink{Revoked: true}
+	if err := link.checkUsable(now); err != errLinkRevoked {
+		t.Errorf("have %v want %v", err, errLinkRevoked)
+	}
+}
+
+func TestShareLinkPassword(t *testing.T) {
+	link := &ShareLink{}
+	if !link.checkPassword("") {
+		t.Error("link without password should accept anything")
+	}
+
+	if err := link.setPassword("hunter2"); err != nil {
+		t.Fatal(err)
+	}
+	if link.PasswordHash == "hunter2" {
+		t.Error("password must not be stored in the clear")
+	}
+	if !link.checkPassword("hunter2") {
+		t.Error("expected correct password to pass")
+	}
+	if link.checkPassword("hunter3") || link.checkPassword("") {
+		t.Error("expected wrong password to fail")
+	}
+}
+
+func TestShareLinkPasswordLockout(t *testing.T) {
+	link := &ShareLink{}
+	if err := link.setPassword("hunter2"); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+
+	if _, err := link.tryPassword("hunter3", now); err != errLinkPassword {
+		t.Fatalf("have %v want %v", err, errLinkPassword)
+	}
+	// A right password clears the count.
+	if updates, err := link.tryPassword("hunter2", now); err != nil || len(updates) != 1 || link.PasswordFailures != 0 {
+		t.Fatalf("have %v, %v, %d failures", updates, err, link.PasswordFailures)
+	}
+
+	for i := 0; i < linkPasswordAttempts; i++ {
+		if _, err := link.tryPassword("guess", now); err != errLinkPassword {
+			t.Fatalf("guess %d: have %v want %v", i, err, errLinkPassword)
+		}
+	}
+	if _, err := link.tryPassword("hunter2", now.Add(time.Minute)); err != errLinkLocked {
+		t.Errorf("have %v want %v", err, errLinkLocked)
+	}
+	if _, err := link.tryPassword("hunter2", now.Add(linkLockout+time.Second)); err != nil {
+		t.Errorf("still locked after the lockout: %v", err)
+	}
+}
@@ -2,13 +2,16 @@ package main
 
 import (
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"path"
 	"strings"
+	"time"
 )
 
 const defaultRootFolderName = "ggnetwork"
@@ -32,8 +35,31 @@ func CASPathTransformFunc(key string) PathKey {
 	}
 }
 
+// HashPathTransformFunc lays out keys that already are content hashes,
+// such as chunk blobs: the key is the file name, under two levels of
+// directories taken from its first characters.
+func HashPathTransformFunc(key string) PathKey {
+	if len(key) < 4 {
+		return PathKey{PathName: key, Filename: key}
+	}
+	return PathKey{
+		PathName: key[:2] + "/" + key[2:4],
+		Filename: key,
+	}
+}
+
 type PathTransformFunc func(string) PathKey
 
+// KeyFunc recovers a key from where PathTransformFunc put it, for List and
+// Walk. A PathTransformFunc that hashes its key can't be undone, so a store
+// laid out by CASPathTransformFunc lists the hashes of its keys.
+type KeyFunc func(PathKey) string
+
+// DefaultKeyFunc takes the key to be the file name.
+func DefaultKeyFunc(p PathKey) string {
+	return p.Filename
+}
+
 type PathKey struct {
 	PathName string
 	Filename string
@@ -52,8 +78,11 @@ func (p PathKey) FullPath() string {
 }
 
 type StoreOpts struct {
+	// Root is where a Store without a Backend keeps its files on disk.
 	Root              string
+	Backend           Backend
 	PathTransformFunc PathTransformFunc
+	KeyFunc           KeyFunc
 }
 
 var DefaultPathTransformFunc = func(key string) PathKey {
@@ -71,70 +100,78 @@ func NewStore(opts StoreOpts) *Store {
 	if opts.PathTransformFunc == nil {
 		opts.PathTransformFunc = DefaultPathTransformFunc
 	}
+	if opts.KeyFunc == nil {
+		opts.KeyFunc = DefaultKeyFunc
+	}
 	if len(opts.Root) == 0 {
 		opts.Root = defaultRootFolderName
 	}
+	if opts.Backend == nil {
+		opts.Backend = NewDiskBackend(opts.Root)
+	}
 
 	return &Store{
 		StoreOpts: opts,
 	}
 }
 
-func (s *Store) Has(id string, key string) bool {
-	pathKey := s.PathTransformFunc(key)
-	fullPathWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.FullPath())
+// name is where key of id lives in the backend.
+func (s *Store) name(id string, key string) string {
+	return path.Join(id, s.PathTransformFunc(key).FullPath())
+}
 
-	_, err := os.Stat(fullPathWithRoot)
+func (s *Store) Has(id string, key string) bool {
+	_, err := s.Backend.Stat(s.name(id, key))
 	return !errors.Is(err, os.ErrNotExist)
 }
 
 func (s *Store) Clear() error {
-	return os.RemoveAll(s.Root)
+	if c, ok := s.Backend.(interface{ Clear() error }); ok {
+		return c.Clear()
+	}
+	return s.Backend.List("", func(name string, _ BlobInfo) error {
+		return s.Backend.Delete(name)
+	})
 }
 
+// Delete removes key and nothing else, even where other keys share its
+// path prefix.
 func (s *Store) Delete(id string, key string) error {
-	pathKey := s.PathTransformFunc(key)
-
-	defer func() {
-		log.Printf("deleted [%s] from disk", pathKey.Filename)
-	}()
-
-	firstPathNameWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.FirstPathName())
-
-	return os.RemoveAll(firstPathNameWithRoot)
+	if err := s.Backend.Delete(s.name(id, key)); err != nil {
+		return err
+	}
+	log.Printf("deleted [%s] from disk", s.PathTransformFunc(key).Filename)
+	return nil
 }
 
 func (s *Store) Write(id string, key string, r io.Reader) (int64, error) {
 	return s.writeStream(id, key, r)
 }
 
-func (s *Store) WriteDecrypt(encKey []byte, id string, key string, r io.Reader) (int64, error) {
-	f, err := s.openFileForWriting(id, key)
-	if err != nil {
-		return 0, err
-	}
-	n, err := copyDecrypt(encKey, r, f)
-	return int64(n), err
+func (s *Store) WriteDecrypt(keys KeyLookup, id string, key string, r io.Reader) (int64, error) {
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := openStream(keys, r, pw)
+		pw.CloseWithError(err)
+	}()
+	n, err := s.writeStream(id, key, pr)
+	pr.CloseWithError(err)
+	return n, err
 }
 
-func (s *Store) openFileForWriting(id string, key string) (*os.File, error) {
-	pathKey := s.PathTransformFunc(key)
-	pathNameWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.PathName)
-	if err := os.MkdirAll(pathNameWithRoot, os.ModePerm); err != nil {
-		return nil, err
-	}
-
-	fullPathWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.FullPath())
-
-	return os.Create(fullPathWithRoot)
+// Writes are atomic: a reader, or a node restarting after a crash, sees
+// either the old contents of a key or all of the new.
+func (s *Store) writeStream(id string, key string, r io.Reader) (int64, error) {
+	return s.Backend.Put(s.name(id, key), r)
 }
 
-func (s *Store) writeStream(id string, key string, r io.Reader) (int64, error) {
-	f, err := s.openFileForWriting(id, key)
-	if err != nil {
-		return 0, err
+// Recover cleans up writes that never finished, for a backend that can
+// leave any behind. It must run before the store takes any writes.
+func (s *Store) Recover() (int, error) {
+	if r, ok := s.Backend.(interface{ Recover() (int, error) }); ok {
+		return r.Recover()
 	}
-	return io.Copy(f, r)
+	return 0, nil
 }
 
 func (s *Store) Read(id string, key string) (int64, io.Reader, error) {
@@ -142,18 +179,111 @@ func (s *Store) Read(id string, key string) (int64, io.Reader, error) {
 }
 
 func (s *Store) readStream(id string, key string) (int64, io.ReadCloser, error) {
-	pathKey := s.PathTransformFunc(key)
-	fullPathWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.FullPath())
-
-	file, err := os.Open(fullPathWithRoot)
+	r, info, err := s.Backend.Get(s.name(id, key))
 	if err != nil {
 		return 0, nil, err
 	}
+	return info.Size, r, nil
+}
+
+// KeyStat describes a stored key. Walk leaves Checksum empty; Stat fills it
+// in with the SHA-256 of the stored bytes.
+type KeyStat struct {
+	Key      string
+	Size     int64
+	ModTime  time.Time
+	Checksum string
+}
 
-	fi, err := file.Stat()
+// Usage is how much an id has stored.
+type Usage struct {
+	Keys  int
+	Bytes int64
+}
+
+// WalkFunc is called by Walk for each key. Returning an error stops the walk,
+// and Walk returns it.
+type WalkFunc func(id string, info KeyStat) error
+
+func (s *Store) Stat(id string, key string) (KeyStat, error) {
+	r, info, err := s.Backend.Get(s.name(id, key))
 	if err != nil {
-		return 0, nil, err
+		return KeyStat{}, err
+	}
+	defer r.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return KeyStat{}, err
 	}
 
-	return fi.Size(), file, nil
+	return KeyStat{
+		Key:      key,
+		Size:     info.Size,
+		ModTime:  info.ModTime,
+		Checksum: hex.EncodeToString(h.Sum(nil)),
+	}, nil
+}
+
+// IDs lists the ids that have anything stored.
+func (s *Store) IDs() ([]string, error) {
+	var ids []string
+	seen := map[string]bool{}
+	err := s.Backend.List("", func(name string, _ BlobInfo) error {
+		id, _, ok := strings.Cut(name, "/")
+		if ok && !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+		return nil
+	})
+	return ids, err
+}
+
+// List returns the keys stored for id, in path order.
+func (s *Store) List(id string) ([]string, error) {
+	var keys []string
+	err := s.walkID(id, func(_ string, info KeyStat) error {
+		keys = append(keys, info.Key)
+		return nil
+	})
+	return keys, err
+}
+
+// Walk calls fn for every key of every id, one at a time as they are found
+// in the backend.
+func (s *Store) Walk(fn WalkFunc) error {
+	return s.walkPrefix("", fn)
+}
+
+func (s *Store) Usage(id string) (Usage, error) {
+	var u Usage
+	err := s.walkID(id, func(_ string, info KeyStat) error {
+		u.Keys++
+		u.Bytes += info.Size
+		return nil
+	})
+	return u, err
+}
+
+func (s *Store) walkID(id string, fn WalkFunc) error {
+	return s.walkPrefix(id+"/", fn)
+}
+
+func (s *Store) walkPrefix(prefix string, fn WalkFunc) error {
+	return s.Backend.List(prefix, func(name string, info BlobInfo) error {
+		id, rel, ok := strings.Cut(name, "/")
+		if !ok {
+			return nil
+		}
+		pathKey := PathKey{Filename: rel}
+		if i := strings.LastIndex(rel, "/"); i >= 0 {
+			pathKey = PathKey{PathName: rel[:i], Filename: rel[i+1:]}
+		}
+		return fn(id, KeyStat{
+			Key:     s.KeyFunc(pathKey),
+			Size:    info.Size,
+			ModTime: info.ModTime,
+		})
+	})
 }
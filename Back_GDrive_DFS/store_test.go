@@ -2,8 +2,14 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -58,6 +64,163 @@ func TestStore(t *testing.T) {
 	}
 }
 
+func TestStoreListWalkStatUsage(t *testing.T) {
+	s := NewStore(StoreOpts{Root: t.TempDir(), PathTransformFunc: HashPathTransformFunc})
+
+	data := map[string][]byte{}
+	for i := 0; i < 5; i++ {
+		b := bytes.Repeat([]byte{byte(i)}, 100*(i+1))
+		sum := sha256.Sum256(b)
+		key := hex.EncodeToString(sum[:])
+		data[key] = b
+		if _, err := s.Write("alice", key, bytes.NewReader(b)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Write("bob", "00ff", bytes.NewReader([]byte("bob's")))
+
+	keys, err := s.List("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != len(data) {
+		t.Fatalf("have %d keys want %d", len(keys), len(data))
+	}
+	for _, key := range keys {
+		if _, ok := data[key]; !ok {
+			t.Errorf("listed unknown key %s", key)
+		}
+	}
+
+	seen := map[string]int{}
+	err = s.Walk(func(id string, info KeyStat) error {
+		seen[id]++
+		if id == "alice" && info.Size != int64(len(data[info.Key])) {
+			t.Errorf("%s: have size %d want %d", info.Key, info.Size, len(data[info.Key]))
+		}
+		return nil
+	})
+	if err != nil || seen["alice"] != 5 || seen["bob"] != 1 {
+		t.Errorf("walked %v, %v", seen, err)
+	}
+
+	stop := errors.New("stop")
+	calls := 0
+	if err := s.Walk(func(string, KeyStat) error { calls++; return stop }); err != stop || calls != 1 {
+		t.Errorf("walk did not stop: %d calls, %v", calls, err)
+	}
+
+	// A content-addressed key is its own checksum.
+	info, err := s.Stat("alice", keys[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Checksum != keys[0] || info.Size != int64(len(data[keys[0]])) || info.ModTime.IsZero() {
+		t.Errorf("have %+v", info)
+	}
+	if _, err := s.Stat("alice", "missing"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("have %v", err)
+	}
+
+	u, err := s.Usage("alice")
+	if err != nil || u.Keys != 5 || u.Bytes != 1500 {
+		t.Errorf("have %+v, %v", u, err)
+	}
+	if u, _ := s.Usage("carol"); u.Keys != 0 {
+		t.Errorf("have %+v for an empty id", u)
+	}
+}
+
+func TestStoreDeleteOnlyRemovesKey(t *testing.T) {
+	s := NewStore(StoreOpts{Root: t.TempDir(), PathTransformFunc: HashPathTransformFunc})
+
+	// Share their first directory, and then their second.
+	for _, key := range []string{"aaaa01", "aabb01", "aabb02"} {
+		if _, err := s.Write("alice", key, bytes.NewReader([]byte(key))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := s.Delete("alice", "aabb01"); err != nil {
+		t.Fatal(err)
+	}
+	if keys, _ := s.List("alice"); len(keys) != 2 {
+		t.Errorf("have keys %v", keys)
+	}
+
+	s.Delete("alice", "aabb02")
+	if _, err := os.Stat(filepath.Join(s.Root, "alice", "aa", "bb")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("empty directory left behind: %v", err)
+	}
+	if !s.Has("alice", "aaaa01") {
+		t.Error("deleted a key sharing the prefix")
+	}
+
+	s.Delete("alice", "aaaa01")
+	if ids, _ := s.IDs(); len(ids) != 0 {
+		t.Errorf("have ids %v", ids)
+	}
+	if _, err := os.Stat(s.Root); err != nil {
+		t.Errorf("root went too: %v", err)
+	}
+	if err := s.Delete("alice", "aaaa01"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("deleting a missing key: %v", err)
+	}
+}
+
+type failingReader struct{ n int }
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if r.n == 0 {
+		return 0, errors.New("connection lost")
+	}
+	n := min(len(p), r.n)
+	r.n -= n
+	return n, nil
+}
+
+func TestStoreWriteIsAtomic(t *testing.T) {
+	s := NewStore(StoreOpts{Root: t.TempDir(), PathTransformFunc: HashPathTransformFunc})
+
+	if _, err := s.Write("alice", "abcdef", bytes.NewReader([]byte("old contents"))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Write("alice", "abcdef", &failingReader{n: 4}); err == nil {
+		t.Fatal("expected a failed write to fail")
+	}
+
+	_, r, err := s.Read("alice", "abcdef")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(r)
+	r.(io.Closer).Close()
+	if string(b) != "old contents" {
+		t.Errorf("have %q after a failed write", b)
+	}
+	if keys, _ := s.List("alice"); len(keys) != 1 {
+		t.Errorf("have keys %v", keys)
+	}
+
+	// What a crash mid-write leaves behind.
+	orphan := filepath.Join(s.Root, "alice", "ab", "cd", tempFilePrefix+"123")
+	if err := os.WriteFile(orphan, []byte("trunc"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if u, _ := s.Usage("alice"); u.Keys != 1 {
+		t.Errorf("temp file counted: %+v", u)
+	}
+	if n, err := s.Recover(); err != nil || n != 1 {
+		t.Errorf("recovered %d, %v", n, err)
+	}
+	if _, err := os.Stat(orphan); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("temp file still there: %v", err)
+	}
+	if !s.Has("alice", "abcdef") {
+		t.Error("recover removed a stored key")
+	}
+}
+
 func newStore() *Store {
 	opts := StoreOpts{
 		PathTransformFunc: CASPathTransformFunc,
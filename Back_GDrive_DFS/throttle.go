@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// Background traffic between nodes, that is copies made to repair
+// replication, replicas pushed on upload and files served for either, is
+// held to a token bucket for the node and one for each peer. Transfers for
+// users are never held back, but they spend from the same buckets, and
+// background transfers only go on once users have left a bucket alone for
+// userQuiet.
+
+// throttleChunk is the most a throttled transfer moves per token grab, so
+// that waits stay short and transfers share a bucket fairly.
+const throttleChunk = 32 * 1024
+
+// userQuiet is how long a bucket must go without user traffic before
+// background traffic may use it again.
+const userQuiet = 250 * time.Millisecond
+
+type backgroundKey struct{}
+
+// withBackground marks transfers made with ctx as background traffic.
+func withBackground(ctx context.Context) context.Context {
+	return context.WithValue(ctx, backgroundKey{}, true)
+}
+
+func isBackground(ctx context.Context) bool {
+	b, _ := ctx.Value(backgroundKey{}).(bool)
+	return b
+}
+
+// bucket is a token bucket of bytes. A rate of 0 never runs out.
+type bucket struct {
+	rate float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+	userAt time.Time // last user traffic
+}
+
+// newBucket holds up to a second's worth of rate.
+func newBucket(rate int64) *bucket {
+	return &bucket{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+// refill must be called with mu held.
+func (b *bucket) refill() {
+	now := time.Now()
+	b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*b.rate, b.rate)
+	b.last = now
+}
+
+// wait takes n bytes, first waiting until they have come in.
+func (b *bucket) wait(ctx context.Context, n int) error {
+	if b.rate == 0 {
+		return nil
+	}
+	b.mu.Lock()
+	b.refill()
+	b.tokens -= float64(n)
+	delay := time.Duration(-b.tokens / b.rate * float64(time.Second))
+	b.mu.Unlock()
+	return sleep(ctx, delay)
+}
+
+// yield waits until users have left the bucket alone for userQuiet.
+func (b *bucket) yield(ctx context.Context) error {
+	if b.rate == 0 {
+		return nil
+	}
+	for {
+		b.mu.Lock()
+		delay := time.Until(b.userAt.Add(userQuiet))
+		b.mu.Unlock()
+		if delay <= 0 {
+			return nil
+		}
+		if err := sleep(ctx, delay); err != nil {
+			return err
+		}
+	}
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// take takes n bytes without waiting. The bucket goes into debt, but by
+// no more than a second's worth, so background traffic resumes soon after
+// users stop.
+func (b *bucket) take(n int) {
+	if b.rate == 0 {
+		return
+	}
+	b.mu.Lock()
+	b.refill()
+	b.tokens = max(b.tokens-float64(n), min(b.tokens, -b.rate))
+	b.userAt = time.Now()
+	b.mu.Unlock()
+}
+
+// meter counts bytes, and how many went by in the last meterWindow
+// seconds.
+type meter struct {
+	mu     sync.Mutex
+	total  int64
+	second int64
+	window [meterWindow]int64
+}
+
+const meterWindow = 10
+
+// advance must be called with mu held.
+func (m *meter) advance(now int64) {
+	for m.second < now {
+		m.second++
+		m.window[m.second%meterWindow] = 0
+		if now-m.second > meterWindow {
+			m.second = now - meterWindow
+		}
+	}
+}
+
+func (m *meter) add(n int) {
+	m.mu.Lock()
+	m.advance(time.Now().Unix())
+	m.window[m.second%meterWindow] += int64(n)
+	m.total += int64(n)
+	m.mu.Unlock()
+}
+
+func (m *meter) usage() TrafficUsage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.advance(time.Now().Unix())
+	var recent int64
+	for _, n := range m.window {
+		recent += n
+	}
+	return TrafficUsage{Bytes: m.total, Rate: recent / meterWindow}
+}
+
+type TrafficUsage struct {
+	Bytes int64 `json:"bytes"`
+	// Rate is bytes per second over the last ten seconds.
+	Rate int64 `json:"bytes_per_second"`
+}
+
+// Throttle holds background traffic to NodeRate overall and PeerRate to
+// or from any one peer, in bytes per second, counting both directions; 0
+// is unlimited.
+type Throttle struct {
+	NodeRate int64
+	PeerRate int64
+
+	node       *bucket
+	background meter
+	user       meter
+
+	mu        sync.Mutex
+	peers     map[string]*bucket
+	peerMeter map[string]*meter
+	waited    time.Duration
+}
+
+func NewThrottle(nodeRate, peerRate int64) *Throttle {
+	return &Throttle{
+		NodeRate:  nodeRate,
+		PeerRate:  peerRate,
+		node:      newBucket(nodeRate),
+		peers:     make(map[string]*bucket),
+		peerMeter: make(map[string]*meter),
+	}
+}
+
+func (t *Throttle) peer(id string) (*bucket, *meter) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	b, ok := t.peers[id]
+	if !ok {
+		b = newBucket(t.PeerRate)
+		t.peers[id] = b
+		t.peerMeter[id] = &meter{}
+	}
+	return b, t.peerMeter[id]
+}
+
+// pass accounts for n bytes to or from peer, waiting first if they are
+// background traffic and users are busy or the buckets are short.
+func (t *Throttle) pass(ctx context.Context, peer string, background bool, n int) error {
+	b, m := t.peer(peer)
+	if !background {
+		b.take(n)
+		t.node.take(n)
+		t.user.add(n)
+		return nil
+	}
+
+	start := time.Now()
+	err := b.yield(ctx)
+	if err == nil {
+		err = t.node.yield(ctx)
+	}
+	if err == nil {
+		err = b.wait(ctx, n)
+	}
+	if err == nil {
+		err = t.node.wait(ctx, n)
+	}
+	if waited := time.Since(start); waited > time.Millisecond {
+		t.mu.Lock()
+		t.waited += waited
+		t.mu.Unlock()
+	}
+	if err != nil {
+		return err
+	}
+	t.background.add(n)
+	m.add(n)
+	return nil
+}
+
+// Reader reads r, as traffic from peer.
+func (t *Throttle) Reader(ctx context.Context, peer string, background bool, r io.Reader) io.Reader {
+	return &throttledReader{ctx: ctx, t: t, peer: peer, background: background, r: r}
+}
+
+// Writer writes to w, as traffic to peer.
+func (t *Throttle) Writer(ctx context.Context, peer string, background bool, w io.Writer) io.Writer {
+	return &throttledWriter{ctx: ctx, t: t, peer: peer, background: background, w: w}
+}
+
+type throttledReader struct {
+	ctx        context.Context
+	t          *Throttle
+	peer       string
+	background bool
+	r          io.Reader
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > throttleChunk {
+		p = p[:throttleChunk]
+	}
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if terr := r.t.pass(r.ctx, r.peer, r.background, n); terr != nil && err == nil {
+			err = terr
+		}
+	}
+	return n, err
+}
+
+type throttledWriter struct {
+	ctx        context.Context
+	t          *Throttle
+	peer       string
+	background bool
+	w          io.Writer
+}
+
+func (w *throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), throttleChunk)]
+		if err := w.t.pass(w.ctx, w.peer, w.background, len(chunk)); err != nil {
+			return written, err
+		}
+		n, err := w.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// BandwidthStats is how much traffic a node has moved, and its limits.
+type BandwidthStats struct {
+	NodeLimit  int64        `json:"node_limit"`
+	PeerLimit  int64        `json:"peer_limit"`
+	Background TrafficUsage `json:"background"`
+	User       TrafficUsage `json:"user"`
+	// Peers is background traffic by peer.
+	Peers map[string]TrafficUsage `json:"peers"`
+	// Throttled is how long background transfers have spent waiting.
+	Throttled float64 `json:"throttled_seconds"`
+}
+
+func (t *Throttle) Stats() BandwidthStats {
+	st := BandwidthStats{
+		NodeLimit:  t.NodeRate,
+		PeerLimit:  t.PeerRate,
+		Background: t.background.usage(),
+		User:       t.user.usage(),
+		Peers:      make(map[string]TrafficUsage),
+	}
+	t.mu.Lock()
+	meters := make(map[string]*meter, len(t.peerMeter))
+	for id, m := range t.peerMeter {
+		meters[id] = m
+	}
+	st.Throttled = t.waited.Seconds()
+	t.mu.Unlock()
+	for id, m := range meters {
+		st.Peers[id] = m.usage()
+	}
+	return st
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestThrottleHoldsBackgroundTraffic(t *testing.T) {
+	const rate = 256 * 1024
+	th := NewThrottle(rate, 0)
+	ctx := withBackground(context.Background())
+
+	// The bucket starts full, so the second half has to wait for it.
+	start := time.Now()
+	w := th.Writer(ctx, "s2", isBackground(ctx), io.Discard)
+	if _, err := w.Write(make([]byte, 2*rate)); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 900*time.Millisecond {
+		t.Errorf("sent %d bytes in %v", 2*rate, elapsed)
+	}
+
+	st := th.Stats()
+	if st.Background.Bytes != 2*rate || st.Peers["s2"].Bytes != 2*rate || st.User.Bytes != 0 {
+		t.Errorf("stats %+v", st)
+	}
+	if st.Throttled == 0 {
+		t.Error("no time spent throttled")
+	}
+}
+
+func TestThrottleLetsUsersThrough(t *testing.T) {
+	const rate = 256 * 1024
+	th := NewThrottle(rate, rate)
+
+	start := time.Now()
+	r := th.Reader(context.Background(), "s2", false, bytes.NewReader(make([]byte, 4*rate)))
+	if n, err := io.Copy(io.Discard, r); err != nil || n != 4*rate {
+		t.Fatalf("read %d: %v", n, err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("user read held back for %v", elapsed)
+	}
+
+	// What users used is gone for background traffic.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	w := th.Writer(ctx, "s3", true, io.Discard)
+	if _, err := w.Write(make([]byte, 1024)); err == nil {
+		t.Error("background write went through while users had used the bandwidth")
+	}
+}
+
+func TestBackgroundYieldsToUsers(t *testing.T) {
+	const rate = 256 * 1024
+	th := NewThrottle(rate, 0)
+
+	ctx, cancel := context.WithTimeout(withBackground(context.Background()), 10*time.Second)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		w := th.Writer(ctx, "s2", true, io.Discard)
+		_, err := w.Write(make([]byte, 2*rate))
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// A user read well under the limit still has the node to itself.
+	before := th.Stats().Background.Bytes
+	r := th.Reader(context.Background(), "s3", false, bytes.NewReader(make([]byte, rate)))
+	buf := make([]byte, 4096)
+	for end := time.Now().Add(time.Second); time.Now().Before(end); {
+		r.Read(buf)
+		time.Sleep(50 * time.Millisecond)
+	}
+	if moved := th.Stats().Background.Bytes - before; moved > throttleChunk {
+		t.Errorf("background moved %d bytes while a user was reading", moved)
+	}
+
+	// Once the user is done, background traffic picks up again.
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if st := th.Stats(); st.Background.Bytes != 2*rate {
+		t.Errorf("stats %+v", st)
+	}
+}
+
+func TestBackgroundCopyIsThrottled(t *testing.T) {
+	keys := newTestKeyManager(t)
+	s1 := startTestServer(t, "s1", keys)
+	s2 := startTestServer(t, "s2", keys, s1.Transport.Addr())
+	waitForPeers(t, s1, s2)
+
+	data := bytes.Repeat([]byte("replicated in the background "), 2000)
+	if _, err := s1.WriteFile("alice", "a.txt", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if _, err := s2.CopyFile(withBackground(ctx), "s1", "alice", "a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if _, err := s2.FetchFile(ctx, "s1", "alice", "a.txt", &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	// Both ends count the copy as background traffic, and the read as a
+	// user's.
+	for _, s := range []*FileServer{s1, s2} {
+		st := s.Throttle.Stats()
+		if st.Background.Bytes == 0 || st.User.Bytes == 0 {
+			t.Errorf("%s: %+v", s.ID, st)
+		}
+	}
+	if st := s1.Throttle.Stats(); st.Peers["s2"].Bytes == 0 {
+		t.Errorf("s1 has no traffic for s2: %+v", st)
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"log"
+	"os"
+	"time"
+)
+
+// A node with a cold backend keeps the chunks of files nobody reads on it,
+// and the rest on its own disk, the hot tier. A file's chunks are all in
+// one tier, named in its manifest. Files go cold by the TieringPolicy and
+// come back on their first read.
+const (
+	tierHot  = "hot"
+	tierCold = "cold"
+)
+
+// accessResolution is how far behind a manifest's access time may fall
+// before a read updates it, so that reading a file doesn't mean rewriting
+// its manifest every time.
+const accessResolution = time.Hour
+
+type TieringPolicy struct {
+	// ColdAfter is how long a file goes unread before it moves to the
+	// cold tier.
+	ColdAfter time.Duration
+	// MinSize keeps files smaller than this hot, where moving them would
+	// save little.
+	MinSize int64
+}
+
+func (p TieringPolicy) goesCold(m *Manifest) bool {
+	return m.tier() == tierHot && m.Size >= p.MinSize && time.Since(m.lastAccess()) >= p.ColdAfter
+}
+
+func (m *Manifest) tier() string {
+	if m.Tier == "" {
+		return tierHot
+	}
+	return m.Tier
+}
+
+// lastAccess falls back to when the file was written, for manifests from
+// before access times were kept.
+func (m *Manifest) lastAccess() time.Time {
+	if m.Accessed.IsZero() {
+		return m.Modified
+	}
+	return m.Accessed
+}
+
+// sameVersion tells whether a and b describe the same write of a file.
+// Every write seals under a new data key, so no two share a chunk.
+func sameVersion(a, b *Manifest) bool {
+	return len(a.Chunks) == len(b.Chunks) && (len(a.Chunks) == 0 || a.Chunks[0].Key == b.Chunks[0].Key)
+}
+
+// tierStore is where the chunks of a file in tier are.
+func (s *FileServer) tierStore(tier string) *Store {
+	if tier == tierCold && s.cold != nil {
+		return s.cold
+	}
+	return s.store
+}
+
+// recordRead notes that m was just read: a cold file is promoted in the
+// background, a hot one gets its access time brought up to date.
+func (s *FileServer) recordRead(userID string, m *Manifest) {
+	if m.tier() == tierCold {
+		go func() {
+			if _, err := s.moveFile(userID, m, tierHot); err != nil {
+				log.Printf("[tiers] promoting %s/%s: %v", userID, m.Name, err)
+			}
+		}()
+		return
+	}
+	if time.Since(m.lastAccess()) < accessResolution {
+		return
+	}
+
+	s.fileLock.Lock()
+	defer s.fileLock.Unlock()
+	cur, err := s.readManifest(userID, m.Name)
+	if err != nil || !sameVersion(cur, m) {
+		return
+	}
+	cur.Accessed = time.Now()
+	if err := s.writeManifest(userID, cur); err != nil {
+		log.Printf("[tiers] recording read of %s/%s: %v", userID, m.Name, err)
+	}
+}
+
+// moveFile copies m's chunks to tier, switches the manifest over and then
+// removes them from where they were. It reports false if there was nothing
+// to do: the file is already there or being moved, or was rewritten or
+// deleted meanwhile.
+func (s *FileServer) moveFile(userID string, m *Manifest, tier string) (bool, error) {
+	from := m.tier()
+	if s.cold == nil || from == tier {
+		return false, nil
+	}
+
+	id := userID + "/" + m.Name
+	s.fileLock.Lock()
+	if s.moving[id] {
+		s.fileLock.Unlock()
+		return false, nil
+	}
+	s.moving[id] = true
+	s.fileLock.Unlock()
+	defer func() {
+		s.fileLock.Lock()
+		delete(s.moving, id)
+		s.fileLock.Unlock()
+	}()
+
+	src, dst := s.tierStore(from), s.tierStore(tier)
+	for _, chunk := range m.Chunks {
+		if err := copyKey(src, dst, userID, chunk.Key); err != nil {
+			s.removeChunks(dst, userID, m)
+			return false, err
+		}
+	}
+
+	s.fileLock.Lock()
+	cur, err := s.readManifest(userID, m.Name)
+	moved := err == nil && sameVersion(cur, m) && cur.tier() == from
+	if moved {
+		cur.Tier = tier
+		if tier == tierHot {
+			cur.Accessed = time.Now()
+		}
+		err = s.writeManifest(userID, cur)
+	}
+	s.fileLock.Unlock()
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	if !moved || err != nil {
+		s.removeChunks(dst, userID, m)
+		return false, err
+	}
+
+	s.removeChunks(src, userID, m)
+	return true, nil
+}
+
+func copyKey(src, dst *Store, id, key string) error {
+	_, r, err := src.readStream(id, key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	_, err = dst.Write(id, key, r)
+	return err
+}
+
+// ApplyTiering moves every file p says should be cold to the cold tier.
+func (s *FileServer) ApplyTiering(p TieringPolicy) (int, error) {
+	if s.cold == nil {
+		return 0, nil
+	}
+
+	moved := 0
+	err := s.WalkFiles(func(userID string, m *Manifest) error {
+		if !p.goesCold(m) {
+			return nil
+		}
+		ok, err := s.moveFile(userID, m, tierCold)
+		if err != nil {
+			log.Printf("[tiers] demoting %s/%s: %v", userID, m.Name, err)
+		}
+		if ok {
+			moved++
+		}
+		return nil
+	})
+	return moved, err
+}
+
+// runTiering applies p every interval.
+func (s *FileServer) runTiering(interval time.Duration, p TieringPolicy) {
+	if s.cold == nil {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			n, err := s.ApplyTiering(p)
+			if err != nil {
+				log.Printf("[tiers] tiering failed: %v", err)
+			}
+			if n > 0 {
+				log.Printf("[tiers] moved %d files to the cold tier", n)
+			}
+		case <-s.quitch:
+			return
+		}
+	}
+}
+
+// TierStats is what a node keeps in one tier: the files there and the bytes
+// their chunks take up.
+type TierStats struct {
+	Files int   `json:"files"`
+	Bytes int64 `json:"bytes"`
+}
+
+func (s *FileServer) TierUsage() (map[string]TierStats, error) {
+	usage := map[string]TierStats{}
+	for tier := range s.tierStores() {
+		usage[tier] = TierStats{}
+	}
+
+	err := s.WalkFiles(func(_ string, m *Manifest) error {
+		u := usage[m.tier()]
+		u.Files++
+		usage[m.tier()] = u
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for tier, st := range s.tierStores() {
+		err := st.Walk(func(_ string, info KeyStat) error {
+			u := usage[tier]
+			u.Bytes += info.Size
+			usage[tier] = u
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return usage, nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTiering(t *testing.T) {
+	s := NewFileServer(FileServerOpts{
+		ID:                "s1",
+		Keys:              newTestKeyManager(t),
+		StorageRoot:       t.TempDir(),
+		PathTransformFunc: HashPathTransformFunc,
+		ColdBackend:       NewMemoryBackend(),
+	})
+
+	big := bytes.Repeat([]byte("rarely read "), ChunkSize/6)
+	small := []byte("small")
+	weekAgo := time.Now().Add(-8 * 24 * time.Hour)
+	s.writeFile("alice", "big.bin", bytes.NewReader(big), weekAgo)
+	s.writeFile("alice", "small.txt", bytes.NewReader(small), weekAgo)
+	s.WriteFile("alice", "new.bin", bytes.NewReader(big))
+
+	policy := TieringPolicy{ColdAfter: 7 * 24 * time.Hour, MinSize: 1024}
+	if n, err := s.ApplyTiering(policy); err != nil || n != 1 {
+		t.Fatalf("moved %d files, %v", n, err)
+	}
+	m, _ := s.StatFile("alice", "big.bin")
+	if m.tier() != tierCold {
+		t.Errorf("big.bin is %s", m.tier())
+	}
+	if keys, _ := s.cold.List("alice"); len(keys) != len(m.Chunks) {
+		t.Errorf("have %d cold chunks, want %d", len(keys), len(m.Chunks))
+	}
+	for _, name := range []string{"small.txt", "new.bin"} {
+		if m, _ := s.StatFile("alice", name); m.tier() != tierHot {
+			t.Errorf("%s is %s", name, m.tier())
+		}
+	}
+
+	usage, err := s.TierUsage()
+	if err != nil || usage[tierCold].Files != 1 || usage[tierHot].Files != 2 || usage[tierCold].Bytes <= int64(len(big)) {
+		t.Errorf("have %+v, %v", usage, err)
+	}
+
+	// Reading serves the cold copy, and brings it back.
+	var out bytes.Buffer
+	if _, err := s.ReadFile("alice", "big.bin", &out); err != nil || !bytes.Equal(out.Bytes(), big) {
+		t.Fatalf("read %d bytes, %v", out.Len(), err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		m, _ = s.StatFile("alice", "big.bin")
+		if m.tier() == tierHot {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("big.bin was not promoted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if time.Since(m.Accessed) > time.Minute {
+		t.Errorf("access time not updated: %v", m.Accessed)
+	}
+	if keys, _ := s.cold.List("alice"); len(keys) != 0 {
+		t.Errorf("cold chunks left after promotion: %v", keys)
+	}
+	out.Reset()
+	if _, err := s.ReadFile("alice", "big.bin", &out); err != nil || !bytes.Equal(out.Bytes(), big) {
+		t.Errorf("read %d bytes after promotion, %v", out.Len(), err)
+	}
+
+	// Just read, so it stays hot.
+	if n, _ := s.ApplyTiering(policy); n != 0 {
+		t.Errorf("moved %d files", n)
+	}
+}
+
+func TestBackgroundFetchLeavesFileCold(t *testing.T) {
+	s1 := newTestServer(t, "s1", newTestKeyManager(t))
+	s1.cold = NewStore(StoreOpts{Backend: NewMemoryBackend(), PathTransformFunc: HashPathTransformFunc})
+	go s1.Start()
+	t.Cleanup(s1.Stop)
+	time.Sleep(50 * time.Millisecond)
+	s2 := startTestServer(t, "s2", newTestKeyManager(t), s1.Transport.Addr())
+	waitForPeers(t, s1, s2)
+
+	data := bytes.Repeat([]byte("rarely read "), ChunkSize/6)
+	s1.writeFile("alice", "big.bin", bytes.NewReader(data), time.Now().Add(-8*24*time.Hour))
+	if n, err := s1.ApplyTiering(TieringPolicy{ColdAfter: 7 * 24 * time.Hour}); err != nil || n != 1 {
+		t.Fatalf("moved %d files, %v", n, err)
+	}
+	before, _ := s1.StatFile("alice", "big.bin")
+
+	// Replication copies the file without reading it for anyone.
+	var out bytes.Buffer
+	if _, err := s2.FetchFile(withBackground(context.Background()), "s1", "alice", "big.bin", &out); err != nil || !bytes.Equal(out.Bytes(), data) {
+		t.Fatalf("fetched %d bytes, %v", out.Len(), err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	m, _ := s1.StatFile("alice", "big.bin")
+	if m.tier() != tierCold || !m.Accessed.Equal(before.Accessed) {
+		t.Errorf("background fetch left big.bin %s, accessed %v", m.tier(), m.Accessed)
+	}
+
+	// A user's read through a peer does bring it back.
+	if _, err := s2.FetchFile(context.Background(), "s1", "alice", "big.bin", &out); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for m.tier() != tierHot {
+		if time.Now().After(deadline) {
+			t.Fatal("big.bin was not promoted")
+		}
+		time.Sleep(10 * time.Millisecond)
+		m, _ = s1.StatFile("alice", "big.bin")
+	}
+}
+
+func TestColdDiskMustBeApart(t *testing.T) {
+	t.Setenv("STORAGE_BACKEND", "disk")
+	t.Setenv("COLD_STORAGE_BACKEND", "disk")
+	storage := t.TempDir()
+	hotRoot := filepath.Join(storage, "s1", blobsDir)
+
+	// One root for both tiers would have demoting a file copy each chunk
+	// onto itself and then delete it.
+	for _, root := range []string{storage, hotRoot} {
+		t.Setenv("COLD_STORAGE_ROOT", root)
+		if _, err := newColdBackendFromEnv("s1", hotRoot); err == nil {
+			t.Errorf("cold root %s was accepted", root)
+		}
+	}
+
+	t.Setenv("COLD_STORAGE_ROOT", t.TempDir())
+	hot, err := newBackendFromEnv(hotRoot, "s1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cold, err := newColdBackendFromEnv("s1", hotRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewFileServer(FileServerOpts{
+		ID:                "s1",
+		Keys:              newTestKeyManager(t),
+		StorageRoot:       filepath.Join(storage, "s1"),
+		PathTransformFunc: HashPathTransformFunc,
+		Backend:           hot,
+		ColdBackend:       cold,
+	})
+	data := bytes.Repeat([]byte("rarely read "), ChunkSize/6)
+	s.writeFile("alice", "big.bin", bytes.NewReader(data), time.Now().Add(-8*24*time.Hour))
+	if n, err := s.ApplyTiering(TieringPolicy{ColdAfter: 7 * 24 * time.Hour}); err != nil || n != 1 {
+		t.Fatalf("moved %d files, %v", n, err)
+	}
+	if n, err := s.CollectGarbage(0); err != nil || n != 0 {
+		t.Errorf("collected %d, %v", n, err)
+	}
+	var out bytes.Buffer
+	if _, err := s.ReadFile("alice", "big.bin", &out); err != nil || !bytes.Equal(out.Bytes(), data) {
+		t.Errorf("read %d bytes, %v", out.Len(), err)
+	}
+}
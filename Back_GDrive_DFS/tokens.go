@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gofiber/fiber/v3"
+	"google.golang.org/api/iterator"
+)
+
+// Personal access tokens are long-lived credentials for automation. The raw
+// token is only shown once at creation; we keep a SHA-256 of its secret.
+// Tokens look like gdp_<id>_<secret> so the id can be looked up directly.
+const accessTokenPrefix = "gdp_"
+
+const (
+	ScopeRead  = "read"
+	ScopeWrite = "write"
+)
+
+var (
+	errTokenRevoked = errors.New("access token revoked")
+	errTokenInvalid = errors.New("invalid access token")
+)
+
+type AccessToken struct {
+	ID             string    `json:"id" firestore:"-"`
+	UserID         string    `json:"userId" firestore:"userId"`
+	CreatedBy      string    `json:"createdBy" firestore:"createdBy"`
+	Name           string    `json:"name" firestore:"name"`
+	TokenHash      string    `json:"-" firestore:"tokenHash"`
+	Scopes         []string  `json:"scopes" firestore:"scopes"`
+	FolderID       string    `json:"folderId,omitempty" firestore:"folderId"`
+	ServiceAccount bool      `json:"serviceAccount" firestore:"serviceAccount"`
+	CreatedAt      time.Time `json:"createdAt" firestore:"createdAt"`
+	ExpiresAt      time.Time `json:"expiresAt" firestore:"expiresAt"` // zero means never
+	LastUsedAt     time.Time `json:"lastUsedAt" firestore:"lastUsedAt"`
+	Revoked        bool      `json:"revoked" firestore:"revoked"`
+}
+
+func hashTokenSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func newTokenSecret() string {
+	buf := make([]byte, 32)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+func formatAccessToken(id, secret string) string {
+	return accessTokenPrefix + id + "_" + secret
+}
+
+func parseAccessToken(raw string) (id, secret string, ok bool) {
+	rest, ok := strings.CutPrefix(raw, accessTokenPrefix)
+	if !ok {
+		return "", "", false
+	}
+	id, secret, ok = strings.Cut(rest, "_")
+	if !ok || id == "" || secret == "" {
+		return "", "", false
+	}
+	return id, secret, true
+}
+
+func (t *AccessToken) verify(secret string, now time.Time) error {
+	if subtle.ConstantTimeCompare([]byte(t.TokenHash), []byte(hashTokenSecret(secret))) != 1 {
+		return errTokenInvalid
+	}
+	if t.Revoked {
+		return errTokenRevoked
+	}
+	if !t.ExpiresAt.IsZero() && now.After(t.ExpiresAt) {
+		return errTokenExpired
+	}
+	return nil
+}
+
+func validScopes(scopes []string) bool {
+	if len(scopes) == 0 {
+		return false
+	}
+	for _, s := range scopes {
+		if s != ScopeRead && s != ScopeWrite {
+			return false
+		}
+	}
+	return true
+}
+
+// -------------------- Authenticator --------------------
+
+// TokenStore is where access tokens are looked up. Firestore backs it in
+// production; tests use an in-memory map.
+type TokenStore interface {
+	GetToken(ctx context.Context, id string) (*AccessToken, error)
+	TouchToken(ctx context.Context, id string, at time.Time)
+}
+
+// TokenAuthenticator accepts personal access tokens and hands every other
+// bearer token to next, so PATs work alongside the regular provider.
+type TokenAuthenticator struct {
+	next  Authenticator
+	store TokenStore
+}
+
+func NewTokenAuthenticator(next Authenticator, store TokenStore) *TokenAuthenticator {
+	return &TokenAuthenticator{next: next, store: store}
+}
+
+func (a *TokenAuthenticator) Authenticate(ctx context.Context, raw string) (*Identity, error) {
+	id, secret, ok := parseAccessToken(raw)
+	if !ok {
+		return a.next.Authenticate(ctx, raw)
+	}
+
+	tok, err := a.store.GetToken(ctx, id)
+	if err != nil {
+		return nil, errTokenInvalid
+	}
+	now := time.Now()
+	if err := tok.verify(secret, now); err != nil {
+		return nil, err
+	}
+	go a.store.TouchToken(context.Background(), id, now)
+
+	return &Identity{
+		UserID: tok.UserID,
+		Claims: map[string]interface{}{
+			"token_id":  tok.ID,
+			"scopes":    tok.Scopes,
+			"folder_id": tok.FolderID,
+		},
+	}, nil
+}
+
+type firestoreTokenStore struct{}
+
+func tokensCollection() *firestore.CollectionRef {
+	return firestoreClient.Collection("accessTokens")
+}
+
+func (firestoreTokenStore) GetToken(ctx context.Context, id string) (*AccessToken, error) {
+	doc, err := tokensCollection().Doc(id).Get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var tok AccessToken
+	if err := doc.DataTo(&tok); err != nil {
+		return nil, err
+	}
+	tok.ID = doc.Ref.ID
+	return &tok, nil
+}
+
+func (firestoreTokenStore) TouchToken(ctx context.Context, id string, at time.Time) {
+	if _, err := tokensCollection().Doc(id).Update(ctx, []firestore.Update{{Path: "lastUsedAt", Value: at}}); err != nil {
+		log.Printf("[tokens] failed to record use of %s: %v", id, err)
+	}
+}
+
+// -------------------- Scope Checks --------------------
+
+// tokenGrant returns the limits of the access token the request was made
+// with. ok is false for interactive sessions, which are not scoped.
+func tokenGrant(c fiber.Ctx) (scopes []string, folderID string, ok bool) {
+	claims, _ := c.Locals("claims").(map[string]interface{})
+	if _, isToken := claims["token_id"]; !isToken {
+		return nil, "", false
+	}
+	scopes, _ = claims["scopes"].([]string)
+	folderID, _ = claims["folder_id"].(string)
+	return scopes, folderID, true
+}
+
+func scopeForRole(need Role) string {
+	if need == RoleViewer {
+		return ScopeRead
+	}
+	return ScopeWrite
+}
+
+// checkTokenAccess enforces an access token's scope and folder limit for an
+// operation needing scope on a file in folderID.
+func checkTokenAccess(c fiber.Ctx, scope, folderID string) error {
+	scopes, tokenFolder, ok := tokenGrant(c)
+	if !ok {
+		return nil
+	}
+	if !slices.Contains(scopes, scope) {
+		return errForbidden
+	}
+	if tokenFolder != "" && tokenFolder != folderID {
+		return errForbidden
+	}
+	return nil
+}
+
+// requireScope guards routes that don't address a single file.
+func requireScope(scope string) fiber.Handler {
+	return func(c fiber.Ctx) error {
+		scopes, _, ok := tokenGrant(c)
+		if ok && !slices.Contains(scopes, scope) {
+			return c.Status(403).JSON(fiber.Map{"error": fmt.Sprintf("token lacks %s scope", scope)})
+		}
+		return c.Next()
+	}
+}
+
+// requireInteractive keeps access tokens from managing access tokens, or
+// from handing out access any other way: sharing, public links and vault
+// membership all need a browser session.
+func requireInteractive(c fiber.Ctx) error {
+	if _, _, ok := tokenGrant(c); ok {
+		return c.Status(403).JSON(fiber.Map{"error": "not allowed with an access token"})
+	}
+	return c.Next()
+}
+
+// -------------------- Token Endpoints --------------------
+
+var serviceAccountName = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{1,40}$`)
+
+func createTokenHandler(c fiber.Ctx) error {
+	userID := localUserID(c)
+
+	body := struct {
+		Name           string   `json:"name"`
+		Scopes         []string `json:"scopes"`
+		FolderID       string   `json:"folder_id"`
+		ExpiresIn      int64    `json:"expires_in"` // seconds, 0 for no expiry
+		ServiceAccount string   `json:"service_account"`
+	}{}
+	if err := c.Bind().JSON(&body); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "invalid request"})
+	}
+	if body.Name == "" || !validScopes(body.Scopes) {
+		return c.Status(400).JSON(fiber.Map{"error": "name and scopes (read, write) are required"})
+	}
+	if body.ExpiresIn < 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "expires_in must not be negative"})
+	}
+
+	tok := AccessToken{
+		UserID:    userID,
+		CreatedBy: userID,
+		Name:      body.Name,
+		Scopes:    body.Scopes,
+		FolderID:  body.FolderID,
+		CreatedAt: time.Now(),
+	}
+	if body.ExpiresIn > 0 {
+		tok.ExpiresAt = tok.CreatedAt.Add(time.Duration(body.ExpiresIn) * time.Second)
+	}
+
+	// Service accounts own their files under their own user id. Only admins
+	// may mint them.
+	if body.ServiceAccount != "" {
+		claims, _ := c.Locals("claims").(map[string]interface{})
+		if isAdmin, _ := claims["admin"].(bool); !isAdmin {
+			return c.Status(403).JSON(fiber.Map{"error": "admin access required"})
+		}
+		if !serviceAccountName.MatchString(body.ServiceAccount) {
+			return c.Status(400).JSON(fiber.Map{"error": "invalid service account name"})
+		}
+		tok.UserID = "svc-" + body.ServiceAccount
+		tok.ServiceAccount = true
+	}
+
+	secret := newTokenSecret()
+	tok.TokenHash = hashTokenSecret(secret)
+
+	ref, _, err := tokensCollection().Add(context.Background(), tok)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	tok.ID = ref.ID
+
+	log.Printf("[tokens] %s created token %s (%s) for %s scopes=%v", userID, tok.ID, tok.Name, tok.UserID, tok.Scopes)
+	return c.JSON(fiber.Map{
+		"success": true,
+		"token":   formatAccessToken(tok.ID, secret),
+		"info":    tok,
+	})
+}
+
+func listTokensHandler(c fiber.Ctx) error {
+	userID := localUserID(c)
+
+	iter := tokensCollection().Where("createdBy", "==", userID).Documents(context.Background())
+	tokens := []AccessToken{}
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		var tok AccessToken
+		if err := doc.DataTo(&tok); err != nil {
+			continue
+		}
+		tok.ID = doc.Ref.ID
+		tokens = append(tokens, tok)
+	}
+
+	return c.JSON(fiber.Map{"success": true, "tokens": tokens})
+}
+
+func revokeTokenHandler(c fiber.Ctx) error {
+	userID := localUserID(c)
+	tokenID := c.Params("tokenID")
+
+	ctx := context.Background()
+	tok, err := firestoreTokenStore{}.GetToken(ctx, tokenID)
+	if err != nil || tok.CreatedBy != userID {
+		return c.Status(404).JSON(fiber.Map{"error": "token not found"})
+	}
+
+	if _, err := tokensCollection().Doc(tokenID).Update(ctx, []firestore.Update{{Path: "revoked", Value: true}}); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	log.Printf("[tokens] %s revoked token %s", userID, tokenID)
+	return c.JSON(fiber.Map{"success": true, "id": tokenID})
+}
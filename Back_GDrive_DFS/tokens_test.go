@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+)
+
+type memTokenStore struct {
+	mu     sync.Mutex
+	tokens map[string]*AccessToken
+}
+
+func (s *memTokenStore) GetToken(ctx context.Context, id string) (*AccessToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tok, ok := s.tokens[id]
+	if !ok {
+		return nil, fmt.Errorf("token %s not found", id)
+	}
+	cp := *tok
+	return &cp, nil
+}
+
+func (s *memTokenStore) TouchToken(ctx context.Context, id string, at time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if tok, ok := s.tokens[id]; ok {
+		tok.LastUsedAt = at
+	}
+}
+
+func TestParseAccessToken(t *testing.T) {
+	raw := formatAccessToken("AbC123", "deadbeef")
+	id, secret, ok := parseAccessToken(raw)
+	if !ok || id != "AbC123" || secret != "deadbeef" {
+		t.Errorf("have %s %s %v", id, secret, ok)
+	}
+
+	for _, bad := range []string{"", "gdp_", "gdp_id", "gdp__secret", "eyJhbGciOi.x.y"} {
+		if _, _, ok := parseAccessToken(bad); ok {
+			t.Errorf("expected %q not to parse", bad)
+		}
+	}
+}
+
+func TestTokenAuthenticator(t *testing.T) {
+	secret := newTokenSecret()
+	store := &memTokenStore{tokens: map[string]*AccessToken{
+		"ci": {ID: "ci", UserID: "alice", TokenHash: hashTokenSecret(secret), Scopes: []string{ScopeWrite}, FolderID: "builds"},
+		"old": {ID: "old", UserID: "alice", TokenHash: hashTokenSecret(secret), Scopes: []string{ScopeRead},
+			ExpiresAt: time.Now().Add(-time.Hour)},
+		"gone": {ID: "gone", UserID: "alice", TokenHash: hashTokenSecret(secret), Scopes: []string{ScopeRead}, Revoked: true},
+	}}
+	next, _ := NewStaticAuthenticator(StaticOpts{APIKeys: map[string]string{"browser": "bob"}})
+	a := NewTokenAuthenticator(next, store)
+	ctx := context.Background()
+
+	ident, err := a.Authenticate(ctx, formatAccessToken("ci", secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ident.UserID != "alice" || ident.Claims["folder_id"] != "builds" {
+		t.Errorf("have %+v", ident)
+	}
+
+	if _, err := a.Authenticate(ctx, formatAccessToken("ci", newTokenSecret())); err == nil {
+		t.Error("expected wrong secret to fail")
+	}
+	if _, err := a.Authenticate(ctx, formatAccessToken("old", secret)); err == nil {
+		t.Error("expected expired token to fail")
+	}
+	if _, err := a.Authenticate(ctx, formatAccessToken("gone", secret)); err == nil {
+		t.Error("expected revoked token to fail")
+	}
+	if _, err := a.Authenticate(ctx, formatAccessToken("missing", secret)); err == nil {
+		t.Error("expected unknown token to fail")
+	}
+
+	ident, err = a.Authenticate(ctx, "browser")
+	if err != nil || ident.UserID != "bob" {
+		t.Errorf("other tokens must fall through to the provider: %+v, %v", ident, err)
+	}
+}
+
+func TestTokenScopes(t *testing.T) {
+	secret := newTokenSecret()
+	store := &memTokenStore{tokens: map[string]*AccessToken{
+		"ro": {ID: "ro", UserID: "alice", TokenHash: hashTokenSecret(secret), Scopes: []string{ScopeRead}},
+		"wf": {ID: "wf", UserID: "alice", TokenHash: hashTokenSecret(secret), Scopes: []string{ScopeWrite}, FolderID: "builds"},
+	}}
+	next, _ := NewStaticAuthenticator(StaticOpts{APIKeys: map[string]string{"browser": "alice"}})
+
+	prev := authenticator
+	defer func() { authenticator = prev }()
+	authenticator = NewTokenAuthenticator(next, store)
+
+	app := fiber.New()
+	app.Post("/upload", authMiddleware, requireScope(ScopeWrite), func(c fiber.Ctx) error {
+		if err := checkTokenAccess(c, ScopeWrite, c.Query("folder")); err != nil {
+			return accessErrorResponse(c, err)
+		}
+		return c.SendString("ok")
+	})
+	app.Post("/tokens", authMiddleware, requireInteractive, func(c fiber.Ctx) error {
+		return c.SendString("ok")
+	})
+
+	do := func(method, path, token string) int {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode
+	}
+
+	if code := do(http.MethodPost, "/upload", formatAccessToken("ro", secret)); code != 403 {
+		t.Errorf("read-only token upload: have %d want 403", code)
+	}
+	if code := do(http.MethodPost, "/upload?folder=builds", formatAccessToken("wf", secret)); code != 200 {
+		t.Errorf("write token in its folder: have %d want 200", code)
+	}
+	if code := do(http.MethodPost, "/upload?folder=photos", formatAccessToken("wf", secret)); code != 403 {
+		t.Errorf("write token outside its folder: have %d want 403", code)
+	}
+	if code := do(http.MethodPost, "/upload?folder=photos", "browser"); code != 200 {
+		t.Errorf("interactive session: have %d want 200", code)
+	}
+	if code := do(http.MethodPost, "/tokens", formatAccessToken("wf", secret)); code != 403 {
+		t.Errorf("token managing tokens: have %d want 403", code)
+	}
+}
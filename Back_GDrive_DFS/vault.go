@@ -0,0 +1,481 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gofiber/fiber/v3"
+	"google.golang.org/api/iterator"
+)
+
+// Vaults are folders encrypted end to end in the browser. The server only
+// ever holds opaque values: blobs the client encrypted under the vault key,
+// file names encrypted the same way, and envelopes that wrap the vault key
+// for each member's public key. Members keep their private key here too, but
+// wrapped by a passphrase the server never sees. Nothing in a vault can be
+// read, indexed or sniffed server side.
+//
+// Blobs are stored and replicated like any other file, under the storage
+// user vault-<vaultID> and a random blob id instead of their name.
+type Vault struct {
+	ID            string            `json:"id" firestore:"-"`
+	OwnerID       string            `json:"ownerId" firestore:"ownerId"`
+	EncryptedName string            `json:"encryptedName" firestore:"encryptedName"`
+	Members       []string          `json:"members" firestore:"members"`
+	Envelopes     map[string]string `json:"-" firestore:"envelopes"`
+	CreatedAt     time.Time         `json:"createdAt" firestore:"createdAt"`
+}
+
+type VaultBlob struct {
+	ID            string    `json:"id" firestore:"-"`
+	EncryptedName string    `json:"encryptedName" firestore:"encryptedName"`
+	Size          int       `json:"size" firestore:"size"`
+	NodeID        []string  `json:"nodeId" firestore:"nodeId"`
+	CreatedBy     string    `json:"createdBy" firestore:"createdBy"`
+	CreatedAt     time.Time `json:"createdAt" firestore:"createdAt"`
+}
+
+// VaultKeyBundle is a user's vault key pair. KDF holds whatever parameters
+// the client needs to rederive the key wrapping the private key.
+type VaultKeyBundle struct {
+	UserID            string    `json:"userId" firestore:"-"`
+	PublicKey         string    `json:"publicKey" firestore:"publicKey"`
+	WrappedPrivateKey string    `json:"wrappedPrivateKey,omitempty" firestore:"wrappedPrivateKey"`
+	KDF               string    `json:"kdf,omitempty" firestore:"kdf"`
+	UpdatedAt         time.Time `json:"updatedAt" firestore:"updatedAt"`
+}
+
+const (
+	maxOpaqueKey  = 8 * 1024
+	maxOpaqueName = 2 * 1024
+)
+
+var errVaultNotFound = errors.New("vault not found")
+
+// Vault and blob ids are Firestore document ids.
+var vaultIDPattern = regexp.MustCompile(`^[A-Za-z0-9]{1,64}$`)
+
+// validOpaque checks a client supplied ciphertext is base64 and not absurdly
+// large. We can't check anything else about it.
+func validOpaque(s string, max int) bool {
+	if s == "" || len(s) > max {
+		return false
+	}
+	_, err := base64.StdEncoding.DecodeString(s)
+	return err == nil
+}
+
+func (v *Vault) isMember(userID string) bool {
+	return slices.Contains(v.Members, userID)
+}
+
+const vaultUserPrefix = "vault-"
+
+func vaultStorageUser(vaultID string) string {
+	return vaultUserPrefix + vaultID
+}
+
+// isVaultStorageUser reports whether files stored for userID are vault
+// blobs, whose contents are ciphertext: not worth sniffing or compressing.
+func isVaultStorageUser(userID string) bool {
+	return strings.HasPrefix(userID, vaultUserPrefix)
+}
+
+func vaultsCollection() *firestore.CollectionRef {
+	return firestoreClient.Collection("vaults")
+}
+
+func vaultKeysCollection() *firestore.CollectionRef {
+	return firestoreClient.Collection("vaultKeys")
+}
+
+func getVault(ctx context.Context, vaultID string) (*Vault, error) {
+	doc, err := vaultsCollection().Doc(vaultID).Get(ctx)
+	if err != nil {
+		return nil, errVaultNotFound
+	}
+	var v Vault
+	if err := doc.DataTo(&v); err != nil {
+		return nil, err
+	}
+	v.ID = doc.Ref.ID
+	return &v, nil
+}
+
+// authorizeVault loads the vault in the route for a member. Non members get
+// the same answer as for a vault that doesn't exist.
+func authorizeVault(c fiber.Ctx, scope string, ownerOnly bool) (*Vault, error) {
+	userID := localUserID(c)
+	if !vaultIDPattern.MatchString(c.Params("vaultID")) {
+		return nil, errVaultNotFound
+	}
+	v, err := getVault(context.Background(), c.Params("vaultID"))
+	if err != nil {
+		return nil, err
+	}
+	if !v.isMember(userID) {
+		return nil, errVaultNotFound
+	}
+	if ownerOnly && v.OwnerID != userID {
+		return nil, errForbidden
+	}
+	if err := checkTokenAccess(c, scope, v.ID); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func vaultErrorResponse(c fiber.Ctx, err error) error {
+	if errors.Is(err, errVaultNotFound) {
+		return c.Status(404).JSON(fiber.Map{"error": err.Error()})
+	}
+	return accessErrorResponse(c, err)
+}
+
+// -------------------- Key Bundles --------------------
+
+func putVaultKeysHandler(c fiber.Ctx) error {
+	userID := localUserID(c)
+
+	var bundle VaultKeyBundle
+	if err := c.Bind().JSON(&bundle); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "invalid request"})
+	}
+	if !validOpaque(bundle.PublicKey, maxOpaqueKey) || !validOpaque(bundle.WrappedPrivateKey, maxOpaqueKey) {
+		return c.Status(400).JSON(fiber.Map{"error": "publicKey and wrappedPrivateKey must be base64"})
+	}
+	if len(bundle.KDF) > maxOpaqueKey {
+		return c.Status(400).JSON(fiber.Map{"error": "kdf too large"})
+	}
+	bundle.UpdatedAt = time.Now()
+
+	if _, err := vaultKeysCollection().Doc(userID).Set(context.Background(), bundle); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	bundle.UserID = userID
+	return c.JSON(fiber.Map{"success": true, "keys": bundle})
+}
+
+// getVaultKeysHandler returns the caller's full bundle, or only the public
+// key when asked about someone else.
+func getVaultKeysHandler(c fiber.Ctx) error {
+	userID := localUserID(c)
+	target := c.Params("userID")
+	if target == "me" {
+		target = userID
+	}
+
+	doc, err := vaultKeysCollection().Doc(target).Get(context.Background())
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "no vault keys for user"})
+	}
+	var bundle VaultKeyBundle
+	if err := doc.DataTo(&bundle); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	bundle.UserID = target
+	if target != userID {
+		bundle.WrappedPrivateKey = ""
+		bundle.KDF = ""
+	}
+	return c.JSON(fiber.Map{"success": true, "keys": bundle})
+}
+
+// -------------------- Vaults --------------------
+
+func createVaultHandler(c fiber.Ctx) error {
+	userID := localUserID(c)
+
+	body := struct {
+		EncryptedName string `json:"encryptedName"`
+		Envelope      string `json:"envelope"`
+	}{}
+	if err := c.Bind().JSON(&body); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "invalid request"})
+	}
+	if !validOpaque(body.EncryptedName, maxOpaqueName) || !validOpaque(body.Envelope, maxOpaqueKey) {
+		return c.Status(400).JSON(fiber.Map{"error": "encryptedName and envelope must be base64"})
+	}
+
+	v := Vault{
+		OwnerID:       userID,
+		EncryptedName: body.EncryptedName,
+		Members:       []string{userID},
+		Envelopes:     map[string]string{userID: body.Envelope},
+		CreatedAt:     time.Now(),
+	}
+	ref, _, err := vaultsCollection().Add(context.Background(), v)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	v.ID = ref.ID
+
+	log.Printf("[vault] %s created vault %s", userID, v.ID)
+	return c.JSON(fiber.Map{"success": true, "vault": v, "envelope": body.Envelope})
+}
+
+// listVaultsHandler returns the vaults the caller belongs to, each with the
+// caller's own envelope for the vault key.
+func listVaultsHandler(c fiber.Ctx) error {
+	userID := localUserID(c)
+
+	iter := vaultsCollection().Where("members", "array-contains", userID).Documents(context.Background())
+	vaults := []fiber.Map{}
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		var v Vault
+		if err := doc.DataTo(&v); err != nil {
+			continue
+		}
+		v.ID = doc.Ref.ID
+		if checkTokenAccess(c, ScopeRead, v.ID) != nil {
+			continue
+		}
+		vaults = append(vaults, fiber.Map{"vault": v, "envelope": v.Envelopes[userID]})
+	}
+
+	return c.JSON(fiber.Map{"success": true, "vaults": vaults})
+}
+
+// addVaultMemberHandler stores an envelope the owner made for another user
+// from that user's public key.
+func addVaultMemberHandler(c fiber.Ctx) error {
+	v, err := authorizeVault(c, ScopeWrite, true)
+	if err != nil {
+		return vaultErrorResponse(c, err)
+	}
+
+	body := struct {
+		Email    string `json:"email"`
+		UserID   string `json:"user_id"`
+		Envelope string `json:"envelope"`
+	}{}
+	if err := c.Bind().JSON(&body); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "invalid request"})
+	}
+	if !validOpaque(body.Envelope, maxOpaqueKey) {
+		return c.Status(400).JSON(fiber.Map{"error": "envelope must be base64"})
+	}
+
+	ctx := context.Background()
+	member, err := lookupUser(ctx, body.Email, body.UserID)
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "user not found"})
+	}
+
+	_, err = vaultsCollection().Doc(v.ID).Update(ctx, []firestore.Update{
+		{Path: "members", Value: firestore.ArrayUnion(member.UID)},
+		{FieldPath: firestore.FieldPath{"envelopes", member.UID}, Value: body.Envelope},
+	})
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	log.Printf("[vault] %s added %s to vault %s", v.OwnerID, member.UID, v.ID)
+	return c.JSON(fiber.Map{"success": true, "vault": v.ID, "userId": member.UID})
+}
+
+// removeVaultMemberHandler drops a member's envelope. Their copy of the key
+// can't be taken back, so owners should rotate the vault key client side
+// for anything added afterwards.
+func removeVaultMemberHandler(c fiber.Ctx) error {
+	v, err := authorizeVault(c, ScopeWrite, true)
+	if err != nil {
+		return vaultErrorResponse(c, err)
+	}
+	memberID := c.Params("userID")
+	if memberID == v.OwnerID {
+		return c.Status(400).JSON(fiber.Map{"error": "the owner can't leave their vault"})
+	}
+
+	_, err = vaultsCollection().Doc(v.ID).Update(context.Background(), []firestore.Update{
+		{Path: "members", Value: firestore.ArrayRemove(memberID)},
+		{FieldPath: firestore.FieldPath{"envelopes", memberID}, Value: firestore.Delete},
+	})
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(fiber.Map{"success": true, "vault": v.ID, "userId": memberID})
+}
+
+// -------------------- Blobs --------------------
+
+func vaultBlobs(vaultID string) *firestore.CollectionRef {
+	return vaultsCollection().Doc(vaultID).Collection("blobs")
+}
+
+func uploadVaultBlobHandler(c fiber.Ctx) error {
+	v, err := authorizeVault(c, ScopeWrite, false)
+	if err != nil {
+		return vaultErrorResponse(c, err)
+	}
+
+	encryptedName := c.FormValue("encrypted_name")
+	if !validOpaque(encryptedName, maxOpaqueName) {
+		return c.Status(400).JSON(fiber.Map{"error": "encrypted_name must be base64"})
+	}
+	fileHeader, err := c.FormFile("blob")
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "blob required"})
+	}
+	src, err := fileHeader.Open()
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "failed to open blob"})
+	}
+	defer src.Close()
+	data, err := io.ReadAll(src)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "failed to read blob"})
+	}
+
+	ctx := context.Background()
+	ref := vaultBlobs(v.ID).NewDoc()
+	storedNodes, _, err := storeFile(vaultStorageUser(v.ID), ref.ID, data)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	blob := VaultBlob{
+		EncryptedName: encryptedName,
+		Size:          len(data),
+		NodeID:        storedNodes,
+		CreatedBy:     localUserID(c),
+		CreatedAt:     time.Now(),
+	}
+	if _, err := ref.Set(ctx, blob); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	blob.ID = ref.ID
+
+	return c.JSON(fiber.Map{"success": true, "blob": blob})
+}
+
+func listVaultBlobsHandler(c fiber.Ctx) error {
+	v, err := authorizeVault(c, ScopeRead, false)
+	if err != nil {
+		return vaultErrorResponse(c, err)
+	}
+
+	iter := vaultBlobs(v.ID).OrderBy("createdAt", firestore.Asc).Documents(context.Background())
+	blobs := []VaultBlob{}
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		var b VaultBlob
+		if err := doc.DataTo(&b); err != nil {
+			continue
+		}
+		b.ID = doc.Ref.ID
+		blobs = append(blobs, b)
+	}
+	return c.JSON(fiber.Map{"success": true, "blobs": blobs})
+}
+
+func getVaultBlob(ctx context.Context, vaultID, blobID string) (*VaultBlob, error) {
+	doc, err := vaultBlobs(vaultID).Doc(blobID).Get(ctx)
+	if err != nil {
+		return nil, errFileNotFound
+	}
+	var b VaultBlob
+	if err := doc.DataTo(&b); err != nil {
+		return nil, err
+	}
+	b.ID = doc.Ref.ID
+	return &b, nil
+}
+
+func downloadVaultBlobHandler(c fiber.Ctx) error {
+	v, err := authorizeVault(c, ScopeRead, false)
+	if err != nil {
+		return vaultErrorResponse(c, err)
+	}
+	blob, err := getVaultBlob(context.Background(), v.ID, c.Params("blobID"))
+	if err != nil {
+		return accessErrorResponse(c, err)
+	}
+
+	// The blob goes out under its id; sendFile never looks inside it.
+	meta := &FileMeta{
+		FileName:      blob.ID,
+		NodeID:        blob.NodeID,
+		StorageUserID: vaultStorageUser(v.ID),
+		UserID:        v.OwnerID,
+		Vault:         v.ID,
+	}
+	return sendFile(c, meta, blob.ID)
+}
+
+func deleteVaultBlobHandler(c fiber.Ctx) error {
+	v, err := authorizeVault(c, ScopeWrite, false)
+	if err != nil {
+		return vaultErrorResponse(c, err)
+	}
+	ctx := context.Background()
+	blob, err := getVaultBlob(ctx, v.ID, c.Params("blobID"))
+	if err != nil {
+		return accessErrorResponse(c, err)
+	}
+	if userID := localUserID(c); userID != v.OwnerID && userID != blob.CreatedBy {
+		return accessErrorResponse(c, errForbidden)
+	}
+
+	storageUser := vaultStorageUser(v.ID)
+	if err := fileServer.DeleteFile(storageUser, blob.ID); err != nil {
+		log.Printf("[vault] failed to delete local blob %s: %v", blob.ID, err)
+	}
+	fileServer.RecordDelete(storageUser, blob.ID)
+	client := &http.Client{Timeout: 5 * time.Second}
+	for _, peer := range peersList() {
+		reqURL := fmt.Sprintf("%s/vault/raw/%s/%s", peer, url.PathEscape(v.ID), url.PathEscape(blob.ID))
+		req, err := newClusterRequest(http.MethodDelete, reqURL, nil)
+		if err != nil {
+			log.Printf("[vault] delete on %s: %v", peer, err)
+			continue
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			log.Printf("[vault] delete on %s failed: %v", peer, err)
+			continue
+		}
+		resp.Body.Close()
+	}
+
+	if _, err := vaultBlobs(v.ID).Doc(blob.ID).Delete(ctx); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(fiber.Map{"success": true, "id": blob.ID})
+}
+
+// deleteVaultBlobLocalHandler drops this node's replica of a blob for a peer.
+func deleteVaultBlobLocalHandler(c fiber.Ctx) error {
+	vaultID, blobID := c.Params("vaultID"), c.Params("blobID")
+	if !vaultIDPattern.MatchString(vaultID) || !vaultIDPattern.MatchString(blobID) {
+		return c.Status(400).JSON(fiber.Map{"error": "invalid blob"})
+	}
+	if err := fileServer.DeleteFile(vaultStorageUser(vaultID), blobID); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(fiber.Map{"success": true})
+}
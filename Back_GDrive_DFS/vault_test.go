@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestValidOpaque(t *testing.T) {
+	ok := base64.StdEncoding.EncodeToString([]byte("ciphertext"))
+	if !validOpaque(ok, maxOpaqueName) {
+		t.Errorf("expected %q to be accepted", ok)
+	}
+	for _, bad := range []string{"", "not base64!", strings.Repeat("A", maxOpaqueName+4)} {
+		if validOpaque(bad, maxOpaqueName) {
+			t.Errorf("expected %.20q to be rejected", bad)
+		}
+	}
+}
+
+func TestVaultIDPattern(t *testing.T) {
+	if !vaultIDPattern.MatchString("aB3xYz0123456789QwEr") {
+		t.Error("expected a Firestore id to match")
+	}
+	for _, bad := range []string{"", "..", "a/b", "../x", "id with space"} {
+		if vaultIDPattern.MatchString(bad) {
+			t.Errorf("expected %q not to match", bad)
+		}
+	}
+}
+
+func TestContentTypeNeverSniffed(t *testing.T) {
+	cases := []struct {
+		meta FileMeta
+		want string
+	}{
+		{FileMeta{FileName: "report.pdf"}, "application/pdf"},
+		{FileMeta{FileName: "notes"}, "application/octet-stream"},
+		// A vault blob is ciphertext whatever it is called.
+		{FileMeta{FileName: "photo.png", Vault: "v1"}, "application/octet-stream"},
+	}
+	for _, tc := range cases {
+		if have := tc.meta.contentType(); have != tc.want {
+			t.Errorf("%s: have %s want %s", tc.meta.FileName, have, tc.want)
+		}
+	}
+}
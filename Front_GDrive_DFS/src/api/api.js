@@ -4,8 +4,16 @@ export const UPLOAD_FILE_URL = `${API_BASE_URL}/api/upload`;
 
 export const DELETE_FILE_URL = `${API_BASE_URL}/api/files`;
 
+export const FILES_URL = `${API_BASE_URL}/api/files`;
+
+export const FOLDERS_URL = `${API_BASE_URL}/api/folders`;
+
 export const CheckHealth_FILE_URL = `${API_BASE_URL}/api/cluster/status`;
 
 export const LOG_FILE_URL = `${API_BASE_URL}/api/cluster/logs`;
 
 export const TOGGLE_FILE_URL = `${API_BASE_URL}/api/node/toggle`;
+
+export const VAULT_KEYS_URL = `${API_BASE_URL}/api/vault/keys`;
+
+export const VAULTS_URL = `${API_BASE_URL}/api/vaults`;
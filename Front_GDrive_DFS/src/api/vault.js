@@ -0,0 +1,164 @@
+// Client side of vault folders. Everything is encrypted here before it is
+// sent; the backend only stores the resulting base64 blobs.
+//
+// - Each user has an RSA-OAEP key pair. The private key is wrapped with an
+//   AES-GCM key derived from the user's vault passphrase (PBKDF2).
+// - Each vault has a random AES-GCM key, stored once per member as an
+//   envelope encrypted to that member's public key.
+// - File contents and names are encrypted with the vault key.
+import firebase from 'firebase/app';
+import 'firebase/auth';
+import { VAULT_KEYS_URL, VAULTS_URL } from './api';
+
+const PBKDF2_ITERATIONS = 310000;
+
+const toB64 = (buf) => btoa(String.fromCharCode(...new Uint8Array(buf)));
+const fromB64 = (s) => Uint8Array.from(atob(s), (c) => c.charCodeAt(0));
+
+const authHeaders = async () => {
+  const user = firebase.auth().currentUser;
+  if (!user) return {};
+  const token = await user.getIdToken();
+  return { Authorization: `Bearer ${token}` };
+};
+
+const request = async (url, options = {}) => {
+  const res = await fetch(url, {
+    ...options,
+    headers: { ...(options.headers || {}), ...(await authHeaders()) },
+  });
+  if (!res.ok) throw new Error(`${res.status}: ${await res.text()}`);
+  return res;
+};
+
+const jsonBody = (body) => ({
+  headers: { 'Content-Type': 'application/json' },
+  body: JSON.stringify(body),
+});
+
+// AES-GCM output is iv || ciphertext.
+const seal = async (key, data) => {
+  const iv = crypto.getRandomValues(new Uint8Array(12));
+  const ct = await crypto.subtle.encrypt({ name: 'AES-GCM', iv }, key, data);
+  const out = new Uint8Array(iv.length + ct.byteLength);
+  out.set(iv);
+  out.set(new Uint8Array(ct), iv.length);
+  return out;
+};
+
+const open = async (key, data) => {
+  const iv = data.slice(0, 12);
+  return crypto.subtle.decrypt({ name: 'AES-GCM', iv }, key, data.slice(12));
+};
+
+const passphraseKey = async (passphrase, salt, iterations) => {
+  const base = await crypto.subtle.importKey('raw', new TextEncoder().encode(passphrase), 'PBKDF2', false, ['deriveKey']);
+  return crypto.subtle.deriveKey(
+    { name: 'PBKDF2', salt, iterations, hash: 'SHA-256' },
+    base,
+    { name: 'AES-GCM', length: 256 },
+    false,
+    ['encrypt', 'decrypt'],
+  );
+};
+
+const importPublicKey = (b64) =>
+  crypto.subtle.importKey('spki', fromB64(b64), { name: 'RSA-OAEP', hash: 'SHA-256' }, false, ['encrypt']);
+
+// setupVaultKeys creates the user's key pair and uploads it, private key
+// wrapped with the passphrase.
+export const setupVaultKeys = async (passphrase) => {
+  const pair = await crypto.subtle.generateKey(
+    { name: 'RSA-OAEP', modulusLength: 3072, publicExponent: new Uint8Array([1, 0, 1]), hash: 'SHA-256' },
+    true,
+    ['encrypt', 'decrypt'],
+  );
+  const salt = crypto.getRandomValues(new Uint8Array(16));
+  const wrapKey = await passphraseKey(passphrase, salt, PBKDF2_ITERATIONS);
+  const pkcs8 = await crypto.subtle.exportKey('pkcs8', pair.privateKey);
+  const spki = await crypto.subtle.exportKey('spki', pair.publicKey);
+
+  await request(VAULT_KEYS_URL, {
+    method: 'PUT',
+    ...jsonBody({
+      publicKey: toB64(spki),
+      wrappedPrivateKey: toB64(await seal(wrapKey, pkcs8)),
+      kdf: JSON.stringify({ alg: 'PBKDF2-SHA256', salt: toB64(salt), iterations: PBKDF2_ITERATIONS }),
+    }),
+  });
+  return pair.privateKey;
+};
+
+// unlockVaultKeys fetches the user's bundle and unwraps the private key.
+export const unlockVaultKeys = async (passphrase) => {
+  const { keys } = await (await request(`${VAULT_KEYS_URL}/me`)).json();
+  const kdf = JSON.parse(keys.kdf);
+  const wrapKey = await passphraseKey(passphrase, fromB64(kdf.salt), kdf.iterations);
+  const pkcs8 = await open(wrapKey, fromB64(keys.wrappedPrivateKey));
+  return crypto.subtle.importKey('pkcs8', pkcs8, { name: 'RSA-OAEP', hash: 'SHA-256' }, false, ['decrypt']);
+};
+
+const envelopeFor = async (publicKeyB64, rawVaultKey) =>
+  toB64(await crypto.subtle.encrypt({ name: 'RSA-OAEP' }, await importPublicKey(publicKeyB64), rawVaultKey));
+
+export const openEnvelope = async (privateKey, envelope) => {
+  const raw = await crypto.subtle.decrypt({ name: 'RSA-OAEP' }, privateKey, fromB64(envelope));
+  return crypto.subtle.importKey('raw', raw, 'AES-GCM', false, ['encrypt', 'decrypt']);
+};
+
+export const encryptName = async (vaultKey, name) => toB64(await seal(vaultKey, new TextEncoder().encode(name)));
+
+export const decryptName = async (vaultKey, encrypted) =>
+  new TextDecoder().decode(await open(vaultKey, fromB64(encrypted)));
+
+export const createVault = async (name) => {
+  const { keys } = await (await request(`${VAULT_KEYS_URL}/me`)).json();
+  const raw = crypto.getRandomValues(new Uint8Array(32));
+  const vaultKey = await crypto.subtle.importKey('raw', raw, 'AES-GCM', false, ['encrypt', 'decrypt']);
+  const res = await request(VAULTS_URL, {
+    method: 'POST',
+    ...jsonBody({ encryptedName: await encryptName(vaultKey, name), envelope: await envelopeFor(keys.publicKey, raw) }),
+  });
+  return { ...(await res.json()).vault, key: vaultKey };
+};
+
+export const listVaults = async (privateKey) => {
+  const { vaults } = await (await request(VAULTS_URL)).json();
+  return Promise.all(
+    vaults.map(async ({ vault, envelope }) => {
+      const key = await openEnvelope(privateKey, envelope);
+      return { ...vault, key, name: await decryptName(key, vault.encryptedName) };
+    }),
+  );
+};
+
+// shareVault needs the raw vault key, so it unwraps the caller's envelope
+// again as extractable.
+export const shareVault = async (privateKey, vaultId, envelope, email, memberUserId) => {
+  const raw = await crypto.subtle.decrypt({ name: 'RSA-OAEP' }, privateKey, fromB64(envelope));
+  const { keys } = await (await request(`${VAULT_KEYS_URL}/${encodeURIComponent(memberUserId)}`)).json();
+  await request(`${VAULTS_URL}/${vaultId}/members`, {
+    method: 'POST',
+    ...jsonBody({ email, user_id: memberUserId, envelope: await envelopeFor(keys.publicKey, raw) }),
+  });
+};
+
+export const uploadToVault = async (vault, file) => {
+  const form = new FormData();
+  const blob = await seal(vault.key, await file.arrayBuffer());
+  form.append('blob', new Blob([blob]), 'blob');
+  form.append('encrypted_name', await encryptName(vault.key, file.name));
+  const res = await request(`${VAULTS_URL}/${vault.id}/blobs`, { method: 'POST', body: form });
+  return (await res.json()).blob;
+};
+
+export const listVaultFiles = async (vault) => {
+  const { blobs } = await (await request(`${VAULTS_URL}/${vault.id}/blobs`)).json();
+  return Promise.all(blobs.map(async (b) => ({ ...b, name: await decryptName(vault.key, b.encryptedName) })));
+};
+
+export const downloadFromVault = async (vault, blob) => {
+  const res = await request(`${VAULTS_URL}/${vault.id}/blobs/${blob.id}`);
+  const plain = await open(vault.key, new Uint8Array(await res.arrayBuffer()));
+  return new File([plain], blob.name);
+};
@@ -2,6 +2,16 @@ import React, { useEffect, useState } from "react";
 import '../../styles/AdminDashboard.css'
 import { CheckHealth_FILE_URL, LOG_FILE_URL, TOGGLE_FILE_URL } from '../../api/api'; 
 import { db } from '../../firebase'; 
+import firebase from 'firebase/app';
+import 'firebase/auth';
+
+// Admin routes need an ID token carrying the admin custom claim.
+const authHeaders = async () => {
+  const user = firebase.auth().currentUser;
+  if (!user) return {};
+  const token = await user.getIdToken();
+  return { Authorization: `Bearer ${token}` };
+};
 
 const AdminDashboard = () => {
   const [cluster, setCluster] = useState(null);
@@ -53,7 +63,7 @@ const AdminDashboard = () => {
     useEffect(() => {
     const loadLogs = async () => {
         try {
-        const res = await fetch(`${LOG_FILE_URL}`);
+        const res = await fetch(`${LOG_FILE_URL}`, { headers: await authHeaders() });
         if (!res.ok) throw new Error(`HTTP error! status: ${res.status}`);
         const data = await res.json();
         setLogs(data.logs || {});
@@ -80,7 +90,7 @@ const AdminDashboard = () => {
     try {
       const res = await fetch(`${TOGGLE_FILE_URL}`, {
         method: "POST",
-        headers: { "Content-Type": "application/json" },
+        headers: { "Content-Type": "application/json", ...(await authHeaders()) },
         body: JSON.stringify({ node, action }),
       });
       if (!res.ok) throw new Error(`HTTP error! status: ${res.status}`);
@@ -7,6 +7,7 @@ import MoreVertIcon from '@material-ui/icons/MoreVert';
 import firebase from 'firebase/app';
 import 'firebase/auth';
 import { db } from '../../firebase';
+import { FILES_URL, FOLDERS_URL } from '../../api/api';
 import StarIcon from '@material-ui/icons/Star';
 
 
@@ -55,10 +56,16 @@ const FileCard = ({ name, fileId, type = 'file', onDownload, onMove, onDelete, f
   const handleShare = async () => {
     if (!shareEmail) return alert('Please enter an email');
     try {
-      const collection = type === 'folder' ? 'folders' : 'files';
-      await db.collection(collection).doc(fileId).update({
-        shareWith: firebase.firestore.FieldValue.arrayUnion(shareEmail)
+      const url = type === 'folder'
+        ? `${FOLDERS_URL}/${encodeURIComponent(fileId)}/shares`
+        : `${FILES_URL}/${encodeURIComponent(name)}/shares`;
+      const token = await firebase.auth().currentUser.getIdToken();
+      const res = await fetch(url, {
+        method: 'POST',
+        headers: { Authorization: `Bearer ${token}`, 'Content-Type': 'application/json' },
+        body: JSON.stringify({ email: shareEmail, role: 'viewer' }),
       });
+      if (!res.ok) throw new Error(`share failed: ${res.status}`);
       alert('Shared successfully!');
       setShareEmail('');
       safeSetState(setShareOpen, false);
@@ -7,6 +7,7 @@ import CircularProgress from '@material-ui/core/CircularProgress';
 import firebase from 'firebase/app';
 import 'firebase/auth';
 import { db } from '../../firebase';
+import { FOLDERS_URL } from '../../api/api';
 import MoreVertIcon from '@material-ui/icons/MoreVert';
 import StarIcon from '@material-ui/icons/Star';
 
@@ -259,19 +260,13 @@ const FilesView = ({ searchTerm = '' }) => {
                     onClick={async () => {
                       if (!shareEmail) return alert('Please enter email');
                       try {
-                        await db.collection('folders').doc(shareId).update({
-                          shareWith: firebase.firestore.FieldValue.arrayUnion(shareEmail)
+                        const token = await currentUser.getIdToken();
+                        const res = await fetch(`${FOLDERS_URL}/${encodeURIComponent(shareId)}/shares`, {
+                          method: 'POST',
+                          headers: { Authorization: `Bearer ${token}`, 'Content-Type': 'application/json' },
+                          body: JSON.stringify({ email: shareEmail, role: 'viewer' }),
                         });
-
-                        const filesInFolder = files.filter(f => f.folderId === shareId);
-                        const batch = db.batch();
-                        filesInFolder.forEach(file => {
-                          const fileRef = db.collection('files').doc(file.id);
-                          batch.update(fileRef, {
-                            shareWith: firebase.firestore.FieldValue.arrayUnion(shareEmail)
-                          });
-                        });
-                        await batch.commit();
+                        if (!res.ok) throw new Error(`share failed: ${res.status}`);
 
                         alert('Folder and all files shared!');
                         setShareEmail('');
@@ -98,11 +98,11 @@ const Shareview = ({ searchTerm = '' }) => {
     return () => document.removeEventListener('mousedown', handleClickOutside);
   }, [menuRef]);
 
-  const downloadFile = async (fileName) => {
+  const downloadFile = async (fileName, owner) => {
     if (!currentUser) return;
     try {
       const token = await currentUser.getIdToken(true);
-      const res = await fetch(`/api/files/${encodeURIComponent(fileName)}`, {
+      const res = await fetch(`/api/files/${encodeURIComponent(fileName)}?owner=${encodeURIComponent(owner)}`, {
         headers: { Authorization: `Bearer ${token}` }
       });
       if (!res.ok) { alert('Download error'); return; }
@@ -246,7 +246,7 @@ const Shareview = ({ searchTerm = '' }) => {
                     key={file.id}
                     name={file.fileName}
                     fileId={file.id}
-                    onDownload={() => downloadFile(file.fileName)}
+                    onDownload={() => downloadFile(file.fileName, file.userId)}
                     onMove={moveFile}
                     folders={folders}
                   />
@@ -272,7 +272,7 @@ const Shareview = ({ searchTerm = '' }) => {
                   caption={file.fileName}
                   timestamp={file.timestamp}
                   size={file.size}
-                  onDownload={() => downloadFile(file.fileName)}
+                  onDownload={() => downloadFile(file.fileName, file.userId)}
                   draggable
                   onDragStart={(e) => e.dataTransfer.setData('fileId', file.id)}
                   onContextMenu={async (e) => {